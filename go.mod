@@ -11,6 +11,7 @@ require (
 	github.com/grafana/sqlds/v4 v4.1.0
 	github.com/jpillora/backoff v1.0.0
 	github.com/magefile/mage v1.15.0
+	github.com/prometheus/client_golang v1.20.3
 	github.com/stretchr/testify v1.9.0
 )
 
@@ -74,7 +75,6 @@ require (
 	github.com/perimeterx/marshmallow v1.1.5 // indirect
 	github.com/pierrec/lz4/v4 v4.1.21 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/prometheus/client_golang v1.20.3 // indirect
 	github.com/prometheus/client_model v0.6.1 // indirect
 	github.com/prometheus/common v0.55.0 // indirect
 	github.com/prometheus/procfs v0.15.1 // indirect
@@ -0,0 +1,54 @@
+package awsds
+
+import (
+	"runtime/debug"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// sdkModulePath is the module path of grafana-aws-sdk
+const sdkModulePath = "github.com/grafana/grafana-aws-sdk"
+
+// sdkVersion is the version of grafana-aws-sdk. It can be set at compile time with
+// -ldflags "-X github.com/grafana/grafana-aws-sdk/pkg/awsds.sdkVersion=v1.2.3",
+// otherwise it's read from the build info of the binary.
+var sdkVersion = ""
+
+// SDKBuildInfo holds the versions of the SDKs a plugin is built with
+type SDKBuildInfo struct {
+	// Version of grafana-aws-sdk, "dev" if unknown
+	Version string
+	// Version of the AWS SDK
+	AWSSDKVersion string
+}
+
+// BuildInfo returns the versions of grafana-aws-sdk and of the AWS SDK, e.g. to report them in health checks
+func BuildInfo() SDKBuildInfo {
+	return SDKBuildInfo{
+		Version:       moduleVersion(),
+		AWSSDKVersion: aws.SDKVersion,
+	}
+}
+
+func moduleVersion() string {
+	if sdkVersion != "" {
+		return sdkVersion
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	if info.Main.Path == sdkModulePath && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != sdkModulePath {
+			continue
+		}
+		if dep.Replace != nil && dep.Replace.Version != "" {
+			return dep.Replace.Version
+		}
+		return dep.Version
+	}
+	return "dev"
+}
@@ -0,0 +1,27 @@
+package awsds
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildInfo(t *testing.T) {
+	t.Run("it returns the versions of both sdks", func(t *testing.T) {
+		info := BuildInfo()
+		assert.NotEmpty(t, info.Version)
+		assert.Equal(t, aws.SDKVersion, info.AWSSDKVersion)
+	})
+
+	t.Run("it prefers the version set at compile time", func(t *testing.T) {
+		orig := sdkVersion
+		sdkVersion = "v1.2.3"
+		t.Cleanup(func() { sdkVersion = orig })
+
+		assert.Equal(t, "v1.2.3", BuildInfo().Version)
+		agent := GetUserAgentString("Athena")
+		assert.Contains(t, agent, "grafana-aws-sdk/v1.2.3")
+		assert.Contains(t, agent, aws.SDKName+"/"+aws.SDKVersion)
+	})
+}
@@ -0,0 +1,78 @@
+package awsds
+
+import (
+	"database/sql/driver"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Column describes a column of the rows returned by an AsyncDB
+type Column struct {
+	Name string
+	// DatabaseType is the type of the column in the AWS service, e.g. "varchar" or "timestamp",
+	// empty if the driver doesn't report it
+	DatabaseType string
+	Nullable     bool
+}
+
+// ResultColumns returns the columns of the rows, with the types reported by the driver through
+// driver.RowsColumnTypeDatabaseTypeName and driver.RowsColumnTypeNullable. Columns are considered
+// nullable unless the driver tells otherwise.
+func ResultColumns(rows driver.Rows) []Column {
+	names := rows.Columns()
+	typeNames, _ := rows.(driver.RowsColumnTypeDatabaseTypeName)
+	nullables, _ := rows.(driver.RowsColumnTypeNullable)
+
+	columns := make([]Column, len(names))
+	for i, name := range names {
+		columns[i] = Column{Name: name, Nullable: true}
+		if typeNames != nil {
+			columns[i].DatabaseType = typeNames.ColumnTypeDatabaseTypeName(i)
+		}
+		if nullables != nil {
+			if nullable, ok := nullables.ColumnTypeNullable(i); ok {
+				columns[i].Nullable = nullable
+			}
+		}
+	}
+	return columns
+}
+
+// FieldType returns the type of the Grafana data frame field holding the values of the column
+func (c Column) FieldType() data.FieldType {
+	fieldType := FieldTypeFor(c.DatabaseType)
+	if c.Nullable {
+		return fieldType.NullableType()
+	}
+	return fieldType
+}
+
+// FieldTypeFor maps the name of an Athena, Redshift or Timestream column type to a Grafana field type.
+// Parameters like the length of a varchar are ignored. Unknown and nested types map to strings.
+func FieldTypeFor(databaseType string) data.FieldType {
+	name := strings.ToLower(strings.TrimSpace(databaseType))
+	if i := strings.IndexAny(name, "(<"); i >= 0 {
+		name = strings.TrimSpace(name[:i])
+	}
+	switch name {
+	case "boolean", "bool":
+		return data.FieldTypeBool
+	case "tinyint":
+		return data.FieldTypeInt8
+	case "smallint", "int2":
+		return data.FieldTypeInt16
+	case "integer", "int", "int4":
+		return data.FieldTypeInt32
+	case "bigint", "int8", "long":
+		return data.FieldTypeInt64
+	case "real", "float", "float4":
+		return data.FieldTypeFloat32
+	case "double", "double precision", "float8", "decimal", "numeric":
+		return data.FieldTypeFloat64
+	case "date", "timestamp", "timestamptz", "timestamp with time zone", "timestamp without time zone":
+		return data.FieldTypeTime
+	default:
+		return data.FieldTypeString
+	}
+}
@@ -0,0 +1,59 @@
+package awsds
+
+import (
+	"database/sql/driver"
+	"io"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+// typedRows reports the type of its columns, all nullable but the first one
+type typedRows struct {
+	columns []string
+	types   []string
+}
+
+func (r *typedRows) Columns() []string           { return r.columns }
+func (r *typedRows) Close() error                { return nil }
+func (r *typedRows) Next(_ []driver.Value) error { return io.EOF }
+
+func (r *typedRows) ColumnTypeDatabaseTypeName(index int) string {
+	return r.types[index]
+}
+
+func (r *typedRows) ColumnTypeNullable(index int) (bool, bool) {
+	return index != 0, true
+}
+
+func TestResultColumns(t *testing.T) {
+	t.Run("it maps the column types to field types", func(t *testing.T) {
+		rows := &typedRows{
+			columns: []string{"id", "name", "price", "created", "active", "tags", "payload"},
+			types:   []string{"bigint", "varchar(255)", "decimal(10,2)", "timestamp with time zone", "boolean", "array<varchar>", "hyperloglog"},
+		}
+
+		columns := ResultColumns(rows)
+		assert.Equal(t, Column{Name: "id", DatabaseType: "bigint"}, columns[0])
+		fieldTypes := []data.FieldType{}
+		for _, c := range columns {
+			fieldTypes = append(fieldTypes, c.FieldType())
+		}
+		assert.Equal(t, []data.FieldType{
+			data.FieldTypeInt64,
+			data.FieldTypeNullableString,
+			data.FieldTypeNullableFloat64,
+			data.FieldTypeNullableTime,
+			data.FieldTypeNullableBool,
+			data.FieldTypeNullableString,
+			data.FieldTypeNullableString,
+		}, fieldTypes)
+	})
+
+	t.Run("it defaults to nullable strings when the driver doesn't report types", func(t *testing.T) {
+		columns := ResultColumns(&pageRows{})
+		assert.Equal(t, []Column{{Name: "id", Nullable: true}}, columns)
+		assert.Equal(t, data.FieldTypeNullableString, columns[0].FieldType())
+	})
+}
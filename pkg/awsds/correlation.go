@@ -0,0 +1,26 @@
+package awsds
+
+import "context"
+
+type correlationIDKey struct{}
+
+// ContextWithCorrelationID returns a copy of ctx carrying the correlation id of the request,
+// sent to AWS by sessions of a SessionCache created WithCorrelationIDHeader
+func ContextWithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationIDFromContext returns the correlation id carried by ctx, empty if none
+func CorrelationIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// WithCorrelationIDHeader makes the sessions set the given header with the correlation id of the
+// context of each AWS request, e.g. "X-Correlation-Id". Use the WithContext variants of the service
+// methods so the context reaches the request.
+func WithCorrelationIDHeader(header string) SessionCacheOption {
+	return func(sc *SessionCache) {
+		sc.correlationIDHeader = header
+	}
+}
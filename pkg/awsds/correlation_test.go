@@ -0,0 +1,46 @@
+package awsds
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithCorrelationIDHeader(t *testing.T) {
+	getHeader := func(t *testing.T, cache *SessionCache, ctx context.Context) string {
+		t.Helper()
+		sess, err := cache.GetSessionWithAuthSettings(GetSessionConfig{
+			Settings: AWSDatasourceSettings{
+				AuthType:  AuthTypeKeys,
+				AccessKey: "foo",
+				SecretKey: "bar",
+				Region:    "us-east-1",
+			},
+		}, AuthSettings{AllowedAuthProviders: []string{"keys"}})
+		require.NoError(t, err)
+
+		req, _ := sts.New(sess).GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+		req.SetContext(ctx)
+		require.NoError(t, req.Build())
+		return req.HTTPRequest.Header.Get("X-Correlation-Id")
+	}
+
+	t.Run("it sends the correlation id of the context", func(t *testing.T) {
+		cache := NewSessionCache(WithCorrelationIDHeader("X-Correlation-Id"))
+		ctx := ContextWithCorrelationID(context.Background(), "4bf92f3577b34da6")
+		assert.Equal(t, "4bf92f3577b34da6", getHeader(t, cache, ctx))
+	})
+
+	t.Run("it sends nothing without a correlation id", func(t *testing.T) {
+		cache := NewSessionCache(WithCorrelationIDHeader("X-Correlation-Id"))
+		assert.Empty(t, getHeader(t, cache, context.Background()))
+	})
+
+	t.Run("it sends nothing unless enabled", func(t *testing.T) {
+		ctx := ContextWithCorrelationID(context.Background(), "4bf92f3577b34da6")
+		assert.Empty(t, getHeader(t, NewSessionCache(), ctx))
+	})
+}
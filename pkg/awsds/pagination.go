@@ -0,0 +1,30 @@
+package awsds
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+)
+
+// ErrInvalidPageToken is returned when a page token is used with an AsyncDB that returns all the
+// results in a single page
+var ErrInvalidPageToken = errors.New("the async db returns a single page of results, the page token must be empty")
+
+// PagedAsyncDB is implemented by the AsyncDB of drivers able to fetch the query results one page at a time.
+// The next token is empty once the last page has been returned.
+type PagedAsyncDB interface {
+	GetQueryResultPage(ctx context.Context, queryID string, token string, pageSize int) (driver.Rows, string, error)
+}
+
+// GetQueryResultPage returns a page of the results of the query together with the token of the next page.
+// An AsyncDB that doesn't implement PagedAsyncDB returns all the rows in the first page, whatever the page size.
+func GetQueryResultPage(ctx context.Context, db AsyncDB, queryID string, token string, pageSize int) (driver.Rows, string, error) {
+	if paged, ok := db.(PagedAsyncDB); ok {
+		return paged.GetQueryResultPage(ctx, queryID, token, pageSize)
+	}
+	if token != "" {
+		return nil, "", ErrInvalidPageToken
+	}
+	rows, err := db.GetRows(ctx, queryID)
+	return rows, "", err
+}
@@ -0,0 +1,88 @@
+package awsds
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pageRows struct {
+	values []driver.Value
+}
+
+func (r *pageRows) Columns() []string { return []string{"id"} }
+func (r *pageRows) Close() error      { return nil }
+
+func (r *pageRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0] = r.values[0]
+	r.values = r.values[1:]
+	return nil
+}
+
+// pagedAsyncDB serves its values in pages, using the offset of the page as token
+type pagedAsyncDB struct {
+	fakeAsyncDB
+	values []driver.Value
+	tokens []string
+}
+
+func (db *pagedAsyncDB) GetQueryResultPage(_ context.Context, _ string, token string, pageSize int) (driver.Rows, string, error) {
+	db.tokens = append(db.tokens, token)
+	offsets := map[string]int{"": 0, "page-2": pageSize}
+	start, ok := offsets[token]
+	if !ok {
+		return nil, "", ErrInvalidPageToken
+	}
+	end, next := start+pageSize, "page-2"
+	if end >= len(db.values) {
+		end, next = len(db.values), ""
+	}
+	return &pageRows{values: db.values[start:end]}, next, nil
+}
+
+func readPage(t *testing.T, rows driver.Rows) []driver.Value {
+	t.Helper()
+	values := []driver.Value{}
+	row := make([]driver.Value, 1)
+	for rows.Next(row) == nil {
+		values = append(values, row[0])
+	}
+	return values
+}
+
+func TestGetQueryResultPage(t *testing.T) {
+	t.Run("it fetches the results page by page", func(t *testing.T) {
+		db := &pagedAsyncDB{values: []driver.Value{int64(1), int64(2), int64(3)}}
+
+		rows, token, err := GetQueryResultPage(context.Background(), db, "query", "", 2)
+		require.NoError(t, err)
+		assert.Equal(t, "page-2", token)
+		assert.Equal(t, []driver.Value{int64(1), int64(2)}, readPage(t, rows))
+
+		rows, token, err = GetQueryResultPage(context.Background(), db, "query", token, 2)
+		require.NoError(t, err)
+		assert.Equal(t, "", token)
+		assert.Equal(t, []driver.Value{int64(3)}, readPage(t, rows))
+
+		assert.Equal(t, []string{"", "page-2"}, db.tokens)
+	})
+
+	t.Run("it returns all the rows in one page for other drivers", func(t *testing.T) {
+		rows, token, err := GetQueryResultPage(context.Background(), fakeAsyncDB{}, "query", "", 2)
+		require.NoError(t, err)
+		assert.Nil(t, rows)
+		assert.Equal(t, "", token)
+	})
+
+	t.Run("it rejects a page token for other drivers", func(t *testing.T) {
+		_, _, err := GetQueryResultPage(context.Background(), fakeAsyncDB{}, "query", "page-2", 2)
+		assert.ErrorIs(t, err, ErrInvalidPageToken)
+	})
+}
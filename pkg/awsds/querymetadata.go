@@ -0,0 +1,95 @@
+package awsds
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// QueryMetadataStore keeps metadata about async queries, like execution stats, by query id.
+// Entries expire after a TTL and the oldest ones are evicted once the store is full, so queries
+// whose results are never fetched don't leak.
+type QueryMetadataStore struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // oldest entry first
+	ttl     time.Duration
+	maxSize int
+
+	// now returns the current time, stubbable by tests
+	now func() time.Time
+}
+
+type queryMetadataEntry struct {
+	queryID  string
+	metadata interface{}
+	stored   time.Time
+}
+
+// NewQueryMetadataStore creates a store keeping each entry for ttl and at most maxSize entries
+func NewQueryMetadataStore(ttl time.Duration, maxSize int) *QueryMetadataStore {
+	return &QueryMetadataStore{
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		ttl:     ttl,
+		maxSize: maxSize,
+		now:     time.Now,
+	}
+}
+
+// Set stores the metadata of a query, replacing the previous one
+func (s *QueryMetadataStore) Set(queryID string, metadata interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[queryID]; ok {
+		s.order.Remove(elem)
+	}
+	s.entries[queryID] = s.order.PushBack(&queryMetadataEntry{queryID: queryID, metadata: metadata, stored: s.now()})
+	s.evict()
+}
+
+// Get returns the metadata of a query, if stored and not expired
+func (s *QueryMetadataStore) Get(queryID string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.evict()
+	elem, ok := s.entries[queryID]
+	if !ok {
+		return nil, false
+	}
+	return elem.Value.(*queryMetadataEntry).metadata, true
+}
+
+// Delete removes the metadata of a query, e.g. once its results are fetched
+func (s *QueryMetadataStore) Delete(queryID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[queryID]; ok {
+		s.order.Remove(elem)
+		delete(s.entries, queryID)
+	}
+}
+
+// Len returns the number of entries in the store, expired ones included until evicted
+func (s *QueryMetadataStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+// evict removes the expired entries and the oldest ones over the size limit. s.mu must be held.
+func (s *QueryMetadataStore) evict() {
+	now := s.now()
+	for elem := s.order.Front(); elem != nil; elem = s.order.Front() {
+		entry := elem.Value.(*queryMetadataEntry)
+		expired := s.ttl > 0 && now.Sub(entry.stored) >= s.ttl
+		if !expired && (s.maxSize <= 0 || s.order.Len() <= s.maxSize) {
+			return
+		}
+		s.order.Remove(elem)
+		delete(s.entries, entry.queryID)
+	}
+}
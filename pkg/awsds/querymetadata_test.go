@@ -0,0 +1,59 @@
+package awsds
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryMetadataStore(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newStore := func(ttl time.Duration, maxSize int) *QueryMetadataStore {
+		store := NewQueryMetadataStore(ttl, maxSize)
+		store.now = func() time.Time { return now }
+		return store
+	}
+
+	t.Run("it evicts expired entries", func(t *testing.T) {
+		store := newStore(time.Minute, 10)
+		store.Set("q1", "stats 1")
+		now = now.Add(30 * time.Second)
+		store.Set("q2", "stats 2")
+
+		now = now.Add(30 * time.Second)
+		_, ok := store.Get("q1")
+		assert.False(t, ok)
+		metadata, ok := store.Get("q2")
+		assert.True(t, ok)
+		assert.Equal(t, "stats 2", metadata)
+		assert.Equal(t, 1, store.Len())
+	})
+
+	t.Run("it evicts the oldest entries over the size cap", func(t *testing.T) {
+		store := newStore(time.Hour, 2)
+		store.Set("q1", "stats 1")
+		store.Set("q2", "stats 2")
+		store.Set("q1", "stats 1 updated")
+		store.Set("q3", "stats 3")
+
+		_, ok := store.Get("q2")
+		assert.False(t, ok)
+		metadata, ok := store.Get("q1")
+		assert.True(t, ok)
+		assert.Equal(t, "stats 1 updated", metadata)
+		_, ok = store.Get("q3")
+		assert.True(t, ok)
+		assert.Equal(t, 2, store.Len())
+	})
+
+	t.Run("it deletes entries", func(t *testing.T) {
+		store := newStore(time.Hour, 2)
+		store.Set("q1", "stats 1")
+		store.Delete("q1")
+
+		_, ok := store.Get("q1")
+		assert.False(t, ok)
+		assert.Zero(t, store.Len())
+	})
+}
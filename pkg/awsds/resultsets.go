@@ -0,0 +1,25 @@
+package awsds
+
+import (
+	"context"
+	"database/sql/driver"
+)
+
+// MultiResultAsyncDB is implemented by the AsyncDB of drivers whose queries can return several result
+// sets, e.g. Redshift multi-statement queries. The sets are returned in the order of the statements.
+type MultiResultAsyncDB interface {
+	GetResultSets(ctx context.Context, queryID string) ([]driver.Rows, error)
+}
+
+// GetResultSets returns the result sets of the query. An AsyncDB that doesn't implement
+// MultiResultAsyncDB returns the rows of GetRows as a single set.
+func GetResultSets(ctx context.Context, db AsyncDB, queryID string) ([]driver.Rows, error) {
+	if multi, ok := db.(MultiResultAsyncDB); ok {
+		return multi.GetResultSets(ctx, queryID)
+	}
+	rows, err := db.GetRows(ctx, queryID)
+	if err != nil {
+		return nil, err
+	}
+	return []driver.Rows{rows}, nil
+}
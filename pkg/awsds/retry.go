@@ -0,0 +1,58 @@
+package awsds
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// IsRetryableError is the default retry classification: server errors, throttling and the
+// errors the AWS SDK considers retryable, like connection resets
+func IsRetryableError(err error) bool {
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) && requestFailure.StatusCode() >= http.StatusInternalServerError {
+		return true
+	}
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && (request.IsErrorRetryable(awsErr) || request.IsErrorThrottle(awsErr))
+}
+
+// IsExpiredTokenError returns true if AWS rejected the request because its credentials expired,
+// which fresh credentials fix
+func IsExpiredTokenError(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	return awsErr.Code() == "ExpiredToken" || awsErr.Code() == "ExpiredTokenException"
+}
+
+// WithRetryClassifier makes the sessions retry the failed AWS requests for which classify returns true,
+// instead of using the SDK classification. Use IsRetryableError to extend the default one.
+func WithRetryClassifier(classify func(error) bool) SessionCacheOption {
+	return func(sc *SessionCache) {
+		sc.retryClassifier = classify
+	}
+}
+
+// classifyingRetryer retries the requests classify accepts, with the delays of the default retryer
+type classifyingRetryer struct {
+	client.DefaultRetryer
+	classify func(error) bool
+}
+
+func (r classifyingRetryer) ShouldRetry(req *request.Request) bool {
+	return req.Error != nil && r.classify(req.Error)
+}
+
+func newClassifyingRetryer(cfg *aws.Config, classify func(error) bool) request.Retryer {
+	maxRetries := client.DefaultRetryerMaxNumRetries
+	if cfg.MaxRetries != nil && *cfg.MaxRetries != aws.UseServiceDefaultRetries {
+		maxRetries = *cfg.MaxRetries
+	}
+	return classifyingRetryer{DefaultRetryer: client.DefaultRetryer{NumMaxRetries: maxRetries}, classify: classify}
+}
@@ -0,0 +1,71 @@
+package awsds
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRetryableError(t *testing.T) {
+	assert.True(t, IsRetryableError(awserr.NewRequestFailure(awserr.New("InternalFailure", "failed", nil), 500, "1")))
+	assert.True(t, IsRetryableError(awserr.New("ThrottlingException", "slow down", nil)))
+	assert.False(t, IsRetryableError(awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "1")))
+	assert.False(t, IsRetryableError(errors.New("failed")))
+}
+
+func TestWithRetryClassifier(t *testing.T) {
+	origNewSession := newSession
+	t.Cleanup(func() { newSession = origNewSession })
+	newSession = realNewSession
+
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>SerializableIsolationViolation</Code>` +
+			`<Message>concurrent transaction</Message></Error><RequestId>1</RequestId></ErrorResponse>`))
+	}))
+	defer srv.Close()
+	sessionConfig := SessionConfig{
+		Settings:     AWSDatasourceSettings{AuthType: AuthTypeKeys, AccessKey: "foo", SecretKey: "bar", Region: "us-east-1", Endpoint: srv.URL},
+		AuthSettings: &AuthSettings{AllowedAuthProviders: []string{"keys"}},
+	}
+	isTransient := func(err error) bool {
+		var awsErr awserr.Error
+		return errors.As(err, &awsErr) && awsErr.Code() == "SerializableIsolationViolation"
+	}
+
+	t.Run("it retries the errors accepted by the classifier", func(t *testing.T) {
+		calls = 0
+		sess, err := NewSessionCache(WithRetryClassifier(isTransient)).GetSession(sessionConfig)
+		require.NoError(t, err)
+
+		_, err = sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		require.Error(t, err)
+		assert.Equal(t, 4, calls)
+	})
+
+	t.Run("it doesn't retry client errors by default", func(t *testing.T) {
+		calls = 0
+		sess, err := NewSessionCache().GetSession(sessionConfig)
+		require.NoError(t, err)
+
+		_, err = sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		require.Error(t, err)
+		assert.Equal(t, 1, calls)
+	})
+}
+
+func TestIsExpiredTokenError(t *testing.T) {
+	assert.True(t, IsExpiredTokenError(awserr.New("ExpiredToken", "The provided token has expired", nil)))
+	assert.True(t, IsExpiredTokenError(fmt.Errorf("query failed: %w", awserr.New("ExpiredTokenException", "expired", nil))))
+	assert.False(t, IsExpiredTokenError(awserr.New("AccessDeniedException", "denied", nil)))
+	assert.False(t, IsExpiredTokenError(nil))
+}
@@ -0,0 +1,57 @@
+package awsds
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// RetryAfterError is a throttled request failure for which AWS sent a Retry-After header.
+// It keeps the code of the original failure, so the SDK still treats it as throttling.
+type RetryAfterError struct {
+	awserr.RequestFailure
+	Delay time.Duration
+}
+
+// RetryAfter returns how long AWS asked to wait before retrying
+func (e *RetryAfterError) RetryAfter() time.Duration {
+	return e.Delay
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.RequestFailure
+}
+
+// retryAfterHandler adds the Retry-After hint of throttled responses to the request error
+var retryAfterHandler = request.NamedHandler{
+	Name: "awsds.RetryAfterHandler",
+	Fn: func(r *request.Request) {
+		failure, ok := r.Error.(awserr.RequestFailure)
+		if !ok || r.HTTPResponse == nil || !request.IsErrorThrottle(failure) {
+			return
+		}
+		if delay, ok := parseRetryAfter(r.HTTPResponse.Header.Get("Retry-After"), time.Now()); ok {
+			r.Error = &RetryAfterError{RequestFailure: failure, Delay: delay}
+		}
+	},
+}
+
+// parseRetryAfter parses a Retry-After header, either a number of seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
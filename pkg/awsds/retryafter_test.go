@@ -0,0 +1,62 @@
+package awsds
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryAfterHandler(t *testing.T) {
+	run := func(code string, retryAfter string) error {
+		r := &request.Request{
+			HTTPResponse: &http.Response{Header: http.Header{}},
+			Error:        awserr.NewRequestFailure(awserr.New(code, "Rate exceeded", nil), http.StatusBadRequest, "req-1"),
+		}
+		if retryAfter != "" {
+			r.HTTPResponse.Header.Set("Retry-After", retryAfter)
+		}
+		retryAfterHandler.Fn(r)
+		return r.Error
+	}
+
+	t.Run("it adds the hint to throttling errors", func(t *testing.T) {
+		err := run("ThrottlingException", "3")
+		retryAfterErr, ok := err.(*RetryAfterError)
+		require.True(t, ok)
+		assert.Equal(t, 3*time.Second, retryAfterErr.RetryAfter())
+		assert.Equal(t, "ThrottlingException", retryAfterErr.Code())
+		assert.True(t, request.IsErrorThrottle(err))
+	})
+
+	t.Run("it ignores throttling errors without hint", func(t *testing.T) {
+		_, ok := run("ThrottlingException", "").(*RetryAfterError)
+		assert.False(t, ok)
+	})
+
+	t.Run("it ignores other errors", func(t *testing.T) {
+		_, ok := run("AccessDeniedException", "3").(*RetryAfterError)
+		assert.False(t, ok)
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		"Mon, 01 Jan 2024 00:00:30 GMT": 30 * time.Second,
+		"Sun, 31 Dec 2023 23:59:00 GMT": 0,
+	} {
+		delay, ok := parseRetryAfter(value, now)
+		assert.True(t, ok, value)
+		assert.Equal(t, expected, delay, value)
+	}
+	for _, value := range []string{"", "soon", "-1"} {
+		_, ok := parseRetryAfter(value, now)
+		assert.False(t, ok, value)
+	}
+}
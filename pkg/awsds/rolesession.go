@@ -0,0 +1,30 @@
+package awsds
+
+import (
+	"regexp"
+	"strings"
+)
+
+const maxRoleSessionNameLength = 64
+
+// roleSessionNameInvalidChars matches the characters STS rejects in role session names
+var roleSessionNameInvalidChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// RenderRoleSessionName renders the role session name template, replacing {user} with the login of
+// the Grafana user and {region} with the region, and sanitizes the result for STS: invalid characters
+// become "-" and it's cut to 64 characters. It returns an empty name, for the SDK default, if the
+// result is too short.
+func RenderRoleSessionName(template string, user string, region string) string {
+	if template == "" {
+		return ""
+	}
+	name := strings.NewReplacer("{user}", user, "{region}", region).Replace(template)
+	name = roleSessionNameInvalidChars.ReplaceAllString(name, "-")
+	if len(name) > maxRoleSessionNameLength {
+		name = name[:maxRoleSessionNameLength]
+	}
+	if len(name) < 2 {
+		return ""
+	}
+	return name
+}
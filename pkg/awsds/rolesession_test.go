@@ -0,0 +1,29 @@
+package awsds
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderRoleSessionName(t *testing.T) {
+	tests := []struct {
+		description string
+		template    string
+		user        string
+		expected    string
+	}{
+		{description: "it renders the placeholders", template: "grafana-{user}-{region}", user: "jane", expected: "grafana-jane-eu-west-1"},
+		{description: "it keeps the allowed characters", template: "{user}", user: "jane.doe+ops=1,x@example.com", expected: "jane.doe+ops=1,x@example.com"},
+		{description: "it replaces the invalid characters", template: "grafana/{user}", user: "Jane Doe:admin", expected: "grafana-Jane-Doe-admin"},
+		{description: "it cuts long names", template: "grafana-{user}", user: strings.Repeat("a", 80), expected: "grafana-" + strings.Repeat("a", 56)},
+		{description: "it falls back to the default for short names", template: "{user}", user: "j", expected: ""},
+		{description: "it falls back to the default without template", user: "jane", expected: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			assert.Equal(t, tt.expected, RenderRoleSessionName(tt.template, tt.user, "eu-west-1"))
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package awsds
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// sdkLogLevels are the AWS SDK log levels SDKLogLevel can name, several can be joined with commas
+var sdkLogLevels = map[string]aws.LogLevelType{
+	"debug":                        aws.LogDebug,
+	"debug-with-signing":           aws.LogDebugWithSigning,
+	"debug-with-http-body":         aws.LogDebugWithHTTPBody,
+	"debug-with-request-retries":   aws.LogDebugWithRequestRetries,
+	"debug-with-request-errors":    aws.LogDebugWithRequestErrors,
+	"debug-with-event-stream-body": aws.LogDebugWithEventStreamBody,
+}
+
+// parseSDKLogLevel returns the AWS SDK log level of the given names, e.g. "debug-with-signing,debug-with-http-body"
+func parseSDKLogLevel(names string) (aws.LogLevelType, error) {
+	level := aws.LogOff
+	if names == "" {
+		return level, nil
+	}
+	for _, name := range strings.Split(names, ",") {
+		l, ok := sdkLogLevels[strings.TrimSpace(name)]
+		if !ok {
+			return aws.LogOff, fmt.Errorf("unknown AWS SDK log level %q", name)
+		}
+		level |= l
+	}
+	return level, nil
+}
+
+// sdkLogSecrets match the secrets the AWS SDK may log: the signature and token headers of the requests,
+// also found in the canonical strings and presigned URLs, the credentials in STS and SSO responses, the
+// database passwords of Redshift responses and the secrets of Secrets Manager requests and responses.
+// JSON values are matched up to their closing quote, past the escaped quotes of e.g. a JSON secret.
+var sdkLogSecrets = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`(?im)^(authorization|x-amz-security-token):[^\r\n]*`), "${1}: [redacted]"},
+	{regexp.MustCompile(`(?i)(X-Amz-Security-Token|X-Amz-Signature|X-Amz-Credential)=[^&\s]*`), "${1}=[redacted]"},
+	{regexp.MustCompile(`<(SecretAccessKey|SessionToken|DbPassword)>[^<]*<`), "<${1}>[redacted]<"},
+	{regexp.MustCompile(`(?i)"(secretAccessKey|sessionToken|accessToken|refreshToken|dbPassword|secretString|secretBinary)"\s*:\s*"(?:[^"\\]|\\.)*"`), `"${1}":"[redacted]"`},
+}
+
+// scrubSDKLog redacts the secrets of an AWS SDK log message
+func scrubSDKLog(message string) string {
+	for _, secret := range sdkLogSecrets {
+		message = secret.pattern.ReplaceAllString(message, secret.replacement)
+	}
+	return message
+}
+
+// sdkLogConfig returns the config making the AWS SDK log at the given level to the plugin logger,
+// nil to keep the SDK silent
+func sdkLogConfig(names string) *aws.Config {
+	level, err := parseSDKLogLevel(names)
+	if err != nil || level == aws.LogOff {
+		return nil
+	}
+	return &aws.Config{
+		LogLevel: aws.LogLevel(level),
+		Logger: aws.LoggerFunc(func(args ...interface{}) {
+			backend.Logger.Debug(scrubSDKLog(fmt.Sprint(args...)))
+		}),
+	}
+}
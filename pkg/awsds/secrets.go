@@ -0,0 +1,77 @@
+package awsds
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretResolver resolves a reference to a secret kept outside of Grafana, e.g. "vault://path#key",
+// into the secret itself
+type SecretResolver interface {
+	ResolveSecret(reference string) (string, error)
+}
+
+type secretEnvelope struct {
+	value      string
+	expiration time.Time
+}
+
+type secretResolverEntry struct {
+	resolver SecretResolver
+	ttl      time.Duration
+}
+
+var (
+	secretResolvers     = map[string]secretResolverEntry{}
+	secretCache         = map[string]secretEnvelope{}
+	secretResolversLock sync.RWMutex
+)
+
+// Clock used to expire resolved secrets.
+// Stubbable by tests.
+var secretNow = time.Now
+
+// RegisterSecretResolver makes Load resolve the credentials starting with scheme + "://" using resolver.
+// Resolved secrets are cached for ttl, or not at all when ttl is 0.
+func RegisterSecretResolver(scheme string, resolver SecretResolver, ttl time.Duration) {
+	secretResolversLock.Lock()
+	defer secretResolversLock.Unlock()
+	secretResolvers[scheme] = secretResolverEntry{resolver: resolver, ttl: ttl}
+	for reference := range secretCache {
+		if strings.HasPrefix(reference, scheme+"://") {
+			delete(secretCache, reference)
+		}
+	}
+}
+
+// resolveSecret returns value as is unless it's a reference handled by a registered SecretResolver
+func resolveSecret(value string) (string, error) {
+	scheme, _, ok := strings.Cut(value, "://")
+	if !ok {
+		return value, nil
+	}
+
+	secretResolversLock.RLock()
+	entry, registered := secretResolvers[scheme]
+	cached, isCached := secretCache[value]
+	secretResolversLock.RUnlock()
+	if !registered {
+		return value, nil
+	}
+	if isCached && secretNow().Before(cached.expiration) {
+		return cached.value, nil
+	}
+
+	secret, err := entry.resolver.ResolveSecret(value)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve secret %q: %w", value, err)
+	}
+	if entry.ttl > 0 {
+		secretResolversLock.Lock()
+		secretCache[value] = secretEnvelope{value: secret, expiration: secretNow().Add(entry.ttl)}
+		secretResolversLock.Unlock()
+	}
+	return secret, nil
+}
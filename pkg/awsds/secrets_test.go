@@ -0,0 +1,75 @@
+package awsds
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSecretResolver struct {
+	secrets map[string]string
+	calls   int
+}
+
+func (r *fakeSecretResolver) ResolveSecret(reference string) (string, error) {
+	r.calls++
+	secret, ok := r.secrets[reference]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return secret, nil
+}
+
+func TestLoadSettings_SecretResolver(t *testing.T) {
+	now := time.Now()
+	origNow := secretNow
+	secretNow = func() time.Time { return now }
+	t.Cleanup(func() {
+		secretNow = origNow
+		delete(secretResolvers, "vault")
+		secretCache = map[string]secretEnvelope{}
+	})
+
+	resolver := &fakeSecretResolver{secrets: map[string]string{"vault://aws/grafana#secret": "s3cr3t"}}
+	RegisterSecretResolver("vault", resolver, time.Minute)
+	config := backend.DataSourceInstanceSettings{
+		DecryptedSecureJSONData: map[string]string{
+			"accessKey": "AKIAEXAMPLE",
+			"secretKey": "vault://aws/grafana#secret",
+		},
+	}
+
+	t.Run("it resolves references", func(t *testing.T) {
+		settings := &AWSDatasourceSettings{}
+		require.NoError(t, settings.Load(config))
+		assert.Equal(t, "AKIAEXAMPLE", settings.AccessKey)
+		assert.Equal(t, "s3cr3t", settings.SecretKey)
+		assert.Equal(t, 1, resolver.calls)
+	})
+
+	t.Run("it caches resolved secrets until the ttl expires", func(t *testing.T) {
+		resolver.secrets["vault://aws/grafana#secret"] = "rotated"
+
+		settings := &AWSDatasourceSettings{}
+		require.NoError(t, settings.Load(config))
+		assert.Equal(t, "s3cr3t", settings.SecretKey)
+		assert.Equal(t, 1, resolver.calls)
+
+		now = now.Add(time.Minute)
+		require.NoError(t, settings.Load(config))
+		assert.Equal(t, "rotated", settings.SecretKey)
+		assert.Equal(t, 2, resolver.calls)
+	})
+
+	t.Run("it fails when a reference can't be resolved", func(t *testing.T) {
+		settings := &AWSDatasourceSettings{}
+		err := settings.Load(backend.DataSourceInstanceSettings{
+			DecryptedSecureJSONData: map[string]string{"secretKey": "vault://aws/missing#secret"},
+		})
+		require.ErrorContains(t, err, `could not resolve secret "vault://aws/missing#secret"`)
+	})
+}
@@ -1,9 +1,14 @@
 package awsds
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,13 +17,20 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/experimental/errorsource"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/ssocreds"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/defaults"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sso"
+	"github.com/aws/aws-sdk-go/service/ssooidc"
+	"github.com/aws/aws-sdk-go/service/sts"
 )
 
 type envelope struct {
@@ -30,13 +42,273 @@ type envelope struct {
 type SessionCache struct {
 	sessCache     map[string]envelope
 	sessCacheLock sync.RWMutex
+
+	// Header set with the correlation id of the request context, if any
+	correlationIDHeader string
+	// Options the sessions are built from, before the datasource settings
+	baseOptions *session.Options
+	// Returns the MFA code used to assume roles requiring MFA
+	mfaTokenProvider func() (string, error)
+	// Fail the requests to the EC2 instance metadata service instead of sending them
+	disableEC2Metadata bool
+	// Longest time credentials are used before being retrieved again, 0 to rely on their expiry
+	maxCredentialAge time.Duration
+	// Tells which failed requests to retry, the SDK decides if nil
+	retryClassifier func(error) bool
+	// Build the sessions without ever sending their requests
+	dryRun bool
+	// Build a new session on every call instead of reusing the cached ones
+	disabled bool
+	// Longest time an AWS operation called without a context deadline can take, 0 for no limit
+	defaultTimeout time.Duration
+	// Base URLs replacing the EC2 instance metadata service and the ECS container credentials endpoint
+	ec2MetadataEndpoint          string
+	containerCredentialsEndpoint string
+	// Oldest TLS version the sessions connect to AWS with, 0 for the default of the HTTP client
+	minTLSVersion uint16
+	// Directory of the cached SSO access tokens, empty for the one of the AWS CLI
+	ssoTokenDir string
+}
+
+// SessionCacheOption configures optional behavior of the sessions created by a SessionCache
+type SessionCacheOption func(*SessionCache)
+
+// Rotate makes every cached session fetch fresh credentials: the credentials of the sessions already
+// in use expire, so they're retrieved again on next use, and new sessions are created from now on.
+func (sc *SessionCache) Rotate() {
+	sc.sessCacheLock.Lock()
+	defer sc.sessCacheLock.Unlock()
+	for key, env := range sc.sessCache {
+		if env.session.Config != nil && env.session.Config.Credentials != nil {
+			env.session.Config.Credentials.Expire()
+		}
+		delete(sc.sessCache, key)
+	}
+}
+
+// Keys returns the keys of the cached sessions, in no particular order
+func (sc *SessionCache) Keys() []string {
+	sc.sessCacheLock.RLock()
+	defer sc.sessCacheLock.RUnlock()
+	keys := make([]string, 0, len(sc.sessCache))
+	for key := range sc.sessCache {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Prune removes the cached sessions for which remove returns true, e.g. the sessions of a deleted
+// datasource's region or endpoint, and closes the idle connections of their HTTP client.
+// It returns the number of sessions removed.
+func (sc *SessionCache) Prune(remove func(key string, sess *session.Session) bool) int {
+	sc.sessCacheLock.Lock()
+	defer sc.sessCacheLock.Unlock()
+	pruned := 0
+	for key, env := range sc.sessCache {
+		if !remove(key, env.session) {
+			continue
+		}
+		delete(sc.sessCache, key)
+		closeSession(env.session)
+		pruned++
+	}
+	return pruned
+}
+
+// CredentialsProviderName returns the name of the provider that supplied the credentials of the
+// session, e.g. "EnvConfigCredentials", "EC2RoleProvider" or "AssumeRoleProvider", to tell which
+// one of the credential chain is used. The credentials are retrieved if they weren't yet.
+func CredentialsProviderName(ctx context.Context, sess *session.Session) (string, error) {
+	if sess.Config == nil || sess.Config.Credentials == nil {
+		return "", fmt.Errorf("the session has no credentials")
+	}
+	value, err := sess.Config.Credentials.GetWithContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	return value.ProviderName, nil
+}
+
+// closeSession releases the resources held by the session. The HTTP client may be shared with other
+// sessions, so only its idle connections are closed.
+func closeSession(sess *session.Session) {
+	if sess.Config != nil && sess.Config.HTTPClient != nil && sess.Config.HTTPClient != http.DefaultClient {
+		sess.Config.HTTPClient.CloseIdleConnections()
+	}
+}
+
+// WithBaseSessionOptions makes the sessions start from the given options, e.g. with an
+// AssumeRoleTokenProvider, with the settings of the datasource merged on top
+func WithBaseSessionOptions(opts session.Options) SessionCacheOption {
+	return func(sc *SessionCache) {
+		sc.baseOptions = &opts
+	}
+}
+
+// WithMFATokenProvider sets the function returning the current MFA code of the device set in the
+// MFASerial setting, called whenever a role has to be assumed. Codes are short-lived, so it's
+// usually an interactive prompt or a TOTP generator.
+func WithMFATokenProvider(provider func() (string, error)) SessionCacheOption {
+	return func(sc *SessionCache) {
+		sc.mfaTokenProvider = provider
+	}
+}
+
+// WithEC2MetadataDisabled stops the sessions from ever reaching the EC2 instance metadata service,
+// the same way AWS_EC2_METADATA_DISABLED does but without changing the environment of the process.
+// The credential providers relying on it, like the EC2 role provider of the default chain, fail instead.
+func WithEC2MetadataDisabled() SessionCacheOption {
+	return func(sc *SessionCache) {
+		sc.disableEC2Metadata = true
+	}
+}
+
+// WithMaxCredentialAge makes the sessions retrieve their credentials again once they're maxAge old,
+// even if AWS reports a later expiry, e.g. to re-authenticate every 15 minutes. Sessions are also
+// created again after maxAge, so the assumed roles are assumed again.
+func WithMaxCredentialAge(maxAge time.Duration) SessionCacheOption {
+	return func(sc *SessionCache) {
+		sc.maxCredentialAge = maxAge
+	}
+}
+
+// ErrCodeDryRun is the error code of the requests failed by the sessions of a dry run SessionCache
+const ErrCodeDryRun = "DryRunOperation"
+
+// WithDryRun makes the sessions go through the same settings checks and be built the same way, but
+// fail all their requests, including the STS and metadata calls fetching credentials, with
+// ErrCodeDryRun instead of sending them. It lets configurations be validated without network access.
+// The account check of AssumeRoleCrossAccountOnly is skipped, the role is always assumed.
+func WithDryRun() SessionCacheOption {
+	return func(sc *SessionCache) {
+		sc.dryRun = true
+	}
+}
+
+// WithCacheDisabled makes every GetSession call build a new session, with fresh credentials, instead
+// of reusing a cached one. It's meant to rule out stale sessions while debugging, as credentials are
+// then retrieved again for every session, e.g. a role is assumed each time.
+func WithCacheDisabled() SessionCacheOption {
+	return func(sc *SessionCache) {
+		sc.disabled = true
+	}
+}
+
+// dryRunHandler fails the requests before they're signed and sent
+var dryRunHandler = request.NamedHandler{
+	Name: "awsds.DryRunHandler",
+	Fn: func(r *request.Request) {
+		r.Error = awserr.New(ErrCodeDryRun, "request not sent in dry run", nil)
+	},
+}
+
+// WithDefaultTimeout bounds the time every AWS operation of the sessions can take, retries
+// included, when its context has no deadline, e.g. the operations called without a context or with
+// context.Background(). A deadline set by the caller is always kept, even a later one. Operations
+// cut off fail with request.CanceledErrorCode.
+func WithDefaultTimeout(timeout time.Duration) SessionCacheOption {
+	return func(sc *SessionCache) {
+		sc.defaultTimeout = timeout
+	}
+}
+
+// defaultTimeoutHandler gives the requests without a deadline one after timeout
+func defaultTimeoutHandler(timeout time.Duration) request.NamedHandler {
+	return request.NamedHandler{
+		Name: "awsds.DefaultTimeoutHandler",
+		Fn: func(r *request.Request) {
+			if _, ok := r.Context().Deadline(); ok {
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			r.SetContext(ctx)
+			r.Handlers.Complete.PushBack(func(*request.Request) {
+				cancel()
+			})
+		},
+	}
+}
+
+// WithEC2MetadataEndpoint makes the sessions reach the EC2 instance metadata service at endpoint, e.g.
+// a metadata proxy or a stub server in tests, like AWS_EC2_METADATA_SERVICE_ENDPOINT does
+func WithEC2MetadataEndpoint(endpoint string) SessionCacheOption {
+	return func(sc *SessionCache) {
+		sc.ec2MetadataEndpoint = endpoint
+	}
+}
+
+// WithContainerCredentialsEndpoint makes the ec2_iam_role auth type get its credentials from the ECS
+// container credentials endpoint at the given URL, like AWS_CONTAINER_CREDENTIALS_FULL_URI does. The
+// token of AWS_CONTAINER_AUTHORIZATION_TOKEN is still sent. The default auth type keeps reading the
+// endpoint from the environment.
+func WithContainerCredentialsEndpoint(endpoint string) SessionCacheOption {
+	return func(sc *SessionCache) {
+		sc.containerCredentialsEndpoint = endpoint
+	}
+}
+
+// WithSSOTokenDir makes the sso auth type read the cached SSO access tokens from dir instead of
+// ~/.aws/sso/cache, e.g. a directory provisioned for the plugin. The token of a start URL is in the
+// file `aws sso login` names after it, which is rewritten when the token is refreshed.
+func WithSSOTokenDir(dir string) SessionCacheOption {
+	return func(sc *SessionCache) {
+		sc.ssoTokenDir = dir
+	}
+}
+
+// newSSOCredentials returns the IAM Identity Center role credentials of the settings. They're retrieved
+// again once expired, with the cached access token, itself refreshed when it carries a refresh token.
+func newSSOCredentials(sess *session.Session, settings AWSDatasourceSettings, tokenDir string) (*credentials.Credentials, error) {
+	tokenFile, err := ssocreds.StandardCachedTokenFilepath(settings.SSOStartURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not find the cached SSO token: %w", err)
+	}
+	if tokenDir != "" {
+		// the file name is a hash of the start URL, so it can't leave the directory
+		tokenFile = filepath.Join(tokenDir, filepath.Base(tokenFile))
+	}
+	cfg := &aws.Config{}
+	if settings.SSORegion != "" {
+		cfg.Region = aws.String(settings.SSORegion)
+	}
+	tokenProvider := ssocreds.NewSSOTokenProvider(ssooidc.New(sess, cfg), tokenFile)
+	return ssocreds.NewCredentialsWithClient(sso.New(sess, cfg), settings.SSOAccountID, settings.SSORoleName, settings.SSOStartURL,
+		func(p *ssocreds.Provider) {
+			p.TokenProvider = tokenProvider
+		}), nil
+}
+
+// remoteCredentials returns the credentials of the EC2 or ECS role the process runs with
+func (sc *SessionCache) remoteCredentials(sess *session.Session) *credentials.Credentials {
+	if sc.containerCredentialsEndpoint == "" {
+		return newRemoteCredentials(sess)
+	}
+	return credentials.NewCredentials(endpointcreds.NewProviderClient(*sess.Config, sess.Handlers, sc.containerCredentialsEndpoint,
+		func(p *endpointcreds.Provider) {
+			p.ExpiryWindow = 5 * time.Minute
+			p.AuthorizationToken = os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+		}))
+}
+
+// disableEC2MetadataHandler fails the EC2 metadata requests before they're signed and sent
+var disableEC2MetadataHandler = request.NamedHandler{
+	Name: "awsds.DisableEC2MetadataHandler",
+	Fn: func(r *request.Request) {
+		if r.ClientInfo.ServiceName == ec2metadata.ServiceName {
+			r.Error = awserr.New(request.CanceledErrorCode, "EC2 IMDS access disabled", nil)
+		}
+	},
 }
 
 // NewSessionCache creates a new session cache using the default settings loaded from environment variables
-func NewSessionCache() *SessionCache {
-	return &SessionCache{
+func NewSessionCache(opts ...SessionCacheOption) *SessionCache {
+	sc := &SessionCache{
 		sessCache: map[string]envelope{},
 	}
+	for _, opt := range opts {
+		opt(sc)
+	}
+	return sc
 }
 
 const (
@@ -60,6 +332,18 @@ var newSession = func(cfgs ...*aws.Config) (*session.Session, error) {
 	return s, nil
 }
 
+// Session factory used when the session options can't be derived from the environment.
+// Stubbable by tests.
+//
+//nolint:gocritic
+var newSessionWithOptions = func(opts session.Options) (*session.Session, error) {
+	s, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, errorsource.DownstreamError(err, false)
+	}
+	return s, nil
+}
+
 // STS credentials factory.
 // Stubbable by tests.
 //
@@ -72,12 +356,40 @@ var newSTSCredentials = stscreds.NewCredentials
 //nolint:gocritic
 var newEC2Metadata = ec2metadata.New
 
-// EC2 + ECS role credentials factory.
+// EC2 + ECS role credentials factory. The ECS container credentials are refreshed
+// before the expiration returned by the endpoint.
 // Stubbable by tests.
 var newRemoteCredentials = func(sess *session.Session) *credentials.Credentials {
 	return credentials.NewCredentials(defaults.RemoteCredProvider(*sess.Config, sess.Handlers))
 }
 
+// Current time of the session cache.
+// Stubbable by tests.
+var sessionNow = time.Now
+
+// Caller account lookup, used to skip assuming a role of the current account.
+// Stubbable by tests.
+var getCallerAccount = func(sess *session.Session) (string, error) {
+	identity, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", errorsource.DownstreamError(fmt.Errorf("could not get the caller identity: %w", err), false)
+	}
+	return aws.StringValue(identity.Account), nil
+}
+
+// isInRoleAccount returns true if the credentials of sess already belong to the account of roleARN
+func isInRoleAccount(sess *session.Session, roleARN string) (bool, error) {
+	role, err := arn.Parse(roleARN)
+	if err != nil {
+		return false, fmt.Errorf("invalid assume role ARN %q: %w", roleARN, err)
+	}
+	account, err := getCallerAccount(sess)
+	if err != nil {
+		return false, err
+	}
+	return account == role.AccountID, nil
+}
+
 type GetSessionConfig struct {
 	Settings      AWSDatasourceSettings
 	HTTPClient    *http.Client
@@ -153,19 +465,74 @@ func (sc *SessionCache) GetSession(c SessionConfig) (*session.Session, error) {
 		b.WriteString(strings.ReplaceAll(s, ":", `\:`))
 	}
 
+	for _, service := range sortedKeys(c.Settings.VPCEndpoints) {
+		b.WriteString(":")
+		b.WriteString(strings.ReplaceAll(service+"="+c.Settings.VPCEndpoints[service], ":", `\:`))
+	}
+
+	if c.Settings.AssumeRoleCrossAccountOnly {
+		b.WriteString(":crossAccountOnly")
+	}
+
+	if c.Settings.TLSSkipVerify {
+		b.WriteString(":tlsSkipVerify")
+	}
+
+	if c.Settings.AuthType == AuthTypeSSO {
+		for _, s := range []string{c.Settings.SSOStartURL, c.Settings.SSORegion, c.Settings.SSOAccountID, c.Settings.SSORoleName} {
+			b.WriteString(":sso=" + strings.ReplaceAll(s, ":", `\:`))
+		}
+	}
+
+	if c.Settings.RoleSessionName != "" {
+		b.WriteString(":roleSession=" + c.Settings.RoleSessionName)
+	}
+
+	if c.Settings.MFASerial != "" {
+		b.WriteString(":mfa=" + strings.ReplaceAll(c.Settings.MFASerial, ":", `\:`))
+	}
+
+	if c.Settings.AssumeRolePolicy != "" {
+		b.WriteString(":policy=" + strings.ReplaceAll(c.Settings.AssumeRolePolicy, ":", `\:`))
+	}
+
+	for _, policyARN := range c.Settings.AssumeRolePolicyARNs {
+		b.WriteString(":policyArn=" + strings.ReplaceAll(policyARN, ":", `\:`))
+	}
+
+	if c.Settings.SDKLogLevel != "" {
+		b.WriteString(":sdkLog=" + c.Settings.SDKLogLevel)
+	}
+
+	if c.Settings.EndpointDiscovery {
+		b.WriteString(":endpointDiscovery")
+	}
+
+	if c.Settings.LoadSharedConfig != nil {
+		b.WriteString(":sharedConfig=" + strconv.FormatBool(*c.Settings.LoadSharedConfig))
+	}
+
 	hashedSettings := sha256.Sum256([]byte(b.String()))
 	cacheKey := fmt.Sprintf("%v", hashedSettings)
 
 	// Check if we have a valid session in the cache, if so return it
 	sc.sessCacheLock.RLock()
-	if env, ok := sc.sessCache[cacheKey]; ok {
-		if env.expiration.After(time.Now().UTC()) {
+	if env, ok := sc.sessCache[cacheKey]; ok && !sc.disabled {
+		if env.expiration.After(sessionNow().UTC()) {
 			sc.sessCacheLock.RUnlock()
 			return env.session, nil
 		}
 	}
 	sc.sessCacheLock.RUnlock()
 
+	if sc.minTLSVersion != 0 || c.Settings.TLSSkipVerify {
+		client, err := tlsClient(c.HTTPClient, sc.minTLSVersion, c.Settings.TLSSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		c.HTTPClient = client
+	}
+
 	cfgs := []*aws.Config{
 		{
 			CredentialsChainVerboseErrors: aws.Bool(true),
@@ -173,6 +540,12 @@ func (sc *SessionCache) GetSession(c SessionConfig) (*session.Session, error) {
 		},
 	}
 
+	var vpcEndpointCfg *aws.Config
+	if len(c.Settings.VPCEndpoints) > 0 {
+		vpcEndpointCfg = &aws.Config{EndpointResolver: vpcEndpointResolver(c.Settings.VPCEndpoints)}
+		cfgs = append(cfgs, vpcEndpointCfg)
+	}
+
 	var regionCfg *aws.Config
 	if c.Settings.Region == defaultRegion {
 		backend.Logger.Warn("Region is set to \"default\", which is unsupported")
@@ -210,11 +583,22 @@ func (sc *SessionCache) GetSession(c SessionConfig) (*session.Session, error) {
 		backend.Logger.Debug("Authenticating towards AWS with default SDK method", "region", c.Settings.Region)
 	case AuthTypeEC2IAMRole:
 		backend.Logger.Debug("Authenticating towards AWS with IAM Role", "region", c.Settings.Region)
-		sess, err := newSession(cfgs...)
+		sess, err := sc.buildSession(c, cfgs...)
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, &aws.Config{Credentials: sc.remoteCredentials(sess)})
+	case AuthTypeSSO:
+		backend.Logger.Debug("Authenticating towards AWS with IAM Identity Center", "region", c.Settings.Region)
+		sess, err := sc.buildSession(c, cfgs...)
 		if err != nil {
 			return nil, err
 		}
-		cfgs = append(cfgs, &aws.Config{Credentials: newRemoteCredentials(sess)})
+		creds, err := newSSOCredentials(sess, c.Settings, sc.ssoTokenDir)
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, &aws.Config{Credentials: creds})
 	case AuthTypeGrafanaAssumeRole:
 		backend.Logger.Debug("Authenticating towards AWS with Grafana Assume Role", "region", c.Settings.Region)
 		cfgs = append(cfgs, &aws.Config{
@@ -228,34 +612,67 @@ func (sc *SessionCache) GetSession(c SessionConfig) (*session.Session, error) {
 	if c.AuthSettings.SessionDuration != nil {
 		duration = *c.AuthSettings.SessionDuration
 	}
-	expiration := time.Now().UTC().Add(duration)
+	expiration := sessionNow().UTC().Add(duration)
+	if sc.maxCredentialAge > 0 && sc.maxCredentialAge < duration {
+		expiration = sessionNow().UTC().Add(sc.maxCredentialAge)
+	}
 
 	if c.Settings.Endpoint != "" {
 		cfgs = append(cfgs, &aws.Config{Endpoint: aws.String(c.Settings.Endpoint)})
 	}
 
-	if c.Settings.AssumeRoleARN != "" && c.AuthSettings.AssumeRoleEnabled {
-		// We should assume a role in AWS
-		backend.Logger.Debug("Trying to assume role in AWS", "arn", c.Settings.AssumeRoleARN)
-
+	assumeRole := c.Settings.AssumeRoleARN != "" && c.AuthSettings.AssumeRoleEnabled
+	if assumeRole && c.Settings.MFASerial != "" && sc.mfaTokenProvider == nil {
+		return nil, fmt.Errorf("assuming a role with MFA requires a token provider, set one with WithMFATokenProvider")
+	}
+	if assumeRole {
+		if err := validatePolicy(c.Settings.AssumeRolePolicy); err != nil {
+			return nil, err
+		}
+	}
+	var stsSess *session.Session
+	if assumeRole {
 		// If a FIPS endpoint is set, we need to use the FIPS STS endpoint
+		stsCfgs := cfgs
 		if c.Settings.Endpoint != "" {
 			var endpoint = aws.String(getSTSEndpoint(c.Settings.Endpoint))
-			cfgs = append(cfgs, &aws.Config{Endpoint: endpoint})
+			stsCfgs = append(stsCfgs[:len(stsCfgs):len(stsCfgs)], &aws.Config{Endpoint: endpoint})
 		}
 
-		sess, err := newSession(cfgs...)
+		var err error
+		stsSess, err = sc.buildSession(c, stsCfgs...)
 		if err != nil {
 			return nil, err
 		}
 
+		if c.Settings.AssumeRoleCrossAccountOnly && !sc.dryRun {
+			inAccount, err := isInRoleAccount(stsSess, c.Settings.AssumeRoleARN)
+			if err != nil {
+				return nil, err
+			}
+			if inAccount {
+				backend.Logger.Debug("Already in the account of the role, skipping assume role", "arn", c.Settings.AssumeRoleARN)
+				assumeRole = false
+				if c.Settings.Region != "" {
+					// an opt-in region was replaced by us-east-1 for the role to be assumed, restore it
+					cfgs = append(cfgs, &aws.Config{Region: aws.String(c.Settings.Region)})
+				}
+			}
+		}
+	}
+
+	if assumeRole {
+		// We should assume a role in AWS
+		backend.Logger.Debug("Trying to assume role in AWS", "arn", c.Settings.AssumeRoleARN)
+
 		cfgs = []*aws.Config{
 			{
 				CredentialsChainVerboseErrors: aws.Bool(true),
+				HTTPClient:                    c.HTTPClient,
 			},
 			{
 				// The previous session is used to obtain STS Credentials
-				Credentials: newSTSCredentials(sess, c.Settings.AssumeRoleARN, func(p *stscreds.AssumeRoleProvider) {
+				Credentials: newSTSCredentials(stsSess, c.Settings.AssumeRoleARN, func(p *stscreds.AssumeRoleProvider) {
 					// Not sure if this is necessary, overlaps with p.Duration and is undocumented
 					p.Expiry.SetExpiration(expiration, 0)
 					p.Duration = duration
@@ -264,6 +681,19 @@ func (sc *SessionCache) GetSession(c SessionConfig) (*session.Session, error) {
 					} else if c.Settings.ExternalID != "" {
 						p.ExternalID = aws.String(c.Settings.ExternalID)
 					}
+					if c.Settings.RoleSessionName != "" {
+						p.RoleSessionName = c.Settings.RoleSessionName
+					}
+					if c.Settings.MFASerial != "" {
+						p.SerialNumber = aws.String(c.Settings.MFASerial)
+						p.TokenProvider = sc.mfaTokenProvider
+					}
+					if c.Settings.AssumeRolePolicy != "" {
+						p.Policy = aws.String(c.Settings.AssumeRolePolicy)
+					}
+					for _, policyARN := range c.Settings.AssumeRolePolicyARNs {
+						p.PolicyArns = append(p.PolicyArns, &sts.PolicyDescriptorType{Arn: aws.String(policyARN)})
+					}
 				}),
 			},
 		}
@@ -273,13 +703,17 @@ func (sc *SessionCache) GetSession(c SessionConfig) (*session.Session, error) {
 			cfgs = append(cfgs, regionCfg)
 		}
 
+		if vpcEndpointCfg != nil {
+			cfgs = append(cfgs, vpcEndpointCfg)
+		}
+
 		// If a FIPS endpoint is set, we need to set the endpoint on the returned session
 		if isFIPSEndpoint(c.Settings.Endpoint) {
 			cfgs = append(cfgs, &aws.Config{Endpoint: aws.String(c.Settings.Endpoint)})
 		}
 	}
 
-	sess, err := newSession(cfgs...)
+	sess, err := sc.buildSession(c, cfgs...)
 	if err != nil {
 		return nil, err
 	}
@@ -290,7 +724,34 @@ func (sc *SessionCache) GetSession(c SessionConfig) (*session.Session, error) {
 		})
 	}
 
+	sess.Handlers.UnmarshalError.PushBackNamed(retryAfterHandler)
+
+	if sc.retryClassifier != nil {
+		sess.Config.Retryer = newClassifyingRetryer(sess.Config, sc.retryClassifier)
+		// the SDK flags some errors as retryable itself, skipping the retryer otherwise
+		sess.Config.EnforceShouldRetryCheck = aws.Bool(true)
+	}
+
+	if sc.maxCredentialAge > 0 && sess.Config.Credentials != nil {
+		sess.Config.Credentials = credentials.NewCredentials(&maxAgeProvider{
+			creds:  sess.Config.Credentials,
+			maxAge: sc.maxCredentialAge,
+		})
+	}
+
+	if sc.correlationIDHeader != "" {
+		header := sc.correlationIDHeader
+		sess.Handlers.Build.PushBack(func(r *request.Request) {
+			if id := CorrelationIDFromContext(r.Context()); id != "" {
+				r.HTTPRequest.Header.Set(header, id)
+			}
+		})
+	}
+
 	backend.Logger.Debug("Successfully created AWS session")
+	if sc.disabled {
+		return sess, nil
+	}
 
 	sc.sessCacheLock.Lock()
 	sc.sessCache[cacheKey] = envelope{
@@ -302,6 +763,82 @@ func (sc *SessionCache) GetSession(c SessionConfig) (*session.Session, error) {
 	return sess, nil
 }
 
+// maxAgeProvider retrieves the wrapped credentials again once they're maxAge old, whatever
+// their expiry. The credentials.Credentials calling it serializes the calls.
+type maxAgeProvider struct {
+	creds       *credentials.Credentials
+	maxAge      time.Duration
+	retrievedAt time.Time
+}
+
+func (p *maxAgeProvider) Retrieve() (credentials.Value, error) {
+	return p.RetrieveWithContext(aws.BackgroundContext())
+}
+
+func (p *maxAgeProvider) RetrieveWithContext(ctx credentials.Context) (credentials.Value, error) {
+	if !p.retrievedAt.IsZero() {
+		p.creds.Expire()
+	}
+	value, err := p.creds.GetWithContext(ctx)
+	if err != nil {
+		return value, err
+	}
+	p.retrievedAt = sessionNow()
+	return value, nil
+}
+
+func (p *maxAgeProvider) IsExpired() bool {
+	return p.creds.IsExpired() || !sessionNow().Before(p.retrievedAt.Add(p.maxAge))
+}
+
+// buildSession creates a session from the given configs, loading the shared config file
+// if the settings require it
+func (sc *SessionCache) buildSession(c SessionConfig, cfgs ...*aws.Config) (*session.Session, error) {
+	if logCfg := sdkLogConfig(c.Settings.SDKLogLevel); logCfg != nil {
+		cfgs = append(cfgs[:len(cfgs):len(cfgs)], logCfg)
+	}
+	if c.Settings.EndpointDiscovery {
+		// the services without endpoint discovery ignore it
+		cfgs = append(cfgs[:len(cfgs):len(cfgs)], &aws.Config{EnableEndpointDiscovery: aws.Bool(true)})
+	}
+	if c.Settings.LoadSharedConfig == nil && sc.baseOptions == nil && !sc.disableEC2Metadata && !sc.dryRun && sc.defaultTimeout == 0 && sc.ec2MetadataEndpoint == "" {
+		return newSession(cfgs...)
+	}
+	opts := session.Options{}
+	if sc.baseOptions != nil {
+		opts = *sc.baseOptions
+		opts.Config = *sc.baseOptions.Config.Copy()
+	}
+	if sc.disableEC2Metadata || sc.dryRun || sc.defaultTimeout > 0 {
+		// the handlers must be set when the session is created, so the default credential chain gets them too
+		if opts.Handlers.IsEmpty() {
+			opts.Handlers = defaults.Handlers()
+		} else {
+			opts.Handlers = opts.Handlers.Copy()
+		}
+		if sc.disableEC2Metadata {
+			opts.Handlers.Build.PushFrontNamed(disableEC2MetadataHandler)
+		}
+		if sc.dryRun {
+			opts.Handlers.Build.PushFrontNamed(dryRunHandler)
+		}
+		if sc.defaultTimeout > 0 {
+			opts.Handlers.Build.PushFrontNamed(defaultTimeoutHandler(sc.defaultTimeout))
+		}
+	}
+	if sc.ec2MetadataEndpoint != "" {
+		opts.EC2IMDSEndpoint = sc.ec2MetadataEndpoint
+	}
+	if c.Settings.LoadSharedConfig != nil {
+		opts.SharedConfigState = session.SharedConfigDisable
+		if *c.Settings.LoadSharedConfig {
+			opts.SharedConfigState = session.SharedConfigEnable
+		}
+	}
+	opts.Config.MergeIn(cfgs...)
+	return newSessionWithOptions(opts)
+}
+
 // AuthSettings can be grabed from the datasource instance's context with ReadAuthSettingsFromContext
 func (sc *SessionCache) GetSessionWithAuthSettings(c GetSessionConfig, as AuthSettings) (*session.Session, error) {
 	return sc.GetSession(SessionConfig{
@@ -312,6 +849,30 @@ func (sc *SessionCache) GetSessionWithAuthSettings(c GetSessionConfig, as AuthSe
 	})
 }
 
+// vpcEndpointResolver resolves the configured services to their VPC endpoint, keeping the signing region
+// of the request. Other services use the default resolver.
+func vpcEndpointResolver(vpcEndpoints map[string]string) endpoints.Resolver {
+	return endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		if url, ok := vpcEndpoints[service]; ok && url != "" {
+			return endpoints.ResolvedEndpoint{
+				URL:           url,
+				SigningRegion: region,
+				SigningMethod: "v4",
+			}, nil
+		}
+		return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	})
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // getSTSEndpoint returns true if the set endpoint is a fips endpoint
 func isFIPSEndpoint(endpoint string) bool {
 	return strings.Contains(endpoint, "fips") ||
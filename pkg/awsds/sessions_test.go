@@ -1,22 +1,31 @@
 package awsds
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/ssocreds"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/stretchr/testify/assert"
@@ -610,3 +619,939 @@ func TestGetSessionWithAuthSettings(t *testing.T) {
 		require.EqualError(t, err, "attempting to use an auth type that is not allowed: \"keys\"")
 	})
 }
+
+func TestNewSession_VPCEndpoints(t *testing.T) {
+	origNewSession := newSession
+	t.Cleanup(func() {
+		newSession = origNewSession
+	})
+	newSession = func(cfgs ...*aws.Config) (*session.Session, error) {
+		return session.NewSession(cfgs...)
+	}
+
+	const vpcEndpoint = "https://vpce-0123456789abcdef0-abcdefgh.sts.eu-west-1.vpce.amazonaws.com"
+	cache := NewSessionCache()
+	sess, err := cache.GetSession(SessionConfig{
+		Settings: AWSDatasourceSettings{
+			AuthType:     AuthTypeKeys,
+			AccessKey:    "foo",
+			SecretKey:    "bar",
+			Region:       "eu-west-1",
+			VPCEndpoints: map[string]string{"sts": vpcEndpoint},
+		},
+		AuthSettings: &AuthSettings{
+			AllowedAuthProviders: []string{"keys"},
+		},
+	})
+	require.NoError(t, err)
+
+	t.Run("requests go to the vpc endpoint signed for the configured region", func(t *testing.T) {
+		req, _ := sts.New(sess).GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+		require.NoError(t, req.Sign())
+
+		assert.Equal(t, "vpce-0123456789abcdef0-abcdefgh.sts.eu-west-1.vpce.amazonaws.com", req.HTTPRequest.URL.Host)
+		assert.Contains(t, req.HTTPRequest.Header.Get("Authorization"), "/eu-west-1/sts/aws4_request")
+	})
+
+	t.Run("other services use the default endpoint", func(t *testing.T) {
+		resolved, err := sess.Config.EndpointResolver.EndpointFor("athena", "eu-west-1")
+		require.NoError(t, err)
+		assert.Equal(t, "https://athena.eu-west-1.amazonaws.com", resolved.URL)
+	})
+}
+
+func TestNewSession_LoadSharedConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(configFile, []byte("[default]\nregion = eu-west-3\n"), 0600))
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_PROFILE", "")
+
+	getSession := func(loadSharedConfig bool) *session.Session {
+		cache := NewSessionCache()
+		sess, err := cache.GetSession(SessionConfig{
+			Settings: AWSDatasourceSettings{
+				AuthType:         AuthTypeKeys,
+				AccessKey:        "foo",
+				SecretKey:        "bar",
+				LoadSharedConfig: aws.Bool(loadSharedConfig),
+			},
+			AuthSettings: &AuthSettings{
+				AllowedAuthProviders: []string{"keys"},
+			},
+		})
+		require.NoError(t, err)
+		return sess
+	}
+
+	t.Run("it loads the shared config when enabled even if the env var disables it", func(t *testing.T) {
+		t.Setenv("AWS_SDK_LOAD_CONFIG", "0")
+		sess := getSession(true)
+		assert.Equal(t, "eu-west-3", aws.StringValue(sess.Config.Region))
+	})
+
+	t.Run("it ignores the shared config when disabled even if the env var enables it", func(t *testing.T) {
+		t.Setenv("AWS_SDK_LOAD_CONFIG", "1")
+		sess := getSession(false)
+		assert.Empty(t, aws.StringValue(sess.Config.Region))
+	})
+}
+
+func TestNewSession_AssumeRoleCrossAccountOnly(t *testing.T) {
+	origNewSession := newSession
+	origNewSTSCredentials := newSTSCredentials
+	origGetCallerAccount := getCallerAccount
+	t.Cleanup(func() {
+		newSession = origNewSession
+		newSTSCredentials = origNewSTSCredentials
+		getCallerAccount = origGetCallerAccount
+	})
+	newSession = func(cfgs ...*aws.Config) (*session.Session, error) {
+		cfg := aws.Config{}
+		cfg.MergeIn(cfgs...)
+		return &session.Session{Config: &cfg}, nil
+	}
+	assumedRoles := []string{}
+	newSTSCredentials = func(c client.ConfigProvider, roleARN string,
+		options ...func(*stscreds.AssumeRoleProvider)) *credentials.Credentials {
+		assumedRoles = append(assumedRoles, roleARN)
+		return credentials.NewCredentials(&stscreds.AssumeRoleProvider{RoleARN: roleARN})
+	}
+	getCallerAccount = func(*session.Session) (string, error) {
+		return "111111111111", nil
+	}
+	authSettings := &AuthSettings{
+		AllowedAuthProviders: []string{"default"},
+		AssumeRoleEnabled:    true,
+	}
+
+	t.Run("it skips assume role in the same account", func(t *testing.T) {
+		assumedRoles = []string{}
+		sess, err := NewSessionCache().GetSession(SessionConfig{
+			Settings: AWSDatasourceSettings{
+				AssumeRoleARN:              "arn:aws:iam::111111111111:role/grafana",
+				AssumeRoleCrossAccountOnly: true,
+			},
+			AuthSettings: authSettings,
+		})
+		require.NoError(t, err)
+		assert.Empty(t, assumedRoles)
+		assert.Nil(t, sess.Config.Credentials)
+	})
+
+	t.Run("it keeps an opt-in region when skipping assume role", func(t *testing.T) {
+		assumedRoles = []string{}
+		sess, err := NewSessionCache().GetSession(SessionConfig{
+			Settings: AWSDatasourceSettings{
+				Region:                     "af-south-1",
+				AssumeRoleARN:              "arn:aws:iam::111111111111:role/grafana",
+				AssumeRoleCrossAccountOnly: true,
+			},
+			AuthSettings: authSettings,
+		})
+		require.NoError(t, err)
+		assert.Empty(t, assumedRoles)
+		assert.Equal(t, "af-south-1", aws.StringValue(sess.Config.Region))
+	})
+
+	t.Run("it assumes the role of another account", func(t *testing.T) {
+		assumedRoles = []string{}
+		sess, err := NewSessionCache().GetSession(SessionConfig{
+			Settings: AWSDatasourceSettings{
+				AssumeRoleARN:              "arn:aws:iam::222222222222:role/grafana",
+				AssumeRoleCrossAccountOnly: true,
+			},
+			AuthSettings: authSettings,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"arn:aws:iam::222222222222:role/grafana"}, assumedRoles)
+		assert.NotNil(t, sess.Config.Credentials)
+	})
+
+	t.Run("it rejects an invalid role ARN", func(t *testing.T) {
+		_, err := NewSessionCache().GetSession(SessionConfig{
+			Settings: AWSDatasourceSettings{
+				AssumeRoleARN:              "grafana",
+				AssumeRoleCrossAccountOnly: true,
+			},
+			AuthSettings: authSettings,
+		})
+		require.ErrorContains(t, err, `invalid assume role ARN "grafana"`)
+	})
+}
+
+func TestNewSession_BaseSessionOptions(t *testing.T) {
+	origNewSessionWithOptions := newSessionWithOptions
+	t.Cleanup(func() {
+		newSessionWithOptions = origNewSessionWithOptions
+	})
+	var built []session.Options
+	newSessionWithOptions = func(opts session.Options) (*session.Session, error) {
+		built = append(built, opts)
+		return &session.Session{Config: &opts.Config}, nil
+	}
+
+	tokenProvider := func() (string, error) {
+		return "123456", nil
+	}
+	cache := NewSessionCache(WithBaseSessionOptions(session.Options{
+		Profile:                 "mfa",
+		SharedConfigState:       session.SharedConfigEnable,
+		AssumeRoleTokenProvider: tokenProvider,
+		Config:                  aws.Config{MaxRetries: aws.Int(7)},
+	}))
+	_, err := cache.GetSession(SessionConfig{
+		Settings: AWSDatasourceSettings{
+			AuthType: AuthTypeDefault,
+			Region:   "eu-west-1",
+		},
+		AuthSettings: &AuthSettings{
+			AllowedAuthProviders: []string{"default"},
+		},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, built, 1)
+	opts := built[0]
+	assert.Equal(t, "mfa", opts.Profile)
+	assert.Equal(t, session.SharedConfigEnable, opts.SharedConfigState)
+	require.NotNil(t, opts.AssumeRoleTokenProvider)
+	token, err := opts.AssumeRoleTokenProvider()
+	require.NoError(t, err)
+	assert.Equal(t, "123456", token)
+	assert.Equal(t, 7, aws.IntValue(opts.Config.MaxRetries))
+	assert.Equal(t, "eu-west-1", aws.StringValue(opts.Config.Region))
+}
+
+func TestNewSession_AssumeRoleMFA(t *testing.T) {
+	origNewSession := newSession
+	origNewSTSCredentials := newSTSCredentials
+	t.Cleanup(func() {
+		newSession = origNewSession
+		newSTSCredentials = origNewSTSCredentials
+	})
+	newSession = func(cfgs ...*aws.Config) (*session.Session, error) {
+		cfg := aws.Config{}
+		cfg.MergeIn(cfgs...)
+		return &session.Session{Config: &cfg}, nil
+	}
+	var provider *stscreds.AssumeRoleProvider
+	newSTSCredentials = func(c client.ConfigProvider, roleARN string,
+		options ...func(*stscreds.AssumeRoleProvider)) *credentials.Credentials {
+		provider = &stscreds.AssumeRoleProvider{RoleARN: roleARN}
+		for _, o := range options {
+			o(provider)
+		}
+		return credentials.NewCredentials(provider)
+	}
+	sessionConfig := SessionConfig{
+		Settings: AWSDatasourceSettings{
+			AssumeRoleARN: "arn:aws:iam::123456789012:role/grafana",
+			MFASerial:     "arn:aws:iam::123456789012:mfa/jane",
+		},
+		AuthSettings: &AuthSettings{
+			AllowedAuthProviders: []string{"default"},
+			AssumeRoleEnabled:    true,
+		},
+	}
+
+	t.Run("it passes the serial and the token to the assume role request", func(t *testing.T) {
+		cache := NewSessionCache(WithMFATokenProvider(func() (string, error) {
+			return "123456", nil
+		}))
+		_, err := cache.GetSession(sessionConfig)
+		require.NoError(t, err)
+
+		require.NotNil(t, provider)
+		assert.Equal(t, "arn:aws:iam::123456789012:mfa/jane", aws.StringValue(provider.SerialNumber))
+		require.NotNil(t, provider.TokenProvider)
+		token, err := provider.TokenProvider()
+		require.NoError(t, err)
+		assert.Equal(t, "123456", token)
+	})
+
+	t.Run("it requires a token provider", func(t *testing.T) {
+		_, err := NewSessionCache().GetSession(sessionConfig)
+		require.ErrorContains(t, err, "requires a token provider")
+	})
+}
+
+// countingProvider returns new credentials on each retrieval
+type countingProvider struct {
+	retrievals int
+	expired    bool
+}
+
+func (p *countingProvider) Retrieve() (credentials.Value, error) {
+	p.retrievals++
+	p.expired = false
+	return credentials.Value{AccessKeyID: "foo", SecretAccessKey: "bar"}, nil
+}
+
+func (p *countingProvider) IsExpired() bool {
+	return p.expired
+}
+
+func TestSessionCache_Rotate(t *testing.T) {
+	cache := NewSessionCache()
+	sessionConfig := SessionConfig{
+		Settings:     AWSDatasourceSettings{AuthType: AuthTypeKeys, AccessKey: "foo", SecretKey: "bar", Region: "us-east-1"},
+		AuthSettings: &AuthSettings{AllowedAuthProviders: []string{"keys"}},
+	}
+	sess, err := cache.GetSession(sessionConfig)
+	require.NoError(t, err)
+	provider := &countingProvider{}
+	sess.Config.Credentials = credentials.NewCredentials(provider)
+	_, err = sess.Config.Credentials.Get()
+	require.NoError(t, err)
+
+	cached, err := cache.GetSession(sessionConfig)
+	require.NoError(t, err)
+	require.Same(t, sess, cached)
+
+	cache.Rotate()
+
+	assert.True(t, sess.Config.Credentials.IsExpired())
+	_, err = sess.Config.Credentials.Get()
+	require.NoError(t, err)
+	assert.Equal(t, 2, provider.retrievals)
+
+	fresh, err := cache.GetSession(sessionConfig)
+	require.NoError(t, err)
+	assert.NotSame(t, sess, fresh)
+}
+
+func TestSessionCache_Disabled(t *testing.T) {
+	origNewSession := newSession
+	t.Cleanup(func() {
+		newSession = origNewSession
+	})
+	built := 0
+	newSession = func(cfgs ...*aws.Config) (*session.Session, error) {
+		built++
+		cfg := aws.Config{}
+		cfg.MergeIn(cfgs...)
+		return &session.Session{Config: &cfg}, nil
+	}
+	sessionConfig := SessionConfig{
+		Settings:     AWSDatasourceSettings{AuthType: AuthTypeKeys, AccessKey: "foo", SecretKey: "bar", Region: "us-east-1"},
+		AuthSettings: &AuthSettings{AllowedAuthProviders: []string{"keys"}},
+	}
+
+	t.Run("it builds a new session on every call", func(t *testing.T) {
+		built = 0
+		cache := NewSessionCache(WithCacheDisabled())
+		first, err := cache.GetSession(sessionConfig)
+		require.NoError(t, err)
+		second, err := cache.GetSession(sessionConfig)
+		require.NoError(t, err)
+
+		assert.NotSame(t, first, second)
+		assert.Equal(t, 2, built)
+		assert.Empty(t, cache.Keys())
+	})
+
+	t.Run("it reuses the cached session by default", func(t *testing.T) {
+		built = 0
+		cache := NewSessionCache()
+		first, err := cache.GetSession(sessionConfig)
+		require.NoError(t, err)
+		second, err := cache.GetSession(sessionConfig)
+		require.NoError(t, err)
+
+		assert.Same(t, first, second)
+		assert.Equal(t, 1, built)
+	})
+}
+
+// the real factories, as some tests stub them without restoring them
+var (
+	realNewSession            = newSession
+	realNewSessionWithOptions = newSessionWithOptions
+	realNewRemoteCredentials  = newRemoteCredentials
+)
+
+func TestNewSession_EC2MetadataDisabled(t *testing.T) {
+	origNewSession, origNewSessionWithOptions, origNewRemoteCredentials := newSession, newSessionWithOptions, newRemoteCredentials
+	t.Cleanup(func() {
+		newSession, newSessionWithOptions, newRemoteCredentials = origNewSession, origNewSessionWithOptions, origNewRemoteCredentials
+	})
+	newSession, newSessionWithOptions, newRemoteCredentials = realNewSession, realNewSessionWithOptions, realNewRemoteCredentials
+
+	metadataCalls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		metadataCalls++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	// no credentials but the ones of the instance metadata service
+	missingFile := filepath.Join(t.TempDir(), "missing")
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", srv.URL)
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", missingFile)
+	t.Setenv("AWS_CONFIG_FILE", missingFile)
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY", "AWS_PROFILE",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI", "AWS_WEB_IDENTITY_TOKEN_FILE"} {
+		t.Setenv(env, "")
+	}
+
+	for _, authType := range []AuthType{AuthTypeDefault, AuthTypeEC2IAMRole} {
+		sessionConfig := SessionConfig{
+			Settings:     AWSDatasourceSettings{AuthType: authType, Region: "us-east-1"},
+			AuthSettings: &AuthSettings{AllowedAuthProviders: []string{authType.String()}},
+		}
+
+		t.Run("it never calls the metadata service with "+authType.String(), func(t *testing.T) {
+			metadataCalls = 0
+			sess, err := NewSessionCache(WithEC2MetadataDisabled()).GetSession(sessionConfig)
+			require.NoError(t, err)
+
+			_, err = sess.Config.Credentials.Get()
+			require.Error(t, err)
+			assert.Equal(t, 0, metadataCalls)
+		})
+
+		t.Run("it calls the metadata service by default with "+authType.String(), func(t *testing.T) {
+			metadataCalls = 0
+			sess, err := NewSessionCache().GetSession(sessionConfig)
+			require.NoError(t, err)
+
+			_, err = sess.Config.Credentials.Get()
+			require.Error(t, err)
+			assert.NotZero(t, metadataCalls)
+		})
+	}
+}
+
+func TestSessionCache_MaxCredentialAge(t *testing.T) {
+	origNewSession, origNow := newSession, sessionNow
+	t.Cleanup(func() {
+		newSession, sessionNow = origNewSession, origNow
+	})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sessionNow = func() time.Time { return now }
+
+	// credentials that never expire on their own
+	provider := &countingProvider{}
+	newSession = func(cfgs ...*aws.Config) (*session.Session, error) {
+		sess, err := realNewSession(cfgs...)
+		if err != nil {
+			return nil, err
+		}
+		sess.Config.Credentials = credentials.NewCredentials(provider)
+		return sess, nil
+	}
+
+	cache := NewSessionCache(WithMaxCredentialAge(15 * time.Minute))
+	sessionConfig := SessionConfig{
+		Settings:     AWSDatasourceSettings{AuthType: AuthTypeKeys, AccessKey: "foo", SecretKey: "bar", Region: "us-east-1"},
+		AuthSettings: &AuthSettings{AllowedAuthProviders: []string{"keys"}},
+	}
+	sess, err := cache.GetSession(sessionConfig)
+	require.NoError(t, err)
+
+	_, err = sess.Config.Credentials.Get()
+	require.NoError(t, err)
+	assert.Equal(t, 1, provider.retrievals)
+
+	now = now.Add(10 * time.Minute)
+	_, err = sess.Config.Credentials.Get()
+	require.NoError(t, err)
+	assert.Equal(t, 1, provider.retrievals)
+	cached, err := cache.GetSession(sessionConfig)
+	require.NoError(t, err)
+	assert.Same(t, sess, cached)
+
+	now = now.Add(5 * time.Minute)
+	assert.True(t, sess.Config.Credentials.IsExpired())
+	_, err = sess.Config.Credentials.Get()
+	require.NoError(t, err)
+	assert.Equal(t, 2, provider.retrievals)
+	fresh, err := cache.GetSession(sessionConfig)
+	require.NoError(t, err)
+	assert.NotSame(t, sess, fresh)
+}
+
+// fakeAssumeRoler records the assume role requests
+type fakeAssumeRoler struct {
+	input *sts.AssumeRoleInput
+}
+
+func (f *fakeAssumeRoler) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	return f.AssumeRoleWithContext(aws.BackgroundContext(), input)
+}
+
+func (f *fakeAssumeRoler) AssumeRoleWithContext(_ aws.Context, input *sts.AssumeRoleInput, _ ...request.Option) (*sts.AssumeRoleOutput, error) {
+	f.input = input
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("foo"),
+		SecretAccessKey: aws.String("bar"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}}, nil
+}
+
+func TestNewSession_RoleSessionName(t *testing.T) {
+	origNewSession := newSession
+	origNewSTSCredentials := newSTSCredentials
+	t.Cleanup(func() {
+		newSession = origNewSession
+		newSTSCredentials = origNewSTSCredentials
+	})
+	newSession = func(cfgs ...*aws.Config) (*session.Session, error) {
+		cfg := aws.Config{}
+		cfg.MergeIn(cfgs...)
+		return &session.Session{Config: &cfg}, nil
+	}
+	stsClient := &fakeAssumeRoler{}
+	newSTSCredentials = func(_ client.ConfigProvider, roleARN string,
+		options ...func(*stscreds.AssumeRoleProvider)) *credentials.Credentials {
+		provider := &stscreds.AssumeRoleProvider{Client: stsClient, RoleARN: roleARN}
+		for _, o := range options {
+			o(provider)
+		}
+		return credentials.NewCredentials(provider)
+	}
+	settings := AWSDatasourceSettings{
+		AssumeRoleARN:           "arn:aws:iam::123456789012:role/grafana",
+		RoleSessionNameTemplate: "grafana-{user}",
+	}
+	settings.ApplyRoleSessionName("Jane Doe")
+	authSettings := &AuthSettings{AllowedAuthProviders: []string{"default"}, AssumeRoleEnabled: true}
+
+	cache := NewSessionCache()
+	sess, err := cache.GetSession(SessionConfig{Settings: settings, AuthSettings: authSettings})
+	require.NoError(t, err)
+	_, err = sess.Config.Credentials.Get()
+	require.NoError(t, err)
+	require.NotNil(t, stsClient.input)
+	assert.Equal(t, "grafana-Jane-Doe", aws.StringValue(stsClient.input.RoleSessionName))
+
+	settings.ApplyRoleSessionName("john")
+	other, err := cache.GetSession(SessionConfig{Settings: settings, AuthSettings: authSettings})
+	require.NoError(t, err)
+	assert.NotSame(t, sess, other, "sessions of different users aren't shared")
+}
+
+// closeTrackingTransport records whether its idle connections were closed
+type closeTrackingTransport struct {
+	http.RoundTripper
+	closed bool
+}
+
+func (t *closeTrackingTransport) CloseIdleConnections() {
+	t.closed = true
+}
+
+func TestSessionCache_Prune(t *testing.T) {
+	// a CA bundle requires the default transport
+	t.Setenv("AWS_CA_BUNDLE", "")
+	cache := NewSessionCache()
+	transports := map[string]*closeTrackingTransport{}
+	for _, region := range []string{"us-east-1", "us-west-2", "eu-west-1"} {
+		transports[region] = &closeTrackingTransport{}
+		_, err := cache.GetSession(SessionConfig{
+			Settings:     AWSDatasourceSettings{AuthType: AuthTypeKeys, AccessKey: "foo", SecretKey: "bar", Region: region},
+			AuthSettings: &AuthSettings{AllowedAuthProviders: []string{"keys"}},
+			HTTPClient:   &http.Client{Transport: transports[region]},
+		})
+		require.NoError(t, err)
+	}
+	require.Len(t, cache.Keys(), 3)
+
+	pruned := cache.Prune(func(_ string, sess *session.Session) bool {
+		return aws.StringValue(sess.Config.Region) != "eu-west-1"
+	})
+
+	assert.Equal(t, 2, pruned)
+	keys := cache.Keys()
+	require.Len(t, keys, 1)
+	cache.sessCacheLock.RLock()
+	assert.Equal(t, "eu-west-1", aws.StringValue(cache.sessCache[keys[0]].session.Config.Region))
+	cache.sessCacheLock.RUnlock()
+	assert.True(t, transports["us-east-1"].closed)
+	assert.True(t, transports["us-west-2"].closed)
+	assert.False(t, transports["eu-west-1"].closed)
+}
+
+func TestNewSession_ContainerCredentials(t *testing.T) {
+	origNewSession, origNewSessionWithOptions, origNewRemoteCredentials := newSession, newSessionWithOptions, newRemoteCredentials
+	t.Cleanup(func() {
+		newSession, newSessionWithOptions, newRemoteCredentials = origNewSession, origNewSessionWithOptions, origNewRemoteCredentials
+	})
+	newSession, newSessionWithOptions, newRemoteCredentials = realNewSession, realNewSessionWithOptions, realNewRemoteCredentials
+
+	var mu sync.Mutex
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, r.Header.Get("Authorization"))
+		n := len(calls)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		// expiring within the refresh window, so every Get fetches them again
+		_, _ = fmt.Fprintf(w, `{"AccessKeyId":"container-key-%d","SecretAccessKey":"secret","Token":"token","Expiration":%q}`,
+			n, time.Now().Add(time.Minute).UTC().Format(time.RFC3339))
+	}))
+	defer srv.Close()
+
+	missingFile := filepath.Join(t.TempDir(), "missing")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", srv.URL+"/v2/credentials")
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "container-token")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", missingFile)
+	t.Setenv("AWS_CONFIG_FILE", missingFile)
+	t.Setenv("AWS_CA_BUNDLE", "")
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY", "AWS_PROFILE",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_WEB_IDENTITY_TOKEN_FILE"} {
+		t.Setenv(env, "")
+	}
+
+	for _, authType := range []AuthType{AuthTypeDefault, AuthTypeEC2IAMRole} {
+		t.Run("it uses and refreshes the container credentials with "+authType.String(), func(t *testing.T) {
+			mu.Lock()
+			calls = nil
+			mu.Unlock()
+			sess, err := NewSessionCache(WithEC2MetadataDisabled()).GetSession(SessionConfig{
+				Settings:     AWSDatasourceSettings{AuthType: authType, Region: "us-east-1"},
+				AuthSettings: &AuthSettings{AllowedAuthProviders: []string{authType.String()}},
+			})
+			require.NoError(t, err)
+
+			creds, err := sess.Config.Credentials.Get()
+			require.NoError(t, err)
+			assert.Equal(t, "container-key-1", creds.AccessKeyID)
+			assert.Equal(t, "token", creds.SessionToken)
+
+			creds, err = sess.Config.Credentials.Get()
+			require.NoError(t, err)
+			assert.Equal(t, "container-key-2", creds.AccessKeyID)
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, []string{"container-token", "container-token"}, calls)
+		})
+	}
+}
+
+func TestNewSession_EndpointOverrides(t *testing.T) {
+	origNewSession, origNewSessionWithOptions, origNewRemoteCredentials := newSession, newSessionWithOptions, newRemoteCredentials
+	t.Cleanup(func() {
+		newSession, newSessionWithOptions, newRemoteCredentials = origNewSession, origNewSessionWithOptions, origNewRemoteCredentials
+	})
+	newSession, newSessionWithOptions, newRemoteCredentials = realNewSession, realNewSessionWithOptions, realNewRemoteCredentials
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "")
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/api/token":
+			_, _ = w.Write([]byte("imds-token"))
+		case "/latest/meta-data/instance-id":
+			_, _ = w.Write([]byte("i-stub"))
+		case "/credentials":
+			_, _ = w.Write([]byte(`{"AccessKeyId":"container-key","SecretAccessKey":"secret","Token":"token"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	sessionConfig := SessionConfig{
+		Settings:     AWSDatasourceSettings{AuthType: AuthTypeEC2IAMRole, Region: "us-east-1"},
+		AuthSettings: &AuthSettings{AllowedAuthProviders: []string{"ec2_iam_role"}},
+	}
+
+	t.Run("it calls the metadata service at the given endpoint", func(t *testing.T) {
+		sess, err := NewSessionCache(WithEC2MetadataEndpoint(srv.URL)).GetSession(sessionConfig)
+		require.NoError(t, err)
+
+		instanceID, err := ec2metadata.New(sess).GetMetadata("instance-id")
+		require.NoError(t, err)
+		assert.Equal(t, "i-stub", instanceID)
+	})
+
+	t.Run("it gets the credentials from the given container endpoint", func(t *testing.T) {
+		sess, err := NewSessionCache(WithContainerCredentialsEndpoint(srv.URL + "/credentials")).GetSession(sessionConfig)
+		require.NoError(t, err)
+
+		creds, err := sess.Config.Credentials.Get()
+		require.NoError(t, err)
+		assert.Equal(t, "container-key", creds.AccessKeyID)
+	})
+}
+
+func TestNewSession_SSO(t *testing.T) {
+	origNewSession, origNewSessionWithOptions := newSession, newSessionWithOptions
+	t.Cleanup(func() {
+		newSession, newSessionWithOptions = origNewSession, origNewSessionWithOptions
+	})
+	newSession, newSessionWithOptions = realNewSession, realNewSessionWithOptions
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	var mu sync.Mutex
+	var bearerTokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			_, _ = w.Write([]byte(`{"accessToken":"refreshed-token","expiresIn":3600,"refreshToken":"next-refresh-token"}`))
+		case "/federation/credentials":
+			assert.Equal(t, "123456789012", r.URL.Query().Get("account_id"))
+			assert.Equal(t, "ReadOnly", r.URL.Query().Get("role_name"))
+			mu.Lock()
+			bearerTokens = append(bearerTokens, r.Header.Get("x-amz-sso_bearer_token"))
+			n := len(bearerTokens)
+			mu.Unlock()
+			// already expired, so every Get retrieves them again
+			_, _ = fmt.Fprintf(w, `{"roleCredentials":{"accessKeyId":"sso-key-%d","secretAccessKey":"secret","sessionToken":"token","expiration":%d}}`,
+				n, time.Now().Add(-time.Minute).UnixMilli())
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	newSettings := func() AWSDatasourceSettings {
+		return AWSDatasourceSettings{
+			AuthType:     AuthTypeSSO,
+			Region:       "us-east-1",
+			SSOStartURL:  "https://example.awsapps.com/start",
+			SSORegion:    "us-east-1",
+			SSOAccountID: "123456789012",
+			SSORoleName:  "ReadOnly",
+			VPCEndpoints: map[string]string{"portal.sso": srv.URL, "oidc": srv.URL},
+		}
+	}
+	authSettings := &AuthSettings{AllowedAuthProviders: []string{"sso"}}
+	// the token of the start URL, in the directory the cache reads them from
+	newTokenFile := func(t *testing.T) (string, string) {
+		standard, err := ssocreds.StandardCachedTokenFilepath("https://example.awsapps.com/start")
+		require.NoError(t, err)
+		dir := t.TempDir()
+		return dir, filepath.Join(dir, filepath.Base(standard))
+	}
+
+	t.Run("it derives the credentials from the cached token", func(t *testing.T) {
+		tokenDir, tokenFile := newTokenFile(t)
+		require.NoError(t, os.WriteFile(tokenFile, []byte(fmt.Sprintf(`{"accessToken":"cached-token","expiresAt":%q}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))), 0600))
+		mu.Lock()
+		bearerTokens = nil
+		mu.Unlock()
+
+		sess, err := NewSessionCache(WithSSOTokenDir(tokenDir)).GetSession(SessionConfig{Settings: newSettings(), AuthSettings: authSettings})
+		require.NoError(t, err)
+
+		creds, err := sess.Config.Credentials.Get()
+		require.NoError(t, err)
+		assert.Equal(t, "sso-key-1", creds.AccessKeyID)
+
+		// a token provisioned again is picked up with the next credentials
+		require.NoError(t, os.WriteFile(tokenFile, []byte(fmt.Sprintf(`{"accessToken":"new-cached-token","expiresAt":%q}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))), 0600))
+		creds, err = sess.Config.Credentials.Get()
+		require.NoError(t, err)
+		assert.Equal(t, "sso-key-2", creds.AccessKeyID)
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, []string{"cached-token", "new-cached-token"}, bearerTokens)
+	})
+
+	t.Run("it refreshes an expired token", func(t *testing.T) {
+		tokenDir, tokenFile := newTokenFile(t)
+		require.NoError(t, os.WriteFile(tokenFile, []byte(fmt.Sprintf(
+			`{"accessToken":"expired-token","expiresAt":%q,"clientId":"client","clientSecret":"secret","refreshToken":"refresh-token"}`,
+			time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))), 0600))
+		mu.Lock()
+		bearerTokens = nil
+		mu.Unlock()
+
+		sess, err := NewSessionCache(WithSSOTokenDir(tokenDir)).GetSession(SessionConfig{Settings: newSettings(), AuthSettings: authSettings})
+		require.NoError(t, err)
+
+		_, err = sess.Config.Credentials.Get()
+		require.NoError(t, err)
+
+		mu.Lock()
+		assert.Equal(t, []string{"refreshed-token"}, bearerTokens)
+		mu.Unlock()
+		cached, err := os.ReadFile(tokenFile)
+		require.NoError(t, err)
+		assert.Contains(t, string(cached), "next-refresh-token")
+	})
+
+	t.Run("it requires the account and role", func(t *testing.T) {
+		settings := newSettings()
+		settings.SSORoleName = ""
+		assert.EqualError(t, settings.Validate(), "the sso auth type requires a start URL, an account ID and a role name")
+	})
+}
+
+// failingTransport fails the test on any request
+type failingTransport struct {
+	t *testing.T
+}
+
+func (f failingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	f.t.Errorf("unexpected request to %s", r.URL)
+	return nil, errors.New("unexpected request")
+}
+
+func TestNewSession_DryRun(t *testing.T) {
+	origNewSession, origNewSessionWithOptions := newSession, newSessionWithOptions
+	t.Cleanup(func() {
+		newSession, newSessionWithOptions = origNewSession, origNewSessionWithOptions
+	})
+	newSession, newSessionWithOptions = realNewSession, realNewSessionWithOptions
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	sess, err := NewSessionCache(WithDryRun()).GetSession(SessionConfig{
+		Settings: AWSDatasourceSettings{
+			AuthType:                   AuthTypeKeys,
+			AccessKey:                  "foo",
+			SecretKey:                  "bar",
+			Region:                     "us-east-1",
+			AssumeRoleARN:              "arn:aws:iam::123456789012:role/grafana",
+			AssumeRoleCrossAccountOnly: true,
+		},
+		HTTPClient:   &http.Client{Transport: failingTransport{t}},
+		AuthSettings: &AuthSettings{AllowedAuthProviders: []string{"keys"}, AssumeRoleEnabled: true},
+	})
+	require.NoError(t, err)
+
+	_, err = sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	var awsErr awserr.Error
+	require.True(t, errors.As(err, &awsErr))
+	assert.Equal(t, ErrCodeDryRun, awsErr.Code())
+	// assuming the role needs an STS call too
+	_, err = sess.Config.Credentials.Get()
+	assert.ErrorContains(t, err, "request not sent in dry run")
+
+	t.Run("it still checks the settings", func(t *testing.T) {
+		_, err := NewSessionCache(WithDryRun()).GetSession(SessionConfig{
+			Settings:     AWSDatasourceSettings{AuthType: AuthTypeEC2IAMRole, Region: "us-east-1"},
+			AuthSettings: &AuthSettings{AllowedAuthProviders: []string{"keys"}},
+		})
+		require.ErrorContains(t, err, "attempting to use an auth type that is not allowed")
+	})
+}
+
+func TestNewSession_AssumeRolePolicy(t *testing.T) {
+	origNewSession, origNewSessionWithOptions := newSession, newSessionWithOptions
+	t.Cleanup(func() {
+		newSession, newSessionWithOptions = origNewSession, origNewSessionWithOptions
+	})
+	newSession, newSessionWithOptions = realNewSession, realNewSessionWithOptions
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	var mu sync.Mutex
+	var forms []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		mu.Lock()
+		forms = append(forms, r.PostForm)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/xml")
+		_, _ = fmt.Fprintf(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials>
+<AccessKeyId>assumed-key</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken>
+<Expiration>%s</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer srv.Close()
+
+	policy := `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"athena:GetQueryResults","Resource":"*"}]}`
+	newConfig := func(policy string) SessionConfig {
+		return SessionConfig{
+			Settings: AWSDatasourceSettings{
+				AuthType:             AuthTypeKeys,
+				AccessKey:            "foo",
+				SecretKey:            "bar",
+				Region:               "us-east-1",
+				AssumeRoleARN:        "arn:aws:iam::123456789012:role/grafana",
+				AssumeRolePolicy:     policy,
+				AssumeRolePolicyARNs: []string{"arn:aws:iam::aws:policy/AmazonAthenaReadOnly"},
+				VPCEndpoints:         map[string]string{"sts": srv.URL},
+			},
+			AuthSettings: &AuthSettings{AllowedAuthProviders: []string{"keys"}, AssumeRoleEnabled: true},
+		}
+	}
+
+	t.Run("it passes the session policies to the assume role request", func(t *testing.T) {
+		sess, err := NewSessionCache().GetSession(newConfig(policy))
+		require.NoError(t, err)
+		creds, err := sess.Config.Credentials.Get()
+		require.NoError(t, err)
+		assert.Equal(t, "assumed-key", creds.AccessKeyID)
+
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, forms, 1)
+		assert.Equal(t, "AssumeRole", forms[0].Get("Action"))
+		assert.Equal(t, policy, forms[0].Get("Policy"))
+		assert.Equal(t, "arn:aws:iam::aws:policy/AmazonAthenaReadOnly", forms[0].Get("PolicyArns.member.1.arn"))
+	})
+
+	t.Run("it rejects an inline policy that isn't JSON before assuming the role", func(t *testing.T) {
+		mu.Lock()
+		forms = nil
+		mu.Unlock()
+
+		_, err := NewSessionCache().GetSession(newConfig(`{"Version":`))
+		require.EqualError(t, err, "invalid assume role policy: not a valid JSON document")
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Empty(t, forms)
+	})
+}
+
+func TestNewSession_DefaultTimeout(t *testing.T) {
+	origNewSession, origNewSessionWithOptions := newSession, newSessionWithOptions
+	t.Cleanup(func() {
+		newSession, newSessionWithOptions = origNewSession, origNewSessionWithOptions
+	})
+	newSession, newSessionWithOptions = realNewSession, realNewSessionWithOptions
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	// the endpoint never answers
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	sess, err := NewSessionCache(WithDefaultTimeout(50 * time.Millisecond)).GetSession(SessionConfig{
+		Settings: AWSDatasourceSettings{
+			AuthType:     AuthTypeKeys,
+			AccessKey:    "foo",
+			SecretKey:    "bar",
+			Region:       "us-east-1",
+			VPCEndpoints: map[string]string{"sts": srv.URL},
+		},
+		AuthSettings: &AuthSettings{AllowedAuthProviders: []string{"keys"}},
+	})
+	require.NoError(t, err)
+
+	t.Run("it cuts off an operation without deadline", func(t *testing.T) {
+		start := time.Now()
+		_, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		var awsErr awserr.Error
+		require.True(t, errors.As(err, &awsErr), err)
+		assert.Equal(t, request.CanceledErrorCode, awsErr.Code())
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+
+	t.Run("it keeps the deadline of the context", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := sts.New(sess).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+		require.Error(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+	})
+}
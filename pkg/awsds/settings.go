@@ -2,9 +2,16 @@ package awsds
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 )
 
@@ -16,8 +23,14 @@ const (
 	AuthTypeDefault AuthType = iota
 	AuthTypeSharedCreds
 	AuthTypeKeys
+	// AuthTypeEC2IAMRole uses the role of the host: the ECS/Fargate task role when the container
+	// credentials endpoint is set (AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or _FULL_URI), else the
+	// EC2 instance role
 	AuthTypeEC2IAMRole
 	AuthTypeGrafanaAssumeRole //cloud only
+	// AuthTypeSSO gets role credentials from IAM Identity Center (SSO) with a cached access token,
+	// e.g. the one of `aws sso login` or a pre-provisioned one for headless hosts
+	AuthTypeSSO
 )
 
 func (at AuthType) String() string {
@@ -32,6 +45,8 @@ func (at AuthType) String() string {
 		return "ec2_iam_role"
 	case AuthTypeGrafanaAssumeRole:
 		return "grafana_assume_role"
+	case AuthTypeSSO:
+		return "sso"
 	default:
 		panic(fmt.Sprintf("Unrecognized auth type %d", at))
 	}
@@ -51,6 +66,8 @@ func ToAuthType(authType string) (AuthType, error) {
 		return AuthTypeDefault, nil
 	case "grafana_assume_role":
 		return AuthTypeGrafanaAssumeRole, nil
+	case "sso":
+		return AuthTypeSSO, nil
 	default:
 		return AuthTypeDefault, fmt.Errorf("invalid auth type: %s", authType)
 	}
@@ -82,6 +99,8 @@ func (at *AuthType) UnmarshalJSON(b []byte) error {
 		*at = AuthTypeEC2IAMRole
 	case "grafana_assume_role":
 		*at = AuthTypeGrafanaAssumeRole
+	case "sso":
+		*at = AuthTypeSSO
 	case "default":
 		fallthrough
 	default:
@@ -98,9 +117,100 @@ type AWSDatasourceSettings struct {
 	AssumeRoleARN string   `json:"assumeRoleARN"`
 	ExternalID    string   `json:"externalId"`
 
+	// Serial number or ARN of the MFA device required to assume AssumeRoleARN.
+	// The codes come from the token provider of the SessionCache.
+	MFASerial string `json:"mfaSerial,omitempty"`
+
+	// Template of the session name of the assumed role, shown in CloudTrail, e.g. "grafana-{user}".
+	// See RenderRoleSessionName for the placeholders.
+	RoleSessionNameTemplate string `json:"roleSessionNameTemplate,omitempty"`
+
+	// Session name of the assumed role rendered from RoleSessionNameTemplate by ApplyRoleSessionName
+	RoleSessionName string `json:"-"`
+
+	// Session policies passed when assuming AssumeRoleARN, to grant the session less than the role:
+	// an inline JSON policy document and the ARNs of managed policies
+	AssumeRolePolicy     string   `json:"assumeRolePolicy,omitempty"`
+	AssumeRolePolicyARNs []string `json:"assumeRolePolicyArns,omitempty"`
+
+	// IAM Identity Center settings of the sso auth type: the start URL of the access portal and its
+	// region, and the account and role to get credentials for
+	SSOStartURL  string `json:"ssoStartUrl,omitempty"`
+	SSORegion    string `json:"ssoRegion,omitempty"`
+	SSOAccountID string `json:"ssoAccountId,omitempty"`
+	SSORoleName  string `json:"ssoRoleName,omitempty"`
+
+	// Only assume AssumeRoleARN when the credentials belong to another account
+	AssumeRoleCrossAccountOnly bool `json:"assumeRoleCrossAccountOnly,omitempty"`
+
 	// Override the client endpoint
 	Endpoint string `json:"endpoint"`
 
+	// VPC endpoint (PrivateLink) URLs keyed by service endpoint ID (e.g. "athena", "sts").
+	// Requests are still signed for Region.
+	VPCEndpoints map[string]string `json:"vpcEndpoints,omitempty"`
+
+	// Whether to load the shared config file (~/.aws/config) when building the session.
+	// When unset, the AWS_SDK_LOAD_CONFIG environment variable decides.
+	LoadSharedConfig *bool `json:"loadSharedConfig,omitempty"`
+
+	// Only accept the regions the AWS SDK knows. Any well-formed region is accepted otherwise, as the
+	// regions released after the pinned SDK version are unknown to it.
+	StrictRegion bool `json:"strictRegion,omitempty"`
+
+	// Partition the region must belong to, e.g. "aws-us-gov" or "aws-cn". Empty to accept any.
+	Partition string `json:"partition,omitempty"`
+
+	// S3 location used to stage query results, e.g. "s3://bucket/prefix/"
+	StagingLocation string `json:"stagingLocation,omitempty"`
+
+	// Account ID expected to own the S3 buckets holding the query results, when they belong to another account
+	ExpectedBucketOwner string `json:"expectedBucketOwner,omitempty"`
+
+	// Longest time to establish a connection, e.g. "5s". Empty for the driver default.
+	ConnectTimeout string `json:"connectTimeout,omitempty"`
+
+	// Longest time a query can run, e.g. "10m". Empty for the driver default.
+	QueryTimeout string `json:"queryTimeout,omitempty"`
+
+	// Most rows returned by an async query, the others are dropped. 0 for no limit.
+	MaxRows int64 `json:"maxRows,omitempty"`
+
+	// Delay before polling the status of an async query again, doubled after each poll, e.g. "1s".
+	// Empty for 200ms.
+	PollInterval string `json:"pollInterval,omitempty"`
+
+	// Longest time a status poll of an async query can take before it's retried, e.g. "10s". Empty for no limit.
+	PollTimeout string `json:"pollTimeout,omitempty"`
+
+	// Tags set on the resources the queries create, e.g. the Athena query executions, for cost allocation
+	ResourceTags map[string]string `json:"resourceTags,omitempty"`
+
+	// Query run to check the connection instead of a ping, e.g. a query on a specific schema
+	ValidationQuery string `json:"validationQuery,omitempty"`
+
+	// Let the AWS SDK discover the endpoints of the services supporting it, e.g. Timestream. The
+	// other services ignore it.
+	EndpointDiscovery bool `json:"endpointDiscovery,omitempty"`
+
+	// Compress the network traffic of the driver, when it supports it
+	Compression bool `json:"compression,omitempty"`
+
+	// Skip the verification of the TLS certificate of the AWS endpoints and of the database, e.g. for a
+	// self-signed test endpoint. Unsafe.
+	TLSSkipVerify bool `json:"tlsSkipVerify,omitempty"`
+
+	// AWS SDK log level of the sessions, e.g. "debug-with-signing", several can be joined with commas.
+	// The logs go to the plugin logger at debug level, with their credentials, signatures, database
+	// passwords and secrets redacted.
+	SDKLogLevel string `json:"sdkLogLevel,omitempty"`
+
+	// Connection string template with placeholders like {region}, rendered for the driver
+	ConnectionTemplate string `json:"connectionTemplate,omitempty"`
+
+	// Alternative credentials, keyed by name, that a query can select instead of the main ones
+	AuthConfigs map[string]AuthConfig `json:"authConfigs,omitempty"`
+
 	//go:deprecated Use Region instead
 	DefaultRegion string `json:"defaultRegion"`
 
@@ -130,5 +240,341 @@ func (s *AWSDatasourceSettings) Load(config backend.DataSourceInstanceSettings)
 	s.SecretKey = config.DecryptedSecureJSONData["secretKey"]
 	s.SessionToken = config.DecryptedSecureJSONData["sessionToken"]
 
+	// Credentials may be references to secrets kept elsewhere
+	for _, secret := range []*string{&s.AccessKey, &s.SecretKey, &s.SessionToken} {
+		resolved, err := resolveSecret(*secret)
+		if err != nil {
+			return err
+		}
+		*secret = resolved
+	}
+
+	return nil
+}
+
+// Validate checks the values read by Load
+func (s *AWSDatasourceSettings) Validate() error {
+	if err := validateRegion(s.Region, s.StrictRegion); err != nil {
+		return err
+	}
+	if err := validatePartition(s.Partition, s.Region); err != nil {
+		return err
+	}
+	if s.StagingLocation != "" {
+		if _, err := ParseS3Location(s.StagingLocation); err != nil {
+			return fmt.Errorf("invalid staging location: %w", err)
+		}
+	}
+	if _, err := parseTimeout(s.ConnectTimeout); err != nil {
+		return fmt.Errorf("invalid connect timeout: %w", err)
+	}
+	if _, err := parseTimeout(s.QueryTimeout); err != nil {
+		return fmt.Errorf("invalid query timeout: %w", err)
+	}
+	if _, err := parseTimeout(s.PollInterval); err != nil {
+		return fmt.Errorf("invalid poll interval: %w", err)
+	}
+	if _, err := parseTimeout(s.PollTimeout); err != nil {
+		return fmt.Errorf("invalid poll timeout: %w", err)
+	}
+	if err := validatePolicy(s.AssumeRolePolicy); err != nil {
+		return err
+	}
+	if s.MaxRows < 0 {
+		return fmt.Errorf("invalid max rows %d: must be positive, or 0 for no limit", s.MaxRows)
+	}
+	if _, err := parseSDKLogLevel(s.SDKLogLevel); err != nil {
+		return err
+	}
+	if err := validateResourceTags(s.ResourceTags); err != nil {
+		return err
+	}
+	if s.AuthType == AuthTypeSSO && (s.SSOStartURL == "" || s.SSOAccountID == "" || s.SSORoleName == "") {
+		return fmt.Errorf("the sso auth type requires a start URL, an account ID and a role name")
+	}
+	if s.ExpectedBucketOwner != "" && !accountIDRegex.MatchString(s.ExpectedBucketOwner) {
+		return fmt.Errorf("invalid expected bucket owner %q: must be a 12 digit AWS account ID", s.ExpectedBucketOwner)
+	}
+	return nil
+}
+
+// ValidateAuth checks that the auth settings don't contradict each other, e.g. access keys set for
+// another auth type, which leaves the credentials actually used ambiguous. All the conflicts are
+// listed in the error.
+func (s *AWSDatasourceSettings) ValidateAuth() error {
+	conflicts := []string{}
+	if (s.AccessKey != "" || s.SecretKey != "" || s.SessionToken != "") && s.AuthType != AuthTypeKeys {
+		conflicts = append(conflicts, fmt.Sprintf("access keys are set but the auth type is %q", s.AuthType.String()))
+	}
+	if s.AssumeRoleARN == "" {
+		if s.ExternalID != "" {
+			conflicts = append(conflicts, "an external ID is set without a role to assume")
+		}
+		if s.MFASerial != "" {
+			conflicts = append(conflicts, "an MFA device is set without a role to assume")
+		}
+		if s.AssumeRoleCrossAccountOnly {
+			conflicts = append(conflicts, "cross account only is set without a role to assume")
+		}
+		if s.AssumeRolePolicy != "" || len(s.AssumeRolePolicyARNs) > 0 {
+			conflicts = append(conflicts, "a session policy is set without a role to assume")
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("conflicting auth settings: %s", strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// Warnings returns advisories about settings that work but are discouraged, e.g. to show them to
+// the user next to a successful connection test
+func (s *AWSDatasourceSettings) Warnings() []string {
+	var warnings []string
+	if s.TLSSkipVerify {
+		warnings = append(warnings, "TLS certificate verification is disabled, the connection is exposed to man-in-the-middle attacks")
+	}
+	if s.AuthType == AuthTypeKeys && s.AccessKey != "" && s.SessionToken == "" {
+		warnings = append(warnings, "long-lived access keys are used, prefer a role or temporary credentials")
+	}
+	return warnings
+}
+
+// ApplyDefaultAuthType sets the auth type with the given name. It's called when the json data doesn't set one.
+func (s *AWSDatasourceSettings) ApplyDefaultAuthType(authType string) {
+	if at, err := ToAuthType(authType); err == nil {
+		s.AuthType = at
+	}
+}
+
+// ApplyRoleSessionName renders the role session name template for the given Grafana user
+func (s *AWSDatasourceSettings) ApplyRoleSessionName(user string) {
+	s.RoleSessionName = RenderRoleSessionName(s.RoleSessionNameTemplate, user, s.Region)
+}
+
+// GetValidationQuery returns the query used to check the connection, empty to ping instead
+func (s *AWSDatasourceSettings) GetValidationQuery() string {
+	return s.ValidationQuery
+}
+
+// GetMaxRows returns the most rows returned by an async query, 0 for no limit
+func (s *AWSDatasourceSettings) GetMaxRows() int64 {
+	return s.MaxRows
+}
+
+// GetResourceTags returns the tags of the resources the queries create, nil for none
+func (s *AWSDatasourceSettings) GetResourceTags() map[string]string {
+	return s.ResourceTags
+}
+
+// GetTLSSkipVerify returns true if the TLS certificate of the servers isn't verified
+func (s *AWSDatasourceSettings) GetTLSSkipVerify() bool {
+	return s.TLSSkipVerify
+}
+
+// UseCompression returns true if the driver should compress its network traffic
+func (s *AWSDatasourceSettings) UseCompression() bool {
+	return s.Compression
+}
+
+// GetExpectedBucketOwner returns the account ID expected to own the S3 result buckets, empty if not checked
+func (s *AWSDatasourceSettings) GetExpectedBucketOwner() string {
+	return s.ExpectedBucketOwner
+}
+
+// GetConnectTimeout returns the longest time to establish a connection, 0 for the driver default
+func (s *AWSDatasourceSettings) GetConnectTimeout() time.Duration {
+	timeout, _ := parseTimeout(s.ConnectTimeout)
+	return timeout
+}
+
+// GetQueryTimeout returns the longest time a query can run, 0 for the driver default
+func (s *AWSDatasourceSettings) GetQueryTimeout() time.Duration {
+	timeout, _ := parseTimeout(s.QueryTimeout)
+	return timeout
+}
+
+// GetPollInterval returns the delay before polling the status of an async query again, 0 for the default
+func (s *AWSDatasourceSettings) GetPollInterval() time.Duration {
+	interval, _ := parseTimeout(s.PollInterval)
+	return interval
+}
+
+// GetPollTimeout returns the longest time a status poll of an async query can take, 0 for no limit
+func (s *AWSDatasourceSettings) GetPollTimeout() time.Duration {
+	timeout, _ := parseTimeout(s.PollTimeout)
+	return timeout
+}
+
+// DSNTemplate returns the connection string template
+func (s *AWSDatasourceSettings) DSNTemplate() string {
+	return s.ConnectionTemplate
+}
+
+// DSNValues returns the values of the connection string placeholders. Plugins with more settings,
+// like a database or a workgroup, should add them.
+func (s *AWSDatasourceSettings) DSNValues() map[string]string {
+	return map[string]string{
+		"region":   s.Region,
+		"endpoint": s.Endpoint,
+		"profile":  s.Profile,
+	}
+}
+
+// Fingerprint returns a stable hash of the loaded settings, e.g. to detect that a datasource changed
+// between versions or to invalidate external caches. The secrets are hashed apart first, so they
+// change the fingerprint without ever being part of its input in clear.
+func (s *AWSDatasourceSettings) Fingerprint() string {
+	// the secrets are not marshalled
+	values, _ := json.Marshal(s)
+	secrets := sha256.Sum256([]byte(strings.Join([]string{s.AccessKey, s.SecretKey, s.SessionToken}, "\x00")))
+
+	h := sha256.New()
+	h.Write(values)
+	h.Write(secrets[:])
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// GetRegion returns the region the datasource targets
+func (s *AWSDatasourceSettings) GetRegion() string {
+	return s.Region
+}
+
+// SetRegion changes the region the datasource targets
+func (s *AWSDatasourceSettings) SetRegion(region string) {
+	s.Region = region
+}
+
+// AuthConfig is a named set of credentials overriding the ones of the datasource
+type AuthConfig struct {
+	Profile       string   `json:"profile"`
+	AuthType      AuthType `json:"authType"`
+	AssumeRoleARN string   `json:"assumeRoleARN"`
+	ExternalID    string   `json:"externalId"`
+}
+
+// SelectAuth replaces the credentials with the auth config with the given name
+func (s *AWSDatasourceSettings) SelectAuth(name string) error {
+	config, ok := s.AuthConfigs[name]
+	if !ok {
+		return fmt.Errorf("unknown auth config %q", name)
+	}
+	s.Profile = config.Profile
+	s.AuthType = config.AuthType
+	s.AssumeRoleARN = config.AssumeRoleARN
+	s.ExternalID = config.ExternalID
 	return nil
 }
+
+// regionRegex matches region names like "us-east-1" or "us-gov-west-1"
+var regionRegex = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d{1,2}$`)
+
+// validateRegion checks the format of region and, if strict, that the SDK knows it
+func validateRegion(region string, strict bool) error {
+	if region == "" || region == defaultRegion {
+		return nil
+	}
+	if !regionRegex.MatchString(region) {
+		return fmt.Errorf("invalid region %q", region)
+	}
+	if !strict {
+		return nil
+	}
+	for _, partition := range endpoints.DefaultPartitions() {
+		if _, ok := partition.Regions()[region]; ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown region %q, disable the strict region check to use a region released after this version", region)
+}
+
+// validatePartition checks that partition is known and that region belongs to it
+func validatePartition(partition string, region string) error {
+	if partition == "" {
+		return nil
+	}
+	known := false
+	for _, p := range endpoints.DefaultPartitions() {
+		if p.ID() == partition {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return fmt.Errorf("unknown partition %q", partition)
+	}
+	if region == "" || region == defaultRegion {
+		return nil
+	}
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); !ok || p.ID() != partition {
+		return fmt.Errorf("region %q isn't in the %q partition", region, partition)
+	}
+	return nil
+}
+
+// validateResourceTags checks the tags follow the AWS limits: at most 50 tags, keys of 1 to 128
+// characters not starting with the reserved "aws:" prefix and values of at most 256 characters
+func validateResourceTags(tags map[string]string) error {
+	if len(tags) > 50 {
+		return fmt.Errorf("invalid resource tags: %d tags set, at most 50 are allowed", len(tags))
+	}
+	for key, value := range tags {
+		if key == "" || utf8.RuneCountInString(key) > 128 {
+			return fmt.Errorf("invalid resource tag key %q: must be 1 to 128 characters long", key)
+		}
+		if strings.HasPrefix(strings.ToLower(key), "aws:") {
+			return fmt.Errorf("invalid resource tag key %q: the aws: prefix is reserved", key)
+		}
+		if utf8.RuneCountInString(value) > 256 {
+			return fmt.Errorf("invalid value of resource tag %q: must be at most 256 characters long", key)
+		}
+	}
+	return nil
+}
+
+// validatePolicy checks that an inline session policy, if any, is a JSON document
+func validatePolicy(policy string) error {
+	if policy != "" && !json.Valid([]byte(policy)) {
+		return fmt.Errorf("invalid assume role policy: not a valid JSON document")
+	}
+	return nil
+}
+
+// parseTimeout parses a timeout setting like "30s", empty meaning no timeout
+func parseTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%q is negative", timeout)
+	}
+	return d, nil
+}
+
+// accountIDRegex matches AWS account IDs
+var accountIDRegex = regexp.MustCompile(`^\d{12}$`)
+
+// S3Location is a bucket and an optional key prefix
+type S3Location struct {
+	Bucket string
+	Prefix string
+}
+
+// s3BucketRegex follows the S3 bucket naming rules
+var s3BucketRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// ParseS3Location parses a location in the form "s3://bucket/prefix"
+func ParseS3Location(location string) (S3Location, error) {
+	path, ok := strings.CutPrefix(location, "s3://")
+	if !ok {
+		return S3Location{}, fmt.Errorf("%q must start with s3://", location)
+	}
+	bucket, prefix, _ := strings.Cut(path, "/")
+	if !s3BucketRegex.MatchString(bucket) || strings.Contains(bucket, "..") {
+		return S3Location{}, fmt.Errorf("%q is not a valid bucket name", bucket)
+	}
+	return S3Location{Bucket: bucket, Prefix: prefix}, nil
+}
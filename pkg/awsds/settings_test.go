@@ -2,11 +2,14 @@ package awsds
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // Test load settings from json
@@ -30,3 +33,156 @@ func TestLoadSettings(t *testing.T) {
 	assert.Empty(t, cmp.Diff(settings.AuthType, copy.AuthType))
 	assert.Empty(t, cmp.Diff(settings.DefaultRegion, copy.DefaultRegion))
 }
+
+func TestParseS3Location(t *testing.T) {
+	tests := []struct {
+		location string
+		expected S3Location
+		valid    bool
+	}{
+		{location: "s3://bucket", expected: S3Location{Bucket: "bucket"}, valid: true},
+		{location: "s3://my.bucket-1/", expected: S3Location{Bucket: "my.bucket-1"}, valid: true},
+		{location: "s3://bucket/athena/results/", expected: S3Location{Bucket: "bucket", Prefix: "athena/results/"}, valid: true},
+		{location: "bucket/prefix"},
+		{location: "https://bucket.s3.amazonaws.com/prefix"},
+		{location: "s3://"},
+		{location: "s3://ab"},
+		{location: "s3://Bucket"},
+		{location: "s3://bucket_name"},
+		{location: "s3://my..bucket"},
+		{location: "s3://-bucket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			location, err := ParseS3Location(tt.location)
+			if !tt.valid {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, location)
+		})
+	}
+}
+
+func TestValidateSettings_ExpectedBucketOwner(t *testing.T) {
+	assert.NoError(t, (&AWSDatasourceSettings{ExpectedBucketOwner: "123456789012"}).Validate())
+	assert.EqualError(t, (&AWSDatasourceSettings{ExpectedBucketOwner: "12345"}).Validate(),
+		`invalid expected bucket owner "12345": must be a 12 digit AWS account ID`)
+}
+
+func TestValidateSettings_ResourceTags(t *testing.T) {
+	assert.NoError(t, (&AWSDatasourceSettings{ResourceTags: map[string]string{"cost-center": "1234", "team": ""}}).Validate())
+	assert.EqualError(t, (&AWSDatasourceSettings{ResourceTags: map[string]string{"": "1234"}}).Validate(),
+		`invalid resource tag key "": must be 1 to 128 characters long`)
+	assert.EqualError(t, (&AWSDatasourceSettings{ResourceTags: map[string]string{"aws:createdBy": "grafana"}}).Validate(),
+		`invalid resource tag key "aws:createdBy": the aws: prefix is reserved`)
+	assert.EqualError(t, (&AWSDatasourceSettings{ResourceTags: map[string]string{"team": strings.Repeat("a", 257)}}).Validate(),
+		`invalid value of resource tag "team": must be at most 256 characters long`)
+}
+
+func TestValidateSettings_Timeouts(t *testing.T) {
+	settings := &AWSDatasourceSettings{ConnectTimeout: "5s", QueryTimeout: "10m"}
+	require.NoError(t, settings.Validate())
+	assert.Equal(t, 5*time.Second, settings.GetConnectTimeout())
+	assert.Equal(t, 10*time.Minute, settings.GetQueryTimeout())
+
+	assert.Zero(t, (&AWSDatasourceSettings{}).GetQueryTimeout())
+	assert.ErrorContains(t, (&AWSDatasourceSettings{ConnectTimeout: "5"}).Validate(), "invalid connect timeout")
+	assert.ErrorContains(t, (&AWSDatasourceSettings{QueryTimeout: "-1m"}).Validate(), "invalid query timeout")
+}
+
+func TestValidateSettings_Poll(t *testing.T) {
+	settings := &AWSDatasourceSettings{PollInterval: "1s", PollTimeout: "10s"}
+	require.NoError(t, settings.Validate())
+	assert.Equal(t, time.Second, settings.GetPollInterval())
+	assert.Equal(t, 10*time.Second, settings.GetPollTimeout())
+
+	assert.Zero(t, (&AWSDatasourceSettings{}).GetPollInterval())
+	assert.ErrorContains(t, (&AWSDatasourceSettings{PollInterval: "1"}).Validate(), "invalid poll interval")
+	assert.ErrorContains(t, (&AWSDatasourceSettings{PollTimeout: "-1s"}).Validate(), "invalid poll timeout")
+}
+
+func TestValidateSettings_StagingLocation(t *testing.T) {
+	assert.NoError(t, (&AWSDatasourceSettings{}).Validate())
+	assert.NoError(t, (&AWSDatasourceSettings{StagingLocation: "s3://bucket/prefix/"}).Validate())
+	assert.EqualError(t, (&AWSDatasourceSettings{StagingLocation: "bucket/prefix/"}).Validate(),
+		`invalid staging location: "bucket/prefix/" must start with s3://`)
+}
+
+func TestValidateSettings_Region(t *testing.T) {
+	assert.NoError(t, (&AWSDatasourceSettings{Region: "us-east-1"}).Validate())
+	assert.NoError(t, (&AWSDatasourceSettings{Region: "us-gov-west-1"}).Validate())
+	assert.NoError(t, (&AWSDatasourceSettings{Region: "default"}).Validate())
+	assert.EqualError(t, (&AWSDatasourceSettings{Region: "us east 1"}).Validate(), `invalid region "us east 1"`)
+	assert.EqualError(t, (&AWSDatasourceSettings{Region: "us-east-1", StrictRegion: true, StagingLocation: "bucket"}).Validate(),
+		`invalid staging location: "bucket" must start with s3://`)
+	// regions released after the pinned SDK version
+	assert.NoError(t, (&AWSDatasourceSettings{Region: "mx-central-1"}).Validate())
+	assert.NoError(t, (&AWSDatasourceSettings{Region: "ap-southeast-7"}).Validate())
+	assert.ErrorContains(t, (&AWSDatasourceSettings{Region: "us-east-11", StrictRegion: true}).Validate(), `unknown region "us-east-11"`)
+	assert.NoError(t, (&AWSDatasourceSettings{Region: "us-east-1", StrictRegion: true}).Validate())
+	assert.EqualError(t, (&AWSDatasourceSettings{Region: "useast1"}).Validate(), `invalid region "useast1"`)
+}
+
+func TestValidateSettings_Partition(t *testing.T) {
+	assert.NoError(t, (&AWSDatasourceSettings{Partition: "aws-us-gov", Region: "us-gov-west-1"}).Validate())
+	assert.NoError(t, (&AWSDatasourceSettings{Partition: "aws-us-gov"}).Validate())
+	assert.NoError(t, (&AWSDatasourceSettings{Partition: "aws-cn", Region: "cn-north-1"}).Validate())
+	assert.NoError(t, (&AWSDatasourceSettings{Region: "us-east-1"}).Validate())
+	assert.EqualError(t, (&AWSDatasourceSettings{Partition: "aws-us-gov", Region: "us-east-1"}).Validate(),
+		`region "us-east-1" isn't in the "aws-us-gov" partition`)
+	assert.EqualError(t, (&AWSDatasourceSettings{Partition: "aws-gov", Region: "us-gov-west-1"}).Validate(), `unknown partition "aws-gov"`)
+}
+
+func TestValidateSettings_AssumeRolePolicy(t *testing.T) {
+	assert.NoError(t, (&AWSDatasourceSettings{AssumeRolePolicy: `{"Version":"2012-10-17","Statement":[]}`}).Validate())
+	assert.EqualError(t, (&AWSDatasourceSettings{AssumeRolePolicy: "Allow *"}).Validate(),
+		"invalid assume role policy: not a valid JSON document")
+	assert.EqualError(t, (&AWSDatasourceSettings{AssumeRolePolicyARNs: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"}}).ValidateAuth(),
+		"conflicting auth settings: a session policy is set without a role to assume")
+}
+
+func TestWarnings(t *testing.T) {
+	assert.Empty(t, (&AWSDatasourceSettings{}).Warnings())
+	assert.Empty(t, (&AWSDatasourceSettings{AuthType: AuthTypeKeys, AccessKey: "foo", SecretKey: "bar", SessionToken: "baz"}).Warnings())
+	assert.Equal(t, []string{"TLS certificate verification is disabled, the connection is exposed to man-in-the-middle attacks"},
+		(&AWSDatasourceSettings{TLSSkipVerify: true}).Warnings())
+	assert.Equal(t, []string{"long-lived access keys are used, prefer a role or temporary credentials"},
+		(&AWSDatasourceSettings{AuthType: AuthTypeKeys, AccessKey: "foo", SecretKey: "bar"}).Warnings())
+}
+
+func TestFingerprint(t *testing.T) {
+	base := AWSDatasourceSettings{
+		AuthType:      AuthTypeKeys,
+		Region:        "us-east-1",
+		AssumeRoleARN: "arn:aws:iam::123456789012:role/grafana",
+		AccessKey:     "key",
+		SecretKey:     "secret",
+	}
+	fingerprint := base.Fingerprint()
+
+	t.Run("it is stable", func(t *testing.T) {
+		same := base
+		assert.Equal(t, fingerprint, same.Fingerprint())
+	})
+
+	t.Run("it doesn't contain the secrets", func(t *testing.T) {
+		assert.Len(t, fingerprint, 64)
+		assert.NotContains(t, fingerprint, "secret")
+	})
+
+	for name, change := range map[string]func(s *AWSDatasourceSettings){
+		"region":        func(s *AWSDatasourceSettings) { s.Region = "eu-west-1" },
+		"role":          func(s *AWSDatasourceSettings) { s.AssumeRoleARN = "arn:aws:iam::123456789012:role/other" },
+		"access key":    func(s *AWSDatasourceSettings) { s.AccessKey = "other" },
+		"secret key":    func(s *AWSDatasourceSettings) { s.SecretKey = "other" },
+		"session token": func(s *AWSDatasourceSettings) { s.SessionToken = "token" },
+	} {
+		t.Run("it changes with the "+name, func(t *testing.T) {
+			changed := base
+			change(&changed)
+			assert.NotEqual(t, fingerprint, changed.Fingerprint())
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package awsds
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+// WithMinTLSVersion makes the sessions refuse to connect to AWS with a TLS version older than version,
+// e.g. tls.VersionTLS12, whatever the Go runtime allows by default. The HTTP client of the session
+// config is copied with the minimum raised, it must use an *http.Transport.
+func WithMinTLSVersion(version uint16) SessionCacheOption {
+	return func(sc *SessionCache) {
+		sc.minTLSVersion = version
+	}
+}
+
+// tlsClient returns a copy of client, or of the default client if nil, whose transport doesn't
+// negotiate TLS versions older than minVersion, if set, and skips the verification of the server
+// certificate if skipVerify. The given client is left untouched.
+func tlsClient(client *http.Client, minVersion uint16, skipVerify bool) (*http.Client, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	roundTripper := client.Transport
+	if roundTripper == nil {
+		roundTripper = http.DefaultTransport
+	}
+	transport, ok := roundTripper.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("TLS settings are set but the HTTP transport %T can't be configured", roundTripper)
+	}
+	transport = transport.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	if transport.TLSClientConfig.MinVersion < minVersion {
+		transport.TLSClientConfig.MinVersion = minVersion
+	}
+	if skipVerify {
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	copied := *client
+	copied.Transport = transport
+	return &copied, nil
+}
@@ -0,0 +1,120 @@
+package awsds
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSession_TLS(t *testing.T) {
+	origNewSession := newSession
+	t.Cleanup(func() {
+		newSession = origNewSession
+	})
+	newSession = func(cfgs ...*aws.Config) (*session.Session, error) {
+		cfg := aws.Config{}
+		cfg.MergeIn(cfgs...)
+		return &session.Session{Config: &cfg}, nil
+	}
+	getSession := func(client *http.Client, opts ...SessionCacheOption) (*session.Session, error) {
+		return NewSessionCache(opts...).GetSession(SessionConfig{
+			Settings:     AWSDatasourceSettings{AuthType: AuthTypeKeys, AccessKey: "foo", SecretKey: "bar", Region: "us-east-1"},
+			HTTPClient:   client,
+			AuthSettings: &AuthSettings{AllowedAuthProviders: []string{"keys"}},
+		})
+	}
+	tlsConfigOf := func(t *testing.T, sess *session.Session) *tls.Config {
+		t.Helper()
+		require.NotNil(t, sess.Config.HTTPClient)
+		transport, ok := sess.Config.HTTPClient.Transport.(*http.Transport)
+		require.True(t, ok)
+		require.NotNil(t, transport.TLSClientConfig)
+		return transport.TLSClientConfig
+	}
+
+	t.Run("it sets the minimum version on the default transport", func(t *testing.T) {
+		sess, err := getSession(nil, WithMinTLSVersion(tls.VersionTLS12))
+		require.NoError(t, err)
+
+		assert.Equal(t, uint16(tls.VersionTLS12), tlsConfigOf(t, sess).MinVersion)
+		assert.NotSame(t, http.DefaultTransport, sess.Config.HTTPClient.Transport)
+	})
+
+	t.Run("it copies the given client, keeping its settings", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{ServerName: "athena.internal"}}}
+
+		sess, err := getSession(client, WithMinTLSVersion(tls.VersionTLS13))
+		require.NoError(t, err)
+
+		assert.Equal(t, uint16(tls.VersionTLS13), tlsConfigOf(t, sess).MinVersion)
+		assert.Equal(t, "athena.internal", tlsConfigOf(t, sess).ServerName)
+		assert.Zero(t, client.Transport.(*http.Transport).TLSClientConfig.MinVersion)
+	})
+
+	t.Run("it keeps a higher minimum of the given client", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS13}}}
+
+		sess, err := getSession(client, WithMinTLSVersion(tls.VersionTLS12))
+		require.NoError(t, err)
+
+		assert.Equal(t, uint16(tls.VersionTLS13), tlsConfigOf(t, sess).MinVersion)
+	})
+
+	t.Run("it fails with transports it can't configure", func(t *testing.T) {
+		client := &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) { return nil, nil })}
+
+		_, err := getSession(client, WithMinTLSVersion(tls.VersionTLS12))
+		assert.ErrorContains(t, err, "TLS settings are set but the HTTP transport awsds.roundTripperFunc can't be configured")
+	})
+
+	t.Run("it skips the certificate verification if the settings ask for it", func(t *testing.T) {
+		sess, err := NewSessionCache().GetSession(SessionConfig{
+			Settings:     AWSDatasourceSettings{AuthType: AuthTypeKeys, AccessKey: "foo", SecretKey: "bar", Region: "us-east-1", TLSSkipVerify: true},
+			AuthSettings: &AuthSettings{AllowedAuthProviders: []string{"keys"}},
+		})
+		require.NoError(t, err)
+
+		assert.True(t, tlsConfigOf(t, sess).InsecureSkipVerify)
+	})
+
+	t.Run("it configures the session of an assumed role", func(t *testing.T) {
+		origNewSTSCredentials := newSTSCredentials
+		t.Cleanup(func() {
+			newSTSCredentials = origNewSTSCredentials
+		})
+		newSTSCredentials = func(_ client.ConfigProvider, roleARN string, _ ...func(*stscreds.AssumeRoleProvider)) *credentials.Credentials {
+			return credentials.NewCredentials(&stscreds.AssumeRoleProvider{RoleARN: roleARN})
+		}
+
+		sess, err := NewSessionCache(WithMinTLSVersion(tls.VersionTLS12)).GetSession(SessionConfig{
+			Settings: AWSDatasourceSettings{AuthType: AuthTypeKeys, AccessKey: "foo", SecretKey: "bar", Region: "us-east-1",
+				AssumeRoleARN: "arn:aws:iam::123456789012:role/athena", TLSSkipVerify: true},
+			AuthSettings: &AuthSettings{AllowedAuthProviders: []string{"keys"}, AssumeRoleEnabled: true},
+		})
+		require.NoError(t, err)
+
+		assert.Equal(t, uint16(tls.VersionTLS12), tlsConfigOf(t, sess).MinVersion)
+		assert.True(t, tlsConfigOf(t, sess).InsecureSkipVerify)
+	})
+
+	t.Run("it leaves the client unchanged by default", func(t *testing.T) {
+		sess, err := getSession(nil)
+		require.NoError(t, err)
+
+		assert.Nil(t, sess.Config.HTTPClient)
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -106,6 +106,8 @@ type AsyncDB interface {
 	Ping(ctx context.Context) error
 
 	// Async flow
+	// StartQuery returns the id the AWS service gave to the query, e.g. the Athena QueryExecutionId or
+	// the Redshift statement id, so it can be used for cost attribution and to correlate logs
 	StartQuery(ctx context.Context, query string, args ...interface{}) (string, error)
 	GetQueryID(ctx context.Context, query string, args ...interface{}) (bool, string, error)
 	QueryStatus(ctx context.Context, queryID string) (QueryStatus, error)
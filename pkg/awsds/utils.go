@@ -63,13 +63,14 @@ func GetUserAgentString(name string) string {
 	// Determine if running in an Amazon Managed Grafana environment
 	_, amgEnv := os.LookupEnv("AMAZON_MANAGED_GRAFANA")
 
-	return fmt.Sprintf("%s/%s (%s; %s;) %s/%s Grafana/%s AMG/%s",
+	return fmt.Sprintf("%s/%s (%s; %s;) %s/%s grafana-aws-sdk/%s Grafana/%s AMG/%s",
 		aws.SDKName,
 		aws.SDKVersion,
 		runtime.Version(),
 		runtime.GOOS,
 		name,
 		buildInfo.Version,
+		BuildInfo().Version,
 		grafanaVersion,
 		strconv.FormatBool(amgEnv))
 }
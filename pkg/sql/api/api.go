@@ -6,6 +6,9 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/sqlds/v4"
@@ -53,6 +56,39 @@ type AWSAPI interface {
 	Resources
 }
 
+// IAMSimulator is implemented by APIs that can check the IAM permissions of their credentials
+type IAMSimulator interface {
+	// IAM returns an IAM client using the credentials of the API
+	IAM() iamiface.IAMAPI
+	// CallerARN returns the ARN of the credentials of the API, as returned by sts:GetCallerIdentity
+	CallerARN(aws.Context) (string, error)
+}
+
+// S3Provider is implemented by APIs that can access S3 with their credentials, e.g. to check their output location
+type S3Provider interface {
+	// S3 returns an S3 client using the credentials of the API
+	S3() s3iface.S3API
+}
+
+// SessionProvider is implemented by APIs that can share the AWS session they're built from, e.g. for diagnostics
+type SessionProvider interface {
+	Session() *session.Session
+}
+
+// QueryEstimate is the estimated cost of a query, as far as the engine can tell before running it
+type QueryEstimate struct {
+	// ScannedBytes is the amount of data the query would scan, -1 if unknown
+	ScannedBytes int64
+	// Detail is the plan or explanation returned by the engine, if any
+	Detail string
+}
+
+// QueryEstimator is implemented by APIs that can estimate the cost of a query without running it,
+// e.g. with an EXPLAIN statement
+type QueryEstimator interface {
+	EstimateQuery(ctx aws.Context, options sqlds.Options, query string) (QueryEstimate, error)
+}
+
 // WaitOnQuery polls the datasource api until the query finishes, returning an error if it failed.
 func WaitOnQuery(ctx context.Context, api SQL, output *ExecuteQueryOutput) error {
 	backoffInstance := backoff.Backoff{
@@ -85,18 +121,40 @@ func WaitOnQuery(ctx context.Context, api SQL, output *ExecuteQueryOutput) error
 	}
 }
 
+// PollOptions configure how WaitOnQueryIDWithOptions polls the status of a query
+type PollOptions struct {
+	// Interval is the delay before the first retry, doubled after each check up to 10 minutes.
+	// Defaults to 200ms.
+	Interval time.Duration
+	// Timeout bounds each status call. A call that times out is retried at the next interval, so a
+	// status API that hangs doesn't stall the query. It can be shorter or longer than the interval
+	// as the next check only starts once the current one returns. No timeout by default.
+	Timeout time.Duration
+}
+
 func WaitOnQueryID(ctx context.Context, queryID string, db awsds.AsyncDB) error {
+	return WaitOnQueryIDWithOptions(ctx, queryID, db, PollOptions{})
+}
+
+// WaitOnQueryIDWithOptions polls the status of the query until it finishes, canceling it if the context is canceled
+func WaitOnQueryIDWithOptions(ctx context.Context, queryID string, db awsds.AsyncDB, opts PollOptions) error {
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = backoffMin
+	}
 	backoffInstance := backoff.Backoff{
-		Min:    backoffMin,
-		Max:    backoffMax,
+		Min:    interval,
+		Max:    max(interval, backoffMax),
 		Factor: 2,
 	}
 	for {
-		status, err := db.QueryStatus(ctx, queryID)
-		if err != nil {
+		status, timedOut, err := queryStatus(ctx, queryID, db, opts.Timeout)
+		switch {
+		case timedOut:
+			log.DefaultLogger.Debug("query status timed out, retrying", "query ID", queryID, "timeout", opts.Timeout)
+		case err != nil:
 			return err
-		}
-		if status.Finished() {
+		case status.Finished():
 			return nil
 		}
 		select {
@@ -115,3 +173,31 @@ func WaitOnQueryID(ctx context.Context, queryID string, db awsds.AsyncDB) error
 		}
 	}
 }
+
+// pollCallerKey holds the context of the caller of WaitOnQueryIDWithOptions in the context of each
+// status call bounded by PollOptions.Timeout
+type pollCallerKey struct{}
+
+// PollCaller returns the context of the caller polling the status of a query, which is ctx unless it's
+// the context of a single status call bounded by PollOptions.Timeout. An AsyncDB can tell with it a
+// status call timing out, to be retried, from the caller no longer waiting for the query.
+func PollCaller(ctx context.Context) context.Context {
+	if caller, ok := ctx.Value(pollCallerKey{}).(context.Context); ok {
+		return caller
+	}
+	return ctx
+}
+
+// queryStatus returns the status of the query, giving up after the timeout if set. Drivers don't always
+// wrap the context error, so whether the call timed out is told by the contexts.
+func queryStatus(ctx context.Context, queryID string, db awsds.AsyncDB, timeout time.Duration) (awsds.QueryStatus, bool, error) {
+	if timeout <= 0 {
+		status, err := db.QueryStatus(ctx, queryID)
+		return status, false, err
+	}
+	pollCtx, cancel := context.WithTimeout(context.WithValue(ctx, pollCallerKey{}, ctx), timeout)
+	defer cancel()
+	status, err := db.QueryStatus(pollCtx, queryID)
+	timedOut := err != nil && errors.Is(pollCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil
+	return status, timedOut, err
+}
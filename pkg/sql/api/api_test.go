@@ -3,10 +3,12 @@ package api
 import (
 	"context"
 	"errors"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
 )
 
 type fakeDS struct {
@@ -111,3 +113,58 @@ func TestConnection_waitOnQueryCancelled(t *testing.T) {
 		t.Errorf("failed to cancel the request")
 	}
 }
+
+// hangingDB hangs on the first status calls until their context is done
+type hangingDB struct {
+	awsds.AsyncDB
+	hangs    int
+	calls    int
+	canceled bool
+}
+
+func (db *hangingDB) QueryStatus(ctx context.Context, _ string) (awsds.QueryStatus, error) {
+	db.calls++
+	if db.calls <= db.hangs {
+		<-ctx.Done()
+		return awsds.QueryUnknown, fmt.Errorf("status request canceled: %v", ctx.Err())
+	}
+	return awsds.QueryFinished, nil
+}
+
+func (db *hangingDB) CancelQuery(context.Context, string) error {
+	db.canceled = true
+	return nil
+}
+
+func TestWaitOnQueryIDWithOptions(t *testing.T) {
+	t.Run("it retries status calls that time out", func(t *testing.T) {
+		db := &hangingDB{hangs: 2}
+		start := time.Now()
+		err := WaitOnQueryIDWithOptions(context.Background(), "query", db, PollOptions{
+			Interval: 5 * time.Millisecond,
+			Timeout:  time.Millisecond,
+		})
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		if db.calls != 3 {
+			t.Errorf("status not called the right amount of times. Want 3 got %d", db.calls)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("status calls not bounded by the timeout, took %v", elapsed)
+		}
+	})
+
+	t.Run("it stops when the query context is done", func(t *testing.T) {
+		db := &hangingDB{hangs: 1}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		err := WaitOnQueryIDWithOptions(ctx, "query", db, PollOptions{Timeout: time.Minute})
+		if err == nil {
+			t.Errorf("expected an error")
+		}
+		if db.calls != 1 {
+			t.Errorf("status not called the right amount of times. Want 1 got %d", db.calls)
+		}
+	})
+}
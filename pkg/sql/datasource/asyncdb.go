@@ -0,0 +1,301 @@
+package datasource
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	asyncDriver "github.com/grafana/grafana-aws-sdk/pkg/sql/driver/async"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/sqlds/v4"
+)
+
+// RowTransform modifies a row in place. columns are the names of the result set columns and row holds
+// their values, in the same order.
+type RowTransform func(columns []string, row []driver.Value) error
+
+// asyncDB wraps the awsds.AsyncDB created by the driver to apply the client options
+type asyncDB struct {
+	awsds.AsyncDB
+	rowTransform RowTransform
+	// isNoRows matches the driver error returned for queries without rows
+	isNoRows func(error) bool
+	// events is nil without a QueryListener nor metrics
+	events *queryEvents
+	// tracker is nil without query tracking
+	tracker *queryTracker
+	// maxRows is the most rows returned per result, 0 for no limit
+	maxRows int64
+	// pollOptions are the poll settings of the datasource, see PollOptions
+	pollOptions api.PollOptions
+	// pageRows counts the rows read from the pages of each query so far, see GetQueryResultPage
+	pageRows sync.Map
+}
+
+func (ds *awsClient) wrapAsyncDB(id int64, options sqlds.Options, settings models.Settings, db awsds.AsyncDB, dr asyncDriver.Driver) awsds.AsyncDB {
+	var isNoRows func(error) bool
+	if matcher, ok := dr.(asyncDriver.NoRowsMatcher); ok && ds.emptyResults {
+		isNoRows = matcher.IsNoRows
+	}
+	var maxRows int64
+	if s, ok := settings.(models.RowLimitSettings); ok {
+		maxRows = s.GetMaxRows()
+	}
+	var pollOptions api.PollOptions
+	if s, ok := settings.(models.PollSettings); ok {
+		pollOptions = api.PollOptions{Interval: s.GetPollInterval(), Timeout: s.GetPollTimeout()}
+	}
+	if db == nil || (ds.rowTransform == nil && isNoRows == nil && ds.queryListener == nil && ds.metrics == nil && !ds.trackQueries && maxRows <= 0 && pollOptions == api.PollOptions{}) {
+		return db
+	}
+	wrapped := &asyncDB{AsyncDB: db, rowTransform: ds.rowTransform, isNoRows: isNoRows, maxRows: maxRows, pollOptions: pollOptions}
+	if ds.queryListener != nil || ds.metrics != nil {
+		wrapped.events = &queryEvents{id: id, listener: ds.queryListener, metrics: ds.metrics, now: ds.now}
+	}
+	if ds.trackQueries {
+		wrapped.tracker = &queryTracker{running: ds.runningQueriesOf(id), key: ds.connectionKey(id, options), now: ds.now}
+	}
+	return wrapped
+}
+
+// PollOptions returns the poll settings of the datasource, picked up by the connections of async.NewConnection
+func (db *asyncDB) PollOptions() api.PollOptions {
+	return db.pollOptions
+}
+
+func (db *asyncDB) StartQuery(ctx context.Context, query string, args ...interface{}) (string, error) {
+	queryID, err := db.startQuery(ctx, query, args...)
+	if err == nil && db.tracker != nil {
+		db.tracker.add(queryID, db.AsyncDB)
+	}
+	return queryID, err
+}
+
+func (db *asyncDB) startQuery(ctx context.Context, query string, args ...interface{}) (string, error) {
+	if db.events == nil {
+		return db.AsyncDB.StartQuery(ctx, query, args...)
+	}
+	begin := db.events.now()
+	queryID, err := db.AsyncDB.StartQuery(ctx, query, args...)
+	db.events.start(ctx, queryID, begin, err)
+	return queryID, err
+}
+
+func (db *asyncDB) QueryStatus(ctx context.Context, queryID string) (awsds.QueryStatus, error) {
+	status, err := db.queryStatus(ctx, queryID)
+	if err == nil && status.Finished() && db.tracker != nil {
+		db.tracker.remove(queryID)
+	}
+	return status, err
+}
+
+func (db *asyncDB) queryStatus(ctx context.Context, queryID string) (awsds.QueryStatus, error) {
+	if db.events == nil {
+		return db.AsyncDB.QueryStatus(ctx, queryID)
+	}
+	begin := db.events.now()
+	status, err := db.AsyncDB.QueryStatus(ctx, queryID)
+	db.events.status(ctx, queryID, begin, status, err)
+	return status, err
+}
+
+func (db *asyncDB) CancelQuery(ctx context.Context, queryID string) error {
+	err := db.AsyncDB.CancelQuery(ctx, queryID)
+	if err == nil && db.tracker != nil {
+		db.tracker.remove(queryID)
+	}
+	return err
+}
+
+func (db *asyncDB) GetRows(ctx context.Context, queryID string) (driver.Rows, error) {
+	rows, err := db.AsyncDB.GetRows(ctx, queryID)
+	if err != nil && db.isNoRows != nil && db.isNoRows(err) {
+		return emptyRows{}, nil
+	}
+	if err != nil || rows == nil {
+		return rows, err
+	}
+	return db.wrapRows(queryID, rows), nil
+}
+
+// GetQueryResultPage keeps the pagination of the driver db, applying the client options to every page.
+// The row limit applies to the pages of the query together, as long as each page is read before the
+// next one is requested: once it's reached, the next pages end the rows and no next token is returned.
+func (db *asyncDB) GetQueryResultPage(ctx context.Context, queryID string, token string, pageSize int) (driver.Rows, string, error) {
+	rows, next, err := awsds.GetQueryResultPage(ctx, db.AsyncDB, queryID, token, pageSize)
+	if err != nil && db.isNoRows != nil && db.isNoRows(err) {
+		db.pageRows.Delete(queryID)
+		return emptyRows{}, "", nil
+	}
+	if err != nil || rows == nil {
+		return rows, next, err
+	}
+	if db.maxRows <= 0 {
+		return db.wrapRows(queryID, rows), next, nil
+	}
+	read := &atomic.Int64{}
+	if token == "" {
+		// the pages are read from the first one, again if they were already
+		db.pageRows.Store(queryID, read)
+	} else if entry, loaded := db.pageRows.LoadOrStore(queryID, read); loaded {
+		read = entry.(*atomic.Int64)
+	}
+	if next == "" || read.Load() >= db.maxRows {
+		db.pageRows.Delete(queryID)
+		next = ""
+	}
+	return db.limitRows(queryID, db.transformRows(rows), read), next, nil
+}
+
+// GetResultSets keeps the result sets of the driver db, applying the client options to every set
+func (db *asyncDB) GetResultSets(ctx context.Context, queryID string) ([]driver.Rows, error) {
+	sets, err := awsds.GetResultSets(ctx, db.AsyncDB, queryID)
+	if err != nil && db.isNoRows != nil && db.isNoRows(err) {
+		return []driver.Rows{emptyRows{}}, nil
+	}
+	if err != nil {
+		return sets, err
+	}
+	for i, rows := range sets {
+		if rows != nil {
+			sets[i] = db.wrapRows(queryID, rows)
+		}
+	}
+	return sets, nil
+}
+
+// wrapRows applies the row transform and the row limit to rows
+func (db *asyncDB) wrapRows(queryID string, rows driver.Rows) driver.Rows {
+	rows = db.transformRows(rows)
+	if db.maxRows > 0 {
+		rows = db.limitRows(queryID, rows, &atomic.Int64{})
+	}
+	return rows
+}
+
+func (db *asyncDB) transformRows(rows driver.Rows) driver.Rows {
+	if db.rowTransform == nil {
+		return rows
+	}
+	return &transformedRows{Rows: rows, transform: db.rowTransform}
+}
+
+// limitRows ends rows once read, shared by the rows of the same query, reaches the row limit
+func (db *asyncDB) limitRows(queryID string, rows driver.Rows, read *atomic.Int64) driver.Rows {
+	return &limitedRows{Rows: rows, queryID: queryID, max: db.maxRows, read: read}
+}
+
+// emptyRows is a result set without columns nor rows
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string {
+	return []string{}
+}
+
+func (emptyRows) Close() error {
+	return nil
+}
+
+func (emptyRows) Next(_ []driver.Value) error {
+	return io.EOF
+}
+
+// limitedRows ends the rows once max of them were read, flagging them truncated if there were more
+type limitedRows struct {
+	driver.Rows
+	queryID string
+	max     int64
+	// read counts the rows read, including those of the previous pages of the query
+	read      *atomic.Int64
+	truncated bool
+}
+
+func (r *limitedRows) Next(dest []driver.Value) error {
+	if r.read.Load() < r.max {
+		if err := r.Rows.Next(dest); err != nil {
+			return err
+		}
+		r.read.Add(1)
+		return nil
+	}
+	if !r.truncated && r.Rows.Next(dest) == nil {
+		r.truncated = true
+		backend.Logger.Warn("Query result truncated to the max rows", "queryId", r.queryID, "maxRows", r.max)
+	}
+	return io.EOF
+}
+
+// Truncated returns true if rows were dropped, once the rows were read up to the limit
+func (r *limitedRows) Truncated() bool {
+	return r.truncated
+}
+
+// ColumnTypeDatabaseTypeName keeps the column types reported by the driver rows, if any
+func (r *limitedRows) ColumnTypeDatabaseTypeName(index int) string {
+	if rows, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return rows.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+// ColumnTypeNullable keeps the column nullability reported by the driver rows, if any
+func (r *limitedRows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	if rows, ok := r.Rows.(driver.RowsColumnTypeNullable); ok {
+		return rows.ColumnTypeNullable(index)
+	}
+	return false, false
+}
+
+// RowsTruncated returns true if rows returned by an AsyncDB of GetAsyncDB were cut at the max rows
+// of the settings, see models.RowLimitSettings. It's only known once the rows were read to the end.
+func RowsTruncated(rows driver.Rows) bool {
+	limited, ok := rows.(*limitedRows)
+	return ok && limited.Truncated()
+}
+
+// AddTruncationNotice adds a warning to frame, built from rows read to the end, if they were cut at
+// the max rows of the settings, so Grafana tells the user the result is incomplete
+func AddTruncationNotice(frame *data.Frame, rows driver.Rows) {
+	if !RowsTruncated(rows) {
+		return
+	}
+	frame.AppendNotices(data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text:     fmt.Sprintf("The result was truncated to the first %d rows, see the max rows of the datasource", rows.(*limitedRows).max),
+	})
+}
+
+type transformedRows struct {
+	driver.Rows
+	transform RowTransform
+}
+
+func (r *transformedRows) Next(dest []driver.Value) error {
+	if err := r.Rows.Next(dest); err != nil {
+		return err
+	}
+	return r.transform(r.Rows.Columns(), dest)
+}
+
+// ColumnTypeDatabaseTypeName keeps the column types reported by the driver rows, if any
+func (r *transformedRows) ColumnTypeDatabaseTypeName(index int) string {
+	if rows, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return rows.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+// ColumnTypeNullable keeps the column nullability reported by the driver rows, if any
+func (r *transformedRows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	if rows, ok := r.Rows.(driver.RowsColumnTypeNullable); ok {
+		return rows.ColumnTypeNullable(index)
+	}
+	return false, false
+}
@@ -0,0 +1,605 @@
+package datasource
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	sqlApi "github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	asyncDriver "github.com/grafana/grafana-aws-sdk/pkg/sql/driver/async"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/sqlds/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// typedRows reports the type of its columns, all nullable but the first one
+type typedRows struct {
+	fakeRows
+	types []string
+}
+
+func (r *typedRows) ColumnTypeDatabaseTypeName(index int) string {
+	return r.types[index]
+}
+
+func (r *typedRows) ColumnTypeNullable(index int) (bool, bool) {
+	return index != 0, true
+}
+
+type fakeAsyncDB struct {
+	rows    driver.Rows
+	rowsErr error
+	queryID string
+}
+
+func (db *fakeAsyncDB) Prepare(_ string) (driver.Stmt, error) {
+	return nil, nil
+}
+
+func (db *fakeAsyncDB) Close() error {
+	return nil
+}
+
+func (db *fakeAsyncDB) Begin() (driver.Tx, error) {
+	return nil, nil
+}
+
+func (db *fakeAsyncDB) Ping(_ context.Context) error {
+	return nil
+}
+
+func (db *fakeAsyncDB) StartQuery(_ context.Context, _ string, _ ...interface{}) (string, error) {
+	return db.queryID, nil
+}
+
+func (db *fakeAsyncDB) GetQueryID(_ context.Context, _ string, _ ...interface{}) (bool, string, error) {
+	return false, "", nil
+}
+
+func (db *fakeAsyncDB) QueryStatus(_ context.Context, _ string) (awsds.QueryStatus, error) {
+	return awsds.QueryFinished, nil
+}
+
+func (db *fakeAsyncDB) CancelQuery(_ context.Context, _ string) error {
+	return nil
+}
+
+func (db *fakeAsyncDB) GetRows(_ context.Context, _ string) (driver.Rows, error) {
+	return db.rows, db.rowsErr
+}
+
+type fakeAsyncDriver struct {
+	fakeDriver
+	db awsds.AsyncDB
+}
+
+func (d *fakeAsyncDriver) GetAsyncDB() (awsds.AsyncDB, error) {
+	return d.db, nil
+}
+
+type fakeAsyncLoader struct {
+	fakeLoader
+	asyncDriver asyncDriver.Driver
+}
+
+func (m fakeAsyncLoader) LoadAsyncDriver(_ context.Context, _ sqlApi.AWSAPI) (asyncDriver.Driver, error) {
+	return m.asyncDriver, nil
+}
+
+func newFakeAsyncClient(db awsds.AsyncDB, opts ...Option) AWSClient {
+	ds := New(fakeAsyncLoader{asyncDriver: &fakeAsyncDriver{db: db}}, opts...)
+	ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+	return ds
+}
+
+func TestGetAsyncDB_RowTransform(t *testing.T) {
+	mask := func(columns []string, row []driver.Value) error {
+		for i, column := range columns {
+			if column == "email" {
+				row[i] = "***"
+			}
+		}
+		return nil
+	}
+
+	t.Run("it masks the configured column", func(t *testing.T) {
+		db := &fakeAsyncDB{rows: &fakeRows{
+			columns: []string{"id", "email"},
+			values:  [][]driver.Value{{int64(1), "jane@example.com"}, {int64(2), "john@example.com"}},
+		}}
+		ds := newFakeAsyncClient(db, WithRowTransform(mask))
+
+		asyncDB, err := ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		rows, err := asyncDB.GetRows(context.Background(), "query")
+		require.NoError(t, err)
+
+		row := make([]driver.Value, 2)
+		for _, id := range []int64{1, 2} {
+			require.NoError(t, rows.Next(row))
+			assert.Equal(t, []driver.Value{id, "***"}, row)
+		}
+		assert.Equal(t, io.EOF, rows.Next(row))
+	})
+
+	t.Run("it handles empty results", func(t *testing.T) {
+		db := &fakeAsyncDB{rows: &fakeRows{columns: []string{"id", "email"}}}
+		ds := newFakeAsyncClient(db, WithRowTransform(mask))
+
+		asyncDB, err := ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		rows, err := asyncDB.GetRows(context.Background(), "query")
+		require.NoError(t, err)
+		assert.Equal(t, io.EOF, rows.Next(make([]driver.Value, 2)))
+	})
+
+	t.Run("it handles nil results", func(t *testing.T) {
+		ds := newFakeAsyncClient(&fakeAsyncDB{}, WithRowTransform(mask))
+
+		asyncDB, err := ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		rows, err := asyncDB.GetRows(context.Background(), "query")
+		require.NoError(t, err)
+		assert.Nil(t, rows)
+	})
+
+	t.Run("it keeps the column types", func(t *testing.T) {
+		db := &fakeAsyncDB{rows: &typedRows{fakeRows: fakeRows{columns: []string{"id", "email"}}, types: []string{"bigint", "varchar"}}}
+		ds := newFakeAsyncClient(db, WithRowTransform(mask))
+
+		asyncDB, err := ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		rows, err := asyncDB.GetRows(context.Background(), "query")
+		require.NoError(t, err)
+		assert.Equal(t, []awsds.Column{
+			{Name: "id", DatabaseType: "bigint", Nullable: false},
+			{Name: "email", DatabaseType: "varchar", Nullable: true},
+		}, awsds.ResultColumns(rows))
+	})
+
+	t.Run("it returns the driver db when no transform is set", func(t *testing.T) {
+		db := &fakeAsyncDB{}
+		ds := newFakeAsyncClient(db)
+
+		asyncDB, err := ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Same(t, db, asyncDB)
+	})
+}
+
+var errNoRows = errors.New("query returned no rows")
+
+// noRowsAsyncDriver fails queries without rows with errNoRows
+type noRowsAsyncDriver struct {
+	fakeAsyncDriver
+}
+
+func (d *noRowsAsyncDriver) IsNoRows(err error) bool {
+	return errors.Is(err, errNoRows)
+}
+
+func TestGetAsyncDB_EmptyResults(t *testing.T) {
+	newClient := func(db awsds.AsyncDB, opts ...Option) AWSClient {
+		ds := New(fakeAsyncLoader{asyncDriver: &noRowsAsyncDriver{fakeAsyncDriver{db: db}}}, opts...)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+		return ds
+	}
+
+	t.Run("it turns the no rows error into an empty result", func(t *testing.T) {
+		ds := newClient(&fakeAsyncDB{rowsErr: fmt.Errorf("athena: %w", errNoRows)}, WithEmptyResults())
+
+		asyncDB, err := ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		rows, err := asyncDB.GetRows(context.Background(), "query")
+		require.NoError(t, err)
+		assert.Empty(t, rows.Columns())
+		assert.Equal(t, io.EOF, rows.Next(nil))
+	})
+
+	t.Run("it keeps other errors", func(t *testing.T) {
+		queryErr := errors.New("syntax error")
+		ds := newClient(&fakeAsyncDB{rowsErr: queryErr}, WithEmptyResults())
+
+		asyncDB, err := ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		_, err = asyncDB.GetRows(context.Background(), "query")
+		assert.ErrorIs(t, err, queryErr)
+	})
+
+	t.Run("it keeps the no rows error unless enabled", func(t *testing.T) {
+		ds := newClient(&fakeAsyncDB{rowsErr: errNoRows})
+
+		asyncDB, err := ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		_, err = asyncDB.GetRows(context.Background(), "query")
+		assert.ErrorIs(t, err, errNoRows)
+	})
+
+	t.Run("it ignores drivers without a matcher", func(t *testing.T) {
+		db := &fakeAsyncDB{rowsErr: errNoRows}
+		ds := newFakeAsyncClient(db, WithEmptyResults())
+
+		asyncDB, err := ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Same(t, db, asyncDB)
+	})
+}
+
+// pagedAsyncDB serves each of its pages in turn, using the index of the next page as token
+type pagedAsyncDB struct {
+	fakeAsyncDB
+	pages []*fakeRows
+}
+
+func (db *pagedAsyncDB) GetQueryResultPage(_ context.Context, _ string, token string, _ int) (driver.Rows, string, error) {
+	page := 0
+	if token != "" {
+		page = 1
+	}
+	next := ""
+	if page+1 < len(db.pages) {
+		next = "page-2"
+	}
+	return db.pages[page], next, nil
+}
+
+func TestGetAsyncDB_Pagination(t *testing.T) {
+	mask := func(_ []string, row []driver.Value) error {
+		row[1] = "***"
+		return nil
+	}
+	db := &pagedAsyncDB{pages: []*fakeRows{
+		{columns: []string{"id", "email"}, values: [][]driver.Value{{int64(1), "jane@example.com"}}},
+		{columns: []string{"id", "email"}, values: [][]driver.Value{{int64(2), "john@example.com"}}},
+	}}
+	ds := newFakeAsyncClient(db, WithRowTransform(mask))
+
+	asyncDB, err := ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+	require.NoError(t, err)
+
+	row := make([]driver.Value, 2)
+	rows, token, err := awsds.GetQueryResultPage(context.Background(), asyncDB, "query", "", 1)
+	require.NoError(t, err)
+	assert.Equal(t, "page-2", token)
+	require.NoError(t, rows.Next(row))
+	assert.Equal(t, []driver.Value{int64(1), "***"}, row)
+
+	rows, token, err = awsds.GetQueryResultPage(context.Background(), asyncDB, "query", token, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "", token)
+	require.NoError(t, rows.Next(row))
+	assert.Equal(t, []driver.Value{int64(2), "***"}, row)
+	assert.Equal(t, io.EOF, rows.Next(row))
+}
+
+func TestGetAsyncDB_QueryID(t *testing.T) {
+	executionID := "a1b2c3d4-5678-90ab-cdef-EXAMPLE11111"
+	for name, opts := range map[string][]Option{
+		"driver db":  nil,
+		"wrapped db": {WithRowTransform(func(_ []string, _ []driver.Value) error { return nil })},
+	} {
+		t.Run("it returns the execution id of the "+name, func(t *testing.T) {
+			ds := newFakeAsyncClient(&fakeAsyncDB{queryID: executionID}, opts...)
+
+			asyncDB, err := ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+			require.NoError(t, err)
+			queryID, err := asyncDB.StartQuery(context.Background(), "SELECT 1")
+			require.NoError(t, err)
+			assert.Equal(t, executionID, queryID)
+		})
+	}
+}
+
+// multiResultAsyncDB returns a result set per statement of its queries
+type multiResultAsyncDB struct {
+	fakeAsyncDB
+	sets []driver.Rows
+}
+
+func (db *multiResultAsyncDB) GetResultSets(_ context.Context, _ string) ([]driver.Rows, error) {
+	return db.sets, nil
+}
+
+func TestGetAsyncDB_ResultSets(t *testing.T) {
+	newSets := func() []driver.Rows {
+		return []driver.Rows{
+			&fakeRows{columns: []string{"id"}, values: [][]driver.Value{{int64(1)}}},
+			&fakeRows{columns: []string{"email"}, values: [][]driver.Value{{"jane@example.com"}}},
+		}
+	}
+
+	t.Run("it returns every result set of the query", func(t *testing.T) {
+		ds := newFakeAsyncClient(&multiResultAsyncDB{sets: newSets()})
+		asyncDB, err := ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		rows, err := asyncDriver.NewConnection(asyncDB).QueryContext(context.Background(), "", []driver.NamedValue{{Name: "queryID", Value: "query"}})
+		require.NoError(t, err)
+		multi, ok := rows.(driver.RowsNextResultSet)
+		require.True(t, ok)
+
+		row := make([]driver.Value, 1)
+		assert.Equal(t, []string{"id"}, rows.Columns())
+		require.NoError(t, rows.Next(row))
+		assert.Equal(t, []driver.Value{int64(1)}, row)
+		assert.Equal(t, io.EOF, rows.Next(row))
+
+		require.True(t, multi.HasNextResultSet())
+		require.NoError(t, multi.NextResultSet())
+		assert.Equal(t, []string{"email"}, rows.Columns())
+		require.NoError(t, rows.Next(row))
+		assert.Equal(t, []driver.Value{"jane@example.com"}, row)
+
+		assert.False(t, multi.HasNextResultSet())
+		assert.Equal(t, io.EOF, multi.NextResultSet())
+		require.NoError(t, rows.Close())
+	})
+
+	t.Run("it applies the row transform to every set", func(t *testing.T) {
+		redact := func(_ []string, row []driver.Value) error {
+			row[0] = "***"
+			return nil
+		}
+		ds := newFakeAsyncClient(&multiResultAsyncDB{sets: newSets()}, WithRowTransform(redact))
+		asyncDB, err := ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		sets, err := awsds.GetResultSets(context.Background(), asyncDB, "query")
+		require.NoError(t, err)
+		require.Len(t, sets, 2)
+		row := make([]driver.Value, 1)
+		for _, set := range sets {
+			require.NoError(t, set.Next(row))
+			assert.Equal(t, []driver.Value{"***"}, row)
+		}
+	})
+
+	t.Run("it returns the rows of single result drivers as one set", func(t *testing.T) {
+		ds := newFakeAsyncClient(&fakeAsyncDB{rows: &fakeRows{columns: []string{"id"}}})
+		asyncDB, err := ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		rows, err := asyncDriver.NewConnection(asyncDB).QueryContext(context.Background(), "", []driver.NamedValue{{Name: "queryID", Value: "query"}})
+		require.NoError(t, err)
+		_, ok := rows.(driver.RowsNextResultSet)
+		assert.False(t, ok)
+	})
+}
+
+// rowLimitLoader loads awsSettings, which can set max rows
+type rowLimitLoader struct {
+	fakeAsyncLoader
+}
+
+func (m rowLimitLoader) LoadSettings(_ context.Context) models.Settings {
+	return &awsSettings{}
+}
+
+func TestGetAsyncDB_MaxRows(t *testing.T) {
+	ctx := context.Background()
+	newClient := func(rows *fakeRows, jsonData string) AWSClient {
+		ds := New(rowLimitLoader{fakeAsyncLoader{asyncDriver: &fakeAsyncDriver{db: &fakeAsyncDB{rows: rows}}}})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(jsonData)})
+		return ds
+	}
+	readAll := func(t *testing.T, rows driver.Rows) []int64 {
+		t.Helper()
+		values := []int64{}
+		dest := make([]driver.Value, 1)
+		for rows.Next(dest) == nil {
+			values = append(values, dest[0].(int64))
+		}
+		return values
+	}
+	threeRows := func() *fakeRows {
+		return &fakeRows{columns: []string{"id"}, values: [][]driver.Value{{int64(1)}, {int64(2)}, {int64(3)}}}
+	}
+
+	t.Run("it truncates the rows over the limit with a warning flag", func(t *testing.T) {
+		db, err := newClient(threeRows(), `{"maxRows":2}`).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		rows, err := db.GetRows(ctx, "query-1")
+		require.NoError(t, err)
+		assert.Equal(t, []int64{1, 2}, readAll(t, rows))
+		assert.True(t, RowsTruncated(rows))
+	})
+
+	t.Run("it doesn't flag results within the limit", func(t *testing.T) {
+		db, err := newClient(threeRows(), `{"maxRows":3}`).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		rows, err := db.GetRows(ctx, "query-1")
+		require.NoError(t, err)
+		assert.Equal(t, []int64{1, 2, 3}, readAll(t, rows))
+		assert.False(t, RowsTruncated(rows))
+	})
+
+	t.Run("it caps the rows of every page together", func(t *testing.T) {
+		paged := &pagedAsyncDB{pages: []*fakeRows{
+			{columns: []string{"id"}, values: [][]driver.Value{{int64(1)}, {int64(2)}}},
+			{columns: []string{"id"}, values: [][]driver.Value{{int64(3)}, {int64(4)}}},
+		}}
+		ds := New(rowLimitLoader{fakeAsyncLoader{asyncDriver: &fakeAsyncDriver{db: paged}}})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"maxRows":3}`)})
+		db, err := ds.GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		rows, token, err := awsds.GetQueryResultPage(ctx, db, "query-1", "", 2)
+		require.NoError(t, err)
+		assert.Equal(t, []int64{1, 2}, readAll(t, rows))
+		assert.False(t, RowsTruncated(rows))
+		require.Equal(t, "page-2", token)
+
+		rows, token, err = awsds.GetQueryResultPage(ctx, db, "query-1", token, 2)
+		require.NoError(t, err)
+		assert.Equal(t, []int64{3}, readAll(t, rows))
+		assert.True(t, RowsTruncated(rows))
+		assert.Empty(t, token)
+	})
+
+	t.Run("it stops the pagination once the limit is reached", func(t *testing.T) {
+		paged := &pagedAsyncDB{pages: []*fakeRows{
+			{columns: []string{"id"}, values: [][]driver.Value{{int64(1)}, {int64(2)}}},
+			{columns: []string{"id"}, values: [][]driver.Value{{int64(3)}}},
+			{columns: []string{"id"}, values: [][]driver.Value{{int64(4)}}},
+		}}
+		ds := New(rowLimitLoader{fakeAsyncLoader{asyncDriver: &fakeAsyncDriver{db: paged}}})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"maxRows":2}`)})
+		db, err := ds.GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		rows, token, err := awsds.GetQueryResultPage(ctx, db, "query-1", "", 2)
+		require.NoError(t, err)
+		assert.Equal(t, []int64{1, 2}, readAll(t, rows))
+		require.Equal(t, "page-2", token)
+
+		rows, token, err = awsds.GetQueryResultPage(ctx, db, "query-1", token, 2)
+		require.NoError(t, err)
+		assert.Empty(t, readAll(t, rows))
+		assert.True(t, RowsTruncated(rows))
+		assert.Empty(t, token)
+	})
+
+	t.Run("it adds a notice to the frames of truncated rows", func(t *testing.T) {
+		db, err := newClient(threeRows(), `{"maxRows":2}`).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+		rows, err := db.GetRows(ctx, "query-1")
+		require.NoError(t, err)
+		readAll(t, rows)
+
+		frame := data.NewFrame("")
+		AddTruncationNotice(frame, rows)
+		require.NotNil(t, frame.Meta)
+		require.Len(t, frame.Meta.Notices, 1)
+		assert.Equal(t, data.NoticeSeverityWarning, frame.Meta.Notices[0].Severity)
+		assert.Contains(t, frame.Meta.Notices[0].Text, "truncated to the first 2 rows")
+	})
+
+	t.Run("it returns every row without a limit", func(t *testing.T) {
+		db, err := newClient(threeRows(), `{}`).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		rows, err := db.GetRows(ctx, "query-1")
+		require.NoError(t, err)
+		assert.Equal(t, []int64{1, 2, 3}, readAll(t, rows))
+		assert.False(t, RowsTruncated(rows))
+	})
+}
+
+func TestGetAsyncDB_PollOptions(t *testing.T) {
+	ctx := context.Background()
+	newClient := func(jsonData string) AWSClient {
+		ds := New(rowLimitLoader{fakeAsyncLoader{asyncDriver: &fakeAsyncDriver{db: &fakeAsyncDB{}}}})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(jsonData)})
+		return ds
+	}
+
+	t.Run("it passes the poll settings to the connections", func(t *testing.T) {
+		db, err := newClient(`{"pollInterval":"1s","pollTimeout":"5s"}`).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		optioner, ok := db.(asyncDriver.PollOptioner)
+		require.True(t, ok)
+		assert.Equal(t, sqlApi.PollOptions{Interval: time.Second, Timeout: 5 * time.Second}, optioner.PollOptions())
+	})
+
+	t.Run("it returns the driver db without poll settings", func(t *testing.T) {
+		db, err := newClient(`{}`).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		_, ok := db.(asyncDriver.PollOptioner)
+		assert.False(t, ok)
+	})
+}
+
+// taggingDB records the resource tags of the driver when a query starts, like a driver sending them
+// with its StartQueryExecution requests
+type taggingDB struct {
+	fakeAsyncDB
+	tags        map[string]string
+	startedWith []map[string]string
+}
+
+func (db *taggingDB) StartQuery(ctx context.Context, query string, args ...interface{}) (string, error) {
+	db.startedWith = append(db.startedWith, db.tags)
+	return db.fakeAsyncDB.StartQuery(ctx, query, args...)
+}
+
+type taggingDriver struct {
+	fakeDriver
+	db *taggingDB
+}
+
+func (d *taggingDriver) GetAsyncDB() (awsds.AsyncDB, error) {
+	return d.db, nil
+}
+
+func (d *taggingDriver) SetResourceTags(tags map[string]string) error {
+	d.db.tags = tags
+	return nil
+}
+
+func TestGetAsyncDB_ResourceTags(t *testing.T) {
+	ctx := context.Background()
+	newClient := func(dr asyncDriver.Driver, jsonData string) AWSClient {
+		ds := New(rowLimitLoader{fakeAsyncLoader{asyncDriver: dr}})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(jsonData)})
+		return ds
+	}
+
+	t.Run("it passes the tags to the queries of the driver", func(t *testing.T) {
+		db := &taggingDB{fakeAsyncDB: fakeAsyncDB{queryID: "qid"}}
+		asyncDB, err := newClient(&taggingDriver{db: db}, `{"resourceTags":{"cost-center":"1234","team":"sales"}}`).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		_, err = asyncDB.StartQuery(ctx, "SELECT 1")
+		require.NoError(t, err)
+		assert.Equal(t, []map[string]string{{"cost-center": "1234", "team": "sales"}}, db.startedWith)
+	})
+
+	t.Run("it leaves the driver unchanged by default", func(t *testing.T) {
+		db := &taggingDB{fakeAsyncDB: fakeAsyncDB{queryID: "qid"}}
+		asyncDB, err := newClient(&taggingDriver{db: db}, `{}`).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		_, err = asyncDB.StartQuery(ctx, "SELECT 1")
+		require.NoError(t, err)
+		assert.Equal(t, []map[string]string{nil}, db.startedWith)
+	})
+
+	t.Run("it fails with drivers not supporting them", func(t *testing.T) {
+		_, err := newClient(&fakeAsyncDriver{db: &fakeAsyncDB{}}, `{"resourceTags":{"team":"sales"}}`).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.ErrorContains(t, err, "resource tags are set but the driver *datasource.fakeAsyncDriver doesn't support them")
+	})
+}
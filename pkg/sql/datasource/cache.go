@@ -0,0 +1,144 @@
+package datasource
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+)
+
+// Reasons passed to the OnEvict callback
+const (
+	// EvictionReasonTTL is used when an API is older than the configured TTL
+	EvictionReasonTTL = "ttl"
+	// EvictionReasonInvalidate is used when the APIs of a datasource are dropped with Invalidate
+	EvictionReasonInvalidate = "invalidate"
+	// EvictionReasonInitChange is used when Init is called with a different configuration
+	EvictionReasonInitChange = "init_change"
+	// EvictionReasonExpiredToken is used when a query run with RunWithDB or RunWithAsyncDB failed
+	// because the credentials expired
+	EvictionReasonExpiredToken = "expired_token"
+)
+
+// dbEntry is the value stored in the db cache
+type dbEntry struct {
+	db *sql.DB
+	id int64
+}
+
+// apiEntry is the value stored in the api cache
+type apiEntry struct {
+	api     api.AWSAPI
+	id      int64
+	options sqlds.Options
+	created time.Time
+}
+
+func (ds *awsClient) now() time.Time {
+	if ds.clock != nil {
+		return ds.clock()
+	}
+	return time.Now()
+}
+
+func (ds *awsClient) storeAPI(id int64, args sqlds.Options, dsAPI api.AWSAPI) {
+	key := ds.connectionKey(id, args)
+	options := make(sqlds.Options, len(args))
+	for k, v := range args {
+		options[k] = v
+	}
+	ds.api.Store(key, &apiEntry{api: dsAPI, id: id, options: options, created: ds.now()})
+}
+
+func (ds *awsClient) loadAPI(id int64, args sqlds.Options) (api.AWSAPI, bool) {
+	key := ds.connectionKey(id, args)
+	value, exists := ds.api.Load(key)
+	if !exists {
+		return nil, false
+	}
+	entry := value.(*apiEntry)
+	if ds.apiTTL > 0 && ds.now().Sub(entry.created) >= ds.apiTTL {
+		ds.evict(key, entry, EvictionReasonTTL)
+		return nil, false
+	}
+	return entry.api, true
+}
+
+// Invalidate drops the cached APIs and DBs of the datasource, for every connection option. The DBs
+// are closed once the queries still running on them are done.
+func (ds *awsClient) Invalidate(id int64) {
+	ds.evictID(id, EvictionReasonInvalidate)
+}
+
+func (ds *awsClient) evictID(id int64, reason string) {
+	ds.api.Range(func(key, value any) bool {
+		if entry := value.(*apiEntry); entry.id == id {
+			ds.evict(key.(string), entry, reason)
+		}
+		return true
+	})
+	ds.db.Range(func(key, value any) bool {
+		if entry := value.(*dbEntry); entry.id == id {
+			ds.evictDB(key.(string), entry)
+		}
+		return true
+	})
+}
+
+// evictDB removes the DB entry from the cache with its keep-alive and warnings, closing the DB once
+// idle if it was still stored, see closeWhenIdle
+func (ds *awsClient) evictDB(key string, entry *dbEntry) {
+	if !ds.db.CompareAndDelete(key, entry) {
+		return
+	}
+	ds.stopKeepAlive(key)
+	ds.warnings.Delete(key)
+	go closeWhenIdle(entry.db)
+}
+
+// idleCheckInterval is how often closeWhenIdle checks whether the connections of a DB are released
+var idleCheckInterval = time.Second
+
+// idleCloseTimeout is how long closeWhenIdle waits for the connections of a DB to be released, so a
+// leaked connection doesn't keep it open forever
+var idleCloseTimeout = 10 * time.Minute
+
+// closeWhenIdle closes db once none of its connections are in use, dropping them as they're released,
+// so callers still holding db can keep running queries on it while it drains. It's closed anyway
+// after idleCloseTimeout.
+func closeWhenIdle(db *sql.DB) {
+	db.SetMaxIdleConns(0)
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	deadline := time.After(idleCloseTimeout)
+	for db.Stats().InUse > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			backend.Logger.Warn("Closing a DB with connections still in use", "inUse", db.Stats().InUse)
+			_ = db.Close()
+			return
+		}
+	}
+	_ = db.Close()
+}
+
+// evict removes the entry from the cache, notifying the OnEvict callback if it was still stored
+func (ds *awsClient) evict(key string, entry *apiEntry, reason string) {
+	if ds.api.CompareAndDelete(key, entry) && ds.onEvict != nil {
+		ds.onEvict(entry.id, reason)
+	}
+}
+
+// RotateCredentials makes every AWS session fetch fresh credentials on next use, e.g. after an IAM
+// change. Configurations and cached APIs are kept.
+func (ds *awsClient) RotateCredentials() {
+	ds.sessionCache.Rotate()
+	ds.orgSessionCaches.Range(func(_, cache any) bool {
+		cache.(*awsds.SessionCache).Rotate()
+		return true
+	})
+}
@@ -0,0 +1,145 @@
+package datasource
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type eviction struct {
+	id     int64
+	reason string
+}
+
+func TestOnEvict(t *testing.T) {
+	ctx := context.Background()
+	args := sqlds.Options{"foo": "bar"}
+
+	t.Run("it fires on ttl expiration", func(t *testing.T) {
+		evictions := []eviction{}
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		ds := New(fakeLoader{}, WithAPITTL(time.Minute), OnEvict(func(id int64, reason string) {
+			evictions = append(evictions, eviction{id, reason})
+		})).(*awsClient)
+		ds.clock = func() time.Time { return now }
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		_, err := ds.GetAPI(ctx, 1, args)
+		require.NoError(t, err)
+		now = now.Add(30 * time.Second)
+		_, exists := ds.loadAPI(1, args)
+		assert.True(t, exists)
+		assert.Empty(t, evictions)
+
+		now = now.Add(30 * time.Second)
+		_, exists = ds.loadAPI(1, args)
+		assert.False(t, exists)
+		assert.Equal(t, []eviction{{1, EvictionReasonTTL}}, evictions)
+	})
+
+	t.Run("it fires on invalidate", func(t *testing.T) {
+		evictions := []eviction{}
+		ds := New(fakeLoader{}, OnEvict(func(id int64, reason string) {
+			evictions = append(evictions, eviction{id, reason})
+		})).(*awsClient)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 2})
+
+		_, err := ds.GetAPI(ctx, 1, args)
+		require.NoError(t, err)
+		_, err = ds.GetAPI(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+		_, err = ds.GetAPI(ctx, 2, args)
+		require.NoError(t, err)
+
+		ds.Invalidate(1)
+		assert.Equal(t, []eviction{{1, EvictionReasonInvalidate}, {1, EvictionReasonInvalidate}}, evictions)
+		_, exists := ds.loadAPI(1, args)
+		assert.False(t, exists)
+		_, exists = ds.loadAPI(2, args)
+		assert.True(t, exists)
+	})
+
+	t.Run("it fires when the configuration changes", func(t *testing.T) {
+		evictions := []eviction{}
+		ds := New(fakeLoader{}, OnEvict(func(id int64, reason string) {
+			evictions = append(evictions, eviction{id, reason})
+		})).(*awsClient)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+		_, err := ds.GetAPI(ctx, 1, args)
+		require.NoError(t, err)
+
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+		assert.Empty(t, evictions)
+
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"region":"us-east-2"}`)})
+		assert.Equal(t, []eviction{{1, EvictionReasonInitChange}}, evictions)
+	})
+}
+
+func TestRotateCredentials(t *testing.T) {
+	ds := New(sessionCacheLoader{})
+	ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+	getSession := func(options sqlds.Options) *session.Session {
+		dsAPI, err := ds.(*awsClient).buildAPI(context.Background(), options, &fakeSettings{})
+		require.NoError(t, err)
+		sess, err := dsAPI.(*sessionCacheAPI).cache.GetSessionWithAuthSettings(awsds.GetSessionConfig{
+			Settings: awsds.AWSDatasourceSettings{AuthType: awsds.AuthTypeKeys, AccessKey: "foo", SecretKey: "bar", Region: "us-east-1"},
+		}, awsds.AuthSettings{AllowedAuthProviders: []string{"keys"}})
+		require.NoError(t, err)
+		return sess
+	}
+
+	for _, options := range []sqlds.Options{{}, {models.OrgKey: "1"}} {
+		before := getSession(options)
+		require.Same(t, before, getSession(options))
+
+		cachedAPI, err := ds.GetAPI(context.Background(), 1, options)
+		require.NoError(t, err)
+
+		ds.RotateCredentials()
+
+		assert.NotSame(t, before, getSession(options))
+		stillCached, err := ds.GetAPI(context.Background(), 1, options)
+		require.NoError(t, err)
+		assert.Same(t, cachedAPI, stillCached)
+	}
+}
+
+func TestWithZeroIDGuard(t *testing.T) {
+	ctx := context.Background()
+	unsaved := []backend.DataSourceInstanceSettings{{UID: "athena-a"}, {UID: "athena-b"}}
+
+	t.Run("it rejects datasources without id", func(t *testing.T) {
+		ds := New(fakeLoader{}, WithZeroIDGuard()).(*awsClient)
+		for _, config := range unsaved {
+			ds.Init(config)
+			_, err := ds.GetAPI(ctx, config.ID, sqlds.Options{})
+			assert.ErrorIs(t, err, ErrZeroID)
+		}
+		_, err := ds.GetDBWithSettings(ctx, unsaved[0], sqlds.Options{})
+		assert.ErrorIs(t, err, ErrZeroID)
+
+		_, exists := ds.loadAPI(0, sqlds.Options{})
+		assert.False(t, exists)
+	})
+
+	t.Run("it shares the cache slot of id 0 by default", func(t *testing.T) {
+		ds := New(fakeLoader{}).(*awsClient)
+		ds.Init(unsaved[0])
+		_, err := ds.GetAPI(ctx, 0, sqlds.Options{})
+		require.NoError(t, err)
+
+		ds.Init(unsaved[1])
+		_, exists := ds.loadAPI(0, sqlds.Options{})
+		assert.False(t, exists, "the API of the first datasource is evicted by the second one")
+	})
+}
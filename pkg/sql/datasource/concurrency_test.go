@@ -0,0 +1,212 @@
+package datasource
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	sqlApi "github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetAPI_Concurrent(t *testing.T) {
+	loader := &countingLoader{}
+	ds := New(loader)
+	ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ds.GetAPI(context.Background(), 1, sqlds.Options{})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, loader.calls)
+}
+
+func TestGetDB_Concurrent(t *testing.T) {
+	ds, dr := newOpeningClient(WithDBCache())
+
+	var wg sync.WaitGroup
+	dbs := make(chan any, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+			assert.NoError(t, err)
+			dbs <- db
+		}()
+	}
+	wg.Wait()
+	close(dbs)
+
+	first := <-dbs
+	for db := range dbs {
+		assert.Same(t, first, db)
+	}
+	assert.Len(t, dr.connectors, 1)
+}
+
+// blockingLoader creates the APIs once release is closed, telling on started when a creation begins
+type blockingLoader struct {
+	fakeLoader
+	started chan struct{}
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (m *blockingLoader) LoadAPI(_ context.Context, _ *awsds.SessionCache, _ models.Settings) (sqlApi.AWSAPI, error) {
+	m.calls.Add(1)
+	m.started <- struct{}{}
+	<-m.release
+	return fakeAPI{}, nil
+}
+
+func TestGetAPI_CreationWait(t *testing.T) {
+	ctx := context.Background()
+	newClient := func(opts ...Option) (AWSClient, *blockingLoader) {
+		loader := &blockingLoader{started: make(chan struct{}, 1), release: make(chan struct{})}
+		ds := New(loader, opts...)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+		return ds, loader
+	}
+
+	t.Run("it blocks a second caller until the first one creates the API", func(t *testing.T) {
+		ds, loader := newClient(WithCreationWait(time.Minute))
+		first := make(chan error, 1)
+		go func() {
+			_, err := ds.GetAPI(ctx, 1, sqlds.Options{})
+			first <- err
+		}()
+		<-loader.started
+
+		second := make(chan error, 1)
+		go func() {
+			_, err := ds.GetAPI(ctx, 1, sqlds.Options{})
+			second <- err
+		}()
+		select {
+		case <-second:
+			t.Fatal("the second caller didn't wait for the API being created")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		close(loader.release)
+		require.NoError(t, <-first)
+		require.NoError(t, <-second)
+		assert.Equal(t, int32(1), loader.calls.Load())
+	})
+
+	t.Run("it stops waiting after the creation wait", func(t *testing.T) {
+		ds, loader := newClient(WithCreationWait(10 * time.Millisecond))
+		defer close(loader.release)
+		go func() {
+			_, _ = ds.GetAPI(ctx, 1, sqlds.Options{})
+		}()
+		<-loader.started
+
+		_, err := ds.GetAPI(ctx, 1, sqlds.Options{})
+		assert.ErrorIs(t, err, ErrCreationWaitTimeout)
+		assert.Equal(t, int32(1), loader.calls.Load())
+	})
+
+	t.Run("it keeps the error of the caller's context", func(t *testing.T) {
+		ds, loader := newClient(WithCreationWait(time.Minute))
+		defer close(loader.release)
+		go func() {
+			_, _ = ds.GetAPI(ctx, 1, sqlds.Options{})
+		}()
+		<-loader.started
+
+		callerCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err := ds.GetAPI(callerCtx, 1, sqlds.Options{})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.NotErrorIs(t, err, ErrCreationWaitTimeout)
+	})
+}
+
+func TestLock_ContextDone(t *testing.T) {
+	locks := keyLocks{}
+	unlock, err := locks.lock(context.Background(), "key")
+	require.NoError(t, err)
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = locks.lock(ctx, "key")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestLock_Release(t *testing.T) {
+	locks := keyLocks{}
+	unlock, err := locks.lock(context.Background(), "key")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = locks.lock(ctx, "key")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Len(t, locks.locks, 1)
+
+	unlock()
+	assert.Empty(t, locks.locks)
+}
+
+// TestClient_Stress is meant to run with the race detector
+func TestClient_Stress(t *testing.T) {
+	ds, _ := newOpeningClient(WithDBCache())
+	options := sqlds.Options{"foo": "bar"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{}`)})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				api, err := ds.GetAPI(context.Background(), 1, options)
+				assert.NoError(t, err)
+				assert.NotNil(t, api)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				db, err := ds.GetDB(context.Background(), 1, options)
+				assert.NoError(t, err)
+				assert.NotNil(t, db)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				ds.Invalidate(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	api, err := ds.GetAPI(context.Background(), 1, options)
+	require.NoError(t, err)
+	cached, err := ds.GetAPI(context.Background(), 1, options)
+	require.NoError(t, err)
+	assert.Equal(t, api, cached)
+}
@@ -0,0 +1,44 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// isConnectError returns true if err comes from resolving or dialing the database host, like a
+// transient DNS failure, rather than from the database itself
+func isConnectError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryConnect calls open again while it fails to resolve or dial the database host, up to the
+// connect retries of the client, waiting twice as long before each retry. It stops waiting once ctx
+// is done. Most drivers open their DBs lazily and only dial with the first query, so the retries
+// only help drivers dialing when they open them.
+func retryConnect[T any](ctx context.Context, ds *awsClient, open func() (T, error)) (T, error) {
+	backoff := ds.connectBackoff
+	for attempt := 0; ; attempt++ {
+		db, err := open()
+		if err == nil || attempt >= ds.connectRetries || !isConnectError(err) {
+			return db, err
+		}
+		backend.Logger.Debug("Retrying to connect to the database", "attempt", attempt+1, "backoff", backoff, "error", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return db, errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
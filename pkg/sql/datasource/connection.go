@@ -0,0 +1,159 @@
+package datasource
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/driver"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+)
+
+// ConnectionStage identifies a step of building a connection
+type ConnectionStage string
+
+const (
+	StageSettings ConnectionStage = "settings"
+	StageAPI      ConnectionStage = "api"
+	StageDriver   ConnectionStage = "driver"
+	StageDB       ConnectionStage = "db"
+	StagePing     ConnectionStage = "ping"
+)
+
+// ConnectionError is returned by GetDB and GetAsyncDB with the stage that failed. Use errors.As to retrieve it.
+type ConnectionError struct {
+	Stage ConnectionStage
+	// Retryable is true if the same call may succeed later, e.g. after throttling or a server error
+	Retryable bool
+	Err       error
+}
+
+// logConnectionFailure logs the failure of the DB of dr at stage, with the sanitized DSN of dr
+func logConnectionFailure(id int64, dr any, stage ConnectionStage, err error) {
+	backend.Logger.Debug("Connection failed", "id", id, "stage", stage, "driver", driver.NameOf(dr), "dsn", driver.SanitizedDSNOf(dr), "error", err)
+}
+
+// newConnectionError wraps err with the stage it happened at, classified with the retry classifier of the client
+func (ds *awsClient) newConnectionError(stage ConnectionStage, err error) *ConnectionError {
+	isRetryable := awsds.IsRetryableError
+	if ds.retryClassifier != nil {
+		isRetryable = ds.retryClassifier
+	}
+	return &ConnectionError{Stage: stage, Retryable: isRetryable(err), Err: err}
+}
+
+func (e *ConnectionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// Code returns the AWS error code of the cause, empty if it isn't an AWS error
+func (e *ConnectionError) Code() string {
+	var awsErr awserr.Error
+	if errors.As(e.Err, &awsErr) {
+		return awsErr.Code()
+	}
+	return ""
+}
+
+// TestConnectionResult reports how far TestConnection got
+type TestConnectionResult struct {
+	// Stage is the failing stage, or StagePing if the connection works
+	Stage ConnectionStage
+	Err   error
+	// Warnings are the non-fatal advisories about the settings, see models.Warner
+	Warnings []string
+}
+
+// OK returns true if every stage succeeded
+func (r TestConnectionResult) OK() bool {
+	return r.Err == nil
+}
+
+// TestConnection builds the settings, API, driver and DB of the datasource the same way GetDB does
+// and pings the resulting DB, or runs the validation query of the settings if they set one.
+// Nothing is cached, so a broken connection is never reused.
+func (ds *awsClient) TestConnection(ctx context.Context, id int64, options sqlds.Options) TestConnectionResult {
+	options = ds.normalizeOptions(options)
+	settings := ds.loader.LoadSettings(ctx)
+	if err := ds.parseSettings(id, options, settings); err != nil {
+		return TestConnectionResult{Stage: StageSettings, Err: err}
+	}
+
+	warnings := settingsWarnings(settings)
+
+	dsAPI, err := ds.buildAPI(ctx, options, settings)
+	if err != nil {
+		return TestConnectionResult{Stage: StageAPI, Err: err, Warnings: warnings}
+	}
+
+	dr, err := ds.createDriver(ctx, dsAPI, settings)
+	if err != nil {
+		return TestConnectionResult{Stage: StageDriver, Err: err, Warnings: warnings}
+	}
+
+	db, err := ds.createDB(ctx, dr)
+	if err != nil {
+		logConnectionFailure(id, dr, StageDB, err)
+		return TestConnectionResult{Stage: StageDB, Err: err, Warnings: warnings}
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	if err := validateDB(ctx, db, settings); err != nil {
+		logConnectionFailure(id, dr, StagePing, err)
+		return TestConnectionResult{Stage: StagePing, Err: err, Warnings: warnings}
+	}
+	return TestConnectionResult{Stage: StagePing, Warnings: warnings}
+}
+
+// validateDB runs the validation query of the settings against db, or pings it if there is none
+func validateDB(ctx context.Context, db *sql.DB, settings models.Settings) error {
+	v, ok := settings.(models.ValidationQuerier)
+	if !ok || v.GetValidationQuery() == "" {
+		return db.PingContext(ctx)
+	}
+	rows, err := db.QueryContext(ctx, v.GetValidationQuery())
+	if err != nil {
+		return fmt.Errorf("validation query failed: %w", err)
+	}
+	defer rows.Close()
+	return rows.Err()
+}
+
+// ValidateConfig builds the settings, API and driver of the datasource and lets the driver check
+// its configuration without opening a DB. Drivers not implementing driver.ConfigValidator are
+// considered valid once created.
+func (ds *awsClient) ValidateConfig(ctx context.Context, id int64, options sqlds.Options) error {
+	options = ds.normalizeOptions(options)
+	settings := ds.loader.LoadSettings(ctx)
+	if err := ds.parseSettings(id, options, settings); err != nil {
+		return ds.newConnectionError(StageSettings, err)
+	}
+
+	dsAPI, err := ds.buildAPI(ctx, options, settings)
+	if err != nil {
+		return ds.newConnectionError(StageAPI, err)
+	}
+
+	dr, err := ds.createDriver(ctx, dsAPI, settings)
+	if err != nil {
+		return ds.newConnectionError(StageDriver, err)
+	}
+
+	if v, ok := dr.(driver.ConfigValidator); ok {
+		if err := v.ValidateConfig(); err != nil {
+			return ds.newConnectionError(StageDriver, fmt.Errorf("invalid driver configuration: %w", err))
+		}
+	}
+	return nil
+}
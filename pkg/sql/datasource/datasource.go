@@ -2,9 +2,14 @@ package datasource
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
+	"errors"
 	"fmt"
+	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
 	"github.com/grafana/grafana-aws-sdk/pkg/sql/api"
@@ -19,8 +24,35 @@ import (
 type AWSClient interface {
 	Init(config backend.DataSourceInstanceSettings)
 	GetDB(ctx context.Context, id int64, options sqlds.Options) (*sql.DB, error)
+	GetDBWithWarnings(ctx context.Context, id int64, options sqlds.Options) (*sql.DB, []string, error)
+	Conn(ctx context.Context, id int64, options sqlds.Options) (*sql.Conn, error)
+	GetDBWithSettings(ctx context.Context, config backend.DataSourceInstanceSettings, options sqlds.Options) (*sql.DB, error)
+	ResetDB(id int64, options sqlds.Options) error
 	GetAsyncDB(ctx context.Context, id int64, options sqlds.Options) (awsds.AsyncDB, error)
 	GetAPI(ctx context.Context, id int64, options sqlds.Options) (api.AWSAPI, error)
+	Invalidate(id int64)
+	RotateCredentials()
+	TestConnection(ctx context.Context, id int64, options sqlds.Options) TestConnectionResult
+	ValidateConfig(ctx context.Context, id int64, options sqlds.Options) error
+	InitAll(ctx context.Context, configs []backend.DataSourceInstanceSettings) error
+	WarmRegions(ctx context.Context, id int64, options sqlds.Options, regions []string) error
+	RecordQuery(id int64, options sqlds.Options, err error)
+	Stats() map[string]ConnectionStats
+	ResetStats()
+	PreflightPermissions(ctx context.Context, id int64, options sqlds.Options, actions []string) (PermissionsReport, error)
+	PreflightOutputLocation(ctx context.Context, id int64, options sqlds.Options, location string) error
+	PreflightTrust(ctx context.Context, id int64, options sqlds.Options, roleARN string) (TrustReport, error)
+	CredentialsProviderName(ctx context.Context, id int64, options sqlds.Options) (string, error)
+	SanitizedConfig(id int64) ([]byte, error)
+	RunWithDB(ctx context.Context, id int64, options sqlds.Options, fn func(*sql.DB) error) error
+	RunWithAsyncDB(ctx context.Context, id int64, options sqlds.Options, fn func(awsds.AsyncDB) error) error
+	ListRunningQueries(id int64) []RunningQuery
+	CancelAllQueries(ctx context.Context, id int64) error
+	RegisterDefaultOptions(defaults sqlds.Options)
+	ExportState() ([]byte, error)
+	ImportState(data []byte) error
+	ExplainQuery(ctx context.Context, id int64, options sqlds.Options, query string) (api.QueryEstimate, error)
+	ConnectionKey(id int64, options sqlds.Options) string
 }
 
 type Loader interface {
@@ -33,127 +65,603 @@ type Loader interface {
 // awsClient provides creation and caching of several types of instances.
 // Each Map will depend on the datasource ID (and connection options):
 //   - sessionCache: AWS cache. This is not a Map since it does not depend on the datasource.
+//   - orgSessionCaches: AWS cache of each org, for connection options carrying models.OrgKey. The
+//     other Maps keyed by datasource ID only aren't scoped by org, see models.OrgKey.
 //   - config: Base configuration. It will be used as base to populate datasource settings.
 //     It does not depend on connection options (only one per datasource)
 //   - api: API instance with the common methods to contact the data source API.
+//   - db: *sql.DB instances, only populated when the client is created WithDBCache.
+//   - keepAlives: Keep-alive of the cached DBs, when the client is created WithKeepAlive.
+//   - warnings: Warnings of the settings of the cached DBs, see models.Warner.
+//   - generations: Counter bumped on every Init, used to detect configuration changes during creation.
+//
+// defaults are read from the environment once, when the client is created.
 type awsClient struct {
-	sessionCache *awsds.SessionCache
-	config       sync.Map
-	api          sync.Map
+	sessionCache     *awsds.SessionCache
+	orgSessionCaches sync.Map
+	config           sync.Map
+	api              sync.Map
+	db               sync.Map
+	generations      sync.Map
+	defaultOptions   atomic.Pointer[sqlds.Options]
+	keepAlives       sync.Map
+	warnings         sync.Map
+	stats            sync.Map
+	running          sync.Map
+	apiLocks         keyLocks
+	pendingMu        sync.Mutex
+	pendingWarm      map[int64][]warmTarget
+	dbLocks          keyLocks
 
-	loader Loader
+	loader   Loader
+	defaults models.Defaults
+
+	rowTransform    RowTransform
+	queryListener   QueryListener
+	warmConcurrency int
+	regionAliases   []string
+	regionResolver  RegionResolver
+	perQueryKeys    []string
+	cacheDB         bool
+	emptyResults    bool
+	normalizer      func(sqlds.Options) sqlds.Options
+	optionsMarshal  OptionsMarshaler
+	migrations      map[int]SettingsMigration
+	skipEmptyArgs   bool
+	zeroIDGuard     bool
+	strictAuth      bool
+	writeCheck      bool
+	trackQueries    bool
+	apiTTL          time.Duration
+	acquireTimeout  time.Duration
+	creationWait    time.Duration
+	hitValidation   time.Duration
+	connectRetries  int
+	connectBackoff  time.Duration
+	maxOptionsSize  int
+	minTLSVersion   uint16
+	// keepAliveEvery is the interval cached DBs are pinged at, 0 to never ping them
+	keepAliveEvery  time.Duration
+	onEvict         func(id int64, reason string)
+	metrics         *metrics
+	metricsConfig   *metricsConfig
+	environment     string
+	isolateEnv      bool
+	errorMapper     func(error) error
+	retryClassifier func(error) bool
+
+	sessionCacheOptions []awsds.SessionCacheOption
+
+	// clock returns the current time, stubbable by tests
+	clock func() time.Time
+	// ticker returns the ticks of a ticker and the function stopping it, stubbable by tests
+	ticker func(interval time.Duration) (<-chan time.Time, func())
 }
 
-func New(loader Loader) AWSClient {
-	ds := &awsClient{sessionCache: awsds.NewSessionCache(), loader: loader}
+func New(loader Loader, opts ...Option) AWSClient {
+	ds := &awsClient{
+		loader:        loader,
+		defaults:      models.ReadDefaultsFromEnvironmentVariables(),
+		regionAliases: defaultRegionAliases,
+	}
+	for _, opt := range opts {
+		opt(ds)
+	}
+	ds.sessionCache = awsds.NewSessionCache(ds.sessionCacheOptions...)
+	if ds.metricsConfig != nil {
+		ds.metrics = newMetrics(*ds.metricsConfig, ds.environment)
+	}
 	return ds
 }
 
 func (ds *awsClient) storeConfig(config backend.DataSourceInstanceSettings) {
-	ds.config.Store(config.ID, config)
+	previous, loaded := ds.config.Swap(config.ID, config)
+	ds.generationCounter(config.ID).Add(1)
+	if loaded && !reflect.DeepEqual(previous, config) {
+		// APIs and DBs built from the previous configuration are stale
+		ds.evictID(config.ID, EvictionReasonInitChange)
+	}
 }
 
-func (ds *awsClient) createDB(dr driver.Driver) (*sql.DB, error) {
-	db, err := dr.OpenDB()
+func (ds *awsClient) generationCounter(id int64) *atomic.Int64 {
+	counter, _ := ds.generations.LoadOrStore(id, &atomic.Int64{})
+	return counter.(*atomic.Int64)
+}
+
+func (ds *awsClient) generation(id int64) int64 {
+	return ds.generationCounter(id).Load()
+}
+
+func (ds *awsClient) createDB(ctx context.Context, dr driver.Driver) (*sql.DB, error) {
+	db, err := retryConnect(ctx, ds, dr.OpenDB)
 	if err != nil {
-		return nil, fmt.Errorf("%w: failed to connect to database (check hostname and port?)", err)
+		return nil, ds.mapError(fmt.Errorf("%w: failed to connect to database (check hostname and port?)", err))
 	}
 
 	return db, nil
 }
 
-func (ds *awsClient) createAsyncDB(dr asyncDriver.Driver) (awsds.AsyncDB, error) {
-	db, err := dr.GetAsyncDB()
+func (ds *awsClient) storeDB(id int64, args sqlds.Options, db *sql.DB) {
+	key := ds.connectionKey(id, args)
+	ds.db.Store(key, &dbEntry{db: db, id: id})
+	ds.startKeepAlive(key, db)
+}
+
+func (ds *awsClient) loadDB(id int64, args sqlds.Options) (*sql.DB, bool) {
+	entry, exists := ds.db.Load(ds.connectionKey(id, args))
+	if exists {
+		return entry.(*dbEntry).db, true
+	}
+	return nil, false
+}
+
+// loadHealthyDB returns the cached DB of the given id and options, pinging it first if the client
+// validates the DBs on hit. A DB failing the ping is removed from the cache with its warnings and
+// closed once the callers still holding it are done with its connections.
+func (ds *awsClient) loadHealthyDB(ctx context.Context, id int64, args sqlds.Options) (*sql.DB, bool) {
+	db, exists := ds.loadDB(id, args)
+	if !exists || ds.hitValidation <= 0 {
+		return db, exists
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, ds.hitValidation)
+	err := db.PingContext(pingCtx)
+	cancel()
+	if err == nil || ctx.Err() != nil {
+		return db, true
+	}
+	key := ds.connectionKey(id, args)
+	backend.Logger.Warn("Cached DB failed validation, opening a new one", "key", key, "error", err)
+	if entry, ok := ds.db.Load(key); ok && entry.(*dbEntry).db == db && ds.db.CompareAndDelete(key, entry) {
+		ds.stopKeepAlive(key)
+		ds.warnings.Delete(key)
+		go closeWhenIdle(db)
+	}
+	return nil, false
+}
+
+func (ds *awsClient) createAsyncDB(ctx context.Context, dr asyncDriver.Driver) (awsds.AsyncDB, error) {
+	db, err := retryConnect(ctx, ds, dr.GetAsyncDB)
 	if err != nil {
-		return nil, fmt.Errorf("%w: failed to connect to database (check hostname and port)", err)
+		return nil, ds.mapError(fmt.Errorf("%w: failed to connect to database (check hostname and port)", err))
 	}
 
 	return db, nil
 }
 
-func (ds *awsClient) storeAPI(id int64, args sqlds.Options, dsAPI api.AWSAPI) {
-	key := connectionKey(id, args)
-	ds.api.Store(key, dsAPI)
+// sessionCacheFor returns the session cache of the org in args, so orgs never share AWS sessions
+func (ds *awsClient) sessionCacheFor(args sqlds.Options) *awsds.SessionCache {
+	org, ok := args[models.OrgKey]
+	if !ok {
+		return ds.sessionCache
+	}
+	cache, _ := ds.orgSessionCaches.LoadOrStore(org, awsds.NewSessionCache(ds.sessionCacheOptions...))
+	return cache.(*awsds.SessionCache)
 }
 
-func (ds *awsClient) loadAPI(id int64, args sqlds.Options) (api.AWSAPI, bool) {
-	key := connectionKey(id, args)
-	dsAPI, exists := ds.api.Load(key)
-	if exists {
-		return dsAPI.(api.AWSAPI), true
+// buildAPI creates an API with the loader, without caching it
+func (ds *awsClient) buildAPI(ctx context.Context, args sqlds.Options, settings models.Settings) (api.AWSAPI, error) {
+	dsAPI, err := ds.loader.LoadAPI(ctx, ds.sessionCacheFor(args), settings)
+	if err != nil {
+		return nil, ds.mapError(fmt.Errorf("%w: Failed to create client", wrapClockSkewError(wrapRegionNotEnabledError(wrapAWSError(err), settings))))
 	}
-	return nil, false
+	return dsAPI, nil
 }
 
-func (ds *awsClient) createAPI(ctx context.Context, id int64, args sqlds.Options, settings models.Settings) (api.AWSAPI, error) {
-	dsAPI, err := ds.loader.LoadAPI(ctx, ds.sessionCache, settings)
+// createAPI builds the API for settings and caches it unless the datasource was initialized again
+// since generation, which callers read before loading the settings.
+func (ds *awsClient) createAPI(ctx context.Context, id, generation int64, args sqlds.Options, settings models.Settings) (api.AWSAPI, error) {
+	dsAPI, err := ds.buildAPI(ctx, args, settings)
 	if err != nil {
-		return nil, fmt.Errorf("%w: Failed to create client", err)
+		return nil, err
+	}
+	if ds.generation(id) != generation {
+		// The datasource was initialized again while the API was being created,
+		// so the instance was built from a stale configuration and shouldn't be cached
+		backend.Logger.Debug("Discarding API created from a stale configuration", "id", id)
+		return dsAPI, nil
 	}
 	ds.storeAPI(id, args, dsAPI)
-	return dsAPI, err
+	return dsAPI, nil
 }
 
-func (ds *awsClient) createDriver(ctx context.Context, dsAPI api.AWSAPI) (driver.Driver, error) {
-	dr, err := ds.loader.LoadDriver(ctx, dsAPI)
+func (ds *awsClient) createDriver(ctx context.Context, dsAPI api.AWSAPI, settings models.Settings) (driver.Driver, error) {
+	ctx, err := withDSN(ctx, settings)
 	if err != nil {
-		return nil, fmt.Errorf("%w: Failed to create client", err)
+		return nil, ds.mapError(err)
+	}
+	dr, err := ds.loader.LoadDriver(models.WithSettings(ctx, settings), dsAPI)
+	if err != nil {
+		return nil, ds.mapError(fmt.Errorf("%w: Failed to create client", err))
 	}
 
+	if err := enableCompression(dr, settings); err != nil {
+		return nil, ds.mapError(err)
+	}
+	if err := setExpectedBucketOwner(dr, settings); err != nil {
+		return nil, ds.mapError(err)
+	}
+	if err := setResourceTags(dr, settings); err != nil {
+		return nil, ds.mapError(err)
+	}
+	if err := setTimeouts(dr, settings); err != nil {
+		return nil, ds.mapError(err)
+	}
+	if err := setTLSConfig(dr, ds.minTLSVersion, settings); err != nil {
+		return nil, ds.mapError(err)
+	}
 	return dr, nil
 }
 
-func (ds *awsClient) createAsyncDriver(ctx context.Context, dsAPI api.AWSAPI) (asyncDriver.Driver, error) {
-	dr, err := ds.loader.LoadAsyncDriver(ctx, dsAPI)
+func (ds *awsClient) createAsyncDriver(ctx context.Context, dsAPI api.AWSAPI, settings models.Settings) (asyncDriver.Driver, error) {
+	ctx, err := withDSN(ctx, settings)
 	if err != nil {
-		return nil, fmt.Errorf("%w: Failed to create client", err)
+		return nil, ds.mapError(err)
+	}
+	dr, err := ds.loader.LoadAsyncDriver(models.WithSettings(ctx, settings), dsAPI)
+	if err != nil {
+		return nil, ds.mapError(fmt.Errorf("%w: Failed to create client", err))
 	}
 
+	if err := enableCompression(dr, settings); err != nil {
+		return nil, ds.mapError(err)
+	}
+	if err := setExpectedBucketOwner(dr, settings); err != nil {
+		return nil, ds.mapError(err)
+	}
+	if err := setResourceTags(dr, settings); err != nil {
+		return nil, ds.mapError(err)
+	}
+	if err := setTimeouts(dr, settings); err != nil {
+		return nil, ds.mapError(err)
+	}
+	if err := setTLSConfig(dr, ds.minTLSVersion, settings); err != nil {
+		return nil, ds.mapError(err)
+	}
 	return dr, nil
 }
 
+// withDSN adds the connection string rendered from the template of the settings to ctx, if they have one
+func withDSN(ctx context.Context, settings models.Settings) (context.Context, error) {
+	t, ok := settings.(models.DSNTemplater)
+	if !ok || t.DSNTemplate() == "" {
+		return ctx, nil
+	}
+	dsn, err := models.RenderDSN(t.DSNTemplate(), t.DSNValues())
+	if err != nil {
+		return nil, err
+	}
+	return models.WithDSN(ctx, dsn), nil
+}
+
+// enableCompression turns on the compression of dr if the settings ask for it
+func enableCompression(dr any, settings models.Settings) error {
+	c, ok := settings.(models.CompressionSettings)
+	if !ok || !c.UseCompression() {
+		return nil
+	}
+	compressor, ok := dr.(driver.Compressor)
+	if !ok {
+		return fmt.Errorf("compression is enabled but the driver %T doesn't support it", dr)
+	}
+	if err := compressor.EnableCompression(); err != nil {
+		return fmt.Errorf("could not enable compression: %w", err)
+	}
+	return nil
+}
+
+// setExpectedBucketOwner passes the account expected to own the S3 result buckets to dr, if the settings set one
+func setExpectedBucketOwner(dr any, settings models.Settings) error {
+	b, ok := settings.(models.BucketOwnerSettings)
+	if !ok || b.GetExpectedBucketOwner() == "" {
+		return nil
+	}
+	checker, ok := dr.(driver.BucketOwnerChecker)
+	if !ok {
+		return fmt.Errorf("an expected bucket owner is set but the driver %T doesn't support it", dr)
+	}
+	if err := checker.SetExpectedBucketOwner(b.GetExpectedBucketOwner()); err != nil {
+		return fmt.Errorf("could not set the expected bucket owner: %w", err)
+	}
+	return nil
+}
+
+// setTLSConfig passes to dr the minimum TLS version of the client and the certificate verification
+// of the settings, if they change the defaults
+func setTLSConfig(dr any, minVersion uint16, settings models.Settings) error {
+	skipVerify := false
+	if t, ok := settings.(models.TLSSettings); ok {
+		skipVerify = t.GetTLSSkipVerify()
+	}
+	if minVersion == 0 && !skipVerify {
+		return nil
+	}
+	configurer, ok := dr.(driver.TLSConfigurer)
+	if !ok {
+		return fmt.Errorf("TLS settings are set but the driver %T doesn't support them", dr)
+	}
+	config := &tls.Config{MinVersion: minVersion, InsecureSkipVerify: skipVerify}
+	if err := configurer.SetTLSConfig(config); err != nil {
+		return fmt.Errorf("could not set the TLS config: %w", err)
+	}
+	return nil
+}
+
+// setResourceTags passes the tags of the resources the queries create to dr, if the settings set some
+func setResourceTags(dr any, settings models.Settings) error {
+	t, ok := settings.(models.ResourceTagSettings)
+	if !ok || len(t.GetResourceTags()) == 0 {
+		return nil
+	}
+	tagger, ok := dr.(driver.ResourceTagger)
+	if !ok {
+		return fmt.Errorf("resource tags are set but the driver %T doesn't support them", dr)
+	}
+	if err := tagger.SetResourceTags(t.GetResourceTags()); err != nil {
+		return fmt.Errorf("could not set the resource tags: %w", err)
+	}
+	return nil
+}
+
+// setTimeouts passes the connect and query timeouts of the settings to dr, if they set them
+func setTimeouts(dr any, settings models.Settings) error {
+	t, ok := settings.(models.TimeoutSettings)
+	if !ok {
+		return nil
+	}
+	if timeout := t.GetConnectTimeout(); timeout > 0 {
+		setter, ok := dr.(driver.ConnectTimeouter)
+		if !ok {
+			return fmt.Errorf("a connect timeout is set but the driver %T doesn't support it", dr)
+		}
+		if err := setter.SetConnectTimeout(timeout); err != nil {
+			return fmt.Errorf("could not set the connect timeout: %w", err)
+		}
+	}
+	if timeout := t.GetQueryTimeout(); timeout > 0 {
+		setter, ok := dr.(driver.QueryTimeouter)
+		if !ok {
+			return fmt.Errorf("a query timeout is set but the driver %T doesn't support it", dr)
+		}
+		if err := setter.SetQueryTimeout(timeout); err != nil {
+			return fmt.Errorf("could not set the query timeout: %w", err)
+		}
+	}
+	return nil
+}
+
 func (ds *awsClient) parseSettings(id int64, args sqlds.Options, settings models.Settings) error {
+	if id == 0 && ds.zeroIDGuard {
+		return ErrZeroID
+	}
+	if settings == nil {
+		return fmt.Errorf("%w: no settings were loaded", ErrLoaderNotSet)
+	}
+	args = ds.withDefaultOptions(args)
+	if err := ds.checkOptionsSize(args); err != nil {
+		return err
+	}
 	config, ok := ds.config.Load(id)
 	if !ok {
 		return fmt.Errorf("unable to find stored configuration for datasource %d. Initialize it first", id)
 	}
-	err := settings.Load(config.(backend.DataSourceInstanceSettings))
+	instanceSettings, err := ds.migrateSettings(config.(backend.DataSourceInstanceSettings))
+	if err != nil {
+		return err
+	}
+	err = settings.Load(instanceSettings)
 	if err != nil {
 		return fmt.Errorf("error reading settings: %s", err.Error())
 	}
+	// Fleet-wide defaults go beneath the per-datasource options
+	if d, ok := settings.(models.DefaultsApplier); ok {
+		d.ApplyDefaults(ds.defaults)
+	}
+	if d, ok := settings.(models.AuthTypeDefaulter); ok && ds.defaults.AuthType != "" && !hasAuthType(instanceSettings) {
+		d.ApplyDefaultAuthType(ds.defaults.AuthType)
+	}
+	args = normalizeRegion(args, ds.regionAliases)
+	if ds.skipEmptyArgs {
+		args = dropEmptyOptions(args)
+	}
 	settings.Apply(args)
+	if name := args[models.AuthKey]; name != "" {
+		selector, ok := settings.(models.AuthSelector)
+		if !ok {
+			return fmt.Errorf("auth config %q requested but the settings don't support named auth configs", name)
+		}
+		if err := selector.SelectAuth(name); err != nil {
+			return fmt.Errorf("invalid settings: %w", err)
+		}
+	}
+	if n, ok := settings.(models.RoleSessionNamer); ok {
+		n.ApplyRoleSessionName(args[models.UserKey])
+	}
+	if err := ds.resolveRegion(settings); err != nil {
+		return err
+	}
+	if v, ok := settings.(models.Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("invalid settings: %w", err)
+		}
+	}
+	if v, ok := settings.(models.AuthValidator); ok && ds.strictAuth {
+		if err := v.ValidateAuth(); err != nil {
+			return fmt.Errorf("invalid settings: %w", err)
+		}
+	}
 	return nil
 }
 
-// Init stores the data source configuration. It's needed for the GetDB and GetAPI functions
+// Init stores the data source configuration. It's needed for the GetDB and GetAPI functions.
+// The configuration is stored per id, for every org, see models.OrgKey.
 func (ds *awsClient) Init(config backend.DataSourceInstanceSettings) {
 	ds.storeConfig(config)
+	ds.warmPending(config.ID)
 }
 
 // GetDB returns a *sql.DB. It will use the loader functions to initialize the required
-// settings, API and driver and finally create a DB.
+// settings, API and driver and finally create a DB. When the client is created WithDBCache,
+// subsequent calls with the same id and options return the cached DB.
 func (ds *awsClient) GetDB(
 	ctx context.Context,
 	id int64,
 	options sqlds.Options,
 ) (*sql.DB, error) {
+	db, _, err := ds.GetDBWithWarnings(ctx, id, options)
+	return db, err
+}
+
+// GetDBWithWarnings is GetDB also returning the warnings of the settings, like insecure TLS, that
+// don't prevent the connection but that the plugin may want to surface. See models.Warner.
+func (ds *awsClient) GetDBWithWarnings(
+	ctx context.Context,
+	id int64,
+	options sqlds.Options,
+) (*sql.DB, []string, error) {
+	options = ds.normalizeOptions(options)
+	if ds.cacheDB {
+		if cachedDB, exists := ds.loadHealthyDB(ctx, id, options); exists {
+			return cachedDB, ds.loadWarnings(id, options), nil
+		}
+
+		unlock, err := ds.waitLock(ctx, &ds.dbLocks, ds.connectionKey(id, options))
+		if err != nil {
+			return nil, nil, err
+		}
+		defer unlock()
+		// Another caller may have opened it while waiting for the lock
+		if cachedDB, exists := ds.loadDB(id, options); exists {
+			return cachedDB, ds.loadWarnings(id, options), nil
+		}
+	}
+
+	for {
+		generation := ds.generation(id)
+		db, settings, err := ds.openDB(ctx, id, generation, options)
+		if err != nil {
+			return nil, nil, err
+		}
+		warnings := settingsWarnings(settings)
+		if !ds.cacheDB {
+			return db, warnings, nil
+		}
+		if ds.generation(id) != generation {
+			// The datasource was initialized again while the DB was being opened, so it was opened
+			// from a stale configuration and is opened again from the new one
+			backend.Logger.Debug("Discarding DB opened from a stale configuration", "id", id)
+			_ = db.Close()
+			continue
+		}
+		ds.warnings.Store(ds.connectionKey(id, options), warnings)
+		ds.storeDB(id, options, db)
+		return db, warnings, nil
+	}
+}
+
+// openDB opens a DB from the settings of the datasource, also returning the settings
+func (ds *awsClient) openDB(ctx context.Context, id, generation int64, options sqlds.Options) (*sql.DB, models.Settings, error) {
 	settings := ds.loader.LoadSettings(ctx)
 	err := ds.parseSettings(id, options, settings)
 	if err != nil {
-		return nil, err
+		return nil, nil, ds.newConnectionError(StageSettings, err)
 	}
 
-	dsAPI, err := ds.createAPI(ctx, id, options, settings)
+	dsAPI, err := ds.createAPI(ctx, id, generation, options, settings)
 	if err != nil {
-		return nil, err
+		return nil, nil, ds.newConnectionError(StageAPI, err)
 	}
 
-	dr, err := ds.createDriver(ctx, dsAPI)
+	start := time.Now()
+	dr, err := ds.createDriver(ctx, dsAPI, settings)
+	ds.metrics.observeDriver(id, dr, time.Since(start))
+	if err != nil {
+		return nil, nil, ds.newConnectionError(StageDriver, err)
+	}
+	ds.recordDriver(id, options, dr)
+
+	start = time.Now()
+	db, err := ds.createDB(ctx, dr)
+	ds.metrics.observeDB(id, dr, time.Since(start))
+	if err != nil {
+		logConnectionFailure(id, dr, StageDB, err)
+		return nil, nil, ds.newConnectionError(StageDB, err)
+	}
+	return db, settings, nil
+}
+
+// Conn returns a connection of the pool of the DB returned by GetDB, to run queries on. The wait for
+// a free connection of a full pool is bounded by the acquire timeout of the client, see
+// WithAcquireTimeout. It requires a client created WithDBCache, as closing the connection returns it
+// to the cached pool and nothing would close an uncached DB.
+func (ds *awsClient) Conn(ctx context.Context, id int64, options sqlds.Options) (*sql.Conn, error) {
+	if !ds.cacheDB {
+		return nil, errors.New("Conn requires a client created WithDBCache")
+	}
+	db, err := ds.GetDB(ctx, id, options)
 	if err != nil {
 		return nil, err
 	}
+	if ds.acquireTimeout <= 0 || !poolFull(db) {
+		// a connection is free or can be opened, the time to dial isn't a wait for the pool
+		return db.Conn(ctx)
+	}
+	acquireCtx, cancel := context.WithTimeout(ctx, ds.acquireTimeout)
+	defer cancel()
+	conn, err := db.Conn(acquireCtx)
+	if err != nil && errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, fmt.Errorf("%w (waited %s)", ErrPoolExhausted, ds.acquireTimeout)
+	}
+	return conn, err
+}
+
+// poolFull returns true if every connection db can open is in use, so getting one waits for a release
+func poolFull(db *sql.DB) bool {
+	stats := db.Stats()
+	return stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections
+}
+
+// settingsWarnings returns the warnings of settings implementing models.Warner
+func settingsWarnings(settings models.Settings) []string {
+	if w, ok := settings.(models.Warner); ok {
+		return w.Warnings()
+	}
+	return nil
+}
+
+// loadWarnings returns the warnings stored with the cached DB of the given id and options
+func (ds *awsClient) loadWarnings(id int64, options sqlds.Options) []string {
+	warnings, _ := ds.warnings.Load(ds.connectionKey(id, options))
+	w, _ := warnings.([]string)
+	return w
+}
+
+// GetDBWithSettings is GetDB for plugins that don't call Init beforehand: config is stored, and the
+// imported connections of the datasource warmed, as Init would do, unless it's already the stored
+// configuration of the datasource.
+func (ds *awsClient) GetDBWithSettings(
+	ctx context.Context,
+	config backend.DataSourceInstanceSettings,
+	options sqlds.Options,
+) (*sql.DB, error) {
+	if stored, ok := ds.config.Load(config.ID); !ok || !reflect.DeepEqual(stored, config) {
+		ds.storeConfig(config)
+		ds.warmPending(config.ID)
+	}
+	return ds.GetDB(ctx, config.ID, options)
+}
 
-	return ds.createDB(dr)
+// ResetDB closes the cached *sql.DB of the given id and options and removes it from the cache,
+// so the next GetDB opens a fresh one. It's a no-op if there is no cached DB.
+func (ds *awsClient) ResetDB(id int64, options sqlds.Options) error {
+	options = ds.normalizeOptions(options)
+	key := ds.connectionKey(id, options)
+	ds.stopKeepAlive(key)
+	ds.warnings.Delete(key)
+	entry, exists := ds.db.LoadAndDelete(key)
+	if !exists {
+		return nil
+	}
+	return entry.(*dbEntry).db.Close()
 }
 
 // GetAsyncDB returns a sqlds.AsyncDB. It will use the loader functions to initialize the required
@@ -163,23 +671,35 @@ func (ds *awsClient) GetAsyncDB(
 	id int64,
 	options sqlds.Options,
 ) (awsds.AsyncDB, error) {
+	options = ds.normalizeOptions(options)
+	generation := ds.generation(id)
 	settings := ds.loader.LoadSettings(ctx)
 	err := ds.parseSettings(id, options, settings)
 	if err != nil {
-		return nil, err
+		return nil, ds.newConnectionError(StageSettings, err)
 	}
 
-	dsAPI, err := ds.createAPI(ctx, id, options, settings)
+	dsAPI, err := ds.createAPI(ctx, id, generation, options, settings)
 	if err != nil {
-		return nil, err
+		return nil, ds.newConnectionError(StageAPI, err)
 	}
 
-	dr, err := ds.createAsyncDriver(ctx, dsAPI)
+	start := time.Now()
+	dr, err := ds.createAsyncDriver(ctx, dsAPI, settings)
+	ds.metrics.observeDriver(id, dr, time.Since(start))
 	if err != nil {
-		return nil, err
+		return nil, ds.newConnectionError(StageDriver, err)
 	}
+	ds.recordDriver(id, options, dr)
 
-	return ds.createAsyncDB(dr)
+	start = time.Now()
+	db, err := ds.createAsyncDB(ctx, dr)
+	ds.metrics.observeDB(id, dr, time.Since(start))
+	if err != nil {
+		logConnectionFailure(id, dr, StageDB, err)
+		return nil, ds.newConnectionError(StageDB, err)
+	}
+	return ds.wrapAsyncDB(id, options, settings, db, dr), nil
 }
 
 // GetAPI returns an API interface. When called multiple times with the same id and options, it
@@ -190,16 +710,28 @@ func (ds *awsClient) GetAPI(
 	id int64,
 	options sqlds.Options,
 ) (api.AWSAPI, error) {
+	options = ds.normalizeOptions(options)
 	cachedAPI, exists := ds.loadAPI(id, options)
 	if exists {
 		return cachedAPI, nil
 	}
 
+	unlock, err := ds.waitLock(ctx, &ds.apiLocks, ds.connectionKey(id, options))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	// Another caller may have created it while waiting for the lock
+	if cachedAPI, exists := ds.loadAPI(id, options); exists {
+		return cachedAPI, nil
+	}
+
 	// create new api
+	generation := ds.generation(id)
 	settings := ds.loader.LoadSettings(ctx)
-	err := ds.parseSettings(id, options, settings)
+	err = ds.parseSettings(id, options, settings)
 	if err != nil {
 		return nil, err
 	}
-	return ds.createAPI(ctx, id, options, settings)
+	return ds.createAPI(ctx, id, generation, options, settings)
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/json"
 	"testing"
 
 	asyncDriver "github.com/grafana/grafana-aws-sdk/pkg/sql/driver/async"
@@ -120,9 +121,8 @@ func TestLoadAPI(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.description, func(t *testing.T) {
 			ds := &awsClient{loader: newFakeLoader(nil)}
-			key := connectionKey(tt.id, tt.args)
 			if tt.api != nil {
-				ds.api.Store(key, tt.api)
+				ds.storeAPI(tt.id, tt.args, tt.api)
 			}
 			res, exists := ds.loadAPI(tt.id, tt.args)
 			if res != tt.res && (res != nil || tt.res != nil) {
@@ -168,37 +168,255 @@ func TestParseSettings(t *testing.T) {
 	}
 }
 
+type fakeRegionSettings struct {
+	Region string `json:"region"`
+}
+
+func (f *fakeRegionSettings) Load(c backend.DataSourceInstanceSettings) error {
+	if len(c.JSONData) == 0 {
+		return nil
+	}
+	return json.Unmarshal(c.JSONData, f)
+}
+
+func (f *fakeRegionSettings) ApplyDefaults(d models.Defaults) {
+	if f.Region == "" {
+		f.Region = d.Region
+	}
+}
+
+func (f *fakeRegionSettings) Apply(args sqlds.Options) {
+	if region, ok := args["region"]; ok {
+		f.Region = region
+	}
+}
+
+func TestParseSettings_EnvironmentDefaults(t *testing.T) {
+	t.Setenv(models.DefaultRegionEnvVarKeyName, "eu-west-1")
+	id := int64(1)
+
+	tests := []struct {
+		description string
+		jsonData    string
+		args        sqlds.Options
+		region      string
+	}{
+		{
+			description: "it should use the env default when settings omit the region",
+			jsonData:    `{}`,
+			args:        sqlds.Options{},
+			region:      "eu-west-1",
+		},
+		{
+			description: "it should prefer the region from the settings",
+			jsonData:    `{"region":"us-east-2"}`,
+			args:        sqlds.Options{},
+			region:      "us-east-2",
+		},
+		{
+			description: "it should prefer the region from the options",
+			jsonData:    `{"region":"us-east-2"}`,
+			args:        sqlds.Options{"region": "ap-south-1"},
+			region:      "ap-south-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			ds := New(newFakeLoader(nil)).(*awsClient)
+			ds.Init(backend.DataSourceInstanceSettings{ID: id, JSONData: []byte(tt.jsonData)})
+
+			settings := &fakeRegionSettings{}
+			if err := ds.parseSettings(id, tt.args, settings); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if settings.Region != tt.region {
+				t.Errorf("unexpected region %q, expected %q", settings.Region, tt.region)
+			}
+		})
+	}
+}
+
 func TestCreateAPI(t *testing.T) {
 	id := int64(1)
 	args := sqlds.Options{"foo": "bar"}
 	ds := &awsClient{loader: newFakeLoader(nil)}
-	key := connectionKey(id, args)
 	settings := &fakeSettings{}
 	ctx := context.Background()
 
-	api, err := ds.createAPI(ctx, id, args, settings)
+	api, err := ds.createAPI(ctx, id, ds.generation(id), args, settings)
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
 	if !cmp.Equal(api, fakeAPI{}) {
 		t.Errorf("unexpected result api %v", cmp.Diff(api, fakeAPI{}))
 	}
-	cachedAPI, ok := ds.api.Load(key)
+	cachedAPI, ok := ds.loadAPI(id, args)
 	if !ok || !cmp.Equal(cachedAPI, fakeAPI{}) {
 		t.Errorf("unexpected cached api %v", cmp.Diff(cachedAPI, fakeAPI{}))
 	}
 }
 
+func TestParseSettings_RegionAliases(t *testing.T) {
+	id := int64(1)
+	tests := []struct {
+		description string
+		args        sqlds.Options
+		region      string
+	}{
+		{
+			description: "it should read the awsRegion alias",
+			args:        sqlds.Options{"awsRegion": "eu-west-1"},
+			region:      "eu-west-1",
+		},
+		{
+			description: "it should read the Region alias",
+			args:        sqlds.Options{"Region": "eu-west-2"},
+			region:      "eu-west-2",
+		},
+		{
+			description: "it should read the canonical key",
+			args:        sqlds.Options{"region": "eu-west-3"},
+			region:      "eu-west-3",
+		},
+		{
+			description: "it should prefer the canonical key over the aliases",
+			args:        sqlds.Options{"awsRegion": "eu-west-1", "Region": "eu-west-2", "region": "eu-west-3"},
+			region:      "eu-west-3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			ds := New(newFakeLoader(nil)).(*awsClient)
+			ds.Init(backend.DataSourceInstanceSettings{ID: id, JSONData: []byte(`{"region":"us-east-1"}`)})
+
+			settings := &fakeRegionSettings{}
+			if err := ds.parseSettings(id, tt.args, settings); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if settings.Region != tt.region {
+				t.Errorf("unexpected region %q, expected %q", settings.Region, tt.region)
+			}
+		})
+	}
+
+	t.Run("it should accept custom aliases", func(t *testing.T) {
+		ds := New(newFakeLoader(nil), WithRegionAliases("location")).(*awsClient)
+		ds.Init(backend.DataSourceInstanceSettings{ID: id})
+
+		settings := &fakeRegionSettings{}
+		if err := ds.parseSettings(id, sqlds.Options{"location": "sa-east-1"}, settings); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if settings.Region != "sa-east-1" {
+			t.Errorf("unexpected region %q", settings.Region)
+		}
+	})
+}
+
+type slowLoader struct {
+	fakeLoader
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m slowLoader) LoadAPI(_ context.Context, _ *awsds.SessionCache, _ models.Settings) (sqlApi.AWSAPI, error) {
+	close(m.started)
+	<-m.release
+	return fakeAPI{}, nil
+}
+
+func TestCreateAPI_StaleGeneration(t *testing.T) {
+	id := int64(1)
+	args := sqlds.Options{"foo": "bar"}
+	loader := slowLoader{started: make(chan struct{}), release: make(chan struct{})}
+	ds := &awsClient{loader: loader}
+	ds.Init(backend.DataSourceInstanceSettings{ID: id})
+
+	done := make(chan error)
+	go func() {
+		_, err := ds.createAPI(context.Background(), id, ds.generation(id), args, &fakeSettings{})
+		done <- err
+	}()
+
+	<-loader.started
+	// A newer configuration arrives while the API is still being created
+	ds.Init(backend.DataSourceInstanceSettings{ID: id, Name: "updated"})
+	close(loader.release)
+
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, ok := ds.api.Load(ConnectionKey(id, args)); ok {
+		t.Errorf("stale api should not be cached")
+	}
+}
+
+type reinitLoader struct {
+	fakeLoader
+	reinit func()
+}
+
+func (m reinitLoader) LoadSettings(ctx context.Context) models.Settings {
+	m.reinit()
+	return m.fakeLoader.LoadSettings(ctx)
+}
+
+func TestGetAPI_ReinitWhileLoadingSettings(t *testing.T) {
+	id := int64(1)
+	args := sqlds.Options{"foo": "bar"}
+	ds := &awsClient{}
+	ds.loader = reinitLoader{reinit: func() {
+		// A newer configuration arrives after the settings started loading
+		ds.Init(backend.DataSourceInstanceSettings{ID: id, Name: "updated"})
+	}}
+	ds.Init(backend.DataSourceInstanceSettings{ID: id})
+
+	if _, err := ds.GetAPI(context.Background(), id, args); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, ok := ds.api.Load(ConnectionKey(id, args)); ok {
+		t.Errorf("stale api should not be cached")
+	}
+}
+
+func TestGetDB_ReinitWhileOpening(t *testing.T) {
+	id := int64(1)
+	dr := &openingDriver{}
+	ds := New(fakeLoader{}, WithDBCache()).(*awsClient)
+	reinits := 0
+	ds.loader = reinitLoader{fakeLoader: fakeLoader{driver: dr}, reinit: func() {
+		if reinits == 0 {
+			// A newer configuration arrives after the settings of the first DB started loading
+			ds.Init(backend.DataSourceInstanceSettings{ID: id, Name: "updated"})
+		}
+		reinits++
+	}}
+	ds.Init(backend.DataSourceInstanceSettings{ID: id})
+
+	db, err := ds.GetDB(context.Background(), id, sqlds.Options{})
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(dr.connectors) != 2 || !dr.connectors[0].closed || dr.connectors[1].closed {
+		t.Errorf("stale db should be closed and opened again")
+	}
+	if cached, ok := ds.loadDB(id, sqlds.Options{}); !ok || cached != db {
+		t.Errorf("db opened from the new configuration should be cached")
+	}
+}
+
 func TestCreateDriver(t *testing.T) {
 	ctx := context.Background()
 	loader := newFakeLoader(nil)
 	ds := &awsClient{loader: loader}
-	api, err := ds.createAPI(ctx, 0, sqlds.Options{}, loader.LoadSettings(ctx))
+	api, err := ds.createAPI(ctx, 0, ds.generation(0), sqlds.Options{}, loader.LoadSettings(ctx))
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
 
-	dr, err := ds.createDriver(context.Background(), api)
+	dr, err := ds.createDriver(context.Background(), api, loader.LoadSettings(ctx))
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
@@ -212,7 +430,7 @@ func TestCreateDB(t *testing.T) {
 	dr := &fakeDriver{db: db}
 	ds := &awsClient{loader: newFakeLoader(db)}
 
-	res, err := ds.createDB(dr)
+	res, err := ds.createDB(context.Background(), dr)
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
@@ -243,7 +461,6 @@ func TestGetAPI(t *testing.T) {
 	ds := &awsClient{loader: fakeLoader{}}
 	config := backend.DataSourceInstanceSettings{ID: id}
 	ds.Init(config)
-	key := connectionKey(id, args)
 
 	api, err := ds.GetAPI(context.Background(), id, args)
 	if err != nil {
@@ -252,7 +469,7 @@ func TestGetAPI(t *testing.T) {
 	if !cmp.Equal(api, fakeAPI{}) {
 		t.Errorf("unexpected result api %v", cmp.Diff(api, fakeAPI{}))
 	}
-	cachedAPI, ok := ds.api.Load(key)
+	cachedAPI, ok := ds.loadAPI(id, args)
 	if !ok || !cmp.Equal(cachedAPI, fakeAPI{}) {
 		t.Errorf("unexpected cached api %v", cmp.Diff(cachedAPI, fakeAPI{}))
 	}
@@ -0,0 +1,649 @@
+package datasource
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	sqlApi "github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	sqlDriver "github.com/grafana/grafana-aws-sdk/pkg/sql/driver"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConnector opens fakeConns and records how they are used
+type fakeConnector struct {
+	mu      sync.Mutex
+	closed  bool
+	pings   int
+	pingErr error
+	queries []string
+}
+
+func (c *fakeConnector) Connect(_ context.Context) (driver.Conn, error) {
+	return &fakeConn{connector: c}, nil
+}
+
+func (c *fakeConnector) Driver() driver.Driver {
+	return nil
+}
+
+func (c *fakeConnector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConnector) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *fakeConnector) pingCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pings
+}
+
+type fakeConn struct {
+	connector *fakeConnector
+}
+
+func (c *fakeConn) Prepare(_ string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeConn) Ping(_ context.Context) error {
+	c.connector.mu.Lock()
+	defer c.connector.mu.Unlock()
+	c.connector.pings++
+	return c.connector.pingErr
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	c.connector.mu.Lock()
+	defer c.connector.mu.Unlock()
+	c.connector.queries = append(c.connector.queries, query)
+	return &fakeRows{columns: []string{"1"}, values: [][]driver.Value{{int64(1)}}}, nil
+}
+
+// openingDriver opens a new *sql.DB on every OpenDB call
+type openingDriver struct {
+	fakeDriver
+	mu         sync.Mutex
+	connectors []*fakeConnector
+}
+
+func (d *openingDriver) OpenDB() (*sql.DB, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	connector := &fakeConnector{}
+	d.connectors = append(d.connectors, connector)
+	return sql.OpenDB(connector), nil
+}
+
+type openingLoader struct {
+	fakeLoader
+	driver *openingDriver
+}
+
+func (m openingLoader) LoadDriver(_ context.Context, _ sqlApi.AWSAPI) (sqlDriver.Driver, error) {
+	return m.driver, nil
+}
+
+func newOpeningClient(opts ...Option) (AWSClient, *openingDriver) {
+	dr := &openingDriver{}
+	ds := New(openingLoader{driver: dr}, opts...)
+	ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+	return ds, dr
+}
+
+func TestGetDB_Cache(t *testing.T) {
+	ctx := context.Background()
+	args := sqlds.Options{"foo": "bar"}
+
+	t.Run("it returns the cached db", func(t *testing.T) {
+		ds, dr := newOpeningClient(WithDBCache())
+		first, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+		second, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+
+		assert.Same(t, first, second)
+		assert.Len(t, dr.connectors, 1)
+	})
+
+	t.Run("it opens a new db on every call without cache", func(t *testing.T) {
+		ds, dr := newOpeningClient()
+		first, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+		second, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+
+		assert.NotSame(t, first, second)
+		assert.Len(t, dr.connectors, 2)
+	})
+}
+
+func TestGetDB_Evict(t *testing.T) {
+	origInterval, origTimeout := idleCheckInterval, idleCloseTimeout
+	idleCheckInterval = time.Millisecond
+	t.Cleanup(func() { idleCheckInterval, idleCloseTimeout = origInterval, origTimeout })
+	ctx := context.Background()
+	args := sqlds.Options{"foo": "bar"}
+
+	t.Run("it rebuilds the cached db when the configuration changes", func(t *testing.T) {
+		ds, dr := newOpeningClient(WithDBCache(), WithKeepAlive(time.Hour))
+		first, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"region":"us-east-2"}`)})
+		require.Len(t, dr.connectors, 1)
+		assert.Eventually(t, dr.connectors[0].isClosed, time.Second, time.Millisecond)
+		_, kept := ds.(*awsClient).keepAlives.Load(ConnectionKey(1, args))
+		assert.False(t, kept)
+
+		second, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+		assert.NotSame(t, first, second)
+		assert.Len(t, dr.connectors, 2)
+	})
+
+	t.Run("it keeps the cached db when the configuration is the same", func(t *testing.T) {
+		ds, dr := newOpeningClient(WithDBCache())
+		first, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+		second, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+		assert.Same(t, first, second)
+		assert.False(t, dr.connectors[0].isClosed())
+	})
+
+	t.Run("it closes the cached dbs of the invalidated datasource only", func(t *testing.T) {
+		ds, dr := newOpeningClient(WithDBCache())
+		ds.Init(backend.DataSourceInstanceSettings{ID: 2})
+		_, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+		_, err = ds.GetDB(ctx, 2, args)
+		require.NoError(t, err)
+
+		ds.Invalidate(1)
+		assert.Eventually(t, dr.connectors[0].isClosed, time.Second, time.Millisecond)
+		assert.False(t, dr.connectors[1].isClosed())
+		_, cached := ds.(*awsClient).loadDB(2, args)
+		assert.True(t, cached)
+	})
+
+	t.Run("it closes an evicted db only once its connections are released", func(t *testing.T) {
+		ds, dr := newOpeningClient(WithDBCache())
+		db, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+		conn, err := db.Conn(ctx)
+		require.NoError(t, err)
+
+		ds.Invalidate(1)
+		assert.Never(t, dr.connectors[0].isClosed, 20*time.Millisecond, time.Millisecond)
+		require.NoError(t, conn.PingContext(ctx))
+
+		require.NoError(t, conn.Close())
+		assert.Eventually(t, dr.connectors[0].isClosed, time.Second, time.Millisecond)
+	})
+
+	t.Run("it closes an evicted db holding a leaked connection after the timeout", func(t *testing.T) {
+		idleCloseTimeout = 20 * time.Millisecond
+		ds, dr := newOpeningClient(WithDBCache())
+		db, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+		conn, err := db.Conn(ctx)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		ds.Invalidate(1)
+		assert.Eventually(t, dr.connectors[0].isClosed, time.Second, time.Millisecond)
+	})
+}
+
+func TestGetDB_ValidateOnHit(t *testing.T) {
+	origInterval := idleCheckInterval
+	idleCheckInterval = time.Millisecond
+	t.Cleanup(func() { idleCheckInterval = origInterval })
+	ctx := context.Background()
+	args := sqlds.Options{"foo": "bar"}
+
+	t.Run("it returns a healthy cached db directly", func(t *testing.T) {
+		ds, dr := newOpeningClient(WithDBCache(), WithValidateOnHit(time.Second))
+		first, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+
+		second, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+		assert.Same(t, first, second)
+		assert.Len(t, dr.connectors, 1)
+		assert.Equal(t, 1, dr.connectors[0].pingCount())
+	})
+
+	t.Run("it replaces a dead cached db", func(t *testing.T) {
+		ds, dr := newOpeningClient(WithDBCache(), WithValidateOnHit(time.Second))
+		first, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+		dr.connectors[0].mu.Lock()
+		dr.connectors[0].pingErr = errors.New("connection reset by peer")
+		dr.connectors[0].mu.Unlock()
+
+		second, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+		assert.NotSame(t, first, second)
+		require.Len(t, dr.connectors, 2)
+		assert.Eventually(t, dr.connectors[0].isClosed, time.Second, time.Millisecond)
+
+		third, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+		assert.Same(t, second, third)
+	})
+
+	t.Run("it closes a dead cached db only once its connections are released", func(t *testing.T) {
+		ds, dr := newOpeningClient(WithDBCache(), WithValidateOnHit(time.Second))
+		first, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+		conn, err := first.Conn(ctx)
+		require.NoError(t, err)
+		dr.connectors[0].mu.Lock()
+		dr.connectors[0].pingErr = errors.New("connection reset by peer")
+		dr.connectors[0].mu.Unlock()
+		ds.(*awsClient).warnings.Store(ds.ConnectionKey(1, args), []string{"insecure"})
+
+		_, healthy := ds.(*awsClient).loadHealthyDB(ctx, 1, args)
+		assert.False(t, healthy)
+		_, exists := ds.(*awsClient).warnings.Load(ds.ConnectionKey(1, args))
+		assert.False(t, exists)
+		assert.Never(t, dr.connectors[0].isClosed, 20*time.Millisecond, time.Millisecond)
+		rows, err := conn.QueryContext(ctx, "SELECT 1")
+		require.NoError(t, err)
+		require.NoError(t, rows.Close())
+
+		require.NoError(t, conn.Close())
+		assert.Eventually(t, dr.connectors[0].isClosed, time.Second, time.Millisecond)
+	})
+
+	t.Run("it doesn't ping the cached db by default", func(t *testing.T) {
+		ds, dr := newOpeningClient(WithDBCache())
+		_, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+
+		_, err = ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+		assert.Zero(t, dr.connectors[0].pingCount())
+	})
+}
+
+func TestGetDB_PerQueryOptions(t *testing.T) {
+	ctx := context.Background()
+	sales := sqlds.Options{"database": "sales"}
+	marketing := sqlds.Options{"database": "marketing"}
+
+	t.Run("it caches a db per database by default", func(t *testing.T) {
+		ds, dr := newOpeningClient(WithDBCache())
+		first, err := ds.GetDB(ctx, 1, sales)
+		require.NoError(t, err)
+		second, err := ds.GetDB(ctx, 1, marketing)
+		require.NoError(t, err)
+
+		assert.NotSame(t, first, second)
+		assert.Len(t, dr.connectors, 2)
+	})
+
+	t.Run("it shares the db of databases switched per query", func(t *testing.T) {
+		ds, dr := newOpeningClient(WithDBCache(), WithPerQueryOptions("database", "schema"))
+		first, err := ds.GetDB(ctx, 1, sales)
+		require.NoError(t, err)
+		second, err := ds.GetDB(ctx, 1, marketing)
+		require.NoError(t, err)
+
+		assert.Same(t, first, second)
+		assert.Len(t, dr.connectors, 1)
+	})
+}
+
+func TestGetDB_OptionsNormalizer(t *testing.T) {
+	ctx := context.Background()
+	dropLabel := func(options sqlds.Options) sqlds.Options {
+		delete(options, "label")
+		return options
+	}
+	ds, dr := newOpeningClient(WithDBCache(), WithOptionsNormalizer(dropLabel))
+
+	first, err := ds.GetDB(ctx, 1, sqlds.Options{"foo": "bar", "label": "Sales"})
+	require.NoError(t, err)
+	second, err := ds.GetDB(ctx, 1, sqlds.Options{"foo": "bar", "label": "Sales (copy)"})
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+	assert.Len(t, dr.connectors, 1)
+
+	t.Run("it keeps apart the options it doesn't normalize", func(t *testing.T) {
+		third, err := ds.GetDB(ctx, 1, sqlds.Options{"foo": "baz", "label": "Sales"})
+		require.NoError(t, err)
+		assert.NotSame(t, first, third)
+	})
+
+	t.Run("it resets the shared db", func(t *testing.T) {
+		require.NoError(t, ds.ResetDB(1, sqlds.Options{"foo": "bar", "label": "Other"}))
+		assert.True(t, dr.connectors[0].isClosed())
+	})
+}
+
+func TestResetDB(t *testing.T) {
+	ctx := context.Background()
+	args := sqlds.Options{"foo": "bar"}
+	ds, dr := newOpeningClient(WithDBCache())
+
+	first, err := ds.GetDB(ctx, 1, args)
+	require.NoError(t, err)
+	require.NoError(t, ds.ResetDB(1, args))
+	assert.True(t, dr.connectors[0].isClosed())
+
+	second, err := ds.GetDB(ctx, 1, args)
+	require.NoError(t, err)
+	assert.NotSame(t, first, second)
+	assert.Len(t, dr.connectors, 2)
+	assert.False(t, dr.connectors[1].isClosed())
+
+	t.Run("it's a no-op without a cached db", func(t *testing.T) {
+		assert.NoError(t, ds.ResetDB(2, args))
+	})
+}
+
+func TestGetDBWithSettings(t *testing.T) {
+	t.Run("it works without Init", func(t *testing.T) {
+		ds := New(openingLoader{driver: &openingDriver{}}).(*awsClient)
+		config := backend.DataSourceInstanceSettings{ID: 2, JSONData: []byte(`{"foo":"bar"}`)}
+
+		db, err := ds.GetDBWithSettings(context.Background(), config, sqlds.Options{})
+		require.NoError(t, err)
+		assert.NotNil(t, db)
+
+		stored, ok := ds.config.Load(int64(2))
+		require.True(t, ok)
+		assert.Equal(t, config, stored)
+	})
+
+	t.Run("it updates the stored configuration", func(t *testing.T) {
+		ds := New(openingLoader{driver: &openingDriver{}}, WithDBCache()).(*awsClient)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 2, JSONData: []byte(`{"foo":"bar"}`)})
+		_, err := ds.GetAPI(context.Background(), 2, sqlds.Options{})
+		require.NoError(t, err)
+
+		config := backend.DataSourceInstanceSettings{ID: 2, JSONData: []byte(`{"foo":"baz"}`)}
+		_, err = ds.GetDBWithSettings(context.Background(), config, sqlds.Options{})
+		require.NoError(t, err)
+
+		stored, _ := ds.config.Load(int64(2))
+		assert.Equal(t, config, stored)
+	})
+
+	t.Run("it keeps the cache when the configuration is unchanged", func(t *testing.T) {
+		ds := New(openingLoader{driver: &openingDriver{}}, WithDBCache()).(*awsClient)
+		config := backend.DataSourceInstanceSettings{ID: 2, JSONData: []byte(`{"foo":"bar"}`)}
+		ds.Init(config)
+		generation := ds.generationCounter(2).Load()
+
+		first, err := ds.GetDBWithSettings(context.Background(), config, sqlds.Options{})
+		require.NoError(t, err)
+		second, err := ds.GetDBWithSettings(context.Background(), config, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Same(t, first, second)
+		assert.Equal(t, generation, ds.generationCounter(2).Load())
+	})
+}
+
+// fakeTicker hands the ticks sent by the test to the keep-alive and records when it's stopped
+type fakeTicker struct {
+	ticks   chan time.Time
+	stopped chan struct{}
+}
+
+func newFakeTicker(ds AWSClient) *fakeTicker {
+	ft := &fakeTicker{ticks: make(chan time.Time), stopped: make(chan struct{})}
+	ds.(*awsClient).ticker = func(_ time.Duration) (<-chan time.Time, func()) {
+		return ft.ticks, func() { close(ft.stopped) }
+	}
+	return ft
+}
+
+func TestGetDB_KeepAlive(t *testing.T) {
+	ctx := context.Background()
+	args := sqlds.Options{"foo": "bar"}
+
+	t.Run("it pings the cached db on every tick", func(t *testing.T) {
+		ds, dr := newOpeningClient(WithDBCache(), WithKeepAlive(time.Minute))
+		ticker := newFakeTicker(ds)
+		_, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+
+		connector := dr.connectors[0]
+		assert.Equal(t, 0, connector.pingCount())
+		ticker.ticks <- time.Now()
+		ticker.ticks <- time.Now()
+		require.Eventually(t, func() bool { return connector.pingCount() == 2 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("it stops pinging once the db is reset", func(t *testing.T) {
+		ds, dr := newOpeningClient(WithDBCache(), WithKeepAlive(time.Minute))
+		ticker := newFakeTicker(ds)
+		_, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+		ticker.ticks <- time.Now()
+
+		ds.ResetDB(1, args)
+		select {
+		case <-ticker.stopped:
+		case <-time.After(time.Second):
+			t.Fatal("keep-alive wasn't stopped")
+		}
+		assert.Equal(t, 1, dr.connectors[0].pingCount())
+	})
+
+	t.Run("it stops pinging once the db is evicted", func(t *testing.T) {
+		ds, _ := newOpeningClient(WithDBCache(), WithKeepAlive(time.Minute))
+		ticker := newFakeTicker(ds)
+		_, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+
+		ds.Invalidate(1)
+		select {
+		case <-ticker.stopped:
+		case <-time.After(time.Second):
+			t.Fatal("keep-alive wasn't stopped")
+		}
+	})
+
+	t.Run("it doesn't ping without keep-alive", func(t *testing.T) {
+		ds, _ := newOpeningClient(WithDBCache())
+		ticker := newFakeTicker(ds)
+		_, err := ds.GetDB(ctx, 1, args)
+		require.NoError(t, err)
+
+		select {
+		case ticker.ticks <- time.Now():
+			t.Fatal("the db shouldn't be pinged")
+		case <-time.After(10 * time.Millisecond):
+		}
+	})
+}
+
+func TestConn_AcquireTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("it fails clearly when the pool has no free connection in time", func(t *testing.T) {
+		ds, _ := newOpeningClient(WithDBCache(), WithAcquireTimeout(50*time.Millisecond))
+		db, err := ds.GetDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+		db.SetMaxOpenConns(1)
+
+		first, err := ds.Conn(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+		rows, err := first.QueryContext(ctx, "SELECT 1")
+		require.NoError(t, err)
+
+		_, err = ds.Conn(ctx, 1, sqlds.Options{})
+		require.ErrorIs(t, err, ErrPoolExhausted)
+		assert.Contains(t, err.Error(), "connection pool exhausted")
+
+		require.NoError(t, rows.Close())
+		require.NoError(t, first.Close())
+		second, err := ds.Conn(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+		require.NoError(t, second.Close())
+	})
+
+	t.Run("it doesn't bound the time to open a connection of a pool not full", func(t *testing.T) {
+		dr := &slowConnectDriver{delay: 50 * time.Millisecond}
+		ds := New(&compressionLoader{driver: dr}, WithDBCache(), WithAcquireTimeout(10*time.Millisecond))
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		conn, err := ds.Conn(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	})
+
+	t.Run("it requires the db cache", func(t *testing.T) {
+		ds, dr := newOpeningClient(WithAcquireTimeout(time.Minute))
+
+		_, err := ds.Conn(ctx, 1, sqlds.Options{})
+		require.ErrorContains(t, err, "Conn requires a client created WithDBCache")
+		assert.Empty(t, dr.connectors)
+	})
+
+	t.Run("it leaves the cancellation of the caller untouched", func(t *testing.T) {
+		ds, _ := newOpeningClient(WithDBCache(), WithAcquireTimeout(time.Minute))
+		db, err := ds.GetDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+		db.SetMaxOpenConns(1)
+		first, err := ds.Conn(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+		defer first.Close()
+
+		callerCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err = ds.Conn(callerCtx, 1, sqlds.Options{})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.NotErrorIs(t, err, ErrPoolExhausted)
+	})
+}
+
+// slowConnector takes delay to open every connection
+type slowConnector struct {
+	fakeConnector
+	delay time.Duration
+}
+
+func (c *slowConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	time.Sleep(c.delay)
+	return c.fakeConnector.Connect(ctx)
+}
+
+// slowConnectDriver opens DBs whose connections are slow to open
+type slowConnectDriver struct {
+	fakeDriver
+	delay time.Duration
+}
+
+func (d *slowConnectDriver) OpenDB() (*sql.DB, error) {
+	return sql.OpenDB(&slowConnector{delay: d.delay}), nil
+}
+
+// dialingDriver dials the database host when it opens a DB, with failures from its stub dialer
+type dialingDriver struct {
+	fakeDriver
+	failures []error
+	dials    int
+}
+
+func (d *dialingDriver) dial() error {
+	d.dials++
+	if len(d.failures) == 0 {
+		return nil
+	}
+	err := d.failures[0]
+	d.failures = d.failures[1:]
+	return err
+}
+
+func (d *dialingDriver) OpenDB() (*sql.DB, error) {
+	if err := d.dial(); err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(&fakeConnector{}), nil
+}
+
+func TestCreateDB_ConnectRetry(t *testing.T) {
+	dnsErr := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "cluster.abc123.us-east-1.redshift.amazonaws.com", IsTemporary: true}}
+
+	t.Run("it retries a DNS failure", func(t *testing.T) {
+		dr := &dialingDriver{failures: []error{dnsErr}}
+		ds := New(fakeLoader{}, WithConnectRetry(2, time.Millisecond)).(*awsClient)
+
+		db, err := ds.createDB(context.Background(), dr)
+		require.NoError(t, err)
+		assert.NotNil(t, db)
+		assert.Equal(t, 2, dr.dials)
+	})
+
+	t.Run("it gives up after the retries", func(t *testing.T) {
+		dr := &dialingDriver{failures: []error{dnsErr, dnsErr, dnsErr}}
+		ds := New(fakeLoader{}, WithConnectRetry(2, time.Millisecond)).(*awsClient)
+
+		_, err := ds.createDB(context.Background(), dr)
+		require.ErrorIs(t, err, dnsErr)
+		assert.Equal(t, 3, dr.dials)
+	})
+
+	t.Run("it doesn't retry other errors", func(t *testing.T) {
+		authErr := errors.New("password authentication failed for user grafana")
+		dr := &dialingDriver{failures: []error{authErr}}
+		ds := New(fakeLoader{}, WithConnectRetry(2, time.Millisecond)).(*awsClient)
+
+		_, err := ds.createDB(context.Background(), dr)
+		require.ErrorIs(t, err, authErr)
+		assert.Equal(t, 1, dr.dials)
+	})
+
+	t.Run("it stops waiting once the context is done", func(t *testing.T) {
+		dr := &dialingDriver{failures: []error{dnsErr, dnsErr}}
+		ds := New(fakeLoader{}, WithConnectRetry(2, time.Hour)).(*awsClient)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := ds.createDB(ctx, dr)
+		require.ErrorIs(t, err, dnsErr)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, 1, dr.dials)
+	})
+
+	t.Run("it doesn't retry by default", func(t *testing.T) {
+		dr := &dialingDriver{failures: []error{dnsErr}}
+		ds := New(fakeLoader{}).(*awsClient)
+
+		_, err := ds.createDB(context.Background(), dr)
+		require.ErrorIs(t, err, dnsErr)
+		assert.Equal(t, 1, dr.dials)
+	})
+}
@@ -0,0 +1,192 @@
+package datasource
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/models"
+)
+
+// ErrZeroID is returned for datasources without an id when the client is created WithZeroIDGuard
+var ErrZeroID = errors.New("the datasource has no id, save it before querying it")
+
+// ErrOptionsTooLarge is returned for connection options larger than the limit set WithMaxOptionsSize
+var ErrOptionsTooLarge = errors.New("connection options too large")
+
+// ErrEstimateNotSupported is returned by ExplainQuery for datasources whose API can't estimate queries
+var ErrEstimateNotSupported = errors.New("query cost estimates are not supported by this datasource")
+
+// ErrPoolExhausted is returned by Conn when no connection of the DB pool was free before the
+// acquire timeout of the client, see WithAcquireTimeout
+var ErrPoolExhausted = errors.New("connection pool exhausted: no connection was released in time, raise the pool size or the acquire timeout")
+
+// ErrCreationWaitTimeout is returned by GetAPI and GetDB when the API or DB another caller is creating
+// wasn't ready before the creation wait of the client, see WithCreationWait
+var ErrCreationWaitTimeout = errors.New("timed out waiting for another caller to create the connection")
+
+// AWSError exposes the details AWS returns with a failed request, like the request id,
+// which are needed to diagnose the failure. Use errors.As to retrieve it.
+type AWSError struct {
+	err        awserr.Error
+	requestID  string
+	statusCode int
+}
+
+func (e *AWSError) Error() string {
+	return e.err.Error()
+}
+
+func (e *AWSError) Unwrap() error {
+	return e.err
+}
+
+// Code returns the AWS error code, e.g. "AccessDeniedException"
+func (e *AWSError) Code() string {
+	return e.err.Code()
+}
+
+// RequestID returns the id of the failed request, empty if AWS didn't return one
+func (e *AWSError) RequestID() string {
+	return e.requestID
+}
+
+// HTTPStatusCode returns the status code of the failed request, 0 if unknown
+func (e *AWSError) HTTPStatusCode() int {
+	return e.statusCode
+}
+
+// Throttled returns true if AWS rejected the request because of its rate limits
+func (e *AWSError) Throttled() bool {
+	return request.IsErrorThrottle(e.err)
+}
+
+// RetryAfter returns how long AWS asked to wait before retrying, 0 if it didn't say
+func (e *AWSError) RetryAfter() time.Duration {
+	var hint interface{ RetryAfter() time.Duration }
+	if errors.As(e.err, &hint) {
+		return hint.RetryAfter()
+	}
+	return 0
+}
+
+// wrapAWSError wraps err in an AWSError if it's an error returned by the AWS SDK
+func wrapAWSError(err error) error {
+	var awsErr *AWSError
+	if errors.As(err, &awsErr) {
+		return err
+	}
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) {
+		return &AWSError{err: requestFailure, requestID: requestFailure.RequestID(), statusCode: requestFailure.StatusCode()}
+	}
+	var sdkErr awserr.Error
+	if errors.As(err, &sdkErr) {
+		return &AWSError{err: sdkErr}
+	}
+	return err
+}
+
+// mapError translates err with the error mapper of the client, if any
+func (ds *awsClient) mapError(err error) error {
+	if ds.errorMapper == nil {
+		return err
+	}
+	return ds.errorMapper(err)
+}
+
+// regionNotEnabledCodes are the error codes AWS returns when the account hasn't opted in to the region
+var regionNotEnabledCodes = map[string]bool{
+	"OptInRequired":           true,
+	"RegionDisabledException": true,
+}
+
+// RegionNotEnabledError is returned when the datasource targets a region the AWS account hasn't enabled
+type RegionNotEnabledError struct {
+	Region string
+	err    error
+}
+
+func (e *RegionNotEnabledError) Error() string {
+	region := "the selected region"
+	if e.Region != "" {
+		region = fmt.Sprintf("region %q", e.Region)
+	}
+	return fmt.Sprintf("%s is not enabled for this AWS account. An account administrator can enable it in the AWS console "+
+		"under Account > AWS Regions, or choose another region (%s)", region, e.err.Error())
+}
+
+func (e *RegionNotEnabledError) Unwrap() error {
+	return e.err
+}
+
+// wrapRegionNotEnabledError wraps err in a RegionNotEnabledError if AWS rejected the request because
+// the region isn't enabled
+func wrapRegionNotEnabledError(err error, settings models.Settings) error {
+	var awsErr *AWSError
+	if !errors.As(err, &awsErr) || !regionNotEnabledCodes[awsErr.Code()] {
+		return err
+	}
+	notEnabled := &RegionNotEnabledError{err: err}
+	if r, ok := settings.(models.RegionGetter); ok {
+		notEnabled.Region = r.GetRegion()
+	}
+	return notEnabled
+}
+
+// clockSkewCodes are the error codes AWS returns when the signing time of a request is too far from
+// its own time. SignatureDoesNotMatch is also returned for wrong secret keys, so it's only a skew
+// when the message tells the signature expired or isn't current yet.
+var clockSkewCodes = map[string]bool{
+	"RequestTimeTooSkewed":      true,
+	"RequestExpired":            true,
+	"SignatureDoesNotMatch":     false,
+	"InvalidSignatureException": false,
+}
+
+// serverTimePattern matches the AWS time in messages like "Signature expired: 20240101T000000Z is now
+// earlier than 20240101T001000Z (20240101T001500Z - 5 min.)"
+var serverTimePattern = regexp.MustCompile(`\((\d{8}T\d{6}Z) [+-] \d+ min\.\)`)
+
+// ClockSkewError is returned when AWS rejects a request because the clock of the host is skewed
+type ClockSkewError struct {
+	// ServerTime is the time of AWS when the request was rejected, zero if AWS didn't tell
+	ServerTime time.Time
+	err        error
+}
+
+func (e *ClockSkewError) Error() string {
+	serverTime := ""
+	if !e.ServerTime.IsZero() {
+		serverTime = fmt.Sprintf(" AWS time was %s.", e.ServerTime.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("AWS rejected the request signature, the clock of the Grafana host is likely skewed.%s "+
+		"Synchronize it, e.g. with NTP (%s)", serverTime, e.err.Error())
+}
+
+func (e *ClockSkewError) Unwrap() error {
+	return e.err
+}
+
+// wrapClockSkewError wraps err in a ClockSkewError if AWS rejected the request because of the time it
+// was signed at
+func wrapClockSkewError(err error) error {
+	var awsErr *AWSError
+	if !errors.As(err, &awsErr) {
+		return err
+	}
+	skewOnly, known := clockSkewCodes[awsErr.Code()]
+	message := awsErr.err.Message()
+	if !known || (!skewOnly && !strings.Contains(message, "Signature expired") && !strings.Contains(message, "Signature not yet current")) {
+		return err
+	}
+	skew := &ClockSkewError{err: err}
+	if match := serverTimePattern.FindStringSubmatch(message); match != nil {
+		skew.ServerTime, _ = time.Parse("20060102T150405Z", match[1])
+	}
+	return skew
+}
@@ -0,0 +1,206 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	sqlApi "github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingLoader struct {
+	fakeLoader
+	err error
+}
+
+func (m failingLoader) LoadAPI(_ context.Context, _ *awsds.SessionCache, _ models.Settings) (sqlApi.AWSAPI, error) {
+	return nil, m.err
+}
+
+func TestCreateAPI_AWSError(t *testing.T) {
+	t.Run("it exposes the details of a request failure", func(t *testing.T) {
+		requestFailure := awserr.NewRequestFailure(
+			awserr.New("AccessDeniedException", "User is not authorized to perform athena:GetWorkGroup", nil),
+			http.StatusForbidden,
+			"8f6c1b2e-1d2a-4c3b-9a8e-0123456789ab",
+		)
+		ds := &awsClient{loader: failingLoader{err: requestFailure}}
+
+		_, err := ds.createAPI(context.Background(), 1, ds.generation(1), sqlds.Options{}, &fakeSettings{})
+		require.Error(t, err)
+
+		var awsErr *AWSError
+		require.True(t, errors.As(err, &awsErr))
+		assert.Equal(t, "AccessDeniedException", awsErr.Code())
+		assert.Equal(t, "8f6c1b2e-1d2a-4c3b-9a8e-0123456789ab", awsErr.RequestID())
+		assert.Equal(t, http.StatusForbidden, awsErr.HTTPStatusCode())
+		assert.ErrorIs(t, err, requestFailure)
+	})
+
+	t.Run("it keeps other errors as they are", func(t *testing.T) {
+		loaderErr := errors.New("boom")
+		ds := &awsClient{loader: failingLoader{err: loaderErr}}
+
+		_, err := ds.createAPI(context.Background(), 1, ds.generation(1), sqlds.Options{}, &fakeSettings{})
+		require.ErrorIs(t, err, loaderErr)
+
+		var awsErr *AWSError
+		assert.False(t, errors.As(err, &awsErr))
+	})
+}
+
+func TestCreateAPI_RegionNotEnabled(t *testing.T) {
+	t.Run("it explains how to enable the region", func(t *testing.T) {
+		optIn := awserr.NewRequestFailure(
+			awserr.New("OptInRequired", "You are not subscribed to this service. Please go to http://aws.amazon.com to subscribe.", nil),
+			http.StatusUnauthorized,
+			"3c0d5f8a-6e1b-4b7c-8d2e-0123456789ab",
+		)
+		ds := &awsClient{loader: failingLoader{err: optIn}}
+
+		_, err := ds.createAPI(context.Background(), 1, ds.generation(1), sqlds.Options{}, &awsSettings{AWSDatasourceSettings: awsds.AWSDatasourceSettings{Region: "ap-east-1"}})
+		require.Error(t, err)
+
+		var notEnabled *RegionNotEnabledError
+		require.True(t, errors.As(err, &notEnabled))
+		assert.Equal(t, "ap-east-1", notEnabled.Region)
+		assert.Contains(t, err.Error(), `region "ap-east-1" is not enabled for this AWS account`)
+		assert.Contains(t, err.Error(), "Account > AWS Regions")
+
+		var awsErr *AWSError
+		require.True(t, errors.As(err, &awsErr))
+		assert.Equal(t, "OptInRequired", awsErr.Code())
+	})
+
+	t.Run("it keeps other AWS errors as they are", func(t *testing.T) {
+		ds := &awsClient{loader: failingLoader{err: awserr.New("AccessDeniedException", "denied", nil)}}
+
+		_, err := ds.createAPI(context.Background(), 1, ds.generation(1), sqlds.Options{}, &awsSettings{})
+		require.Error(t, err)
+
+		var notEnabled *RegionNotEnabledError
+		assert.False(t, errors.As(err, &notEnabled))
+	})
+}
+
+func TestCreateAPI_ClockSkew(t *testing.T) {
+	t.Run("it explains the skew with the time of AWS", func(t *testing.T) {
+		expired := awserr.NewRequestFailure(
+			awserr.New("SignatureDoesNotMatch", "Signature expired: 20240101T000000Z is now earlier than 20240101T001000Z (20240101T001500Z - 5 min.)", nil),
+			http.StatusForbidden,
+			"5a1e2f3b-7c4d-4e5f-9a0b-0123456789ab",
+		)
+		ds := &awsClient{loader: failingLoader{err: expired}}
+
+		_, err := ds.createAPI(context.Background(), 1, ds.generation(1), sqlds.Options{}, &fakeSettings{})
+		require.Error(t, err)
+
+		var skew *ClockSkewError
+		require.True(t, errors.As(err, &skew))
+		assert.Equal(t, time.Date(2024, 1, 1, 0, 15, 0, 0, time.UTC), skew.ServerTime)
+		assert.Contains(t, err.Error(), "the clock of the Grafana host is likely skewed. AWS time was 2024-01-01T00:15:00Z.")
+		assert.ErrorIs(t, err, expired)
+	})
+
+	t.Run("it recognizes a skew without server time", func(t *testing.T) {
+		ds := &awsClient{loader: failingLoader{err: awserr.New("RequestTimeTooSkewed", "The difference between the request time and the current time is too large.", nil)}}
+
+		_, err := ds.createAPI(context.Background(), 1, ds.generation(1), sqlds.Options{}, &fakeSettings{})
+
+		var skew *ClockSkewError
+		require.True(t, errors.As(err, &skew))
+		assert.True(t, skew.ServerTime.IsZero())
+	})
+
+	t.Run("it keeps wrong signatures as they are", func(t *testing.T) {
+		ds := &awsClient{loader: failingLoader{err: awserr.New("SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.", nil)}}
+
+		_, err := ds.createAPI(context.Background(), 1, ds.generation(1), sqlds.Options{}, &fakeSettings{})
+		require.Error(t, err)
+
+		var skew *ClockSkewError
+		assert.False(t, errors.As(err, &skew))
+	})
+}
+
+// localizedError replaces the message of an error and keeps it as its cause
+type localizedError struct {
+	message string
+	err     error
+}
+
+func (e *localizedError) Error() string {
+	return e.message
+}
+
+func (e *localizedError) Unwrap() error {
+	return e.err
+}
+
+func TestErrorMapper(t *testing.T) {
+	accessDenied := awserr.New("AccessDeniedException", "User is not authorized to perform athena:GetWorkGroup", nil)
+	mapper := func(err error) error {
+		var awsErr *AWSError
+		if errors.As(err, &awsErr) && awsErr.Code() == "AccessDeniedException" {
+			return &localizedError{message: "Accès refusé", err: err}
+		}
+		return err
+	}
+
+	t.Run("it maps the errors of createAPI", func(t *testing.T) {
+		ds := &awsClient{loader: failingLoader{err: accessDenied}, errorMapper: mapper}
+
+		_, err := ds.createAPI(context.Background(), 1, ds.generation(1), sqlds.Options{}, &fakeSettings{})
+		require.EqualError(t, err, "Accès refusé")
+
+		original := errors.Unwrap(err)
+		require.NotNil(t, original)
+		assert.Contains(t, original.Error(), "User is not authorized to perform athena:GetWorkGroup")
+		assert.ErrorIs(t, err, accessDenied)
+	})
+
+	t.Run("it maps the errors of GetDB", func(t *testing.T) {
+		ds := New(stageLoader{apiErr: accessDenied}, WithErrorMapper(mapper))
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.Error(t, err)
+		assert.Equal(t, "Accès refusé", err.Error())
+		assert.ErrorIs(t, err, accessDenied)
+	})
+}
+
+func TestCreateAPI_Throttling(t *testing.T) {
+	throttled := &awsds.RetryAfterError{
+		RequestFailure: awserr.NewRequestFailure(awserr.New("ThrottlingException", "Rate exceeded", nil), http.StatusBadRequest, "req-1"),
+		Delay:          5 * time.Second,
+	}
+	ds := &awsClient{loader: failingLoader{err: throttled}}
+
+	_, err := ds.createAPI(context.Background(), 1, ds.generation(1), sqlds.Options{}, &fakeSettings{})
+	require.Error(t, err)
+
+	var awsErr *AWSError
+	require.True(t, errors.As(err, &awsErr))
+	assert.True(t, awsErr.Throttled())
+	assert.Equal(t, 5*time.Second, awsErr.RetryAfter())
+	assert.Equal(t, "req-1", awsErr.RequestID())
+
+	t.Run("it has no hint for other errors", func(t *testing.T) {
+		ds := &awsClient{loader: failingLoader{err: awserr.New("AccessDeniedException", "denied", nil)}}
+
+		_, err := ds.createAPI(context.Background(), 1, ds.generation(1), sqlds.Options{}, &fakeSettings{})
+		require.True(t, errors.As(err, &awsErr))
+		assert.False(t, awsErr.Throttled())
+		assert.Zero(t, awsErr.RetryAfter())
+	})
+}
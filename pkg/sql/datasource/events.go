@@ -0,0 +1,132 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+)
+
+// QueryEventType is a stage of the lifecycle of an async query
+type QueryEventType string
+
+const (
+	// QueryEventStart is sent once the query is started, with its id
+	QueryEventStart QueryEventType = "start"
+	// QueryEventStatus is sent on every status poll, with the status returned or the error of a poll
+	// that failed on its own, e.g. throttled or past the poll timeout, after which the query may still
+	// be polled again
+	QueryEventStatus QueryEventType = "status"
+	// QueryEventComplete is sent when a status poll finds the query finished
+	QueryEventComplete QueryEventType = "complete"
+	// QueryEventFail is sent when the query couldn't start, failed, was canceled or the caller stopped
+	// polling its status, its context being done
+	QueryEventFail QueryEventType = "fail"
+)
+
+// QueryEvent describes a stage of an async query
+type QueryEvent struct {
+	Type QueryEventType
+	// QueryID is the native AWS id of the query, empty when it failed to start
+	QueryID string
+	Status  awsds.QueryStatus
+	// Duration is the time taken by the AWS call of the stage
+	Duration time.Duration
+	// Elapsed is the time since the query was started, zero if it was started by another AsyncDB
+	Elapsed time.Duration
+	Err     error
+}
+
+// QueryListener receives the lifecycle events of the async queries run through GetAsyncDB, e.g. to
+// feed an audit log. Events are sent synchronously and from several goroutines, so OnQueryEvent
+// should return quickly and be safe for concurrent use.
+type QueryListener interface {
+	OnQueryEvent(ctx context.Context, event QueryEvent)
+}
+
+// queryEvents sends the events of the queries of an AsyncDB to the listener and records their
+// outcome in the metrics of the client. Both are optional.
+type queryEvents struct {
+	id       int64
+	listener QueryListener
+	metrics  *metrics
+	now      func() time.Time
+	// started holds the start time of the running queries, by id
+	started sync.Map
+}
+
+func (e *queryEvents) send(ctx context.Context, event QueryEvent) {
+	if e.listener != nil {
+		e.listener.OnQueryEvent(ctx, event)
+	}
+}
+
+func (e *queryEvents) start(ctx context.Context, queryID string, begin time.Time, err error) {
+	end := e.now()
+	if err != nil {
+		e.metrics.observeQuery(e.id, errorOutcome(ctx, err), 0)
+		e.send(ctx, QueryEvent{Type: QueryEventFail, Duration: end.Sub(begin), Err: err})
+		return
+	}
+	e.started.Store(queryID, begin)
+	e.send(ctx, QueryEvent{Type: QueryEventStart, QueryID: queryID, Duration: end.Sub(begin)})
+}
+
+func (e *queryEvents) status(ctx context.Context, queryID string, begin time.Time, status awsds.QueryStatus, err error) {
+	end := e.now()
+	event := QueryEvent{QueryID: queryID, Status: status, Duration: end.Sub(begin), Err: err}
+	if started, ok := e.started.Load(queryID); ok {
+		event.Elapsed = end.Sub(started.(time.Time))
+	}
+	// a status call bounded by PollOptions.Timeout is retried when it times out, unlike the caller's
+	pollTimedOut := ctx.Err() != nil && api.PollCaller(ctx).Err() == nil
+	if err != nil && (pollTimedOut || !isContextError(ctx, err)) {
+		// the query may still be running, its outcome is recorded when a later poll finds it finished
+		event.Type = QueryEventStatus
+		e.send(ctx, event)
+		return
+	}
+	if err != nil {
+		e.started.Delete(queryID)
+		e.metrics.observeQuery(e.id, errorOutcome(ctx, err), event.Elapsed)
+		event.Type = QueryEventFail
+		e.send(ctx, event)
+		return
+	}
+	event.Type = QueryEventStatus
+	e.send(ctx, event)
+	if !status.Finished() {
+		return
+	}
+	e.started.Delete(queryID)
+	event.Type = QueryEventFail
+	switch status {
+	case awsds.QueryFinished:
+		event.Type = QueryEventComplete
+		e.metrics.observeQuery(e.id, outcomeSuccess, event.Elapsed)
+	case awsds.QueryCanceled:
+		e.metrics.observeQuery(e.id, outcomeCancelled, event.Elapsed)
+	default:
+		e.metrics.observeQuery(e.id, outcomeFailure, event.Elapsed)
+	}
+	e.send(ctx, event)
+}
+
+// isContextError tells if err is due to the caller no longer waiting for the call
+func isContextError(ctx context.Context, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || ctx.Err() != nil
+}
+
+// errorOutcome tells if a query failed on its own or because the caller stopped waiting for it
+func errorOutcome(ctx context.Context, err error) string {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return outcomeTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return outcomeCancelled
+	}
+	return outcomeFailure
+}
@@ -0,0 +1,147 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	sqlApi "github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	"github.com/grafana/sqlds/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingListener keeps the events it receives
+type recordingListener struct {
+	mu     sync.Mutex
+	events []QueryEvent
+}
+
+func (l *recordingListener) OnQueryEvent(_ context.Context, event QueryEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+// failingAsyncDB fails to start queries
+type failingAsyncDB struct {
+	fakeAsyncDB
+}
+
+func (db *failingAsyncDB) StartQuery(_ context.Context, _ string, _ ...interface{}) (string, error) {
+	return "", errors.New("access denied")
+}
+
+// hangingAsyncDB hangs on the first status poll until its context is done
+type hangingAsyncDB struct {
+	fakeAsyncDB
+	polls atomic.Int32
+}
+
+func (db *hangingAsyncDB) QueryStatus(ctx context.Context, queryID string) (awsds.QueryStatus, error) {
+	if db.polls.Add(1) == 1 {
+		<-ctx.Done()
+		return awsds.QueryUnknown, ctx.Err()
+	}
+	return db.fakeAsyncDB.QueryStatus(ctx, queryID)
+}
+
+func TestGetAsyncDB_QueryListener(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newClient := func(db awsds.AsyncDB, listener QueryListener) AWSClient {
+		ds := newFakeAsyncClient(db, WithQueryListener(listener))
+		ds.(*awsClient).clock = func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		}
+		return ds
+	}
+
+	t.Run("it sends the start and complete events in order", func(t *testing.T) {
+		listener := &recordingListener{}
+		db, err := newClient(&fakeAsyncDB{queryID: "query-1"}, listener).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		queryID, err := db.StartQuery(ctx, "SELECT 1")
+		require.NoError(t, err)
+		_, err = db.QueryStatus(ctx, queryID)
+		require.NoError(t, err)
+
+		assert.Equal(t, []QueryEvent{
+			{Type: QueryEventStart, QueryID: "query-1", Duration: time.Second},
+			{Type: QueryEventStatus, QueryID: "query-1", Status: awsds.QueryFinished, Duration: time.Second, Elapsed: 3 * time.Second},
+			{Type: QueryEventComplete, QueryID: "query-1", Status: awsds.QueryFinished, Duration: time.Second, Elapsed: 3 * time.Second},
+		}, listener.events)
+	})
+
+	t.Run("it sends a fail event when the query can't start", func(t *testing.T) {
+		listener := &recordingListener{}
+		db, err := newClient(&failingAsyncDB{}, listener).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		_, err = db.StartQuery(ctx, "SELECT 1")
+		require.Error(t, err)
+
+		require.Len(t, listener.events, 1)
+		assert.Equal(t, QueryEventFail, listener.events[0].Type)
+		assert.EqualError(t, listener.events[0].Err, "access denied")
+	})
+
+	t.Run("it keeps following the query after a failed status poll", func(t *testing.T) {
+		listener := &recordingListener{}
+		statusErr := errors.New("ThrottlingException: rate exceeded")
+		driverDB := &failingStatusAsyncDB{fakeAsyncDB{queryID: "query-1"}, statusErr}
+		db, err := newClient(driverDB, listener).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		queryID, err := db.StartQuery(ctx, "SELECT 1")
+		require.NoError(t, err)
+		_, err = db.QueryStatus(ctx, queryID)
+		require.ErrorIs(t, err, statusErr)
+		driverDB.statusErr = nil
+		_, err = db.QueryStatus(ctx, queryID)
+		require.NoError(t, err)
+
+		assert.Equal(t, []QueryEvent{
+			{Type: QueryEventStart, QueryID: "query-1", Duration: time.Second},
+			{Type: QueryEventStatus, QueryID: "query-1", Duration: time.Second, Elapsed: 3 * time.Second, Err: statusErr},
+			{Type: QueryEventStatus, QueryID: "query-1", Status: awsds.QueryFinished, Duration: time.Second, Elapsed: 5 * time.Second},
+			{Type: QueryEventComplete, QueryID: "query-1", Status: awsds.QueryFinished, Duration: time.Second, Elapsed: 5 * time.Second},
+		}, listener.events)
+	})
+
+	t.Run("it keeps following the query after a status poll timed out", func(t *testing.T) {
+		listener := &recordingListener{}
+		registry := prometheus.NewRegistry()
+		ds := newFakeAsyncClient(&hangingAsyncDB{fakeAsyncDB: fakeAsyncDB{queryID: "query-1"}}, WithQueryListener(listener), WithMetrics(registry))
+		db, err := ds.GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		queryID, err := db.StartQuery(ctx, "SELECT 1")
+		require.NoError(t, err)
+		require.NoError(t, sqlApi.WaitOnQueryIDWithOptions(ctx, queryID, db, sqlApi.PollOptions{Interval: time.Millisecond, Timeout: time.Millisecond}))
+
+		types := []QueryEventType{}
+		for _, event := range listener.events {
+			types = append(types, event.Type)
+		}
+		assert.Equal(t, []QueryEventType{QueryEventStart, QueryEventStatus, QueryEventStatus, QueryEventComplete}, types)
+		assert.ErrorIs(t, listener.events[1].Err, context.DeadlineExceeded)
+		assert.NotZero(t, listener.events[3].Elapsed)
+		assert.Zero(t, counterValue(t, registry, "grafana_aws_sdk_sql_async_queries_total", "timeout"))
+		assert.Equal(t, float64(1), counterValue(t, registry, "grafana_aws_sdk_sql_async_queries_total", "success"))
+	})
+
+	t.Run("it returns the driver db without listener", func(t *testing.T) {
+		asyncDB := &fakeAsyncDB{}
+		db, err := newFakeAsyncClient(asyncDB).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Same(t, asyncDB, db)
+	})
+}
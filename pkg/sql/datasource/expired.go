@@ -0,0 +1,68 @@
+package datasource
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+)
+
+// RunWithDB runs fn with the DB returned by GetDB. When fn fails because the credentials expired,
+// e.g. when a query starts just as they do, the cached API and DB of the datasource are dropped,
+// the AWS sessions fetch fresh credentials and fn runs once more with a new DB. Without the DB
+// cache, the DBs are closed once fn returns.
+func (ds *awsClient) RunWithDB(ctx context.Context, id int64, options sqlds.Options, fn func(*sql.DB) error) error {
+	options = ds.normalizeOptions(options)
+	run := func() error {
+		db, err := ds.GetDB(ctx, id, options)
+		if err != nil {
+			return err
+		}
+		if !ds.cacheDB {
+			defer func() {
+				_ = db.Close()
+			}()
+		}
+		return fn(db)
+	}
+
+	err := run()
+	if !awsds.IsExpiredTokenError(err) {
+		return err
+	}
+	backend.Logger.Debug("Credentials expired during the query, retrying with fresh ones", "id", id)
+	ds.dropExpired(id, options)
+	return run()
+}
+
+// RunWithAsyncDB is RunWithDB for the DB returned by GetAsyncDB
+func (ds *awsClient) RunWithAsyncDB(ctx context.Context, id int64, options sqlds.Options, fn func(awsds.AsyncDB) error) error {
+	options = ds.normalizeOptions(options)
+	run := func() error {
+		db, err := ds.GetAsyncDB(ctx, id, options)
+		if err != nil {
+			return err
+		}
+		return fn(db)
+	}
+
+	err := run()
+	if !awsds.IsExpiredTokenError(err) {
+		return err
+	}
+	backend.Logger.Debug("Credentials expired during the query, retrying with fresh ones", "id", id)
+	ds.dropExpired(id, options)
+	return run()
+}
+
+// dropExpired drops what holds the expired credentials of the datasource: its cached APIs and DB
+// and the sessions of its session cache
+func (ds *awsClient) dropExpired(id int64, options sqlds.Options) {
+	ds.evictID(id, EvictionReasonExpiredToken)
+	ds.sessionCacheFor(options).Rotate()
+	if err := ds.ResetDB(id, options); err != nil {
+		backend.Logger.Debug("Could not close the DB of expired credentials", "id", id, "error", err)
+	}
+}
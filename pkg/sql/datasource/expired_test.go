@@ -0,0 +1,84 @@
+package datasource
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/sqlds/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunWithDB(t *testing.T) {
+	ctx := context.Background()
+	args := sqlds.Options{}
+	expired := awserr.New("ExpiredTokenException", "The security token included in the request is expired", nil)
+
+	t.Run("it retries once with a new db when the token expired", func(t *testing.T) {
+		evictions := []string{}
+		ds, dr := newOpeningClient(WithDBCache(), OnEvict(func(_ int64, reason string) {
+			evictions = append(evictions, reason)
+		}))
+		// cache the API, so it has to be evicted
+		_, err := ds.GetAPI(ctx, 1, args)
+		require.NoError(t, err)
+
+		dbs := []*sql.DB{}
+		err = ds.RunWithDB(ctx, 1, args, func(db *sql.DB) error {
+			dbs = append(dbs, db)
+			if len(dbs) == 1 {
+				return expired
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Len(t, dbs, 2)
+		assert.NotSame(t, dbs[0], dbs[1])
+		assert.Eventually(t, dr.connectors[0].isClosed, time.Second, time.Millisecond)
+		assert.Equal(t, []string{EvictionReasonExpiredToken}, evictions)
+	})
+
+	t.Run("it doesn't retry twice", func(t *testing.T) {
+		ds, _ := newOpeningClient(WithDBCache())
+		calls := 0
+		err := ds.RunWithDB(ctx, 1, args, func(_ *sql.DB) error {
+			calls++
+			return expired
+		})
+		assert.ErrorIs(t, err, expired)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("it doesn't retry other errors", func(t *testing.T) {
+		ds, dr := newOpeningClient()
+		queryErr := errors.New("syntax error")
+		calls := 0
+		err := ds.RunWithDB(ctx, 1, args, func(_ *sql.DB) error {
+			calls++
+			return queryErr
+		})
+		assert.ErrorIs(t, err, queryErr)
+		assert.Equal(t, 1, calls)
+		// uncached DBs are closed
+		assert.True(t, dr.connectors[0].isClosed())
+	})
+}
+
+func TestRunWithAsyncDB(t *testing.T) {
+	ds := newFakeAsyncClient(&fakeAsyncDB{})
+	calls := 0
+	err := ds.RunWithAsyncDB(context.Background(), 1, sqlds.Options{}, func(_ awsds.AsyncDB) error {
+		calls++
+		if calls == 1 {
+			return awserr.New("ExpiredToken", "The provided token has expired", nil)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
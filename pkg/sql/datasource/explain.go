@@ -0,0 +1,28 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	"github.com/grafana/sqlds/v4"
+)
+
+// ExplainQuery returns the estimated cost of the query, e.g. the bytes an Athena query would scan,
+// without running it, so users can check an expensive query first. The API of the datasource must
+// implement api.QueryEstimator, else it fails with ErrEstimateNotSupported.
+func (ds *awsClient) ExplainQuery(ctx context.Context, id int64, options sqlds.Options, query string) (api.QueryEstimate, error) {
+	dsAPI, err := ds.GetAPI(ctx, id, options)
+	if err != nil {
+		return api.QueryEstimate{}, err
+	}
+	estimator, ok := dsAPI.(api.QueryEstimator)
+	if !ok {
+		return api.QueryEstimate{}, ErrEstimateNotSupported
+	}
+	estimate, err := estimator.EstimateQuery(ctx, options, query)
+	if err != nil {
+		return api.QueryEstimate{}, fmt.Errorf("could not estimate the query: %w", wrapAWSError(err))
+	}
+	return estimate, nil
+}
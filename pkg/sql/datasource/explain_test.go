@@ -0,0 +1,59 @@
+package datasource
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	sqlApi "github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// estimatingAPI estimates queries, recording the ones it's asked for
+type estimatingAPI struct {
+	fakeAPI
+	estimate sqlApi.QueryEstimate
+	err      error
+	queries  []string
+}
+
+func (a *estimatingAPI) EstimateQuery(_ aws.Context, _ sqlds.Options, query string) (sqlApi.QueryEstimate, error) {
+	a.queries = append(a.queries, query)
+	return a.estimate, a.err
+}
+
+func TestExplainQuery(t *testing.T) {
+	ctx := context.Background()
+	newClient := func(dsAPI sqlApi.AWSAPI) AWSClient {
+		ds := New(simulatorLoader{api: dsAPI})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+		return ds
+	}
+
+	t.Run("it returns the estimate of the API", func(t *testing.T) {
+		dsAPI := &estimatingAPI{estimate: sqlApi.QueryEstimate{ScannedBytes: 42 << 30, Detail: "Fragment 0 [SOURCE]"}}
+
+		estimate, err := newClient(dsAPI).ExplainQuery(ctx, 1, sqlds.Options{}, "SELECT * FROM logs")
+		require.NoError(t, err)
+		assert.Equal(t, sqlApi.QueryEstimate{ScannedBytes: 42 << 30, Detail: "Fragment 0 [SOURCE]"}, estimate)
+		assert.Equal(t, []string{"SELECT * FROM logs"}, dsAPI.queries)
+	})
+
+	t.Run("it exposes the AWS error of a failed estimate", func(t *testing.T) {
+		dsAPI := &estimatingAPI{err: awserr.New("InvalidRequestException", "line 1:15: Table logs does not exist", nil)}
+
+		_, err := newClient(dsAPI).ExplainQuery(ctx, 1, sqlds.Options{}, "SELECT * FROM logs")
+		var awsErr *AWSError
+		require.ErrorAs(t, err, &awsErr)
+		assert.Equal(t, "InvalidRequestException", awsErr.Code())
+	})
+
+	t.Run("it's not supported by other APIs", func(t *testing.T) {
+		_, err := newClient(fakeAPI{}).ExplainQuery(ctx, 1, sqlds.Options{}, "SELECT * FROM logs")
+		assert.ErrorIs(t, err, ErrEstimateNotSupported)
+	})
+}
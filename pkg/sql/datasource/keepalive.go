@@ -0,0 +1,68 @@
+package datasource
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// keepAlive pings a cached DB periodically until it's stopped
+type keepAlive struct {
+	done chan struct{}
+	once sync.Once
+}
+
+func (k *keepAlive) stop() {
+	k.once.Do(func() {
+		close(k.done)
+	})
+}
+
+// newTicker returns the ticks of a ticker of the given interval and the function stopping it
+func (ds *awsClient) newTicker(interval time.Duration) (<-chan time.Time, func()) {
+	if ds.ticker != nil {
+		return ds.ticker(interval)
+	}
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// startKeepAlive pings db at the keep-alive interval of the client, so its connections aren't
+// dropped by NAT gateways and firewalls while idle. It stops once db is reset or evicted from the
+// cache, see stopKeepAlive.
+func (ds *awsClient) startKeepAlive(key string, db *sql.DB) {
+	if ds.keepAliveEvery <= 0 {
+		return
+	}
+	k := &keepAlive{done: make(chan struct{})}
+	if previous, loaded := ds.keepAlives.Swap(key, k); loaded {
+		previous.(*keepAlive).stop()
+	}
+	ticks, stopTicker := ds.newTicker(ds.keepAliveEvery)
+	go func() {
+		defer stopTicker()
+		for {
+			select {
+			case <-k.done:
+				return
+			case <-ticks:
+				ctx, cancel := context.WithTimeout(context.Background(), ds.keepAliveEvery)
+				err := db.PingContext(ctx)
+				cancel()
+				if err != nil {
+					backend.Logger.Debug("Keep-alive ping failed", "key", key, "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// stopKeepAlive stops the keep-alive of the DB cached under key, if any
+func (ds *awsClient) stopKeepAlive(key string) {
+	if k, ok := ds.keepAlives.LoadAndDelete(key); ok {
+		k.(*keepAlive).stop()
+	}
+}
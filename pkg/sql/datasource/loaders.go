@@ -0,0 +1,78 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/driver"
+	asyncDriver "github.com/grafana/grafana-aws-sdk/pkg/sql/driver/async"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/models"
+)
+
+// APILoader creates the API of a datasource from its settings
+type APILoader func(ctx context.Context, cache *awsds.SessionCache, settings models.Settings) (api.AWSAPI, error)
+
+// ErrAsyncNotSupported is returned by Loaders.LoadAsyncDriver when no async driver loader is set
+var ErrAsyncNotSupported = errors.New("async queries are not supported by this datasource")
+
+// ErrLoaderNotSet is returned when Loaders misses the loader of a stage
+var ErrLoaderNotSet = errors.New("loader not set")
+
+// Loaders builds a Loader out of the loader functions of a plugin, so they are registered once with New:
+//
+//	ds := datasource.New(datasource.Loaders{Settings: ..., API: ..., Driver: ..., AsyncDriver: ...})
+//
+// A plugin can embed Loaders and define one of the Load methods to override a single stage.
+// The Context variants receive the context of the request and are used instead of their
+// counterpart when set. Existing loaders can be adapted with their WithContext method.
+type Loaders struct {
+	Settings    models.Loader
+	API         APILoader
+	Driver      driver.Loader
+	AsyncDriver asyncDriver.Loader
+
+	ContextSettings    models.ContextLoader
+	ContextDriver      driver.ContextLoader
+	ContextAsyncDriver asyncDriver.ContextLoader
+}
+
+// LoadSettings returns nil without a settings loader, which the client then fails to parse
+func (l Loaders) LoadSettings(ctx context.Context) models.Settings {
+	if l.ContextSettings != nil {
+		return l.ContextSettings(ctx)
+	}
+	if l.Settings == nil {
+		return nil
+	}
+	return l.Settings()
+}
+
+func (l Loaders) LoadAPI(ctx context.Context, cache *awsds.SessionCache, settings models.Settings) (api.AWSAPI, error) {
+	if l.API == nil {
+		return nil, fmt.Errorf("%w: API", ErrLoaderNotSet)
+	}
+	return l.API(ctx, cache, settings)
+}
+
+func (l Loaders) LoadDriver(ctx context.Context, dsAPI api.AWSAPI) (driver.Driver, error) {
+	if l.ContextDriver != nil {
+		return l.ContextDriver(ctx, dsAPI)
+	}
+	if l.Driver == nil {
+		return nil, fmt.Errorf("%w: Driver", ErrLoaderNotSet)
+	}
+	return l.Driver(dsAPI)
+}
+
+func (l Loaders) LoadAsyncDriver(ctx context.Context, dsAPI api.AWSAPI) (asyncDriver.Driver, error) {
+	if l.ContextAsyncDriver != nil {
+		return l.ContextAsyncDriver(ctx, dsAPI)
+	}
+	if l.AsyncDriver == nil {
+		return nil, ErrAsyncNotSupported
+	}
+	return l.AsyncDriver(dsAPI)
+}
@@ -0,0 +1,158 @@
+package datasource
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	sqlApi "github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	sqlDriver "github.com/grafana/grafana-aws-sdk/pkg/sql/driver"
+	asyncDriver "github.com/grafana/grafana-aws-sdk/pkg/sql/driver/async"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLoaders(calls *[]string, db *sql.DB) Loaders {
+	return Loaders{
+		Settings: func() models.Settings {
+			*calls = append(*calls, "settings")
+			return &fakeSettings{}
+		},
+		API: func(_ context.Context, _ *awsds.SessionCache, _ models.Settings) (sqlApi.AWSAPI, error) {
+			*calls = append(*calls, "api")
+			return fakeAPI{}, nil
+		},
+		Driver: func(sqlApi.AWSAPI) (sqlDriver.Driver, error) {
+			*calls = append(*calls, "driver")
+			return &fakeDriver{db: db}, nil
+		},
+	}
+}
+
+// overridingLoaders replaces the driver loader of the embedded Loaders
+type overridingLoaders struct {
+	Loaders
+	db *sql.DB
+}
+
+func (l overridingLoaders) LoadDriver(_ context.Context, _ sqlApi.AWSAPI) (sqlDriver.Driver, error) {
+	return &fakeDriver{db: l.db}, nil
+}
+
+func TestLoaders(t *testing.T) {
+	t.Run("it uses the registered loaders", func(t *testing.T) {
+		calls := []string{}
+		db := &sql.DB{}
+		ds := New(testLoaders(&calls, db))
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		res, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Same(t, db, res)
+		assert.Equal(t, []string{"settings", "api", "driver"}, calls)
+
+		_, err = ds.GetAsyncDB(context.Background(), 1, sqlds.Options{})
+		require.ErrorIs(t, err, ErrAsyncNotSupported)
+	})
+
+	t.Run("it uses an overridden loader", func(t *testing.T) {
+		calls := []string{}
+		db := &sql.DB{}
+		ds := New(overridingLoaders{Loaders: testLoaders(&calls, &sql.DB{}), db: db})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		res, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Same(t, db, res)
+		assert.Equal(t, []string{"settings", "api"}, calls)
+	})
+}
+
+func TestLoaders_NotSet(t *testing.T) {
+	ctx := context.Background()
+	loaders := testLoaders(&[]string{}, &sql.DB{})
+
+	t.Run("it fails without a settings loader", func(t *testing.T) {
+		ds := New(Loaders{API: loaders.API, Driver: loaders.Driver})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		_, err := ds.GetDB(ctx, 1, sqlds.Options{})
+		assert.ErrorIs(t, err, ErrLoaderNotSet)
+	})
+
+	t.Run("it fails without an API loader", func(t *testing.T) {
+		ds := New(Loaders{Settings: loaders.Settings, Driver: loaders.Driver})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		_, err := ds.GetDB(ctx, 1, sqlds.Options{})
+		assert.ErrorIs(t, err, ErrLoaderNotSet)
+		assert.ErrorContains(t, err, "API")
+	})
+
+	t.Run("it fails without a driver loader", func(t *testing.T) {
+		ds := New(Loaders{Settings: loaders.Settings, API: loaders.API})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		_, err := ds.GetDB(ctx, 1, sqlds.Options{})
+		assert.ErrorIs(t, err, ErrLoaderNotSet)
+		assert.ErrorContains(t, err, "Driver")
+	})
+}
+
+type tenantKey struct{}
+
+func TestLoaders_Context(t *testing.T) {
+	ctx := context.WithValue(context.Background(), tenantKey{}, "tenant-1")
+
+	t.Run("it passes the request context to the context loaders", func(t *testing.T) {
+		tenants := map[string]any{}
+		asyncDB := &fakeAsyncDB{}
+		ds := New(Loaders{
+			ContextSettings: func(ctx context.Context) models.Settings {
+				tenants["settings"] = ctx.Value(tenantKey{})
+				return &fakeSettings{}
+			},
+			API: func(_ context.Context, _ *awsds.SessionCache, _ models.Settings) (sqlApi.AWSAPI, error) {
+				return fakeAPI{}, nil
+			},
+			ContextDriver: func(ctx context.Context, _ sqlApi.AWSAPI) (sqlDriver.Driver, error) {
+				tenants["driver"] = ctx.Value(tenantKey{})
+				return &fakeDriver{db: &sql.DB{}}, nil
+			},
+			ContextAsyncDriver: func(ctx context.Context, _ sqlApi.AWSAPI) (asyncDriver.Driver, error) {
+				tenants["async driver"] = ctx.Value(tenantKey{})
+				return &fakeAsyncDriver{db: asyncDB}, nil
+			},
+		})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		_, err := ds.GetDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+		_, err = ds.GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]any{"settings": "tenant-1", "driver": "tenant-1", "async driver": "tenant-1"}, tenants)
+	})
+
+	t.Run("it adapts the loaders without context", func(t *testing.T) {
+		calls := []string{}
+		loaders := testLoaders(&calls, &sql.DB{})
+		db := &sql.DB{}
+		ds := New(Loaders{
+			ContextSettings: loaders.Settings.WithContext(),
+			API:             loaders.API,
+			ContextDriver: sqlDriver.Loader(func(sqlApi.AWSAPI) (sqlDriver.Driver, error) {
+				return &fakeDriver{db: db}, nil
+			}).WithContext(),
+		})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		res, err := ds.GetDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Same(t, db, res)
+		assert.Equal(t, []string{"settings", "api"}, calls)
+	})
+}
@@ -0,0 +1,73 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// keyLocks serializes the work done for the same key, so concurrent callers missing the cache
+// wait for the first one instead of creating the same instance again. The lock of a key is dropped
+// once no caller holds or waits for it.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	ch chan struct{}
+	// refs counts the callers holding or waiting for the lock, guarded by keyLocks.mu
+	refs int
+}
+
+// lock blocks until the lock of key is acquired or ctx is done. The returned function releases it.
+func (l *keyLocks) lock(ctx context.Context, key string) (func(), error) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*keyLock{}
+	}
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{ch: make(chan struct{}, 1)}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.mu.Unlock()
+
+	select {
+	case kl.ch <- struct{}{}:
+		return func() {
+			<-kl.ch
+			l.release(key, kl)
+		}, nil
+	case <-ctx.Done():
+		l.release(key, kl)
+		return nil, ctx.Err()
+	}
+}
+
+// release drops a reference to the lock of key, deleting it once unreferenced
+func (l *keyLocks) release(key string, kl *keyLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kl.refs--
+	if kl.refs == 0 {
+		delete(l.locks, key)
+	}
+}
+
+// waitLock locks key like locks.lock, waiting at most for the creation wait of the client, if any,
+// for a creation in progress to complete
+func (ds *awsClient) waitLock(ctx context.Context, locks *keyLocks, key string) (func(), error) {
+	if ds.creationWait <= 0 {
+		return locks.lock(ctx, key)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, ds.creationWait)
+	defer cancel()
+	unlock, err := locks.lock(waitCtx, key)
+	if err != nil && errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, fmt.Errorf("%w (waited %s)", ErrCreationWaitTimeout, ds.creationWait)
+	}
+	return unlock, err
+}
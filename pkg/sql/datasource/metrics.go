@@ -0,0 +1,129 @@
+package datasource
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/driver"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of the async queries
+const (
+	outcomeSuccess   = "success"
+	outcomeFailure   = "failure"
+	outcomeCancelled = "cancelled"
+	outcomeTimeout   = "timeout"
+)
+
+// metrics holds the connection establishment histograms and the async query metrics. A nil *metrics
+// records nothing.
+type metrics struct {
+	driverDuration *prometheus.HistogramVec
+	dbDuration     *prometheus.HistogramVec
+	queryDuration  *prometheus.HistogramVec
+	queries        *prometheus.CounterVec
+}
+
+// Default namespace and subsystem of the metrics
+const (
+	metricsNamespace = "grafana_aws_sdk"
+	metricsSubsystem = "sql"
+)
+
+// metricsConfig is where and under which names the metrics are registered
+type metricsConfig struct {
+	registerer prometheus.Registerer
+	namespace  string
+	subsystem  string
+}
+
+// newMetrics registers the metrics, labeled with the given environment if it isn't empty
+func newMetrics(config metricsConfig, environment string) *metrics {
+	registerer, namespace, subsystem := config.registerer, config.namespace, config.subsystem
+	var constLabels prometheus.Labels
+	if environment != "" {
+		constLabels = prometheus.Labels{"environment": environment}
+	}
+	return &metrics{
+		driverDuration: registerHistogram(registerer, prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "create_driver_duration_seconds",
+			Help:        "Time taken to create the driver of a datasource.",
+		}),
+		dbDuration: registerHistogram(registerer, prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "create_db_duration_seconds",
+			Help:        "Time taken to open the DB of a datasource.",
+		}),
+		queryDuration: registerCollector(registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "async_query_duration_seconds",
+			Help:        "Time from the start of an async query to its end, as seen by status polls.",
+			Buckets:     []float64{.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800},
+		}, []string{"datasource_id"})),
+		queries: registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "async_queries_total",
+			Help:        "Number of async queries by outcome: success, failure, cancelled or timeout.",
+		}, []string{"datasource_id", "outcome"})),
+	}
+}
+
+// registerHistogram registers a histogram labeled by datasource id and driver type,
+// reusing the one already registered by another client if any
+func registerHistogram(registerer prometheus.Registerer, opts prometheus.HistogramOpts) *prometheus.HistogramVec {
+	return registerCollector(registerer, prometheus.NewHistogramVec(opts, []string{"datasource_id", "driver"}))
+}
+
+// registerCollector registers collector, returning the same collector already registered by another
+// client if any. If it can't be registered, e.g. because a metric of the same name has other labels,
+// the error is logged and collector is returned unregistered, so its values are recorded but not exported.
+func registerCollector[T prometheus.Collector](registerer prometheus.Registerer, collector T) T {
+	if err := registerer.Register(collector); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if errors.As(err, &registered) {
+			if existing, ok := registered.ExistingCollector.(T); ok {
+				return existing
+			}
+		}
+		backend.Logger.Error("Failed to register the metrics of the client", "error", err)
+	}
+	return collector
+}
+
+func (m *metrics) observeDriver(id int64, dr any, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.driverDuration.WithLabelValues(strconv.FormatInt(id, 10), driver.NameOf(dr)).Observe(elapsed.Seconds())
+}
+
+func (m *metrics) observeDB(id int64, dr any, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.dbDuration.WithLabelValues(strconv.FormatInt(id, 10), driver.NameOf(dr)).Observe(elapsed.Seconds())
+}
+
+// observeQuery records the outcome of an async query, and its duration when it's known
+func (m *metrics) observeQuery(id int64, outcome string, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	label := strconv.FormatInt(id, 10)
+	m.queries.WithLabelValues(label, outcome).Inc()
+	if elapsed > 0 {
+		m.queryDuration.WithLabelValues(label).Observe(elapsed.Seconds())
+	}
+}
@@ -0,0 +1,226 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sampleCount(t *testing.T, registry *prometheus.Registry, name string) (uint64, map[string]string) {
+	t.Helper()
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		require.Len(t, family.GetMetric(), 1)
+		metric := family.GetMetric()[0]
+		labels := map[string]string{}
+		for _, label := range metric.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		return metric.GetHistogram().GetSampleCount(), labels
+	}
+	return 0, nil
+}
+
+func TestGetDB_Metrics(t *testing.T) {
+	t.Run("it observes the driver and db creation", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		ds, _ := newOpeningClient(WithMetrics(registry))
+		ds.Init(backend.DataSourceInstanceSettings{ID: 7})
+
+		_, err := ds.GetDB(context.Background(), 7, sqlds.Options{})
+		require.NoError(t, err)
+
+		for _, name := range []string{
+			"grafana_aws_sdk_sql_create_driver_duration_seconds",
+			"grafana_aws_sdk_sql_create_db_duration_seconds",
+		} {
+			count, labels := sampleCount(t, registry, name)
+			assert.Equal(t, uint64(1), count, name)
+			assert.Equal(t, map[string]string{"datasource_id": "7", "driver": "unknown"}, labels, name)
+		}
+	})
+
+	t.Run("it shares the histograms between clients", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		for i := 0; i < 2; i++ {
+			ds, _ := newOpeningClient(WithMetrics(registry))
+			ds.Init(backend.DataSourceInstanceSettings{ID: 7})
+			_, err := ds.GetDB(context.Background(), 7, sqlds.Options{})
+			require.NoError(t, err)
+		}
+
+		count, _ := sampleCount(t, registry, "grafana_aws_sdk_sql_create_db_duration_seconds")
+		assert.Equal(t, uint64(2), count)
+	})
+
+	t.Run("it names the metrics after the configured namespace", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		athena, _ := newOpeningClient(WithNamespacedMetrics(registry, "grafana_athena", "sql"))
+		redshift, _ := newOpeningClient(WithNamespacedMetrics(registry, "grafana_redshift", "sql"))
+		for _, ds := range []AWSClient{athena, redshift} {
+			_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+			require.NoError(t, err)
+		}
+
+		families, err := registry.Gather()
+		require.NoError(t, err)
+		names := []string{}
+		for _, family := range families {
+			names = append(names, family.GetName())
+		}
+		assert.ElementsMatch(t, []string{
+			"grafana_athena_sql_create_driver_duration_seconds",
+			"grafana_athena_sql_create_db_duration_seconds",
+			"grafana_redshift_sql_create_driver_duration_seconds",
+			"grafana_redshift_sql_create_db_duration_seconds",
+		}, names)
+	})
+
+	t.Run("it labels the metrics with the environment", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		for _, environment := range []string{"dev", "prod"} {
+			ds, _ := newOpeningClient(WithMetrics(registry), WithEnvironment(environment, false))
+			_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+			require.NoError(t, err)
+		}
+
+		families, err := registry.Gather()
+		require.NoError(t, err)
+		environments := []string{}
+		for _, family := range families {
+			if family.GetName() != "grafana_aws_sdk_sql_create_db_duration_seconds" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() == "environment" {
+						environments = append(environments, label.GetValue())
+					}
+				}
+			}
+		}
+		assert.ElementsMatch(t, []string{"dev", "prod"}, environments)
+	})
+
+	t.Run("it doesn't panic when a metric of the same name has other labels", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "grafana_aws_sdk",
+			Subsystem: "sql",
+			Name:      "create_db_duration_seconds",
+			Help:      "Another metric.",
+		}, []string{"database"}))
+
+		ds, _ := newOpeningClient(WithMetrics(registry))
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		count, _ := sampleCount(t, registry, "grafana_aws_sdk_sql_create_driver_duration_seconds")
+		assert.Equal(t, uint64(1), count)
+	})
+
+	t.Run("it records nothing without a registry", func(t *testing.T) {
+		client, _ := newOpeningClient()
+		ds := client.(*awsClient)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 7})
+
+		_, err := ds.GetDB(context.Background(), 7, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Nil(t, ds.metrics)
+	})
+}
+
+// counterValue returns the value of the counter with the given outcome label
+func counterValue(t *testing.T, registry *prometheus.Registry, name, outcome string) float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "outcome" && label.GetValue() == outcome {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// slowAsyncDB never reports a status before the context of the poll is done
+type slowAsyncDB struct {
+	fakeAsyncDB
+}
+
+func (db *slowAsyncDB) QueryStatus(ctx context.Context, _ string) (awsds.QueryStatus, error) {
+	<-ctx.Done()
+	return awsds.QueryUnknown, ctx.Err()
+}
+
+func TestGetAsyncDB_Metrics(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("it counts the successful queries and observes their duration", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		db, err := newFakeAsyncClient(&fakeAsyncDB{queryID: "query-1"}, WithMetrics(registry)).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		queryID, err := db.StartQuery(ctx, "SELECT 1")
+		require.NoError(t, err)
+		_, err = db.QueryStatus(ctx, queryID)
+		require.NoError(t, err)
+
+		assert.Equal(t, float64(1), counterValue(t, registry, "grafana_aws_sdk_sql_async_queries_total", "success"))
+		count, labels := sampleCount(t, registry, "grafana_aws_sdk_sql_async_query_duration_seconds")
+		assert.Equal(t, uint64(1), count)
+		assert.Equal(t, map[string]string{"datasource_id": "1"}, labels)
+	})
+
+	t.Run("it counts the queries timing out", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		db, err := newFakeAsyncClient(&slowAsyncDB{fakeAsyncDB{queryID: "query-1"}}, WithMetrics(registry)).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		queryID, err := db.StartQuery(ctx, "SELECT 1")
+		require.NoError(t, err)
+		pollCtx, cancel := context.WithTimeout(ctx, time.Millisecond)
+		defer cancel()
+		_, err = db.QueryStatus(pollCtx, queryID)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		assert.Equal(t, float64(1), counterValue(t, registry, "grafana_aws_sdk_sql_async_queries_total", "timeout"))
+		assert.Zero(t, counterValue(t, registry, "grafana_aws_sdk_sql_async_queries_total", "success"))
+	})
+
+	t.Run("it counts a query once after a failed status poll", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		driverDB := &failingStatusAsyncDB{fakeAsyncDB{queryID: "query-1"}, errors.New("ThrottlingException: rate exceeded")}
+		db, err := newFakeAsyncClient(driverDB, WithMetrics(registry)).GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		queryID, err := db.StartQuery(ctx, "SELECT 1")
+		require.NoError(t, err)
+		_, err = db.QueryStatus(ctx, queryID)
+		require.Error(t, err)
+		driverDB.statusErr = nil
+		_, err = db.QueryStatus(ctx, queryID)
+		require.NoError(t, err)
+
+		assert.Zero(t, counterValue(t, registry, "grafana_aws_sdk_sql_async_queries_total", "failure"))
+		assert.Equal(t, float64(1), counterValue(t, registry, "grafana_aws_sdk_sql_async_queries_total", "success"))
+	})
+}
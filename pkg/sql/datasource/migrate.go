@@ -0,0 +1,50 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// SchemaVersionKey is the json data field holding the version of the settings schema a datasource
+// was saved with. Datasources without it are at version 0.
+const SchemaVersionKey = "schemaVersion"
+
+// SettingsMigration rewrites the json data of a datasource saved with a version of the settings
+// schema into the shape of the next version, e.g. renaming a field. It can modify jsonData in place.
+type SettingsMigration func(jsonData map[string]any) error
+
+// migrateSettings returns config with its json data migrated to the latest schema version, running
+// in turn the migrations registered from its version on. The stored configuration isn't modified.
+func (ds *awsClient) migrateSettings(config backend.DataSourceInstanceSettings) (backend.DataSourceInstanceSettings, error) {
+	if len(ds.migrations) == 0 || len(config.JSONData) == 0 {
+		return config, nil
+	}
+	jsonData := map[string]any{}
+	if err := json.Unmarshal(config.JSONData, &jsonData); err != nil {
+		return config, fmt.Errorf("could not unmarshal the json data to migrate: %w", err)
+	}
+	version := 0
+	if v, ok := jsonData[SchemaVersionKey].(float64); ok {
+		version = int(v)
+	}
+	migrated := false
+	for migrate, ok := ds.migrations[version]; ok; migrate, ok = ds.migrations[version] {
+		if err := migrate(jsonData); err != nil {
+			return config, fmt.Errorf("could not migrate the settings from version %d: %w", version, err)
+		}
+		version++
+		jsonData[SchemaVersionKey] = version
+		migrated = true
+	}
+	if !migrated {
+		return config, nil
+	}
+	raw, err := json.Marshal(jsonData)
+	if err != nil {
+		return config, fmt.Errorf("could not marshal the migrated json data: %w", err)
+	}
+	config.JSONData = raw
+	return config, nil
+}
@@ -0,0 +1,319 @@
+package datasource
+
+import (
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/sqlds/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option configures optional behavior of the client returned by New
+type Option func(*awsClient)
+
+// WithRowTransform sets a transform applied to every row returned by the AsyncDB instances of GetAsyncDB.
+// It can be used to mask or redact columns before results leave the driver.
+func WithRowTransform(transform RowTransform) Option {
+	return func(ds *awsClient) {
+		ds.rowTransform = transform
+	}
+}
+
+// WithQueryListener sets a listener receiving the lifecycle events of the queries started, polled and
+// completed through the AsyncDB instances of GetAsyncDB, with their native query id and timings
+func WithQueryListener(listener QueryListener) Option {
+	return func(ds *awsClient) {
+		ds.queryListener = listener
+	}
+}
+
+// WithWarmConcurrency limits the number of APIs created at once by InitAll and WarmRegions
+func WithWarmConcurrency(n int) Option {
+	return func(ds *awsClient) {
+		ds.warmConcurrency = n
+	}
+}
+
+// WithRegionAliases sets the connection option keys accepted as aliases of models.RegionKey.
+// When several are present, the canonical key wins, then the aliases in the given order.
+func WithRegionAliases(aliases ...string) Option {
+	return func(ds *awsClient) {
+		ds.regionAliases = aliases
+	}
+}
+
+// WithRegionResolver sets the resolver of the logical regions of the settings, e.g. an environment
+// name, into AWS regions. Without it, regions are used as they are set.
+func WithRegionResolver(resolver RegionResolver) Option {
+	return func(ds *awsClient) {
+		ds.regionResolver = resolver
+	}
+}
+
+// WithEmptyOptionsIgnored makes the connection options set to an empty string leave the settings
+// unchanged, as if they were missing, instead of clearing them. It suits front-ends sending every
+// option of their query editor, filled or not.
+func WithEmptyOptionsIgnored() Option {
+	return func(ds *awsClient) {
+		ds.skipEmptyArgs = true
+	}
+}
+
+// WithDBCache makes GetDB cache the *sql.DB of each datasource id and connection options,
+// returning the same instance until it's reset with ResetDB.
+func WithDBCache() Option {
+	return func(ds *awsClient) {
+		ds.cacheDB = true
+	}
+}
+
+// WithOptionsNormalizer sets a function rewriting the connection options before they're used, e.g.
+// to drop a display label. Options normalized to the same values share the cached APIs and DBs and
+// the settings never see what's removed. It must be idempotent, as it may run more than once per call.
+func WithOptionsNormalizer(normalize func(options sqlds.Options) sqlds.Options) Option {
+	return func(ds *awsClient) {
+		ds.normalizer = normalize
+	}
+}
+
+// WithOptionsMarshaler makes the client serialize the connection options of its cache keys with
+// marshal instead of CanonicalOptions, e.g. to keep the keys of a previous format. The ConnectionKey
+// function then no longer returns the keys of the client, its ConnectionKey method does.
+func WithOptionsMarshaler(marshal OptionsMarshaler) Option {
+	return func(ds *awsClient) {
+		ds.optionsMarshal = marshal
+	}
+}
+
+// WithSettingsMigration registers the migration of the json data saved with the given version of the
+// settings schema, see SchemaVersionKey, to the next one. Before settings are loaded, the migrations
+// run in turn from the version of the datasource on, so saved datasources keep working as fields are
+// renamed or reshaped.
+func WithSettingsMigration(fromVersion int, migrate SettingsMigration) Option {
+	return func(ds *awsClient) {
+		if ds.migrations == nil {
+			ds.migrations = map[int]SettingsMigration{}
+		}
+		ds.migrations[fromVersion] = migrate
+	}
+}
+
+// WithKeepAlive makes the DBs cached WithDBCache be pinged at the given interval, so their idle
+// connections aren't dropped by NAT gateways or firewalls and the first query after a pause works.
+// The pings stop once the DB is reset with ResetDB or closed.
+func WithKeepAlive(interval time.Duration) Option {
+	return func(ds *awsClient) {
+		ds.keepAliveEvery = interval
+	}
+}
+
+// WithQueryTracking keeps track of the async queries started through GetAsyncDB until they are seen
+// finished or cancelled, so ListRunningQueries and CancelAllQueries can list and stop them. Queries
+// whose status is no longer polled, e.g. after an error, are forgotten a day after they started.
+func WithQueryTracking() Option {
+	return func(ds *awsClient) {
+		ds.trackQueries = true
+	}
+}
+
+// WithConnectRetry makes the client open the DBs again, up to retries times, when they fail to
+// resolve or dial the database host, e.g. on a transient DNS failure. The first retry waits for
+// backoff, each next one twice as long, unless the context of the call is done first. It only helps
+// drivers dialing when they open their DBs, most only dial with the first query. The AWS API
+// requests are retried apart, see WithRetryClassifier.
+func WithConnectRetry(retries int, backoff time.Duration) Option {
+	return func(ds *awsClient) {
+		ds.connectRetries = retries
+		ds.connectBackoff = backoff
+	}
+}
+
+// WithMinTLSVersion makes the client refuse TLS versions older than version, e.g. tls.VersionTLS12,
+// both for the AWS sessions (see awsds.WithMinTLSVersion) and for the drivers, which must then
+// implement driver.TLSConfigurer.
+func WithMinTLSVersion(version uint16) Option {
+	return func(ds *awsClient) {
+		ds.minTLSVersion = version
+		ds.sessionCacheOptions = append(ds.sessionCacheOptions, awsds.WithMinTLSVersion(version))
+	}
+}
+
+// WithValidateOnHit makes GetDB ping the cached DBs, for at most timeout, before returning them. A DB
+// failing the ping, e.g. after its connections were dropped, is closed and a new one is opened. It
+// adds the latency of a ping to every GetDB, only the DBs cached WithDBCache are validated.
+func WithValidateOnHit(timeout time.Duration) Option {
+	return func(ds *awsClient) {
+		ds.hitValidation = timeout
+	}
+}
+
+// WithCreationWait bounds the time GetAPI and GetDB wait for the API or DB another caller is creating
+// for the same connection, which they get too once created. They then fail with
+// ErrCreationWaitTimeout instead of waiting as long as their context allows.
+func WithCreationWait(timeout time.Duration) Option {
+	return func(ds *awsClient) {
+		ds.creationWait = timeout
+	}
+}
+
+// WithAcquireTimeout bounds the time Conn waits for a free connection of the DB pool, when its
+// MaxOpenConns are all running queries, independently of the query timeout. Conn then fails with
+// ErrPoolExhausted. Opening a new connection in a pool not full isn't bounded.
+func WithAcquireTimeout(timeout time.Duration) Option {
+	return func(ds *awsClient) {
+		ds.acquireTimeout = timeout
+	}
+}
+
+// WithMaxOptionsSize rejects the connection options whose keys and values add up to more than the
+// given number of bytes with ErrOptionsTooLarge, before they are applied to the settings, so an
+// oversized parameter never reaches the driver
+func WithMaxOptionsSize(bytes int) Option {
+	return func(ds *awsClient) {
+		ds.maxOptionsSize = bytes
+	}
+}
+
+// WithAPITTL makes cached APIs expire after the given duration, so they are created again on next use
+func WithAPITTL(ttl time.Duration) Option {
+	return func(ds *awsClient) {
+		ds.apiTTL = ttl
+	}
+}
+
+// OnEvict sets a callback fired whenever an API is removed from the cache, with the datasource id
+// and one of the EvictionReason constants
+func OnEvict(callback func(id int64, reason string)) Option {
+	return func(ds *awsClient) {
+		ds.onEvict = callback
+	}
+}
+
+// WithMetrics registers histograms of the time taken to create drivers and DBs, labeled by
+// datasource id and driver name, see driver.NameOf, to the given registerer. The async queries run through GetAsyncDB
+// are counted by outcome and their duration observed, labeled by datasource id. Without it no
+// metrics are recorded.
+func WithMetrics(registerer prometheus.Registerer) Option {
+	return func(ds *awsClient) {
+		ds.metricsConfig = &metricsConfig{registerer: registerer, namespace: metricsNamespace, subsystem: metricsSubsystem}
+	}
+}
+
+// WithNamespacedMetrics is WithMetrics with the metrics named <namespace>_<subsystem>_<name> instead
+// of grafana_aws_sdk_sql_<name>, so the metrics of plugins sharing a process don't collide. Either
+// can be empty to be left out of the names.
+func WithNamespacedMetrics(registerer prometheus.Registerer, namespace, subsystem string) Option {
+	return func(ds *awsClient) {
+		ds.metricsConfig = &metricsConfig{registerer: registerer, namespace: namespace, subsystem: subsystem}
+	}
+}
+
+// WithEnvironment labels the client with a deployment environment, e.g. "dev" or "prod", for the
+// processes serving several of them. The metrics get an "environment" label, so the clients sharing
+// a registerer should all set one, and the Stats report it. With isolate, the environment is also
+// part of the connection keys, keeping caches aligned with them from reusing connections across
+// environments.
+func WithEnvironment(environment string, isolate bool) Option {
+	return func(ds *awsClient) {
+		ds.environment = environment
+		ds.isolateEnv = isolate
+	}
+}
+
+// WithErrorMapper sets a function translating the errors met while creating APIs, drivers and DBs,
+// e.g. to present AWS error codes with custom messages. The mapper should wrap the error it
+// receives so the cause stays accessible.
+func WithErrorMapper(mapper func(error) error) Option {
+	return func(ds *awsClient) {
+		ds.errorMapper = mapper
+	}
+}
+
+// WithDefaultAuthType sets the auth type used by datasources whose settings don't set one,
+// instead of relying on the default AWS SDK credentials chain
+func WithDefaultAuthType(authType awsds.AuthType) Option {
+	return func(ds *awsClient) {
+		ds.defaults.AuthType = authType.String()
+	}
+}
+
+// WithEmptyResults makes the AsyncDB instances of GetAsyncDB return an empty result instead of the
+// error the driver fails queries without rows with. Only drivers implementing async.NoRowsMatcher
+// are affected.
+func WithEmptyResults() Option {
+	return func(ds *awsClient) {
+		ds.emptyResults = true
+	}
+}
+
+// WithZeroIDGuard makes the client fail with ErrZeroID for datasources with id 0, like provisioned
+// datasources not saved yet. Otherwise they all share the cache entries of id 0.
+func WithZeroIDGuard() Option {
+	return func(ds *awsClient) {
+		ds.zeroIDGuard = true
+	}
+}
+
+// WithStrictAuth makes the client reject settings with conflicting auth values, like access keys
+// set for the EC2 IAM role auth type, instead of silently using one of them
+func WithStrictAuth() Option {
+	return func(ds *awsClient) {
+		ds.strictAuth = true
+	}
+}
+
+// WithRetryClassifier sets which errors are worth retrying, instead of the standard AWS classification
+// (see awsds.IsRetryableError). The AWS requests of the APIs are retried accordingly and the errors of
+// GetDB and GetAsyncDB report it in ConnectionError.Retryable.
+func WithRetryClassifier(classify func(error) bool) Option {
+	return func(ds *awsClient) {
+		ds.retryClassifier = classify
+		ds.sessionCacheOptions = append(ds.sessionCacheOptions, awsds.WithRetryClassifier(classify))
+	}
+}
+
+// WithSessionCacheOptions configures the AWS session caches of the client, e.g. with
+// awsds.WithCorrelationIDHeader to trace AWS calls
+func WithSessionCacheOptions(opts ...awsds.SessionCacheOption) Option {
+	return func(ds *awsClient) {
+		ds.sessionCacheOptions = append(ds.sessionCacheOptions, opts...)
+	}
+}
+
+// WithOutputWriteCheck makes PreflightOutputLocation write, then delete, a small object in the
+// output location to check the credentials can write query results there. Without it, only the
+// access to the bucket is checked, which has no side effects.
+func WithOutputWriteCheck() Option {
+	return func(ds *awsClient) {
+		ds.writeCheck = true
+	}
+}
+
+// WithPerQueryOptions sets the connection options, e.g. "database" or "schema", the driver applies
+// to each query without reconnecting. Every connection option separates the cached APIs and DBs by
+// default, so a driver binding the database at connect time gets a DB per database. The options
+// set here don't, and the connections differing only by them are shared.
+func WithPerQueryOptions(keys ...string) Option {
+	return func(ds *awsClient) {
+		ds.perQueryKeys = keys
+	}
+}
+
+// WithDryRun makes the AWS sessions of the client fail their requests instead of sending them, so
+// ValidateConfig checks the settings, API and driver of a datasource without network access, e.g. in
+// CI. See awsds.WithDryRun.
+func WithDryRun() Option {
+	return WithSessionCacheOptions(awsds.WithDryRun())
+}
+
+// WithSessionCacheDisabled makes every API created by the client use a new AWS session, e.g. to rule
+// out stale sessions while debugging. See awsds.WithCacheDisabled.
+func WithSessionCacheDisabled() Option {
+	return WithSessionCacheOptions(awsds.WithCacheDisabled())
+}
+
+// WithEC2MetadataDisabled keeps the AWS sessions of the client from ever calling the EC2 instance
+// metadata service, e.g. to rule out SSRF on hardened hosts. See awsds.WithEC2MetadataDisabled.
+func WithEC2MetadataDisabled() Option {
+	return WithSessionCacheOptions(awsds.WithEC2MetadataDisabled())
+}
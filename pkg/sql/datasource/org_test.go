@@ -0,0 +1,91 @@
+package datasource
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	sqlApi "github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sessionCacheAPI records the session cache it was created with
+type sessionCacheAPI struct {
+	fakeAPI
+	cache *awsds.SessionCache
+}
+
+type sessionCacheLoader struct {
+	fakeLoader
+}
+
+func (m sessionCacheLoader) LoadAPI(_ context.Context, cache *awsds.SessionCache, _ models.Settings) (sqlApi.AWSAPI, error) {
+	return &sessionCacheAPI{cache: cache}, nil
+}
+
+func TestGetAPI_Org(t *testing.T) {
+	ds := New(sessionCacheLoader{})
+	ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+	org1, err := ds.GetAPI(context.Background(), 1, sqlds.Options{"foo": "bar", models.OrgKey: "1"})
+	require.NoError(t, err)
+	org2, err := ds.GetAPI(context.Background(), 1, sqlds.Options{"foo": "bar", models.OrgKey: "2"})
+	require.NoError(t, err)
+	noOrg, err := ds.GetAPI(context.Background(), 1, sqlds.Options{"foo": "bar"})
+	require.NoError(t, err)
+
+	assert.NotSame(t, org1, org2)
+	assert.NotSame(t, org1.(*sessionCacheAPI).cache, org2.(*sessionCacheAPI).cache)
+	assert.NotSame(t, org1.(*sessionCacheAPI).cache, noOrg.(*sessionCacheAPI).cache)
+
+	cached, err := ds.GetAPI(context.Background(), 1, sqlds.Options{"foo": "bar", models.OrgKey: "1"})
+	require.NoError(t, err)
+	assert.Same(t, org1, cached)
+
+	ds.Init(backend.DataSourceInstanceSettings{ID: 2})
+	sameOrg, err := ds.GetAPI(context.Background(), 2, sqlds.Options{models.OrgKey: "1"})
+	require.NoError(t, err)
+	assert.Same(t, org1.(*sessionCacheAPI).cache, sameOrg.(*sessionCacheAPI).cache)
+}
+
+func TestWithSessionCacheOptions(t *testing.T) {
+	ds := New(sessionCacheLoader{}, WithSessionCacheOptions(awsds.WithCorrelationIDHeader("X-Correlation-Id")))
+	ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+	for _, options := range []sqlds.Options{{}, {models.OrgKey: "1"}} {
+		dsAPI, err := ds.GetAPI(context.Background(), 1, options)
+		require.NoError(t, err)
+
+		sess, err := dsAPI.(*sessionCacheAPI).cache.GetSessionWithAuthSettings(awsds.GetSessionConfig{
+			Settings: awsds.AWSDatasourceSettings{AuthType: awsds.AuthTypeKeys, AccessKey: "foo", SecretKey: "bar", Region: "us-east-1"},
+		}, awsds.AuthSettings{AllowedAuthProviders: []string{"keys"}})
+		require.NoError(t, err)
+
+		req, _ := sts.New(sess).GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+		req.SetContext(awsds.ContextWithCorrelationID(context.Background(), "4bf92f3577b34da6"))
+		require.NoError(t, req.Build())
+		assert.Equal(t, "4bf92f3577b34da6", req.HTTPRequest.Header.Get("X-Correlation-Id"))
+	}
+}
+
+func TestWithEC2MetadataDisabled(t *testing.T) {
+	ds := New(sessionCacheLoader{}, WithEC2MetadataDisabled())
+	ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+	dsAPI, err := ds.GetAPI(context.Background(), 1, sqlds.Options{})
+	require.NoError(t, err)
+
+	sess, err := dsAPI.(*sessionCacheAPI).cache.GetSessionWithAuthSettings(awsds.GetSessionConfig{
+		Settings: awsds.AWSDatasourceSettings{AuthType: awsds.AuthTypeKeys, AccessKey: "foo", SecretKey: "bar", Region: "us-east-1"},
+	}, awsds.AuthSettings{AllowedAuthProviders: []string{"keys"}})
+	require.NoError(t, err)
+
+	_, err = ec2metadata.New(sess).GetMetadata("instance-id")
+	assert.ErrorContains(t, err, "EC2 IMDS access disabled")
+}
@@ -0,0 +1,195 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+)
+
+// preflightObject is the name of the object written by PreflightOutputLocation, under the prefix of the location
+const preflightObject = ".grafana-preflight"
+
+// PermissionsReport lists the simulated IAM actions, split by decision
+type PermissionsReport struct {
+	PrincipalARN string
+	Allowed      []string
+	Denied       []string
+}
+
+// OK returns true if every action is allowed
+func (r PermissionsReport) OK() bool {
+	return len(r.Denied) == 0
+}
+
+// PreflightPermissions simulates the IAM policies of the credentials of the datasource for the given
+// actions, e.g. "athena:StartQueryExecution", so missing permissions are found before running queries.
+// The API of the datasource must implement api.IAMSimulator and its credentials need iam:SimulatePrincipalPolicy,
+// and iam:GetRole on their own role if it has a path.
+func (ds *awsClient) PreflightPermissions(ctx context.Context, id int64, options sqlds.Options, actions []string) (PermissionsReport, error) {
+	dsAPI, err := ds.GetAPI(ctx, id, options)
+	if err != nil {
+		return PermissionsReport{}, err
+	}
+	simulator, ok := dsAPI.(api.IAMSimulator)
+	if !ok {
+		return PermissionsReport{}, fmt.Errorf("the API of datasource %d can't simulate IAM policies", id)
+	}
+
+	callerARN, err := simulator.CallerARN(ctx)
+	if err != nil {
+		return PermissionsReport{}, fmt.Errorf("could not get the caller identity: %w", wrapAWSError(err))
+	}
+	principalARN, err := resolvePrincipal(ctx, simulator, callerARN)
+	if err != nil {
+		return PermissionsReport{}, err
+	}
+
+	report := PermissionsReport{PrincipalARN: principalARN}
+	err = simulator.IAM().SimulatePrincipalPolicyPagesWithContext(ctx, &iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: aws.String(principalARN),
+		ActionNames:     aws.StringSlice(actions),
+	}, func(page *iam.SimulatePolicyResponse, _ bool) bool {
+		for _, result := range page.EvaluationResults {
+			if aws.StringValue(result.EvalDecision) == iam.PolicyEvaluationDecisionTypeAllowed {
+				report.Allowed = append(report.Allowed, aws.StringValue(result.EvalActionName))
+			} else {
+				report.Denied = append(report.Denied, aws.StringValue(result.EvalActionName))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return PermissionsReport{}, fmt.Errorf("could not simulate the IAM policies of %s: %w", principalARN, wrapAWSError(err))
+	}
+	return report, nil
+}
+
+// resolvePrincipal returns the principalARN of callerARN, with the path of the role of assumed role
+// sessions read with iam:GetRole. Without access to the role, its path is left out.
+func resolvePrincipal(ctx context.Context, simulator api.IAMSimulator, callerARN string) (string, error) {
+	principal, err := principalARN(callerARN)
+	if err != nil || principal == callerARN {
+		return principal, err
+	}
+	roleName := principal[strings.LastIndex(principal, "/")+1:]
+	out, err := simulator.IAM().GetRoleWithContext(ctx, &iam.GetRoleInput{RoleName: aws.String(roleName)})
+	if err != nil || out.Role == nil || out.Role.Arn == nil {
+		backend.Logger.Debug("Could not read the path of the caller role", "role", principal, "error", err)
+		return principal, nil
+	}
+	return aws.StringValue(out.Role.Arn), nil
+}
+
+// principalARN returns the ARN IAM can simulate the policies of. Assumed role sessions are replaced by
+// their role, without its path since sts:GetCallerIdentity doesn't return it, see resolvePrincipal.
+func principalARN(callerARN string) (string, error) {
+	parsed, err := arn.Parse(callerARN)
+	if err != nil {
+		return "", fmt.Errorf("invalid caller ARN %q: %w", callerARN, err)
+	}
+	if parsed.Service != "sts" {
+		return callerARN, nil
+	}
+	parts := strings.Split(parsed.Resource, "/")
+	if len(parts) < 2 || parts[0] != "assumed-role" {
+		return "", fmt.Errorf("unsupported caller ARN %q", callerARN)
+	}
+	return arn.ARN{
+		Partition: parsed.Partition,
+		Service:   "iam",
+		AccountID: parsed.AccountID,
+		Resource:  "role/" + parts[1],
+	}.String(), nil
+}
+
+// PreflightOutputLocation checks that the credentials of the datasource can use the S3 location the
+// query results are written to, e.g. "s3://bucket/prefix/", so a misconfigured location is found
+// before the first query. The bucket is checked with HeadBucket, and when the client is created
+// WithOutputWriteCheck a small object is written and deleted again. The API of the datasource must
+// implement api.S3Provider.
+func (ds *awsClient) PreflightOutputLocation(ctx context.Context, id int64, options sqlds.Options, location string) error {
+	loc, err := awsds.ParseS3Location(location)
+	if err != nil {
+		return fmt.Errorf("invalid output location: %w", err)
+	}
+	dsAPI, err := ds.GetAPI(ctx, id, options)
+	if err != nil {
+		return err
+	}
+	provider, ok := dsAPI.(api.S3Provider)
+	if !ok {
+		return fmt.Errorf("the API of datasource %d can't access S3", id)
+	}
+
+	client := provider.S3()
+	if _, err := client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(loc.Bucket)}); err != nil {
+		if isAccessDenied(err) {
+			return fmt.Errorf("the credentials of datasource %d can't access the bucket of %s: %w", id, location, wrapAWSError(err))
+		}
+		return fmt.Errorf("could not access the bucket of %s: %w", location, wrapAWSError(err))
+	}
+	if !ds.writeCheck {
+		return nil
+	}
+
+	key := loc.Prefix
+	if key != "" && !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+	key += preflightObject
+	_, err = client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(loc.Bucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader("grafana"),
+	})
+	if err != nil {
+		if isAccessDenied(err) {
+			return fmt.Errorf("the credentials of datasource %d can't write to %s, check they are allowed s3:PutObject: %w", id, location, wrapAWSError(err))
+		}
+		return fmt.Errorf("could not write to %s: %w", location, wrapAWSError(err))
+	}
+	// The check succeeded even if the object can't be deleted, e.g. without s3:DeleteObject
+	if _, err := client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: aws.String(loc.Bucket), Key: aws.String(key)}); err != nil {
+		backend.Logger.Debug("Could not delete the preflight object", "bucket", loc.Bucket, "key", key, "error", err)
+	}
+	return nil
+}
+
+// isAccessDenied returns true if S3 denied the request, which HeadBucket reports as Forbidden
+func isAccessDenied(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	return awsErr.Code() == "AccessDenied" || awsErr.Code() == "Forbidden"
+}
+
+// CredentialsProviderName returns the name of the provider in the AWS credential chain that supplied
+// the credentials of the datasource, e.g. "EnvConfigCredentials" or "AssumeRoleProvider", to debug
+// which credentials are actually used. The API of the datasource must implement api.SessionProvider.
+func (ds *awsClient) CredentialsProviderName(ctx context.Context, id int64, options sqlds.Options) (string, error) {
+	dsAPI, err := ds.GetAPI(ctx, id, options)
+	if err != nil {
+		return "", err
+	}
+	provider, ok := dsAPI.(api.SessionProvider)
+	if !ok {
+		return "", fmt.Errorf("the API of datasource %d doesn't share its session", id)
+	}
+	name, err := awsds.CredentialsProviderName(ctx, provider.Session())
+	if err != nil {
+		return "", fmt.Errorf("could not retrieve the credentials: %w", wrapAWSError(err))
+	}
+	return name, nil
+}
@@ -0,0 +1,117 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+)
+
+// RunningQuery is an async query started through GetAsyncDB which hasn't finished yet
+type RunningQuery struct {
+	// QueryID is the id the AWS service gave to the query
+	QueryID string
+	// ConnectionKey is the key of the connection running the query, see the ConnectionKey method of the client
+	ConnectionKey string
+	StartedAt     time.Time
+}
+
+// maxRunningQueryAge is how long a query is tracked without being seen finished or cancelled, e.g.
+// when its status stopped being polled after an error, past the longest runtime of the AWS services
+const maxRunningQueryAge = 24 * time.Hour
+
+type runningQuery struct {
+	RunningQuery
+	db awsds.AsyncDB
+}
+
+// runningQueries are the running queries of a datasource, by query id
+type runningQueries struct {
+	mu      sync.Mutex
+	queries map[string]runningQuery
+}
+
+// queryTracker records the queries of an AsyncDB in the running queries of its datasource
+type queryTracker struct {
+	running *runningQueries
+	key     string
+	now     func() time.Time
+}
+
+func (ds *awsClient) runningQueriesOf(id int64) *runningQueries {
+	running, _ := ds.running.LoadOrStore(id, &runningQueries{queries: map[string]runningQuery{}})
+	return running.(*runningQueries)
+}
+
+// pruneLocked forgets the queries started more than maxRunningQueryAge before now, r.mu must be held
+func (r *runningQueries) pruneLocked(now time.Time) {
+	for queryID, q := range r.queries {
+		if now.Sub(q.StartedAt) > maxRunningQueryAge {
+			delete(r.queries, queryID)
+		}
+	}
+}
+
+func (t *queryTracker) add(queryID string, db awsds.AsyncDB) {
+	t.running.mu.Lock()
+	defer t.running.mu.Unlock()
+	now := t.now()
+	t.running.pruneLocked(now)
+	t.running.queries[queryID] = runningQuery{
+		RunningQuery: RunningQuery{QueryID: queryID, ConnectionKey: t.key, StartedAt: now},
+		db:           db,
+	}
+}
+
+func (t *queryTracker) remove(queryID string) {
+	t.running.mu.Lock()
+	defer t.running.mu.Unlock()
+	delete(t.running.queries, queryID)
+}
+
+// ListRunningQueries returns the queries of the datasource started through GetAsyncDB and not seen
+// finished or cancelled yet, oldest first, whatever their org. Queries are only tracked WithQueryTracking,
+// for a day at most.
+func (ds *awsClient) ListRunningQueries(id int64) []RunningQuery {
+	running := ds.runningQueriesOf(id)
+	running.mu.Lock()
+	defer running.mu.Unlock()
+	running.pruneLocked(ds.now())
+	queries := make([]RunningQuery, 0, len(running.queries))
+	for _, q := range running.queries {
+		queries = append(queries, q.RunningQuery)
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		return queries[i].StartedAt.Before(queries[j].StartedAt)
+	})
+	return queries
+}
+
+// CancelAllQueries cancels every running query of the datasource, see ListRunningQueries. The queries
+// failing to cancel stay listed and their errors are joined.
+func (ds *awsClient) CancelAllQueries(ctx context.Context, id int64) error {
+	running := ds.runningQueriesOf(id)
+	running.mu.Lock()
+	running.pruneLocked(ds.now())
+	queries := make([]runningQuery, 0, len(running.queries))
+	for _, q := range running.queries {
+		queries = append(queries, q)
+	}
+	running.mu.Unlock()
+
+	var errs []error
+	for _, q := range queries {
+		if err := q.db.CancelQuery(ctx, q.QueryID); err != nil {
+			errs = append(errs, fmt.Errorf("failed to cancel query %s: %w", q.QueryID, err))
+			continue
+		}
+		running.mu.Lock()
+		delete(running.queries, q.QueryID)
+		running.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,156 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	"github.com/grafana/sqlds/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cancellingAsyncDB runs its queries until they are cancelled, recording the cancellations
+type cancellingAsyncDB struct {
+	fakeAsyncDB
+	mu        sync.Mutex
+	started   int
+	cancelled []string
+	cancelErr map[string]error
+}
+
+func (db *cancellingAsyncDB) StartQuery(_ context.Context, _ string, _ ...interface{}) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.started++
+	return fmt.Sprintf("query-%d", db.started), nil
+}
+
+func (db *cancellingAsyncDB) QueryStatus(_ context.Context, queryID string) (awsds.QueryStatus, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, cancelled := range db.cancelled {
+		if cancelled == queryID {
+			return awsds.QueryCanceled, nil
+		}
+	}
+	return awsds.QueryRunning, nil
+}
+
+func (db *cancellingAsyncDB) CancelQuery(_ context.Context, queryID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.cancelErr[queryID]; err != nil {
+		return err
+	}
+	db.cancelled = append(db.cancelled, queryID)
+	return nil
+}
+
+// failingStatusAsyncDB fails to tell the status of its queries while statusErr is set
+type failingStatusAsyncDB struct {
+	fakeAsyncDB
+	statusErr error
+}
+
+func (db *failingStatusAsyncDB) QueryStatus(ctx context.Context, queryID string) (awsds.QueryStatus, error) {
+	if db.statusErr != nil {
+		return awsds.QueryUnknown, db.statusErr
+	}
+	return db.fakeAsyncDB.QueryStatus(ctx, queryID)
+}
+
+func TestRunningQueries(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("it lists the queries until they finish", func(t *testing.T) {
+		ds := newFakeAsyncClient(&fakeAsyncDB{queryID: "query-1"}, WithQueryTracking())
+		client := ds.(*awsClient)
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		client.clock = func() time.Time { return now }
+		db, err := ds.GetAsyncDB(ctx, 1, sqlds.Options{"database": "sales"})
+		require.NoError(t, err)
+
+		_, err = db.StartQuery(ctx, "SELECT 1")
+		require.NoError(t, err)
+		assert.Equal(t, []RunningQuery{{
+			QueryID:       "query-1",
+			ConnectionKey: ConnectionKey(1, sqlds.Options{"database": "sales"}),
+			StartedAt:     now,
+		}}, ds.ListRunningQueries(1))
+		assert.Empty(t, ds.ListRunningQueries(2))
+
+		_, err = db.QueryStatus(ctx, "query-1")
+		require.NoError(t, err)
+		assert.Empty(t, ds.ListRunningQueries(1))
+	})
+
+	t.Run("it cancels every running query of the datasource", func(t *testing.T) {
+		driverDB := &cancellingAsyncDB{}
+		ds := newFakeAsyncClient(driverDB, WithQueryTracking())
+		for _, database := range []string{"sales", "events"} {
+			db, err := ds.GetAsyncDB(ctx, 1, sqlds.Options{"database": database})
+			require.NoError(t, err)
+			_, err = db.StartQuery(ctx, "SELECT 1")
+			require.NoError(t, err)
+		}
+		require.Len(t, ds.ListRunningQueries(1), 2)
+
+		require.NoError(t, ds.CancelAllQueries(ctx, 1))
+		assert.ElementsMatch(t, []string{"query-1", "query-2"}, driverDB.cancelled)
+		assert.Empty(t, ds.ListRunningQueries(1))
+	})
+
+	t.Run("it keeps the queries failing to cancel", func(t *testing.T) {
+		cancelErr := errors.New("InvalidRequestException: query already completed")
+		driverDB := &cancellingAsyncDB{cancelErr: map[string]error{"query-2": cancelErr}}
+		ds := newFakeAsyncClient(driverDB, WithQueryTracking())
+		db, err := ds.GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			_, err = db.StartQuery(ctx, "SELECT 1")
+			require.NoError(t, err)
+		}
+
+		err = ds.CancelAllQueries(ctx, 1)
+		require.ErrorIs(t, err, cancelErr)
+		assert.Equal(t, []string{"query-1"}, driverDB.cancelled)
+		running := ds.ListRunningQueries(1)
+		require.Len(t, running, 1)
+		assert.Equal(t, "query-2", running[0].QueryID)
+	})
+
+	t.Run("it forgets the queries never seen finished after a day", func(t *testing.T) {
+		statusErr := errors.New("ThrottlingException: rate exceeded")
+		ds := newFakeAsyncClient(&failingStatusAsyncDB{fakeAsyncDB{queryID: "query-1"}, statusErr}, WithQueryTracking())
+		client := ds.(*awsClient)
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		client.clock = func() time.Time { return now }
+		db, err := ds.GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		_, err = db.StartQuery(ctx, "SELECT 1")
+		require.NoError(t, err)
+		_, err = db.QueryStatus(ctx, "query-1")
+		require.ErrorIs(t, err, statusErr)
+		now = now.Add(23 * time.Hour)
+		assert.Len(t, ds.ListRunningQueries(1), 1)
+
+		now = now.Add(2 * time.Hour)
+		assert.Empty(t, ds.ListRunningQueries(1))
+	})
+
+	t.Run("it tracks nothing unless enabled", func(t *testing.T) {
+		ds := newFakeAsyncClient(&fakeAsyncDB{queryID: "query-1"})
+		db, err := ds.GetAsyncDB(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		_, err = db.StartQuery(ctx, "SELECT 1")
+		require.NoError(t, err)
+		assert.Empty(t, ds.ListRunningQueries(1))
+	})
+}
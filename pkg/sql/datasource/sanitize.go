@@ -0,0 +1,112 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const redacted = "[redacted]"
+
+// redactedFields are parts of the names of the json data fields SanitizedConfig redacts, lower case
+var redactedFields = []string{"secret", "password", "token", "externalid"}
+
+// maskedSecrets are the secrets SanitizedConfig shows masked instead of redacted, since their end
+// helps to identify them, e.g. in the IAM console
+var maskedSecrets = map[string]bool{"accessKey": true}
+
+// sanitizedConfig is the configuration of a datasource exported by SanitizedConfig
+type sanitizedConfig struct {
+	ID            int64          `json:"id"`
+	UID           string         `json:"uid"`
+	Type          string         `json:"type"`
+	Name          string         `json:"name"`
+	URL           string         `json:"url,omitempty"`
+	User          string         `json:"user,omitempty"`
+	Database      string         `json:"database,omitempty"`
+	BasicAuthUser string         `json:"basicAuthUser,omitempty"`
+	JSONData      map[string]any `json:"jsonData"`
+	// SecureJSONFields lists the secrets that are set, masked or redacted
+	SecureJSONFields map[string]string `json:"secureJsonFields"`
+	Updated          time.Time         `json:"updated"`
+}
+
+// SanitizedConfig returns the stored configuration of the datasource as JSON, with its secrets
+// masked or redacted, so users can attach it to support tickets. The json data fields that may be
+// sensitive, like an external ID, are redacted too.
+func (ds *awsClient) SanitizedConfig(id int64) ([]byte, error) {
+	stored, ok := ds.config.Load(id)
+	if !ok {
+		return nil, fmt.Errorf("unable to find stored configuration for datasource %d. Initialize it first", id)
+	}
+	config := stored.(backend.DataSourceInstanceSettings)
+
+	jsonData := map[string]any{}
+	if len(config.JSONData) > 1 {
+		if err := json.Unmarshal(config.JSONData, &jsonData); err != nil {
+			return nil, fmt.Errorf("could not unmarshal the json data of datasource %d: %w", id, err)
+		}
+	}
+	secrets := map[string]string{}
+	for key, value := range config.DecryptedSecureJSONData {
+		if maskedSecrets[key] {
+			secrets[key] = mask(value)
+		} else {
+			secrets[key] = redacted
+		}
+	}
+
+	return json.Marshal(sanitizedConfig{
+		ID:               config.ID,
+		UID:              config.UID,
+		Type:             config.Type,
+		Name:             config.Name,
+		URL:              config.URL,
+		User:             config.User,
+		Database:         config.Database,
+		BasicAuthUser:    config.BasicAuthUser,
+		JSONData:         redactFields(jsonData).(map[string]any),
+		SecureJSONFields: secrets,
+		Updated:          config.Updated,
+	})
+}
+
+// redactFields returns value with the sensitive fields of its objects, at any depth, redacted
+func redactFields(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if isSensitive(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redactFields(field)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redactFields(item)
+		}
+	}
+	return value
+}
+
+func isSensitive(field string) bool {
+	field = strings.ToLower(field)
+	for _, part := range redactedFields {
+		if strings.Contains(field, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// mask hides all but the last 4 characters of secret
+func mask(secret string) string {
+	if len(secret) <= 8 {
+		return strings.Repeat("*", len(secret))
+	}
+	return strings.Repeat("*", len(secret)-4) + secret[len(secret)-4:]
+}
@@ -0,0 +1,658 @@
+package datasource
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	sqlApi "github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	sqlDriver "github.com/grafana/grafana-aws-sdk/pkg/sql/driver"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// awsSettings mimics the settings of a plugin built on top of awsds.AWSDatasourceSettings
+type awsSettings struct {
+	awsds.AWSDatasourceSettings
+}
+
+func (s *awsSettings) Apply(args sqlds.Options) {
+	if region, ok := args[models.RegionKey]; ok {
+		s.Region = region
+	}
+}
+
+// settingsLoader loads awsSettings and records the settings received by the driver loader
+type settingsLoader struct {
+	fakeLoader
+	driverSettings models.Settings
+}
+
+func (m *settingsLoader) LoadSettings(_ context.Context) models.Settings {
+	return &awsSettings{}
+}
+
+func (m *settingsLoader) LoadDriver(ctx context.Context, _ sqlApi.AWSAPI) (sqlDriver.Driver, error) {
+	m.driverSettings, _ = models.SettingsFromContext(ctx)
+	return &fakeDriver{db: &sql.DB{}}, nil
+}
+
+func TestGetDB_StagingLocation(t *testing.T) {
+	t.Run("it passes the staging location to the driver", func(t *testing.T) {
+		loader := &settingsLoader{}
+		ds := New(loader)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"stagingLocation":"s3://bucket/results/"}`)})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+
+		settings, ok := loader.driverSettings.(*awsSettings)
+		require.True(t, ok)
+		location, err := awsds.ParseS3Location(settings.StagingLocation)
+		require.NoError(t, err)
+		assert.Equal(t, awsds.S3Location{Bucket: "bucket", Prefix: "results/"}, location)
+	})
+
+	t.Run("it rejects an invalid staging location", func(t *testing.T) {
+		loader := &settingsLoader{}
+		ds := New(loader)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"stagingLocation":"bucket/results/"}`)})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.ErrorContains(t, err, "invalid staging location")
+		assert.Nil(t, loader.driverSettings)
+	})
+}
+
+func TestGetDB_PartialOptions(t *testing.T) {
+	config := backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"region":"us-east-1","profile":"analytics"}`)}
+	getSettings := func(t *testing.T, options sqlds.Options, opts ...Option) *awsSettings {
+		t.Helper()
+		loader := &settingsLoader{}
+		ds := New(loader, opts...)
+		ds.Init(config)
+		_, err := ds.GetDB(context.Background(), 1, options)
+		require.NoError(t, err)
+		settings, ok := loader.driverSettings.(*awsSettings)
+		require.True(t, ok)
+		return settings
+	}
+
+	t.Run("it merges a partial override", func(t *testing.T) {
+		settings := getSettings(t, sqlds.Options{models.RegionKey: "eu-west-1"})
+		assert.Equal(t, "eu-west-1", settings.Region)
+		assert.Equal(t, "analytics", settings.Profile)
+	})
+
+	t.Run("it clears a setting with an empty option", func(t *testing.T) {
+		settings := getSettings(t, sqlds.Options{models.RegionKey: ""})
+		assert.Empty(t, settings.Region)
+	})
+
+	t.Run("it ignores empty options when asked to", func(t *testing.T) {
+		settings := getSettings(t, sqlds.Options{models.RegionKey: "", "awsRegion": ""}, WithEmptyOptionsIgnored())
+		assert.Equal(t, "us-east-1", settings.Region)
+		assert.Equal(t, "analytics", settings.Profile)
+	})
+}
+
+func TestGetDB_NamedAuth(t *testing.T) {
+	jsonData := []byte(`{"assumeRoleARN":"arn:main","authConfigs":{
+		"reader":{"authType":"default","assumeRoleARN":"arn:reader"},
+		"admin":{"authType":"sharedCreds","profile":"admin"}}}`)
+
+	t.Run("it selects among the named auth configs", func(t *testing.T) {
+		loader := &settingsLoader{}
+		ds := New(loader).(*awsClient)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: jsonData})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{models.AuthKey: "reader"})
+		require.NoError(t, err)
+		settings := loader.driverSettings.(*awsSettings)
+		assert.Equal(t, awsds.AuthTypeDefault, settings.AuthType)
+		assert.Equal(t, "arn:reader", settings.AssumeRoleARN)
+
+		_, err = ds.GetDB(context.Background(), 1, sqlds.Options{models.AuthKey: "admin"})
+		require.NoError(t, err)
+		settings = loader.driverSettings.(*awsSettings)
+		assert.Equal(t, awsds.AuthTypeSharedCreds, settings.AuthType)
+		assert.Equal(t, "admin", settings.Profile)
+		assert.Empty(t, settings.AssumeRoleARN)
+
+		_, readerCached := ds.loadAPI(1, sqlds.Options{models.AuthKey: "reader"})
+		_, adminCached := ds.loadAPI(1, sqlds.Options{models.AuthKey: "admin"})
+		assert.True(t, readerCached)
+		assert.True(t, adminCached)
+	})
+
+	t.Run("it uses the main credentials when none is selected", func(t *testing.T) {
+		loader := &settingsLoader{}
+		ds := New(loader)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: jsonData})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Equal(t, "arn:main", loader.driverSettings.(*awsSettings).AssumeRoleARN)
+	})
+
+	t.Run("it rejects an unknown auth config", func(t *testing.T) {
+		loader := &settingsLoader{}
+		ds := New(loader)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: jsonData})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{models.AuthKey: "writer"})
+		require.ErrorContains(t, err, `unknown auth config "writer"`)
+		assert.Nil(t, loader.driverSettings)
+	})
+}
+
+func TestParseSettings_DefaultAuthType(t *testing.T) {
+	tests := []struct {
+		description string
+		jsonData    string
+		expected    awsds.AuthType
+	}{
+		{
+			description: "it applies the default when the auth type is omitted",
+			jsonData:    `{"region":"us-east-1"}`,
+			expected:    awsds.AuthTypeEC2IAMRole,
+		},
+		{
+			description: "it applies the default without json data",
+			expected:    awsds.AuthTypeEC2IAMRole,
+		},
+		{
+			description: "it applies the default when the auth type is empty",
+			jsonData:    `{"authType":""}`,
+			expected:    awsds.AuthTypeEC2IAMRole,
+		},
+		{
+			description: "it keeps the configured auth type",
+			jsonData:    `{"authType":"keys"}`,
+			expected:    awsds.AuthTypeKeys,
+		},
+		{
+			description: "it keeps an explicit default auth type",
+			jsonData:    `{"authType":"default"}`,
+			expected:    awsds.AuthTypeDefault,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			ds := New(&settingsLoader{}, WithDefaultAuthType(awsds.AuthTypeEC2IAMRole)).(*awsClient)
+			ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(tt.jsonData)})
+
+			settings := &awsSettings{}
+			require.NoError(t, ds.parseSettings(1, sqlds.Options{}, settings))
+			assert.Equal(t, tt.expected, settings.AuthType)
+		})
+	}
+
+	t.Run("it leaves the auth type alone without a default", func(t *testing.T) {
+		ds := New(&settingsLoader{}).(*awsClient)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		settings := &awsSettings{}
+		require.NoError(t, ds.parseSettings(1, sqlds.Options{}, settings))
+		assert.Equal(t, awsds.AuthTypeDefault, settings.AuthType)
+	})
+}
+
+func TestParseSettings_StrictAuth(t *testing.T) {
+	keys := map[string]string{"accessKey": "AKIA", "secretKey": "secret"}
+	tests := []struct {
+		description string
+		jsonData    string
+		secureData  map[string]string
+		expectedErr string
+	}{
+		{
+			description: "it accepts access keys with the keys auth type",
+			jsonData:    `{"authType":"keys"}`,
+			secureData:  keys,
+		},
+		{
+			description: "it accepts an assumed role with an external id",
+			jsonData:    `{"authType":"ec2_iam_role","assumeRoleARN":"arn:aws:iam::123456789012:role/reader","externalId":"grafana"}`,
+		},
+		{
+			description: "it rejects access keys with the ec2 iam role auth type",
+			jsonData:    `{"authType":"ec2_iam_role"}`,
+			secureData:  keys,
+			expectedErr: `invalid settings: conflicting auth settings: access keys are set but the auth type is "ec2_iam_role"`,
+		},
+		{
+			description: "it rejects an external id without a role",
+			jsonData:    `{"authType":"default","externalId":"grafana"}`,
+			expectedErr: "invalid settings: conflicting auth settings: an external ID is set without a role to assume",
+		},
+		{
+			description: "it lists every conflict",
+			jsonData:    `{"authType":"credentials","mfaSerial":"arn:aws:iam::123456789012:mfa/jane","assumeRoleCrossAccountOnly":true}`,
+			secureData:  map[string]string{"sessionToken": "token"},
+			expectedErr: `invalid settings: conflicting auth settings: access keys are set but the auth type is "credentials"; ` +
+				"an MFA device is set without a role to assume; cross account only is set without a role to assume",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			ds := New(&settingsLoader{}, WithStrictAuth()).(*awsClient)
+			ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(tt.jsonData), DecryptedSecureJSONData: tt.secureData})
+
+			err := ds.parseSettings(1, sqlds.Options{}, &awsSettings{})
+			if tt.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.expectedErr)
+		})
+	}
+
+	t.Run("it ignores conflicts unless strict", func(t *testing.T) {
+		ds := New(&settingsLoader{}).(*awsClient)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"authType":"ec2_iam_role"}`), DecryptedSecureJSONData: keys})
+
+		require.NoError(t, ds.parseSettings(1, sqlds.Options{}, &awsSettings{}))
+	})
+}
+
+func TestParseSettings_RoleSessionName(t *testing.T) {
+	ds := New(&settingsLoader{}).(*awsClient)
+	ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"roleSessionNameTemplate":"grafana-{user}"}`)})
+	ctx := backend.WithPluginContext(context.Background(), backend.PluginContext{User: &backend.User{Login: "jane@example.com"}})
+
+	settings := &awsSettings{}
+	require.NoError(t, ds.parseSettings(1, models.WithUser(ctx, sqlds.Options{"foo": "bar"}), settings))
+	assert.Equal(t, "grafana-jane@example.com", settings.RoleSessionName)
+
+	settings = &awsSettings{}
+	require.NoError(t, ds.parseSettings(1, sqlds.Options{}, settings))
+	assert.Equal(t, "grafana-", settings.RoleSessionName)
+}
+
+// compressingDriver records whether compression was enabled
+type compressingDriver struct {
+	fakeDriver
+	compression bool
+}
+
+func (d *compressingDriver) EnableCompression() error {
+	d.compression = true
+	return nil
+}
+
+type compressionLoader struct {
+	settingsLoader
+	driver sqlDriver.Driver
+}
+
+func (m *compressionLoader) LoadDriver(_ context.Context, _ sqlApi.AWSAPI) (sqlDriver.Driver, error) {
+	return m.driver, nil
+}
+
+func TestGetDB_Compression(t *testing.T) {
+	t.Run("it enables the compression of the driver", func(t *testing.T) {
+		dr := &compressingDriver{fakeDriver: fakeDriver{db: &sql.DB{}}}
+		ds := New(&compressionLoader{driver: dr})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"compression":true}`)})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.True(t, dr.compression)
+	})
+
+	t.Run("it leaves the compression disabled by default", func(t *testing.T) {
+		dr := &compressingDriver{fakeDriver: fakeDriver{db: &sql.DB{}}}
+		ds := New(&compressionLoader{driver: dr})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.False(t, dr.compression)
+	})
+
+	t.Run("it fails with drivers not supporting compression", func(t *testing.T) {
+		ds := New(&compressionLoader{driver: &fakeDriver{db: &sql.DB{}}})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"compression":true}`)})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.ErrorContains(t, err, "compression is enabled but the driver *datasource.fakeDriver doesn't support it")
+	})
+}
+
+// s3Driver records the S3 settings it receives
+type s3Driver struct {
+	fakeDriver
+	expectedBucketOwner string
+}
+
+func (d *s3Driver) SetExpectedBucketOwner(accountID string) error {
+	d.expectedBucketOwner = accountID
+	return nil
+}
+
+func TestGetDB_ExpectedBucketOwner(t *testing.T) {
+	t.Run("it passes the expected bucket owner to the driver", func(t *testing.T) {
+		dr := &s3Driver{fakeDriver: fakeDriver{db: &sql.DB{}}}
+		ds := New(&compressionLoader{driver: dr})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"expectedBucketOwner":"123456789012"}`)})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Equal(t, "123456789012", dr.expectedBucketOwner)
+	})
+
+	t.Run("it leaves the driver unchanged by default", func(t *testing.T) {
+		dr := &s3Driver{fakeDriver: fakeDriver{db: &sql.DB{}}}
+		ds := New(&compressionLoader{driver: dr})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Empty(t, dr.expectedBucketOwner)
+	})
+
+	t.Run("it fails with drivers not supporting it", func(t *testing.T) {
+		ds := New(&compressionLoader{driver: &fakeDriver{db: &sql.DB{}}})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"expectedBucketOwner":"123456789012"}`)})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.ErrorContains(t, err, "an expected bucket owner is set but the driver *datasource.fakeDriver doesn't support it")
+	})
+}
+
+// timeoutDriver records the timeouts it receives
+type timeoutDriver struct {
+	fakeDriver
+	connectTimeout time.Duration
+	queryTimeout   time.Duration
+}
+
+func (d *timeoutDriver) SetConnectTimeout(timeout time.Duration) error {
+	d.connectTimeout = timeout
+	return nil
+}
+
+func (d *timeoutDriver) SetQueryTimeout(timeout time.Duration) error {
+	d.queryTimeout = timeout
+	return nil
+}
+
+func TestGetDB_Timeouts(t *testing.T) {
+	t.Run("it passes each timeout to the driver", func(t *testing.T) {
+		dr := &timeoutDriver{fakeDriver: fakeDriver{db: &sql.DB{}}}
+		ds := New(&compressionLoader{driver: dr})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"connectTimeout":"5s","queryTimeout":"10m"}`)})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Equal(t, 5*time.Second, dr.connectTimeout)
+		assert.Equal(t, 10*time.Minute, dr.queryTimeout)
+	})
+
+	t.Run("it leaves the driver unchanged by default", func(t *testing.T) {
+		dr := &timeoutDriver{fakeDriver: fakeDriver{db: &sql.DB{}}}
+		ds := New(&compressionLoader{driver: dr})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Zero(t, dr.connectTimeout)
+		assert.Zero(t, dr.queryTimeout)
+	})
+
+	t.Run("it fails with drivers not supporting it", func(t *testing.T) {
+		ds := New(&compressionLoader{driver: &fakeDriver{db: &sql.DB{}}})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"queryTimeout":"10m"}`)})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.ErrorContains(t, err, "a query timeout is set but the driver *datasource.fakeDriver doesn't support it")
+	})
+}
+
+// tlsDriver records the TLS config it receives
+type tlsDriver struct {
+	fakeDriver
+	tlsConfig *tls.Config
+}
+
+func (d *tlsDriver) SetTLSConfig(config *tls.Config) error {
+	d.tlsConfig = config
+	return nil
+}
+
+func TestGetDB_TLS(t *testing.T) {
+	t.Run("it passes the minimum version to the driver", func(t *testing.T) {
+		dr := &tlsDriver{fakeDriver: fakeDriver{db: &sql.DB{}}}
+		ds := New(&compressionLoader{driver: dr}, WithMinTLSVersion(tls.VersionTLS12))
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		require.NotNil(t, dr.tlsConfig)
+		assert.Equal(t, uint16(tls.VersionTLS12), dr.tlsConfig.MinVersion)
+		assert.False(t, dr.tlsConfig.InsecureSkipVerify)
+	})
+
+	t.Run("it skips the certificate verification if the settings ask for it", func(t *testing.T) {
+		dr := &tlsDriver{fakeDriver: fakeDriver{db: &sql.DB{}}}
+		ds := New(&compressionLoader{driver: dr})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"tlsSkipVerify":true}`)})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		require.NotNil(t, dr.tlsConfig)
+		assert.True(t, dr.tlsConfig.InsecureSkipVerify)
+	})
+
+	t.Run("it leaves the driver unchanged by default", func(t *testing.T) {
+		dr := &tlsDriver{fakeDriver: fakeDriver{db: &sql.DB{}}}
+		ds := New(&compressionLoader{driver: dr})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Nil(t, dr.tlsConfig)
+	})
+
+	t.Run("it fails with drivers not supporting it", func(t *testing.T) {
+		ds := New(&compressionLoader{driver: &fakeDriver{db: &sql.DB{}}}, WithMinTLSVersion(tls.VersionTLS12))
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.ErrorContains(t, err, "TLS settings are set but the driver *datasource.fakeDriver doesn't support them")
+	})
+}
+
+// workgroupSettings adds plugin specific values to the connection string placeholders
+type workgroupSettings struct {
+	awsSettings
+	Database  string `json:"database"`
+	Workgroup string `json:"workgroup"`
+}
+
+func (s *workgroupSettings) Load(config backend.DataSourceInstanceSettings) error {
+	if err := s.AWSDatasourceSettings.Load(config); err != nil {
+		return err
+	}
+	return json.Unmarshal(config.JSONData, &struct {
+		Database  *string `json:"database"`
+		Workgroup *string `json:"workgroup"`
+	}{&s.Database, &s.Workgroup})
+}
+
+func (s *workgroupSettings) DSNValues() map[string]string {
+	values := s.AWSDatasourceSettings.DSNValues()
+	values["database"] = s.Database
+	values["workgroup"] = s.Workgroup
+	return values
+}
+
+// dsnLoader records the connection string received by the driver loader
+type dsnLoader struct {
+	fakeLoader
+	dsn string
+}
+
+func (m *dsnLoader) LoadSettings(_ context.Context) models.Settings {
+	return &workgroupSettings{}
+}
+
+func (m *dsnLoader) LoadDriver(ctx context.Context, _ sqlApi.AWSAPI) (sqlDriver.Driver, error) {
+	m.dsn, _ = models.DSNFromContext(ctx)
+	return &fakeDriver{db: &sql.DB{}}, nil
+}
+
+func TestGetDB_DSNTemplate(t *testing.T) {
+	t.Run("it renders the template from the settings and options", func(t *testing.T) {
+		loader := &dsnLoader{}
+		ds := New(loader)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{
+			"connectionTemplate":"athena://{region}/{database}?workgroup={workgroup}",
+			"region":"us-east-1","database":"sales","workgroup":"primary"}`)})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{models.RegionKey: "eu-west-1"})
+		require.NoError(t, err)
+		assert.Equal(t, "athena://eu-west-1/sales?workgroup=primary", loader.dsn)
+	})
+
+	t.Run("it fails on a placeholder without value", func(t *testing.T) {
+		loader := &dsnLoader{}
+		ds := New(loader)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{
+			"connectionTemplate":"athena://{region}/{database}?workgroup={workgroup}&catalog={catalog}",
+			"region":"us-east-1","database":"sales"}`)})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.ErrorContains(t, err, `no value for {workgroup}, {catalog} in connection string template`)
+		assert.Empty(t, loader.dsn)
+	})
+
+	t.Run("it passes no connection string without template", func(t *testing.T) {
+		loader := &dsnLoader{dsn: "unset"}
+		ds := New(loader)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"database":"sales"}`)})
+
+		_, err := ds.GetDB(context.Background(), 1, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Empty(t, loader.dsn)
+	})
+}
+
+func TestParseSettings_MaxOptionsSize(t *testing.T) {
+	id := int64(1)
+	ds := New(newFakeLoader(nil), WithMaxOptionsSize(64)).(*awsClient)
+	ds.Init(backend.DataSourceInstanceSettings{ID: id})
+
+	t.Run("it applies options within the limit", func(t *testing.T) {
+		settings := &fakeSettings{}
+		require.NoError(t, ds.parseSettings(id, sqlds.Options{"database": "sales"}, settings))
+		assert.Equal(t, "sales", settings.modifier["database"])
+	})
+
+	t.Run("it rejects an oversized option before applying it", func(t *testing.T) {
+		settings := &fakeSettings{}
+		err := ds.parseSettings(id, sqlds.Options{"database": "sales", "workgroup": strings.Repeat("x", 1024)}, settings)
+		require.ErrorIs(t, err, ErrOptionsTooLarge)
+		assert.Contains(t, err.Error(), `the largest being "workgroup"`)
+		assert.Nil(t, settings.modifier)
+	})
+}
+
+func TestParseSettings_Migrations(t *testing.T) {
+	renameRole := func(jsonData map[string]any) error {
+		if role, ok := jsonData["roleArn"]; ok {
+			jsonData["assumeRoleARN"] = role
+			delete(jsonData, "roleArn")
+		}
+		return nil
+	}
+
+	t.Run("it migrates legacy json data before loading it", func(t *testing.T) {
+		ds := New(newFakeLoader(nil), WithSettingsMigration(0, renameRole)).(*awsClient)
+		config := backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"authType":"keys","roleArn":"arn:aws:iam::123456789012:role/grafana"}`)}
+		ds.Init(config)
+
+		settings := &awsSettings{}
+		require.NoError(t, ds.parseSettings(1, sqlds.Options{}, settings))
+		assert.Equal(t, "arn:aws:iam::123456789012:role/grafana", settings.AssumeRoleARN)
+
+		stored, _ := ds.config.Load(int64(1))
+		assert.Equal(t, config, stored)
+	})
+
+	t.Run("it skips the migrations of older versions", func(t *testing.T) {
+		ds := New(newFakeLoader(nil), WithSettingsMigration(0, renameRole), WithSettingsMigration(1, func(jsonData map[string]any) error {
+			jsonData["region"] = "us-east-1"
+			return nil
+		})).(*awsClient)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{"schemaVersion":1,"roleArn":"arn:aws:iam::123456789012:role/legacy"}`)})
+
+		settings := &awsSettings{}
+		require.NoError(t, ds.parseSettings(1, sqlds.Options{}, settings))
+		assert.Empty(t, settings.AssumeRoleARN)
+		assert.Equal(t, "us-east-1", settings.Region)
+	})
+
+	t.Run("it fails when a migration does", func(t *testing.T) {
+		ds := New(newFakeLoader(nil), WithSettingsMigration(0, func(map[string]any) error {
+			return errors.New("unknown auth representation")
+		})).(*awsClient)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1, JSONData: []byte(`{}`)})
+
+		err := ds.parseSettings(1, sqlds.Options{}, &awsSettings{})
+		assert.ErrorContains(t, err, "could not migrate the settings from version 0: unknown auth representation")
+	})
+}
+
+func TestRegisterDefaultOptions(t *testing.T) {
+	ctx := context.Background()
+	newClient := func() *awsClient {
+		ds := New(newFakeLoader(nil)).(*awsClient)
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+		ds.RegisterDefaultOptions(sqlds.Options{"catalog": "AwsDataCatalog", "format": "csv"})
+		return ds
+	}
+
+	t.Run("it applies the defaults missing from the call", func(t *testing.T) {
+		settings := &fakeSettings{}
+		require.NoError(t, newClient().parseSettings(1, sqlds.Options{"database": "sales"}, settings))
+		assert.Equal(t, sqlds.Options{"catalog": "AwsDataCatalog", "format": "csv", "database": "sales"}, settings.modifier)
+	})
+
+	t.Run("it lets the call override the defaults", func(t *testing.T) {
+		settings := &fakeSettings{}
+		require.NoError(t, newClient().parseSettings(1, sqlds.Options{"catalog": "glue"}, settings))
+		assert.Equal(t, sqlds.Options{"catalog": "glue", "format": "csv"}, settings.modifier)
+	})
+
+	t.Run("it shares the connections of calls relying on the defaults or setting them", func(t *testing.T) {
+		ds := newClient()
+		_, err := ds.GetAPI(ctx, 1, sqlds.Options{})
+		require.NoError(t, err)
+		_, err = ds.GetAPI(ctx, 1, sqlds.Options{"catalog": "AwsDataCatalog"})
+		require.NoError(t, err)
+		cached := 0
+		ds.api.Range(func(_, _ any) bool {
+			cached++
+			return true
+		})
+		assert.Equal(t, 1, cached)
+
+		_, exists := ds.loadAPI(1, sqlds.Options{"catalog": "glue", "format": "csv"})
+		assert.False(t, exists)
+		_, err = ds.GetAPI(ctx, 1, sqlds.Options{"catalog": "glue"})
+		require.NoError(t, err)
+		_, exists = ds.loadAPI(1, sqlds.Options{"catalog": "glue", "format": "csv"})
+		assert.True(t, exists)
+	})
+}
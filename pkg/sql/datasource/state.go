@@ -0,0 +1,95 @@
+package datasource
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+)
+
+// stateVersion is the version of the format written by ExportState
+const stateVersion = 1
+
+// exportedState is the cache metadata written by ExportState
+type exportedState struct {
+	Version int              `json:"version"`
+	Targets []exportedTarget `json:"targets"`
+}
+
+type exportedTarget struct {
+	ID      int64         `json:"id"`
+	Options sqlds.Options `json:"options"`
+}
+
+// ExportState returns the datasource ids and connection options of the cached APIs as JSON, so a
+// restarted process can warm them again with ImportState. No configuration is exported and the
+// options that may be sensitive, like a token, are left out.
+func (ds *awsClient) ExportState() ([]byte, error) {
+	state := exportedState{Version: stateVersion, Targets: []exportedTarget{}}
+	ds.api.Range(func(_, value any) bool {
+		entry := value.(*apiEntry)
+		options := sqlds.Options{}
+		for k, v := range entry.options {
+			if !isSensitive(k) {
+				options[k] = v
+			}
+		}
+		state.Targets = append(state.Targets, exportedTarget{ID: entry.id, Options: options})
+		return true
+	})
+	sort.Slice(state.Targets, func(i, j int) bool {
+		return ConnectionKey(state.Targets[i].ID, state.Targets[i].Options) < ConnectionKey(state.Targets[j].ID, state.Targets[j].Options)
+	})
+	return json.Marshal(state)
+}
+
+// ImportState schedules the warming of the APIs listed by ExportState. The APIs of the datasources
+// already initialized are warmed right away, the others once Init stores their configuration. The
+// warming runs in the background and its failures are only logged.
+func (ds *awsClient) ImportState(data []byte) error {
+	state := exportedState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("could not unmarshal the state: %w", err)
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("unsupported state version %d", state.Version)
+	}
+	ds.pendingMu.Lock()
+	defer ds.pendingMu.Unlock()
+	if ds.pendingWarm == nil {
+		ds.pendingWarm = map[int64][]warmTarget{}
+	}
+	for _, target := range state.Targets {
+		ds.pendingWarm[target.ID] = append(ds.pendingWarm[target.ID], warmTarget{id: target.ID, options: target.Options})
+	}
+	for id := range ds.pendingWarm {
+		if _, ok := ds.config.Load(id); ok {
+			ds.startPendingWarm(id)
+		}
+	}
+	return nil
+}
+
+// warmPending warms in the background the imported targets of the datasource, if any
+func (ds *awsClient) warmPending(id int64) {
+	ds.pendingMu.Lock()
+	defer ds.pendingMu.Unlock()
+	ds.startPendingWarm(id)
+}
+
+// startPendingWarm must be called with pendingMu held
+func (ds *awsClient) startPendingWarm(id int64) {
+	targets := ds.pendingWarm[id]
+	if len(targets) == 0 {
+		return
+	}
+	delete(ds.pendingWarm, id)
+	go func() {
+		if err := ds.warm(context.Background(), targets); err != nil {
+			backend.Logger.Warn("Failed to warm the imported connections", "id", id, "error", err)
+		}
+	}()
+}
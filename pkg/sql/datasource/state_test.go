@@ -0,0 +1,88 @@
+package datasource
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportState(t *testing.T) {
+	ds := New(fakeLoader{})
+	ds.Init(backend.DataSourceInstanceSettings{ID: 1, DecryptedSecureJSONData: map[string]string{"secretKey": "bar"}})
+	_, err := ds.GetAPI(context.Background(), 1, sqlds.Options{"region": "eu-west-1", "sessionToken": "IQoJb3JpZ2lu"})
+	require.NoError(t, err)
+
+	data, err := ds.ExportState()
+	require.NoError(t, err)
+
+	state := exportedState{}
+	require.NoError(t, json.Unmarshal(data, &state))
+	require.Len(t, state.Targets, 1)
+	assert.Equal(t, int64(1), state.Targets[0].ID)
+	assert.Equal(t, sqlds.Options{"region": "eu-west-1"}, state.Targets[0].Options)
+	assert.NotContains(t, string(data), "IQoJb3JpZ2lu")
+	assert.NotContains(t, string(data), "bar")
+}
+
+func TestImportState(t *testing.T) {
+	ctx := context.Background()
+	exported := func(t *testing.T) []byte {
+		ds := New(fakeLoader{})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 2})
+		for _, region := range []string{"us-east-1", "eu-west-1"} {
+			_, err := ds.GetAPI(ctx, 1, sqlds.Options{"region": region})
+			require.NoError(t, err)
+		}
+		_, err := ds.GetAPI(ctx, 2, sqlds.Options{})
+		require.NoError(t, err)
+		data, err := ds.ExportState()
+		require.NoError(t, err)
+		return data
+	}
+	isCached := func(ds AWSClient, id int64, options sqlds.Options) func() bool {
+		return func() bool {
+			_, ok := ds.(*awsClient).loadAPI(id, options)
+			return ok
+		}
+	}
+
+	t.Run("it warms the exported connections once their datasource is initialized", func(t *testing.T) {
+		restarted := New(fakeLoader{})
+		require.NoError(t, restarted.ImportState(exported(t)))
+		assert.False(t, isCached(restarted, 1, sqlds.Options{"region": "us-east-1"})())
+
+		restarted.Init(backend.DataSourceInstanceSettings{ID: 1})
+		assert.Eventually(t, isCached(restarted, 1, sqlds.Options{"region": "us-east-1"}), time.Second, time.Millisecond)
+		assert.Eventually(t, isCached(restarted, 1, sqlds.Options{"region": "eu-west-1"}), time.Second, time.Millisecond)
+		assert.False(t, isCached(restarted, 2, sqlds.Options{})())
+	})
+
+	t.Run("it warms the datasources already initialized right away", func(t *testing.T) {
+		restarted := New(fakeLoader{})
+		restarted.Init(backend.DataSourceInstanceSettings{ID: 2})
+		require.NoError(t, restarted.ImportState(exported(t)))
+
+		assert.Eventually(t, isCached(restarted, 2, sqlds.Options{}), time.Second, time.Millisecond)
+	})
+
+	t.Run("it warms the exported connections of a datasource loaded with its settings", func(t *testing.T) {
+		restarted := New(openingLoader{driver: &openingDriver{}})
+		require.NoError(t, restarted.ImportState(exported(t)))
+
+		_, err := restarted.GetDBWithSettings(ctx, backend.DataSourceInstanceSettings{ID: 1}, sqlds.Options{})
+		require.NoError(t, err)
+		assert.Eventually(t, isCached(restarted, 1, sqlds.Options{"region": "us-east-1"}), time.Second, time.Millisecond)
+		assert.Eventually(t, isCached(restarted, 1, sqlds.Options{"region": "eu-west-1"}), time.Second, time.Millisecond)
+	})
+
+	t.Run("it rejects an unknown state version", func(t *testing.T) {
+		assert.EqualError(t, New(fakeLoader{}).ImportState([]byte(`{"version":2,"targets":[]}`)), "unsupported state version 2")
+	})
+}
@@ -0,0 +1,80 @@
+package datasource
+
+import (
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/driver"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+)
+
+// ConnectionStats describes the use of a connection, as reported with RecordQuery
+type ConnectionStats struct {
+	ID          int64
+	Queries     int64
+	Errors      int64
+	LastError   error
+	LastErrorAt time.Time
+	// Name of the last driver created for the connection, see driver.Namer
+	Driver string
+	// Environment of the client, see WithEnvironment
+	Environment string
+}
+
+type connectionStats struct {
+	mu    sync.Mutex
+	stats ConnectionStats
+}
+
+// statsFor returns the stats entry of the connection of the given id and options
+func (ds *awsClient) statsFor(id int64, options sqlds.Options) *connectionStats {
+	entry, _ := ds.stats.LoadOrStore(ds.connectionKey(id, options), &connectionStats{stats: ConnectionStats{ID: id, Environment: ds.environment}})
+	return entry.(*connectionStats)
+}
+
+// recordDriver records the name of the driver created for the connection of the given id and options
+func (ds *awsClient) recordDriver(id int64, options sqlds.Options, dr any) {
+	name := driver.NameOf(dr)
+	backend.Logger.Debug("Created driver", "id", id, "driver", name, "dsn", driver.SanitizedDSNOf(dr))
+	s := ds.statsFor(id, options)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Driver = name
+}
+
+// RecordQuery records a query served by the connection of the given id and options, with its error if it failed
+func (ds *awsClient) RecordQuery(id int64, options sqlds.Options, err error) {
+	options = ds.normalizeOptions(options)
+	s := ds.statsFor(id, options)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Queries++
+	if err != nil {
+		s.stats.Errors++
+		s.stats.LastError = err
+		s.stats.LastErrorAt = ds.now()
+	}
+}
+
+// Stats returns the stats of every connection a driver was created or a query was recorded for, keyed by the ConnectionKey method of the client
+func (ds *awsClient) Stats() map[string]ConnectionStats {
+	stats := map[string]ConnectionStats{}
+	ds.stats.Range(func(key, value any) bool {
+		s := value.(*connectionStats)
+		s.mu.Lock()
+		stats[key.(string)] = s.stats
+		s.mu.Unlock()
+		return true
+	})
+	return stats
+}
+
+// ResetStats forgets the stats recorded so far, leaving the cached connections as they are.
+// The Prometheus metrics are cumulative and aren't reset.
+func (ds *awsClient) ResetStats() {
+	ds.stats.Range(func(key, _ any) bool {
+		ds.stats.Delete(key)
+		return true
+	})
+}
@@ -0,0 +1,136 @@
+package datasource
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ds := New(fakeLoader{}).(*awsClient)
+	ds.clock = func() time.Time { return now }
+	options := sqlds.Options{"foo": "bar"}
+	queryErr := errors.New("AccessDeniedException: denied")
+
+	ds.RecordQuery(1, options, queryErr)
+	ds.RecordQuery(1, options, nil)
+	ds.RecordQuery(2, sqlds.Options{}, nil)
+
+	stats := ds.Stats()
+	assert.Equal(t, ConnectionStats{
+		ID:          1,
+		Queries:     2,
+		Errors:      1,
+		LastError:   queryErr,
+		LastErrorAt: now,
+	}, stats[ConnectionKey(1, options)])
+	assert.Equal(t, ConnectionStats{ID: 2, Queries: 1}, stats[ConnectionKey(2, sqlds.Options{})])
+	assert.Len(t, stats, 2)
+}
+
+func TestResetStats(t *testing.T) {
+	ds := New(fakeLoader{}).(*awsClient)
+	ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+	options := sqlds.Options{"foo": "bar"}
+
+	_, err := ds.GetAPI(context.Background(), 1, options)
+	require.NoError(t, err)
+	ds.RecordQuery(1, options, errors.New("AccessDeniedException: denied"))
+
+	ds.ResetStats()
+	assert.Empty(t, ds.Stats())
+	_, exists := ds.loadAPI(1, options)
+	assert.True(t, exists)
+
+	ds.RecordQuery(1, options, nil)
+	assert.Equal(t, ConnectionStats{ID: 1, Queries: 1}, ds.Stats()[ConnectionKey(1, options)])
+}
+
+// namedDriver is a driver telling its name
+type namedDriver struct {
+	fakeDriver
+	name string
+}
+
+func (d *namedDriver) Name() string {
+	return d.name
+}
+
+func TestStats_Driver(t *testing.T) {
+	options := sqlds.Options{"foo": "bar"}
+
+	t.Run("it records the name of the created driver", func(t *testing.T) {
+		ds := New(&compressionLoader{driver: &namedDriver{fakeDriver: fakeDriver{db: &sql.DB{}}, name: "athena"}})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		_, err := ds.GetDB(context.Background(), 1, options)
+		require.NoError(t, err)
+		assert.Equal(t, "athena", ds.Stats()[ConnectionKey(1, options)].Driver)
+	})
+
+	t.Run("it defaults to unknown", func(t *testing.T) {
+		ds := New(&compressionLoader{driver: &fakeDriver{db: &sql.DB{}}})
+		ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+		_, err := ds.GetDB(context.Background(), 1, options)
+		require.NoError(t, err)
+		assert.Equal(t, "unknown", ds.Stats()[ConnectionKey(1, options)].Driver)
+	})
+}
+
+func TestStats_Environment(t *testing.T) {
+	options := sqlds.Options{"foo": "bar"}
+
+	t.Run("it reports the environment of the client", func(t *testing.T) {
+		ds := New(fakeLoader{}, WithEnvironment("staging", false))
+		ds.RecordQuery(1, options, nil)
+
+		assert.Equal(t, ConnectionStats{ID: 1, Queries: 1, Environment: "staging"}, ds.Stats()[ConnectionKey(1, options)])
+	})
+
+	t.Run("it separates the connections of isolated environments", func(t *testing.T) {
+		dev := New(fakeLoader{}, WithEnvironment("dev", true))
+		prod := New(fakeLoader{}, WithEnvironment("prod", true))
+		for _, ds := range []AWSClient{dev, prod} {
+			ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+			_, err := ds.GetAPI(context.Background(), 1, options)
+			require.NoError(t, err)
+			ds.RecordQuery(1, options, nil)
+		}
+
+		assert.Contains(t, dev.Stats(), "dev/"+ConnectionKey(1, options))
+		assert.Contains(t, prod.Stats(), "prod/"+ConnectionKey(1, options))
+		_, exists := dev.(*awsClient).loadAPI(1, options)
+		assert.True(t, exists)
+		_, exists = dev.(*awsClient).api.Load(ConnectionKey(1, options))
+		assert.False(t, exists)
+	})
+}
+
+func TestStats_ConnectionKey(t *testing.T) {
+	ds := New(fakeLoader{},
+		WithEnvironment("dev", true),
+		WithPerQueryOptions("workgroup"),
+		WithOptionsMarshaler(func(args sqlds.Options) string { return args["database"] }),
+		WithOptionsNormalizer(func(options sqlds.Options) sqlds.Options {
+			delete(options, "label")
+			return options
+		}),
+	)
+	ds.RegisterDefaultOptions(sqlds.Options{"database": "sales"})
+	options := sqlds.Options{"workgroup": "primary", "label": "Sales"}
+
+	ds.RecordQuery(1, options, nil)
+
+	assert.Equal(t, "dev/1-sales", ds.ConnectionKey(1, options))
+	assert.Contains(t, ds.Stats(), ds.ConnectionKey(1, options))
+	assert.NotContains(t, ds.Stats(), ConnectionKey(1, options))
+}
@@ -0,0 +1,88 @@
+package datasource
+
+import (
+	"context"
+	"database/sql"
+)
+
+const defaultStreamBufferSize = 100
+
+// RowStream delivers the rows of a query while they're read from the database. At most bufferSize
+// rows are read ahead of the consumer, so large results don't have to fit in memory.
+type RowStream struct {
+	columns []string
+	rows    chan []any
+	cancel  context.CancelFunc
+	// err is set before rows is closed
+	err error
+}
+
+// QueryStream runs the query on db and streams its rows, reading at most bufferSize rows ahead
+// (100 if bufferSize isn't positive). Reading stops when ctx is canceled or the stream is closed.
+func QueryStream(ctx context.Context, db *sql.DB, query string, bufferSize int, args ...any) (*RowStream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		cancel()
+		return nil, err
+	}
+	if bufferSize <= 0 {
+		bufferSize = defaultStreamBufferSize
+	}
+	s := &RowStream{columns: columns, rows: make(chan []any, bufferSize), cancel: cancel}
+	go s.read(ctx, rows)
+	return s, nil
+}
+
+func (s *RowStream) read(ctx context.Context, rows *sql.Rows) {
+	defer close(s.rows)
+	defer rows.Close()
+	for rows.Next() {
+		row := make([]any, len(s.columns))
+		dest := make([]any, len(row))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			s.err = err
+			return
+		}
+		select {
+		case s.rows <- row:
+		case <-ctx.Done():
+			s.err = ctx.Err()
+			return
+		}
+	}
+	s.err = rows.Err()
+}
+
+// Columns returns the names of the columns of the rows
+func (s *RowStream) Columns() []string {
+	return s.columns
+}
+
+// Next returns the next row, blocking until it's read. It returns false once all the rows are
+// read or reading stopped, Err then tells why.
+func (s *RowStream) Next() ([]any, bool) {
+	row, ok := <-s.rows
+	return row, ok
+}
+
+// Err returns the error that stopped reading the rows, if any. It's only set once Next returned false.
+func (s *RowStream) Err() error {
+	return s.err
+}
+
+// Close stops reading the rows and releases the connection
+func (s *RowStream) Close() {
+	s.cancel()
+	for range s.rows {
+	}
+}
@@ -0,0 +1,105 @@
+package datasource
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingRows produces size rows on demand, counting how many were read
+type countingRows struct {
+	size int64
+	read *atomic.Int64
+}
+
+func (r *countingRows) Columns() []string {
+	return []string{"n"}
+}
+
+func (r *countingRows) Close() error {
+	return nil
+}
+
+func (r *countingRows) Next(dest []driver.Value) error {
+	n := r.read.Add(1)
+	if n > r.size {
+		return io.EOF
+	}
+	dest[0] = n
+	return nil
+}
+
+// streamingConnector opens connections serving countingRows
+type streamingConnector struct {
+	fakeConnector
+	size int64
+	read atomic.Int64
+}
+
+func (c *streamingConnector) Connect(_ context.Context) (driver.Conn, error) {
+	return &streamingConn{fakeConn: fakeConn{connector: &c.fakeConnector}, rows: &countingRows{size: c.size, read: &c.read}}, nil
+}
+
+type streamingConn struct {
+	fakeConn
+	rows *countingRows
+}
+
+func (c *streamingConn) QueryContext(_ context.Context, _ string, _ []driver.NamedValue) (driver.Rows, error) {
+	return c.rows, nil
+}
+
+func TestQueryStream(t *testing.T) {
+	t.Run("it streams all the rows", func(t *testing.T) {
+		db := sql.OpenDB(&streamingConnector{size: 5})
+		stream, err := QueryStream(context.Background(), db, "SELECT n", 2)
+		require.NoError(t, err)
+		defer stream.Close()
+
+		assert.Equal(t, []string{"n"}, stream.Columns())
+		values := []any{}
+		for row, ok := stream.Next(); ok; row, ok = stream.Next() {
+			values = append(values, row[0])
+		}
+		require.NoError(t, stream.Err())
+		assert.Equal(t, []any{int64(1), int64(2), int64(3), int64(4), int64(5)}, values)
+	})
+
+	t.Run("it reads the rows as they're consumed", func(t *testing.T) {
+		connector := &streamingConnector{size: 1000}
+		stream, err := QueryStream(context.Background(), sql.OpenDB(connector), "SELECT n", 2)
+		require.NoError(t, err)
+		defer stream.Close()
+
+		row, ok := stream.Next()
+		require.True(t, ok)
+		assert.Equal(t, int64(1), row[0])
+		time.Sleep(20 * time.Millisecond)
+		// the consumed row, the buffered ones and the one waiting for room in the buffer
+		assert.LessOrEqual(t, connector.read.Load(), int64(4))
+	})
+
+	t.Run("it stops when the context is canceled", func(t *testing.T) {
+		connector := &streamingConnector{size: 1000}
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := QueryStream(ctx, sql.OpenDB(connector), "SELECT n", 2)
+		require.NoError(t, err)
+		defer stream.Close()
+
+		_, ok := stream.Next()
+		require.True(t, ok)
+		cancel()
+		for _, ok := stream.Next(); ok; _, ok = stream.Next() {
+		}
+		assert.True(t, errors.Is(stream.Err(), context.Canceled))
+		assert.Less(t, connector.read.Load(), int64(1000))
+	})
+}
@@ -0,0 +1,197 @@
+package datasource
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	"github.com/grafana/sqlds/v4"
+)
+
+// TrustReport tells whether the trust policy of a role lets a principal assume it
+type TrustReport struct {
+	PrincipalARN string
+	RoleARN      string
+	Trusted      bool
+	// Unverified is true if the trust policy couldn't be read, the role being in another account than
+	// the credentials of the datasource. Trusted is then false.
+	Unverified bool
+	// Conditional is true if the statement trusting the principal has conditions, e.g. an external ID,
+	// the assume role request must meet
+	Conditional bool
+	// Diagnostic explains the decision
+	Diagnostic string
+}
+
+// trustPolicy is the part of an IAM trust policy document PreflightTrust reads
+type trustPolicy struct {
+	Statement []trustStatement
+}
+
+type trustStatement struct {
+	Effect    string
+	Action    stringOrList
+	Principal json.RawMessage
+	Condition map[string]any
+}
+
+// stringOrList is a policy element that can be a string or a list of strings
+type stringOrList []string
+
+func (s *stringOrList) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*s = []string{one}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+// PreflightTrust reads the trust policy of the role and checks that it lets the credentials of the
+// datasource assume it, so a role that doesn't trust them is found before setting it as the role to
+// assume. The API of the datasource must implement api.IAMSimulator and its credentials need
+// iam:GetRole on the role. The conditions of the policy, like an external ID, aren't evaluated.
+// IAM only lets the credentials read the roles of their own account, the report of a role in
+// another account is Unverified.
+func (ds *awsClient) PreflightTrust(ctx context.Context, id int64, options sqlds.Options, roleARN string) (TrustReport, error) {
+	role, err := arn.Parse(roleARN)
+	if err != nil || !strings.HasPrefix(role.Resource, "role/") {
+		return TrustReport{}, fmt.Errorf("invalid role ARN %q", roleARN)
+	}
+	dsAPI, err := ds.GetAPI(ctx, id, options)
+	if err != nil {
+		return TrustReport{}, err
+	}
+	simulator, ok := dsAPI.(api.IAMSimulator)
+	if !ok {
+		return TrustReport{}, fmt.Errorf("the API of datasource %d can't read IAM roles", id)
+	}
+
+	callerARN, err := simulator.CallerARN(ctx)
+	if err != nil {
+		return TrustReport{}, fmt.Errorf("could not get the caller identity: %w", wrapAWSError(err))
+	}
+	principal, err := resolvePrincipal(ctx, simulator, callerARN)
+	if err != nil {
+		return TrustReport{}, err
+	}
+
+	// iam:GetRole looks the role name up in the account of the credentials, the trust policy of a
+	// role in another account can only be checked by assuming it
+	if caller, err := arn.Parse(principal); err == nil && caller.AccountID != role.AccountID {
+		return TrustReport{
+			PrincipalARN: principal,
+			RoleARN:      roleARN,
+			Unverified:   true,
+			Diagnostic: fmt.Sprintf("the trust policy of %s can't be read from account %s, check that it trusts %s by assuming the role",
+				roleARN, caller.AccountID, principal),
+		}, nil
+	}
+
+	roleName := role.Resource[strings.LastIndex(role.Resource, "/")+1:]
+	out, err := simulator.IAM().GetRoleWithContext(ctx, &iam.GetRoleInput{RoleName: aws.String(roleName)})
+	if err != nil {
+		return TrustReport{}, fmt.Errorf("could not read the trust policy of %s: %w", roleARN, wrapAWSError(err))
+	}
+	if out.Role == nil {
+		return TrustReport{}, fmt.Errorf("could not read the trust policy of %s: no role returned", roleARN)
+	}
+	// IAM returns the policy document URL encoded
+	document, err := url.QueryUnescape(aws.StringValue(out.Role.AssumeRolePolicyDocument))
+	if err != nil {
+		return TrustReport{}, fmt.Errorf("invalid trust policy of %s: %w", roleARN, err)
+	}
+	var policy trustPolicy
+	if err := json.Unmarshal([]byte(document), &policy); err != nil {
+		return TrustReport{}, fmt.Errorf("invalid trust policy of %s: %w", roleARN, err)
+	}
+
+	report := TrustReport{PrincipalARN: principal, RoleARN: roleARN}
+	callers := []string{callerARN, principal}
+	for _, statement := range policy.Statement {
+		if !allowsAssumeRole(statement.Action) || !trustsPrincipal(statement.Principal, callers) {
+			continue
+		}
+		if statement.Effect == "Deny" {
+			return TrustReport{
+				PrincipalARN: principal,
+				RoleARN:      roleARN,
+				Diagnostic:   fmt.Sprintf("the trust policy of %s explicitly denies %s", roleARN, principal),
+			}, nil
+		}
+		if statement.Effect == "Allow" && (!report.Trusted || report.Conditional) {
+			report.Trusted = true
+			report.Conditional = len(statement.Condition) > 0
+		}
+	}
+	switch {
+	case !report.Trusted:
+		report.Diagnostic = fmt.Sprintf("the trust policy of %s doesn't trust %s, add it as an AWS principal allowed sts:AssumeRole", roleARN, principal)
+	case report.Conditional:
+		report.Diagnostic = fmt.Sprintf("the trust policy of %s trusts %s under conditions, e.g. an external ID, the settings must meet", roleARN, principal)
+	default:
+		report.Diagnostic = fmt.Sprintf("the trust policy of %s trusts %s", roleARN, principal)
+	}
+	return report, nil
+}
+
+func allowsAssumeRole(actions stringOrList) bool {
+	for _, action := range actions {
+		if action == "*" || strings.EqualFold(action, "sts:*") || strings.EqualFold(action, "sts:AssumeRole") {
+			return true
+		}
+	}
+	return false
+}
+
+// trustsPrincipal returns true if the principal element of a statement matches one of the caller
+// ARNs, directly, through the root of their account or a wildcard. Roles are compared by account and
+// name, which identify them whatever their path, since the path of the caller role may be unknown.
+func trustsPrincipal(element json.RawMessage, callers []string) bool {
+	var wildcard string
+	if err := json.Unmarshal(element, &wildcard); err == nil {
+		return wildcard == "*"
+	}
+	var principals map[string]stringOrList
+	if err := json.Unmarshal(element, &principals); err != nil {
+		return false
+	}
+	for _, trusted := range principals["AWS"] {
+		for _, caller := range callers {
+			if matchesPrincipal(trusted, caller) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchesPrincipal(trusted, caller string) bool {
+	if trusted == "*" || trusted == caller {
+		return true
+	}
+	parsed, err := arn.Parse(caller)
+	if err != nil {
+		return false
+	}
+	if trusted == parsed.AccountID || trusted == fmt.Sprintf("arn:%s:iam::%s:root", parsed.Partition, parsed.AccountID) {
+		return true
+	}
+	trustedARN, err := arn.Parse(trusted)
+	if err != nil || trustedARN.AccountID != parsed.AccountID || !strings.HasPrefix(trustedARN.Resource, "role/") ||
+		!strings.HasPrefix(parsed.Resource, "role/") {
+		return false
+	}
+	return trustedARN.Resource[strings.LastIndex(trustedARN.Resource, "/")+1:] == parsed.Resource[strings.LastIndex(parsed.Resource, "/")+1:]
+}
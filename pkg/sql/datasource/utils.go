@@ -2,14 +2,215 @@ package datasource
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/models"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/sqlds/v4"
 )
 
-func connectionKey(id int64, args sqlds.Options) string {
-	return fmt.Sprintf("%d-%v", id, args)
+// ConnectionKey returns the key used to cache instances for the given datasource id and connection options
+// by a client created without options changing its keys. The client applies its default options,
+// normalizer, per query options, marshaler and isolated environment to the keys, so plugins keeping
+// their own caches aligned with the datasource should use the ConnectionKey method of the client instead.
+func ConnectionKey(id int64, args sqlds.Options) string {
+	return fmt.Sprintf("%d-%s", id, CanonicalOptions(args))
+}
+
+// OptionsMarshaler serializes the connection options in the cache keys. Equal options must give the
+// same string, whatever the order they were set in, and different options different strings.
+type OptionsMarshaler func(args sqlds.Options) string
+
+// CanonicalOptions is the default OptionsMarshaler, returning the options as JSON with sorted keys.
+// Unlike their %v format, it tells apart values containing separators, e.g. {"a": "1 b:2"} and
+// {"a": "1", "b": "2"}, and keeps nested JSON values as they are.
+func CanonicalOptions(args sqlds.Options) string {
+	if len(args) == 0 {
+		return "{}"
+	}
+	// a map of strings always marshals
+	b, _ := json.Marshal(args)
+	return string(b)
+}
+
+// connectionKey returns the ConnectionKey of the options without the per query ones, so the
+// connections differing only by them are shared, prefixed with the environment if it's isolated
+func (ds *awsClient) connectionKey(id int64, args sqlds.Options) string {
+	if ds.isolateEnv && ds.environment != "" {
+		return ds.environment + "/" + ds.sharedConnectionKey(id, args)
+	}
+	return ds.sharedConnectionKey(id, args)
+}
+
+// ConnectionKey returns the key the client caches the instances for the given datasource id and
+// connection options under, the one of its Stats and running queries
+func (ds *awsClient) ConnectionKey(id int64, options sqlds.Options) string {
+	return ds.connectionKey(id, ds.normalizeOptions(options))
+}
+
+func (ds *awsClient) sharedConnectionKey(id int64, args sqlds.Options) string {
+	if len(ds.perQueryKeys) == 0 {
+		return ds.optionsKey(id, args)
+	}
+	shared := sqlds.Options{}
+	for k, v := range args {
+		shared[k] = v
+	}
+	for _, key := range ds.perQueryKeys {
+		delete(shared, key)
+	}
+	return ds.optionsKey(id, shared)
+}
+
+// optionsKey returns the ConnectionKey of the options, serialized with the marshaler of the client if any
+func (ds *awsClient) optionsKey(id int64, args sqlds.Options) string {
+	if ds.optionsMarshal == nil {
+		return ConnectionKey(id, args)
+	}
+	return fmt.Sprintf("%d-%s", id, ds.optionsMarshal(args))
+}
+
+// checkOptionsSize fails with ErrOptionsTooLarge if the keys and values of args add up to more bytes
+// than the limit of the client, if any
+func (ds *awsClient) checkOptionsSize(args sqlds.Options) error {
+	if ds.maxOptionsSize <= 0 {
+		return nil
+	}
+	size, largest := 0, ""
+	for k, v := range args {
+		size += len(k) + len(v)
+		if len(v) > len(args[largest]) {
+			largest = k
+		}
+	}
+	if size > ds.maxOptionsSize {
+		return fmt.Errorf("%w: %d bytes over the limit of %d, the largest being %q", ErrOptionsTooLarge, size, ds.maxOptionsSize, largest)
+	}
+	return nil
+}
+
+// RegisterDefaultOptions sets connection options merged beneath the options of every call, which
+// win when they set the same key. The defaults are part of the connection keys, so a call setting
+// them explicitly shares the cached APIs and DBs of a call relying on them. Registering other
+// defaults replaces the previous ones.
+func (ds *awsClient) RegisterDefaultOptions(defaults sqlds.Options) {
+	registered := sqlds.Options{}
+	for k, v := range defaults {
+		registered[k] = v
+	}
+	ds.defaultOptions.Store(&registered)
+}
+
+// withDefaultOptions returns a copy of options with the missing default options added. Options set
+// to an empty string count as missing WithEmptyOptionsIgnored.
+func (ds *awsClient) withDefaultOptions(options sqlds.Options) sqlds.Options {
+	defaults := ds.defaultOptions.Load()
+	if defaults == nil || len(*defaults) == 0 {
+		return options
+	}
+	merged := sqlds.Options{}
+	for k, v := range *defaults {
+		merged[k] = v
+	}
+	for k, v := range options {
+		if v == "" && ds.skipEmptyArgs {
+			continue
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// normalizeOptions returns the options with the default options, passed through the normalizer of
+// the client, if any. The normalizer gets a copy it can modify.
+func (ds *awsClient) normalizeOptions(options sqlds.Options) sqlds.Options {
+	options = ds.withDefaultOptions(options)
+	if ds.normalizer == nil {
+		return options
+	}
+	normalized := sqlds.Options{}
+	for k, v := range options {
+		normalized[k] = v
+	}
+	return ds.normalizer(normalized)
+}
+
+// RegionResolver translates the region of the settings, once loaded and merged with the connection
+// options, into the AWS region the sessions are built for. It allows settings to name logical
+// regions, like "prod", mapped to AWS regions by rules of the organization.
+type RegionResolver interface {
+	ResolveRegion(region string) (string, error)
+}
+
+// RegionResolverFunc is a function used as a RegionResolver
+type RegionResolverFunc func(region string) (string, error)
+
+func (f RegionResolverFunc) ResolveRegion(region string) (string, error) {
+	return f(region)
+}
+
+// resolveRegion replaces the region of settings implementing models.RegionSetter with the one
+// resolved by the resolver of the client, if any
+func (ds *awsClient) resolveRegion(settings models.Settings) error {
+	s, ok := settings.(models.RegionSetter)
+	if !ok || ds.regionResolver == nil {
+		return nil
+	}
+	region, err := ds.regionResolver.ResolveRegion(s.GetRegion())
+	if err != nil {
+		return fmt.Errorf("could not resolve region %q: %w", s.GetRegion(), err)
+	}
+	s.SetRegion(region)
+	return nil
+}
+
+// defaultRegionAliases are the option keys used by different front-ends to send the region
+var defaultRegionAliases = []string{"awsRegion", "Region"}
+
+// normalizeRegion returns a copy of args where the first region found, looking at models.RegionKey
+// and then at the aliases, is stored under models.RegionKey and the aliases are removed.
+func normalizeRegion(args sqlds.Options, aliases []string) sqlds.Options {
+	if len(aliases) == 0 {
+		return args
+	}
+	normalized := sqlds.Options{}
+	for k, v := range args {
+		normalized[k] = v
+	}
+	for _, alias := range aliases {
+		region, ok := normalized[alias]
+		if !ok {
+			continue
+		}
+		delete(normalized, alias)
+		if _, exists := normalized[models.RegionKey]; !exists {
+			normalized[models.RegionKey] = region
+		}
+	}
+	return normalized
+}
+
+// dropEmptyOptions returns a copy of args without the options set to an empty string
+func dropEmptyOptions(args sqlds.Options) sqlds.Options {
+	kept := sqlds.Options{}
+	for k, v := range args {
+		if v != "" {
+			kept[k] = v
+		}
+	}
+	return kept
+}
+
+// hasAuthType returns true if the json data of the datasource sets a non empty auth type
+func hasAuthType(config backend.DataSourceInstanceSettings) bool {
+	var fields struct {
+		AuthType string `json:"authType"`
+	}
+	if err := json.Unmarshal(config.JSONData, &fields); err != nil {
+		return false
+	}
+	return fields.AuthType != ""
 }
 
 func GetDatasourceID(ctx context.Context) int64 {
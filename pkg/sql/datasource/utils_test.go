@@ -2,7 +2,10 @@ package datasource
 
 import (
 	"context"
+	"fmt"
 	"testing"
+
+	"github.com/grafana/sqlds/v4"
 )
 
 func TestGetDatasourceID(t *testing.T) {
@@ -22,3 +25,55 @@ func TestGetDatasourceLastUpdatedTime(t *testing.T) {
 		t.Errorf("unexpected time: %s", time)
 	}
 }
+
+func TestConnectionKey(t *testing.T) {
+	id := int64(1)
+	args := sqlds.Options{"region": "us-east-1"}
+	ds := &awsClient{}
+	ds.storeAPI(id, args, fakeAPI{})
+
+	if _, ok := ds.api.Load(ConnectionKey(id, args)); !ok {
+		t.Errorf("api not stored under the exported connection key")
+	}
+	if ConnectionKey(id, args) == ConnectionKey(id, sqlds.Options{"region": "us-east-2"}) {
+		t.Errorf("different options should produce different keys")
+	}
+	if ConnectionKey(id, args) == ConnectionKey(id+1, args) {
+		t.Errorf("different ids should produce different keys")
+	}
+}
+
+func TestConnectionKey_Canonical(t *testing.T) {
+	nested := sqlds.Options{}
+	nested["tags"] = `{"team":"sales","env":["prod","eu"]}`
+	nested["region"] = "us-east-1"
+	nested["database"] = "logs"
+	reordered := sqlds.Options{"database": "logs", "region": "us-east-1", "tags": `{"team":"sales","env":["prod","eu"]}`}
+
+	key := ConnectionKey(1, nested)
+	if key != ConnectionKey(1, reordered) {
+		t.Errorf("the order of the options should not change the key")
+	}
+	if key != `1-{"database":"logs","region":"us-east-1","tags":"{\"team\":\"sales\",\"env\":[\"prod\",\"eu\"]}"}` {
+		t.Errorf("unexpected key: %s", key)
+	}
+	if ConnectionKey(1, sqlds.Options{"a": "1 b:2"}) == ConnectionKey(1, sqlds.Options{"a": "1", "b": "2"}) {
+		t.Errorf("values containing separators should not collide with other options")
+	}
+	if ConnectionKey(1, nil) != ConnectionKey(1, sqlds.Options{}) {
+		t.Errorf("nil and empty options should produce the same key")
+	}
+}
+
+func TestConnectionKey_Marshaler(t *testing.T) {
+	legacy := func(args sqlds.Options) string {
+		return fmt.Sprintf("%v", args)
+	}
+	ds := New(fakeLoader{}, WithOptionsMarshaler(legacy)).(*awsClient)
+	args := sqlds.Options{"region": "us-east-1"}
+	ds.storeAPI(1, args, fakeAPI{})
+
+	if _, ok := ds.api.Load("1-map[region:us-east-1]"); !ok {
+		t.Errorf("api not stored under the key of the marshaler")
+	}
+}
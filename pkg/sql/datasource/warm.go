@@ -0,0 +1,73 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+)
+
+// defaultWarmConcurrency is the number of warm operations allowed to run at once
+const defaultWarmConcurrency = 4
+
+// warmTarget identifies an API to create ahead of the first query
+type warmTarget struct {
+	id      int64
+	options sqlds.Options
+}
+
+// InitAll stores the configuration of every datasource and creates their default API ahead of the first query
+func (ds *awsClient) InitAll(ctx context.Context, configs []backend.DataSourceInstanceSettings) error {
+	targets := make([]warmTarget, 0, len(configs))
+	for _, config := range configs {
+		ds.Init(config)
+		targets = append(targets, warmTarget{id: config.ID, options: sqlds.Options{}})
+	}
+	return ds.warm(ctx, targets)
+}
+
+// WarmRegions creates the API of the datasource for each of the given regions ahead of the first query
+func (ds *awsClient) WarmRegions(ctx context.Context, id int64, options sqlds.Options, regions []string) error {
+	targets := make([]warmTarget, 0, len(regions))
+	for _, region := range regions {
+		regionOptions := sqlds.Options{}
+		for k, v := range options {
+			regionOptions[k] = v
+		}
+		regionOptions[models.RegionKey] = region
+		targets = append(targets, warmTarget{id: id, options: regionOptions})
+	}
+	return ds.warm(ctx, targets)
+}
+
+// warm creates the API of every target, running at most warmConcurrency operations at once
+func (ds *awsClient) warm(ctx context.Context, targets []warmTarget) error {
+	concurrency := ds.warmConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultWarmConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+	errs := make([]error, len(targets))
+	wg := sync.WaitGroup{}
+	for i, target := range targets {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(i int, target warmTarget) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			_, errs[i] = ds.GetAPI(ctx, target.id, target.options)
+		}(i, target)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
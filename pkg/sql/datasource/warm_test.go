@@ -0,0 +1,75 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+	sqlApi "github.com/grafana/grafana-aws-sdk/pkg/sql/api"
+	"github.com/grafana/grafana-aws-sdk/pkg/sql/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingLoader struct {
+	fakeLoader
+	mu        sync.Mutex
+	calls     int
+	active    int
+	maxActive int
+}
+
+func (m *countingLoader) LoadAPI(_ context.Context, _ *awsds.SessionCache, _ models.Settings) (sqlApi.AWSAPI, error) {
+	m.mu.Lock()
+	m.calls++
+	m.active++
+	if m.active > m.maxActive {
+		m.maxActive = m.active
+	}
+	m.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	m.mu.Lock()
+	m.active--
+	m.mu.Unlock()
+	return fakeAPI{}, nil
+}
+
+func TestWarmRegions(t *testing.T) {
+	loader := &countingLoader{}
+	ds := New(loader, WithWarmConcurrency(3))
+	ds.Init(backend.DataSourceInstanceSettings{ID: 1})
+
+	regions := []string{}
+	for i := 0; i < 10; i++ {
+		regions = append(regions, fmt.Sprintf("region-%d", i))
+	}
+	require.NoError(t, ds.WarmRegions(context.Background(), 1, sqlds.Options{"foo": "bar"}, regions))
+
+	assert.Equal(t, 10, loader.calls)
+	assert.LessOrEqual(t, loader.maxActive, 3)
+	for _, region := range regions {
+		_, ok := ds.(*awsClient).api.Load(ConnectionKey(1, sqlds.Options{"foo": "bar", models.RegionKey: region}))
+		assert.True(t, ok, "missing api for region %s", region)
+	}
+}
+
+func TestInitAll(t *testing.T) {
+	loader := &countingLoader{}
+	ds := New(loader, WithWarmConcurrency(2))
+
+	configs := []backend.DataSourceInstanceSettings{}
+	for i := int64(1); i <= 6; i++ {
+		configs = append(configs, backend.DataSourceInstanceSettings{ID: i})
+	}
+	require.NoError(t, ds.InitAll(context.Background(), configs))
+
+	assert.Equal(t, 6, loader.calls)
+	assert.LessOrEqual(t, loader.maxActive, 2)
+}
@@ -11,11 +11,36 @@ import (
 
 // Implements "*sql.DB"
 type Conn struct {
-	db awsds.AsyncDB
+	db          awsds.AsyncDB
+	pollOptions api.PollOptions
 }
 
-func NewConnection(db awsds.AsyncDB) *Conn {
-	return &Conn{db: db}
+// ConnectionOption configures optional behavior of a Conn
+type ConnectionOption func(*Conn)
+
+// PollOptioner is implemented by AsyncDBs telling how to poll the status of their queries, like those
+// of the datasource package configured by the settings
+type PollOptioner interface {
+	PollOptions() api.PollOptions
+}
+
+// WithPollOptions sets the interval and the per-call timeout used to poll the status of synchronous
+// queries, instead of those of a db implementing PollOptioner
+func WithPollOptions(opts api.PollOptions) ConnectionOption {
+	return func(c *Conn) {
+		c.pollOptions = opts
+	}
+}
+
+func NewConnection(db awsds.AsyncDB, opts ...ConnectionOption) *Conn {
+	c := &Conn{db: db}
+	if optioner, ok := db.(PollOptioner); ok {
+		c.pollOptions = optioner.PollOptions()
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 func (c *Conn) CheckNamedValue(v *driver.NamedValue) error {
@@ -34,7 +59,7 @@ func (c *Conn) QueryContext(ctx context.Context, query string, args []driver.Nam
 		}
 	}
 	if queryID != "" {
-		return c.db.GetRows(ctx, queryID)
+		return c.getRows(ctx, queryID)
 	}
 	// Synchronous flow
 	queryID, err := c.db.StartQuery(ctx, query, args)
@@ -42,11 +67,11 @@ func (c *Conn) QueryContext(ctx context.Context, query string, args []driver.Nam
 		return nil, err
 	}
 
-	if err := api.WaitOnQueryID(ctx, queryID, c.db); err != nil {
+	if err := api.WaitOnQueryIDWithOptions(ctx, queryID, c.db, c.pollOptions); err != nil {
 		return nil, err
 	}
 
-	return c.db.GetRows(ctx, queryID)
+	return c.getRows(ctx, queryID)
 }
 
 func (c *Conn) Ping() error {
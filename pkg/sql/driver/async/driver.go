@@ -1,6 +1,8 @@
 package async
 
 import (
+	"context"
+
 	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
 	"github.com/grafana/grafana-aws-sdk/pkg/sql/api"
 	sqlDriver "github.com/grafana/grafana-aws-sdk/pkg/sql/driver"
@@ -11,4 +13,21 @@ type Driver interface {
 	GetAsyncDB() (awsds.AsyncDB, error)
 }
 
+// NoRowsMatcher is implemented by drivers that fail queries without rows. IsNoRows reports whether
+// err is that failure, so it can be turned into an empty result.
+type NoRowsMatcher interface {
+	IsNoRows(err error) bool
+}
+
 type Loader func(api.AWSAPI) (Driver, error)
+
+// ContextLoader is a Loader receiving the context of the request, e.g. to build a client for its user
+// or tenant. The context also carries the settings, see models.SettingsFromContext.
+type ContextLoader func(ctx context.Context, dsAPI api.AWSAPI) (Driver, error)
+
+// WithContext adapts l to a ContextLoader ignoring the context
+func (l Loader) WithContext() ContextLoader {
+	return func(_ context.Context, dsAPI api.AWSAPI) (Driver, error) {
+		return l(dsAPI)
+	}
+}
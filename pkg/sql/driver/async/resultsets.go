@@ -0,0 +1,61 @@
+package async
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
+)
+
+// resultSets iterates the result sets of a query one after the other, so they can be read with
+// sql.Rows.NextResultSet
+type resultSets struct {
+	sets    []driver.Rows
+	current int
+}
+
+func (r *resultSets) Columns() []string {
+	return r.sets[r.current].Columns()
+}
+
+func (r *resultSets) Next(dest []driver.Value) error {
+	return r.sets[r.current].Next(dest)
+}
+
+func (r *resultSets) Close() error {
+	var errs []error
+	for _, set := range r.sets {
+		errs = append(errs, set.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (r *resultSets) HasNextResultSet() bool {
+	return r.current < len(r.sets)-1
+}
+
+func (r *resultSets) NextResultSet() error {
+	if !r.HasNextResultSet() {
+		return io.EOF
+	}
+	r.current++
+	return nil
+}
+
+// getRows returns the rows of the query, iterating its result sets when there are several
+func (c *Conn) getRows(ctx context.Context, queryID string) (driver.Rows, error) {
+	sets, err := awsds.GetResultSets(ctx, c.db, queryID)
+	if err != nil {
+		return nil, err
+	}
+	if len(sets) == 1 {
+		return sets[0], nil
+	}
+	if len(sets) == 0 {
+		return nil, fmt.Errorf("query %s returned no result set", queryID)
+	}
+	return &resultSets{sets: sets}, nil
+}
@@ -1,8 +1,11 @@
 package driver
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"database/sql/driver"
+	"time"
 
 	"github.com/grafana/grafana-aws-sdk/pkg/sql/api"
 )
@@ -13,4 +16,86 @@ type Driver interface {
 	OpenDB() (*sql.DB, error)
 }
 
+// ConfigValidator is implemented by drivers that can check their configuration, e.g. the region
+// and endpoint format, without opening a connection
+type ConfigValidator interface {
+	ValidateConfig() error
+}
+
+// Compressor is implemented by drivers able to compress their network traffic
+type Compressor interface {
+	EnableCompression() error
+}
+
+// ConnectTimeouter is implemented by drivers that can bound the time to establish a connection, e.g. in their dialer
+type ConnectTimeouter interface {
+	SetConnectTimeout(timeout time.Duration) error
+}
+
+// QueryTimeouter is implemented by drivers that can bound the time a statement runs
+type QueryTimeouter interface {
+	SetQueryTimeout(timeout time.Duration) error
+}
+
+// TLSConfigurer is implemented by drivers connecting to their database over TLS, to apply the client's
+// requirements, e.g. the minimum TLS version, to their tls.Config
+type TLSConfigurer interface {
+	SetTLSConfig(config *tls.Config) error
+}
+
+// ResourceTagger is implemented by drivers that can tag the resources their queries create, e.g. the
+// tags of the Athena StartQueryExecution requests
+type ResourceTagger interface {
+	SetResourceTags(tags map[string]string) error
+}
+
+// BucketOwnerChecker is implemented by drivers reading query results from S3, to send the account
+// expected to own the buckets with their requests (the x-amz-expected-bucket-owner header)
+type BucketOwnerChecker interface {
+	SetExpectedBucketOwner(accountID string) error
+}
+
+// Namer is implemented by drivers that can tell which engine they connect to, e.g. "athena" or
+// "redshift", for logs, metrics and stats
+type Namer interface {
+	Name() string
+}
+
+// NameOf returns the name of dr, or "unknown" if it doesn't implement Namer
+func NameOf(dr any) string {
+	if n, ok := dr.(Namer); ok && n.Name() != "" {
+		return n.Name()
+	}
+	return "unknown"
+}
+
+// RedactedDSN is logged instead of the connection string of drivers not implementing DSNSanitizer
+const RedactedDSN = "[redacted]"
+
+// DSNSanitizer is implemented by drivers that can describe their connection string with the
+// credentials and tokens it may embed scrubbed, e.g. "athena://us-east-1?workgroup=primary"
+type DSNSanitizer interface {
+	SanitizeDSN() string
+}
+
+// SanitizedDSNOf returns the sanitized connection string of dr, or RedactedDSN if it doesn't
+// implement DSNSanitizer. Only this should ever be logged about the connection string of a driver.
+func SanitizedDSNOf(dr any) string {
+	if s, ok := dr.(DSNSanitizer); ok {
+		return s.SanitizeDSN()
+	}
+	return RedactedDSN
+}
+
 type Loader func(api.AWSAPI) (Driver, error)
+
+// ContextLoader is a Loader receiving the context of the request, e.g. to build a client for its user
+// or tenant. The context also carries the settings, see models.SettingsFromContext.
+type ContextLoader func(ctx context.Context, dsAPI api.AWSAPI) (Driver, error)
+
+// WithContext adapts l to a ContextLoader ignoring the context
+func (l Loader) WithContext() ContextLoader {
+	return func(_ context.Context, dsAPI api.AWSAPI) (Driver, error) {
+		return l(dsAPI)
+	}
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"os"
+	"strings"
+)
+
+const (
+	// DefaultRegionEnvVarKeyName is the environment variable holding the region used when a datasource doesn't set one
+	DefaultRegionEnvVarKeyName = "AWS_DS_DEFAULT_REGION"
+
+	// DefaultAssumeRoleARNEnvVarKeyName is the environment variable holding a role to assume when a datasource doesn't set one
+	DefaultAssumeRoleARNEnvVarKeyName = "AWS_DS_DEFAULT_ASSUME_ROLE_ARN"
+
+	// DefaultAllowedAuthProvidersEnvVarKeyName is the environment variable holding a comma separated list of auth providers
+	DefaultAllowedAuthProvidersEnvVarKeyName = "AWS_DS_ALLOWED_AUTH_PROVIDERS"
+)
+
+// Defaults holds fleet-wide settings shared by every datasource unless overridden in its own configuration
+type Defaults struct {
+	Region               string
+	AssumeRoleARN        string
+	AllowedAuthProviders []string
+	// AuthType is the name of the auth type used when a datasource doesn't set one, e.g. "ec2_iam_role"
+	AuthType string
+}
+
+// DefaultsApplier is implemented by settings that accept fleet-wide defaults.
+// ApplyDefaults is called after Load and before Apply, so it should only fill in values left empty by Load.
+type DefaultsApplier interface {
+	ApplyDefaults(Defaults)
+}
+
+// AuthTypeDefaulter is implemented by settings accepting a default auth type.
+// ApplyDefaultAuthType is called after Load when the json data of the datasource has no "authType".
+type AuthTypeDefaulter interface {
+	ApplyDefaultAuthType(authType string)
+}
+
+// ReadDefaultsFromEnvironmentVariables gets the fleet-wide defaults from the environment variables
+func ReadDefaultsFromEnvironmentVariables() Defaults {
+	defaults := Defaults{
+		Region:        strings.TrimSpace(os.Getenv(DefaultRegionEnvVarKeyName)),
+		AssumeRoleARN: strings.TrimSpace(os.Getenv(DefaultAssumeRoleARNEnvVarKeyName)),
+	}
+	for _, provider := range strings.Split(os.Getenv(DefaultAllowedAuthProvidersEnvVarKeyName), ",") {
+		provider = strings.TrimSpace(provider)
+		if provider != "" {
+			defaults.AllowedAuthProviders = append(defaults.AllowedAuthProviders, provider)
+		}
+	}
+	return defaults
+}
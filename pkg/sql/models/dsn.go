@@ -0,0 +1,49 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DSNTemplater is implemented by settings holding a connection string template, e.g.
+// "athena://{region}/{workgroup}". Placeholders are replaced with the DSNValues of the settings,
+// once loaded and applied.
+type DSNTemplater interface {
+	DSNTemplate() string
+	DSNValues() map[string]string
+}
+
+var dsnPlaceholderRegex = regexp.MustCompile(`\{(\w+)\}`)
+
+// RenderDSN replaces the placeholders of template with values. Placeholders without a value are an error.
+func RenderDSN(template string, values map[string]string) (string, error) {
+	missing := []string{}
+	dsn := dsnPlaceholderRegex.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value, ok := values[name]
+		if !ok || value == "" {
+			missing = append(missing, placeholder)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("no value for %s in connection string template %q", strings.Join(missing, ", "), template)
+	}
+	return dsn, nil
+}
+
+type dsnKey struct{}
+
+// WithDSN returns a copy of ctx carrying the rendered connection string
+func WithDSN(ctx context.Context, dsn string) context.Context {
+	return context.WithValue(ctx, dsnKey{}, dsn)
+}
+
+// DSNFromContext returns the rendered connection string carried by ctx, if any.
+// Driver loaders can use it instead of assembling the connection string themselves.
+func DSNFromContext(ctx context.Context) (string, bool) {
+	dsn, ok := ctx.Value(dsnKey{}).(string)
+	return dsn, ok
+}
@@ -1,15 +1,159 @@
 package models
 
 import (
+	"context"
+	"time"
+
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/sqlds/v4"
 )
 
 type Settings interface {
 	Load(backend.DataSourceInstanceSettings) error
+	// Apply merges the connection options of a query over the loaded settings. Only the keys present
+	// in args override a setting, the others must be left as loaded. A key set to an empty string
+	// clears its setting, unless the client drops empty options before calling Apply.
 	Apply(args sqlds.Options)
 }
 
 type Loader func() Settings
 
+// ContextLoader is a Loader receiving the context of the request, e.g. to build settings for its user or tenant
+type ContextLoader func(ctx context.Context) Settings
+
+// WithContext adapts l to a ContextLoader ignoring the context
+func (l Loader) WithContext() ContextLoader {
+	return func(_ context.Context) Settings {
+		return l()
+	}
+}
+
+// Validator is implemented by settings that can check their values once loaded and applied
+type Validator interface {
+	Validate() error
+}
+
+// AuthValidator is implemented by settings that can detect conflicting auth values, checked in strict mode
+type AuthValidator interface {
+	ValidateAuth() error
+}
+
+// AuthSelector is implemented by settings holding several named credential sets.
+// SelectAuth is called after Apply when the connection options carry AuthKey.
+type AuthSelector interface {
+	SelectAuth(name string) error
+}
+
+// RegionGetter is implemented by settings that can report the region they target
+type RegionGetter interface {
+	GetRegion() string
+}
+
+// RegionSetter is implemented by settings whose region can be changed once loaded, e.g. to resolve a
+// logical region
+type RegionSetter interface {
+	RegionGetter
+	SetRegion(region string)
+}
+
+// ValidationQuerier is implemented by settings that can set a query to check the connection with
+type ValidationQuerier interface {
+	GetValidationQuery() string
+}
+
+// CompressionSettings is implemented by settings that can ask the driver to compress its network traffic
+type CompressionSettings interface {
+	UseCompression() bool
+}
+
+// RoleSessionNamer is implemented by settings that can name the assumed role session after the Grafana user.
+// ApplyRoleSessionName is called after Apply with the UserKey connection option.
+type RoleSessionNamer interface {
+	ApplyRoleSessionName(user string)
+}
+
+// TimeoutSettings is implemented by settings that can bound the time to connect and to run a query
+type TimeoutSettings interface {
+	GetConnectTimeout() time.Duration
+	GetQueryTimeout() time.Duration
+}
+
+// PollSettings is implemented by settings that can tune how the status of async queries is polled,
+// see api.PollOptions
+type PollSettings interface {
+	GetPollInterval() time.Duration
+	GetPollTimeout() time.Duration
+}
+
+// RowLimitSettings is implemented by settings that can cap the rows returned by async queries
+type RowLimitSettings interface {
+	GetMaxRows() int64
+}
+
+// TLSSettings is implemented by settings that can skip the verification of the TLS certificate of the database
+type TLSSettings interface {
+	GetTLSSkipVerify() bool
+}
+
+// ResourceTagSettings is implemented by settings that can tag the resources created by the queries, e.g. for cost allocation
+type ResourceTagSettings interface {
+	GetResourceTags() map[string]string
+}
+
+// BucketOwnerSettings is implemented by settings that can require the S3 result buckets to belong to a given account
+type BucketOwnerSettings interface {
+	GetExpectedBucketOwner() string
+}
+
+// Warner is implemented by settings that can report non-fatal advisories, e.g. insecure TLS
+type Warner interface {
+	Warnings() []string
+}
+
+type settingsKey struct{}
+
+// WithSettings returns a copy of ctx carrying the resolved settings of the datasource
+func WithSettings(ctx context.Context, settings Settings) context.Context {
+	return context.WithValue(ctx, settingsKey{}, settings)
+}
+
+// SettingsFromContext returns the resolved settings carried by ctx, if any.
+// Driver loaders can use it to read the settings the API was built with.
+func SettingsFromContext(ctx context.Context) (Settings, bool) {
+	settings, ok := ctx.Value(settingsKey{}).(Settings)
+	return settings, ok
+}
+
 const DefaultKey = "__default"
+
+// RegionKey is the connection option holding the region
+const RegionKey = "region"
+
+// AuthKey is the connection option holding the name of the credential set to use
+const AuthKey = "auth"
+
+// OrgKey is the connection option holding the org or tenant of the request. Requests of different orgs
+// get separate cached instances and AWS sessions. The configurations stored by Init, and what depends
+// on them like the invalidation of the cache and the running queries, are still per datasource id, so
+// ids must be unique across orgs, as Grafana's are.
+const OrgKey = "orgId"
+
+// UserKey is the connection option holding the login of the Grafana user running the query. The
+// cached instances are kept per user, so it should only be set when the settings depend on it.
+const UserKey = "user"
+
+// WithUser returns a copy of options with UserKey set to the login of the user of ctx, if any
+func WithUser(ctx context.Context, options sqlds.Options) sqlds.Options {
+	withUser := sqlds.Options{}
+	for k, v := range options {
+		withUser[k] = v
+	}
+	user := backend.UserFromContext(ctx)
+	if user == nil {
+		user = backend.PluginConfigFromContext(ctx).User
+	}
+	if user != nil && user.Login != "" {
+		withUser[UserKey] = user.Login
+	}
+	return withUser
+}